@@ -3,39 +3,74 @@ package DB
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"math/rand"
 	"time"
 
+	"mongodb-budget/config"
+	"mongodb-budget/metrics"
+
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-//const uri string = "mongodb://localhost:27017" // this is for testing; os.Getenv("mongoDB_uri") is for production
+//const uri string = "mongodb://localhost:27017" // this is for testing; cfg.URI (env mongoDB_uri) is for production
 
-func InitDB() *mongo.Client {
+// InitDB 連線並確認資料庫可以用，連不上時依照cfg用exponential backoff重試
+// ctx取消(例如啟動時收到SIGTERM)或重試用完就回傳錯誤，由main決定要不要結束程式
+func InitDB(ctx context.Context, cfg config.DatabaseConfig) (*mongo.Client, error) {
     serverAPI := options.ServerAPI(options.ServerAPIVersion1) // default stable API
-    opts := options.Client().ApplyURI(os.Getenv("mongoDB_uri")).SetServerAPIOptions(serverAPI)
+    opts := options.Client().ApplyURI(cfg.URI).SetServerAPIOptions(serverAPI).
+        SetMaxPoolSize(cfg.MaxPoolSize).
+        SetMinPoolSize(cfg.MinPoolSize).
+        SetMaxConnIdleTime(cfg.MaxConnIdleTime).
+        SetServerSelectionTimeout(cfg.ServerSelectionTimeout)
+    // 每個command的latency跟錯誤數量，以及掛在request span底下的Mongo span
+    opts.SetMonitor(combineMonitors(metrics.CommandMonitor(), otelmongo.NewMonitor()))
 
-    // Separate context for connecting, so that it will have more time to process instead of timeout
-    connectCtx, connectCancel := context.WithTimeout(context.Background(), 10*time.Second)
+    // 所有重試加起來最多等ConnectTimeout
+    connectCtx, connectCancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
     defer connectCancel()
 
+    // Connect只檢查設定，不會真的連線，錯了重試也沒用
     client, err := mongo.Connect(connectCtx, opts)
     if err != nil {
-        log.Fatal("Error in Database Connecting:", err)
+        return nil, fmt.Errorf("database connect: %w", err)
     }
 
-    // Separate context for pinging
-    pingCtx, pingCancel := context.WithTimeout(context.Background(), 2*time.Second)
-    defer pingCancel()
-
-    err = client.Ping(pingCtx, nil)
-    if err != nil {
-        log.Fatal("Error in Database Ping:", err)
+    backoff := cfg.RetryBackoff
+    for attempt := 1; ; attempt++ {
+        err = ping(connectCtx, client, cfg.PingTimeout)
+        if err == nil {
+            break
+        }
+        if attempt > cfg.ConnectRetries {
+            client.Disconnect(context.Background())
+            return nil, fmt.Errorf("database ping after %d attempts: %w", attempt, err)
+        }
+        delay := jitter(backoff)
+        slog.Warn("database not reachable, retrying", "attempt", attempt, "retry_in", delay.String(), "err", err)
+        select {
+        case <-connectCtx.Done():
+            client.Disconnect(context.Background())
+            return nil, fmt.Errorf("database ping: %w (last error: %v)", connectCtx.Err(), err)
+        case <-time.After(delay):
+        }
+        backoff = min(backoff*2, cfg.RetryMaxBackoff)
     }
 
-    fmt.Println("DB is pinged successfully!")
-    return client
+    slog.Info("database connected", "max_pool_size", cfg.MaxPoolSize)
+    return client, nil
 }
 
+func ping(ctx context.Context, client *mongo.Client, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    return client.Ping(ctx, nil)
+}
+
+// jitter 在d的±20%之間隨機，避免多個instance同時重試
+func jitter(d time.Duration) time.Duration {
+    return d + time.Duration((rand.Float64()*0.4-0.2)*float64(d))
+}
@@ -0,0 +1,102 @@
+package DB
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"mongodb-budget/metrics"
+)
+
+// ErrUnavailable 斷路器打開時直接回傳這個錯誤，不會真的去連資料庫
+var ErrUnavailable = errors.New("database unavailable")
+
+// Breaker 是資料庫的斷路器
+// 連續threshold次連線錯誤(網路錯誤、逾時)後打開，cooldown內的操作都直接失敗，
+// cooldown過後放一個操作去試，成功就關閉，失敗就再打開一次
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time // 零值代表關閉
+	trial    bool      // cooldown過後已經放了一個操作去試
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow 回傳這次操作能不能送出，trial代表它是cooldown過後放去試的那一個
+// trial要原樣傳給Record或Release，只有試的那個操作能結束試探狀態
+func (b *Breaker) Allow() (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return true, false
+	}
+	if time.Since(b.openedAt) < b.cooldown || b.trial {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+// Record 記錄操作的結果，只有連線類的錯誤會被計算
+// 打開前就送出、打開後才有結果的操作不會延後cooldown、不會關閉斷路器，也不會清掉試探狀態
+func (b *Breaker) Record(err error, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isConnectionError(err) {
+		b.failures = 0
+		// 打開前就送出的操作晚一點才成功，不代表資料庫已經恢復
+		if trial {
+			b.trial = false
+			b.openedAt = time.Time{}
+			metrics.DBBreakerOpen.Set(0)
+		}
+		return
+	}
+	b.failures++
+	if trial {
+		b.trial = false
+	}
+	if trial || (b.openedAt.IsZero() && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		metrics.DBBreakerOpen.Set(1)
+	}
+}
+
+// Release 操作沒有結果(呼叫的人自己取消了)，如果它是試探用的操作就讓下一個操作再試一次
+func (b *Breaker) Release(trial bool) {
+	if !trial {
+		return
+	}
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// Open 斷路器是不是打開的(包含正在試的狀態)
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+// isConnectionError 只有代表資料庫連不上的錯誤才算，找不到資料、重複key、client取消都不算
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// IsUnavailable 錯誤是不是因為資料庫暫時無法使用，handler用來決定回503還是500
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || isConnectionError(err)
+}
@@ -0,0 +1,144 @@
+package DB
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errNetwork = mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+
+// openBreaker 回傳一個已經打開、cooldown也過了的斷路器
+func openBreaker(t *testing.T) *Breaker {
+	t.Helper()
+	b := NewBreaker(2, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		b.Record(errNetwork, false)
+	}
+	if !b.Open() {
+		t.Fatal("breaker is not open")
+	}
+	time.Sleep(15 * time.Millisecond)
+	return b
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewBreaker(3, time.Minute)
+	b.Record(errNetwork, false)
+	b.Record(context.DeadlineExceeded, false)
+	if b.Open() {
+		t.Fatal("open after 2 failures, want 3")
+	}
+	// 成功會把計數歸零
+	b.Record(nil, false)
+	b.Record(errNetwork, false)
+	b.Record(errNetwork, false)
+	if b.Open() {
+		t.Fatal("failures before a success were counted")
+	}
+	b.Record(errNetwork, false)
+	if !b.Open() {
+		t.Fatal("closed after 3 failures in a row")
+	}
+}
+
+func TestBreakerIgnoresOtherErrors(t *testing.T) {
+	b := NewBreaker(1, time.Minute)
+	for _, err := range []error{mongo.ErrNoDocuments, context.Canceled, errors.New("duplicate key")} {
+		b.Record(err, false)
+	}
+	if b.Open() {
+		t.Fatal("opened on errors that are not connection errors")
+	}
+}
+
+func TestBreakerRejectsDuringCooldown(t *testing.T) {
+	b := NewBreaker(1, time.Minute)
+	b.Record(errNetwork, false)
+	if ok, trial := b.Allow(); ok || trial {
+		t.Fatalf("Allow() = (%v, %v) during cooldown, want (false, false)", ok, trial)
+	}
+}
+
+func TestBreakerSingleTrial(t *testing.T) {
+	b := openBreaker(t)
+	if ok, trial := b.Allow(); !ok || !trial {
+		t.Fatalf("Allow() = (%v, %v) after cooldown, want a trial", ok, trial)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.Allow(); ok {
+			t.Fatal("a second operation was let through while the trial is running")
+		}
+	}
+}
+
+func TestBreakerTrialResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{"success closes", nil, false},
+		{"not found still reached the database", mongo.ErrNoDocuments, false},
+		{"failure opens again", errNetwork, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := openBreaker(t)
+			_, trial := b.Allow()
+			b.Record(tt.err, trial)
+			if b.Open() != tt.wantOpen {
+				t.Fatalf("Open() = %v, want %v", b.Open(), tt.wantOpen)
+			}
+			if ok, _ := b.Allow(); ok == tt.wantOpen {
+				t.Fatalf("Allow() = %v right after the trial, want %v", ok, !tt.wantOpen)
+			}
+		})
+	}
+}
+
+// 打開前就送出的操作晚一點才成功，斷路器還是打開的，試探也還在進行
+func TestBreakerLateSuccess(t *testing.T) {
+	b := NewBreaker(1, 10*time.Millisecond)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("closed breaker rejected an operation")
+	}
+	b.Record(errNetwork, false)
+	b.Record(nil, false)
+	if !b.Open() {
+		t.Fatal("a success sent before the breaker opened closed it")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	if _, trial := b.Allow(); !trial {
+		t.Fatal("no trial after cooldown")
+	}
+	b.Record(nil, false)
+	if !b.Open() {
+		t.Fatal("a success that is not the trial closed the breaker")
+	}
+	if ok, _ := b.Allow(); ok {
+		t.Fatal("a success that is not the trial let a second trial through")
+	}
+}
+
+func TestBreakerReleaseTrial(t *testing.T) {
+	b := openBreaker(t)
+	_, trial := b.Allow()
+	// 不是試探的操作取消了不影響
+	b.Release(false)
+	if ok, _ := b.Allow(); ok {
+		t.Fatal("releasing a non-trial operation let another one through")
+	}
+	// 試探的操作被呼叫的人取消，下一個操作接著試
+	b.Release(trial)
+	if !b.Open() {
+		t.Fatal("a cancelled trial closed the breaker")
+	}
+	if ok, trial := b.Allow(); !ok || !trial {
+		t.Fatalf("Allow() = (%v, %v) after the trial was released, want a new trial", ok, trial)
+	}
+}
@@ -0,0 +1,163 @@
+package DB
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection 包住*mongo.Collection，每個操作都有自己的時限，並且經過斷路器
+// 傳進來的ctx通常是r.Context()，client斷線或request逾時一樣會取消操作
+// 沒有包到的方法會直接用到底下的*mongo.Collection，不會經過斷路器
+// Find跟Aggregate只有送出查詢、拿到第一批結果的部分有時限跟斷路器，之後cursor.All/Next
+// 讀剩下的批次用的是呼叫的人傳的ctx(通常受request的時限限制)，錯誤也不會算進斷路器
+type Collection struct {
+	*mongo.Collection
+	timeout time.Duration
+	breaker *Breaker
+}
+
+func NewCollection(coll *mongo.Collection, timeout time.Duration, breaker *Breaker) *Collection {
+	return &Collection{Collection: coll, timeout: timeout, breaker: breaker}
+}
+
+// run 斷路器打開時直接回ErrUnavailable，否則帶著時限執行op並記錄結果
+// 傳進來的ctx自己到期或被取消(request逾時、client斷線)不算資料庫的錯
+func (c *Collection) run(ctx context.Context, op func(context.Context) error) error {
+	ok, trial := c.breaker.Allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	opCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := op(opCtx)
+	if ctx.Err() != nil {
+		c.breaker.Release(trial)
+	} else {
+		c.breaker.Record(err, trial)
+	}
+	return err
+}
+
+// Find 時限跟斷路器只管到拿到cursor為止，cursor.All讀剩下的批次不算，見Collection的說明
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	var cursor *mongo.Cursor
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		cursor, err = c.Collection.Find(ctx, filter, opts...)
+		return err
+	})
+	return cursor, err
+}
+
+// FindOne 在時限內呼叫Err()把結果讀進來，回傳後Decode就不會再用到已經取消的context
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	var res *mongo.SingleResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		res = c.Collection.FindOne(ctx, filter, opts...)
+		if res.Err() == mongo.ErrNoDocuments {
+			return nil
+		}
+		return res.Err()
+	})
+	if err == ErrUnavailable {
+		// 文件不能是nil，內容不重要，Err()跟Decode都會回傳err
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return res
+}
+
+func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	var count int64
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		count, err = c.Collection.CountDocuments(ctx, filter, opts...)
+		return err
+	})
+	return count, err
+}
+
+// Aggregate 跟Find一樣，讀cursor的部分不經過斷路器
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	var cursor *mongo.Cursor
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		cursor, err = c.Collection.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
+	return cursor, err
+}
+
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	var res *mongo.InsertOneResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.InsertOne(ctx, document, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *Collection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	var res *mongo.InsertManyResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.InsertMany(ctx, documents, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *Collection) UpdateOne(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	var res *mongo.UpdateResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *Collection) UpdateMany(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	var res *mongo.UpdateResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.UpdateMany(ctx, filter, update, opts...)
+		return err
+	})
+	return res, err
+}
+
+// BulkWrite 很多筆寫入一次送出，出錯時回傳的結果還是有已經完成的筆數
+func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	var res *mongo.BulkWriteResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.BulkWrite(ctx, models, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	var res *mongo.DeleteResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *Collection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	var res *mongo.DeleteResult
+	err := c.run(ctx, func(ctx context.Context) error {
+		var err error
+		res, err = c.Collection.DeleteMany(ctx, filter, opts...)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,91 @@
+package Utils
+
+import (
+	"errors"
+	"time"
+)
+
+// 使用者沒有設定時區時的預設值
+const DefaultTimeZone = "Asia/Taipei"
+
+// 日期字串格式 (使用者當地的日曆日)
+const DayLayout = "2006-01-02"
+
+// 大於這個值的date視為毫秒 (前端用Date.now()送來的是毫秒)，秒數要到西元5138年才會超過
+const MillisecondThreshold int64 = 100000000000
+
+// LoadLocation 讀取時區，空字串就用預設時區
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = DefaultTimeZone
+	}
+	return time.LoadLocation(name)
+}
+
+// UnixToTime 把expense的date轉成time.Time，秒或毫秒都可以
+func UnixToTime(date int) time.Time {
+	if int64(date) >= MillisecondThreshold || int64(date) <= -MillisecondThreshold {
+		return time.UnixMilli(int64(date))
+	}
+	return time.Unix(int64(date), 0)
+}
+
+// StartOfDay 回傳t在loc時區當天的00:00
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// ParseDay 把"2006-01-02"解析成loc時區那天的00:00
+func ParseDay(day string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation(DayLayout, day, loc)
+}
+
+// LocalDay 回傳expense的date在loc時區是哪一天
+func LocalDay(date int, loc *time.Location) string {
+	return UnixToTime(date).In(loc).Format(DayLayout)
+}
+
+// PeriodRange 回傳包含day的期間 [start, end)，都是loc時區的日界線
+// period可以是 day, week(從週一開始), month, year
+func PeriodRange(period string, day time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	start := StartOfDay(day, loc)
+	switch period {
+	case "day":
+		return start, start.AddDate(0, 0, 1), nil
+	case "week":
+		offset := (int(start.Weekday()) + 6) % 7 // 週一是0
+		start = start.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), nil
+	case "month":
+		start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), nil
+	case "year":
+		start = time.Date(start.Year(), 1, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, errors.New("unknown period: " + period)
+}
+
+// DayRange 把 from/to 兩個日期(含)轉成 [start, end)，任一個空字串就代表不限制
+func DayRange(from, to string, loc *time.Location) (time.Time, time.Time, error) {
+	var start, end time.Time
+	if from != "" {
+		t, err := ParseDay(from, loc)
+		if err != nil {
+			return start, end, err
+		}
+		start = t
+	}
+	if to != "" {
+		t, err := ParseDay(to, loc)
+		if err != nil {
+			return start, end, err
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	if !start.IsZero() && !end.IsZero() && !start.Before(end) {
+		return start, end, errors.New("from must not be after to")
+	}
+	return start, end, nil
+}
@@ -0,0 +1,63 @@
+package Utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnixToTime(t *testing.T) {
+	want := time.Date(2024, 3, 31, 16, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		date int
+		want time.Time
+	}{
+		{"seconds", int(want.Unix()), want},
+		{"milliseconds", int(want.UnixMilli()), want},
+		{"largest second", int(MillisecondThreshold - 1), time.Unix(MillisecondThreshold-1, 0)},
+		{"threshold is milliseconds", int(MillisecondThreshold), time.UnixMilli(MillisecondThreshold)},
+		{"zero", 0, time.Unix(0, 0)},
+	}
+	for _, tt := range tests {
+		if got := UnixToTime(tt.date); !got.Equal(tt.want) {
+			t.Errorf("%s: UnixToTime(%d) = %v, want %v", tt.name, tt.date, got, tt.want)
+		}
+	}
+}
+
+// UTC的3/31 16:30在台北已經是4/1
+func TestLocalDay(t *testing.T) {
+	taipei, err := LoadLocation("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 3, 31, 16, 30, 0, 0, time.UTC)
+	for _, d := range []int{int(date.Unix()), int(date.UnixMilli())} {
+		if got := LocalDay(d, taipei); got != "2024-04-01" {
+			t.Errorf("LocalDay(%d, Taipei) = %s, want 2024-04-01", d, got)
+		}
+		if got := LocalDay(d, time.UTC); got != "2024-03-31" {
+			t.Errorf("LocalDay(%d, UTC) = %s, want 2024-03-31", d, got)
+		}
+	}
+}
+
+func TestDayRange(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end, err := DayRange("2024-11-03", "2024-11-03", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hours := end.Sub(start).Hours(); hours != 25 {
+		t.Errorf("the day DST ends is %v hours, want 25", hours)
+	}
+	if _, _, err := DayRange("2024-03-02", "2024-03-01", loc); err == nil {
+		t.Error("from after to accepted")
+	}
+	if start, end, err := DayRange("", "", loc); err != nil || !start.IsZero() || !end.IsZero() {
+		t.Errorf("DayRange(\"\", \"\") = (%v, %v, %v), want an open range", start, end, err)
+	}
+}
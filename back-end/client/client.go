@@ -0,0 +1,1063 @@
+// Package client 是Budget API的Go client，型別跟方法對應handler/openapi.json，
+// 修改API時兩邊要一起更新。
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type Budget struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Max         int    `json:"max"`
+	UserID      string `json:"userID,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	ParentID    string `json:"parentID,omitempty"`
+	MaxMode     string `json:"maxMode,omitempty"` // own或children
+}
+
+// BudgetPatch ParentID指向空字串代表移到最上層
+type BudgetPatch struct {
+	Name     *string `json:"name,omitempty"`
+	Max      *int    `json:"max,omitempty"`
+	ParentID *string `json:"parentID,omitempty"`
+	MaxMode  *string `json:"maxMode,omitempty"`
+}
+
+type Expense struct {
+	ID           string   `json:"id"`
+	BudgetID     string   `json:"budgetID"`
+	Description  string   `json:"description"`
+	Amount       int      `json:"amount"`
+	Date         int      `json:"date"`
+	UserID       string   `json:"userID,omitempty"`
+	HouseholdID  string   `json:"householdID,omitempty"`
+	CreatedBy    string   `json:"createdBy,omitempty"`
+	Split        *Split   `json:"split,omitempty"`
+	AccountID    string   `json:"accountID,omitempty"`
+	ReconciledIn string   `json:"reconciledIn,omitempty"` // 對帳鎖定的花費不能修改或刪除
+	Tags         []string `json:"tags,omitempty"`
+	// Allocations 分到好幾個預算，金額加起來要等於Amount，有的話BudgetID可以不填
+	Allocations []Allocation `json:"allocations,omitempty"`
+}
+
+type Allocation struct {
+	BudgetID string `json:"budgetID"`
+	Amount   int    `json:"amount"`
+}
+
+// ExpensePatch Split的Participants是空的代表取消分帳，AccountID指向空字串代表不記在任何帳戶
+type ExpensePatch struct {
+	BudgetID    *string   `json:"budgetID,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Amount      *int      `json:"amount,omitempty"`
+	Date        *int      `json:"date,omitempty"`
+	Split       *Split    `json:"split,omitempty"`
+	AccountID   *string   `json:"accountID,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"` // 整個換掉，空陣列代表清掉
+	// Allocations 整個換掉，空陣列代表取消分配
+	Allocations *[]Allocation `json:"allocations,omitempty"`
+}
+
+// Split Method是equal、shares或exact，PaidBy沒填就是新增花費的人
+type Split struct {
+	PaidBy       string       `json:"paidBy,omitempty"`
+	Method       string       `json:"method,omitempty"`
+	Participants []SplitShare `json:"participants"`
+}
+
+type SplitShare struct {
+	Account string `json:"account"`
+	Shares  int    `json:"shares,omitempty"`
+	Amount  int    `json:"amount,omitempty"`
+}
+
+type Settlement struct {
+	ID          string `json:"id,omitempty"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      int    `json:"amount"`
+	Date        int    `json:"date,omitempty"`
+	Note        string `json:"note,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+// Debt From欠To Amount
+type Debt struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+type MemberBalance struct {
+	Account string `json:"account"`
+	Net     int    `json:"net"`
+}
+
+type Balances struct {
+	Balances []MemberBalance `json:"balances"`
+	Debts    []Debt          `json:"debts"`
+	SettleUp []Debt          `json:"settleUp"`
+}
+
+type HouseholdMember struct {
+	Account  string `json:"account"`
+	Role     string `json:"role"`
+	JoinedAt int64  `json:"joinedAt"`
+}
+
+type HouseholdInvitation struct {
+	Account   string `json:"account"`
+	Role      string `json:"role"`
+	InvitedBy string `json:"invitedBy"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+type Household struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	Members     []HouseholdMember     `json:"members"`
+	Invitations []HouseholdInvitation `json:"invitations"`
+	CreatedAt   int64                 `json:"createdAt"`
+	Role        string                `json:"role,omitempty"` // 自己在這個家庭的角色
+}
+
+// Invitation 是別人對自己的邀請
+type Invitation struct {
+	HouseholdID   string `json:"householdID"`
+	HouseholdName string `json:"householdName"`
+	Role          string `json:"role"`
+	InvitedBy     string `json:"invitedBy"`
+	CreatedAt     int64  `json:"createdAt"`
+}
+
+// ExpenseQuery 對應GET /api/v1/expenses的query string，日期格式是2006-01-02
+// 收入跟收支報表也用同樣的日期條件
+// ExpenseQuery Tags跟TagMatch(any或all)只有ListExpenses會用到
+type ExpenseQuery struct {
+	From     string
+	To       string
+	Period   string
+	Date     string
+	Tags     []string
+	TagMatch string
+}
+
+type Income struct {
+	ID           string `json:"id,omitempty"`
+	Source       string `json:"source"`
+	Description  string `json:"description"`
+	Amount       int    `json:"amount"`
+	Date         int    `json:"date,omitempty"`
+	AccountID    string `json:"accountID,omitempty"`
+	UserID       string `json:"userID,omitempty"`
+	HouseholdID  string `json:"householdID,omitempty"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	RecurringID  string `json:"recurringID,omitempty"` // 由固定收入算出來的才有
+	Projected    bool   `json:"projected,omitempty"`
+	ReconciledIn string `json:"reconciledIn,omitempty"`
+}
+
+type IncomePatch struct {
+	Source      *string `json:"source,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Amount      *int    `json:"amount,omitempty"`
+	Date        *int    `json:"date,omitempty"`
+	AccountID   *string `json:"accountID,omitempty"`
+}
+
+// RecurringIncome Frequency是weekly、biweekly、monthly(預設)或yearly
+type RecurringIncome struct {
+	ID          string `json:"id,omitempty"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+	Amount      int    `json:"amount"`
+	Frequency   string `json:"frequency,omitempty"`
+	StartDate   string `json:"startDate"`
+	EndDate     string `json:"endDate,omitempty"`
+	AccountID   string `json:"accountID,omitempty"`
+	UserID      string `json:"userID,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+// RecurringIncomePatch EndDate、AccountID指向空字串代表取消
+type RecurringIncomePatch struct {
+	Source      *string `json:"source,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Amount      *int    `json:"amount,omitempty"`
+	Frequency   *string `json:"frequency,omitempty"`
+	StartDate   *string `json:"startDate,omitempty"`
+	EndDate     *string `json:"endDate,omitempty"`
+	AccountID   *string `json:"accountID,omitempty"`
+}
+
+type CashFlowRow struct {
+	Start           string  `json:"start"`
+	End             string  `json:"end"`
+	Income          int     `json:"income"`
+	ProjectedIncome int     `json:"projectedIncome"`
+	Expenses        int     `json:"expenses"`
+	Net             int     `json:"net"`
+	SavingsRate     float64 `json:"savingsRate"`
+}
+
+type SourceTotal struct {
+	Source string `json:"source"`
+	Amount int    `json:"amount"`
+}
+
+type CashFlow struct {
+	Interval               string        `json:"interval"`
+	Periods                []CashFlowRow `json:"periods"`
+	Total                  CashFlowRow   `json:"total"`
+	BySource               []SourceTotal `json:"bySource"`
+	Budgeted               int           `json:"budgeted"`
+	AverageMonthlyIncome   int           `json:"averageMonthlyIncome"`
+	AverageMonthlyExpenses int           `json:"averageMonthlyExpenses"`
+	Affordable             bool          `json:"affordable"`
+}
+
+// BudgetTotal 預算的花費，Total包含所有子預算
+type BudgetTotal struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	ParentID      string        `json:"parentID,omitempty"`
+	MaxMode       string        `json:"maxMode"`
+	Max           int           `json:"max"`
+	Spent         int           `json:"spent"`
+	Total         int           `json:"total"`
+	Remaining     int           `json:"remaining"`
+	Overallocated bool          `json:"overallocated,omitempty"`
+	Children      []BudgetTotal `json:"children"`
+}
+
+type BudgetTotals struct {
+	From          string        `json:"from,omitempty"`
+	To            string        `json:"to,omitempty"`
+	Max           int           `json:"max"`
+	Total         int           `json:"total"`
+	Uncategorized int           `json:"uncategorized"`
+	Budgets       []BudgetTotal `json:"budgets"`
+	Tags          []TagTotal    `json:"tags"`
+}
+
+type TagTotal struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Total int    `json:"total"`
+}
+
+// FinancialAccount 是資金帳戶(現金、信用卡等)，Type是cash、debit、credit、savings或other
+type FinancialAccount struct {
+	ID             string `json:"id,omitempty"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	OpeningBalance int    `json:"openingBalance"`
+	Currency       string `json:"currency,omitempty"`
+	Archived       bool   `json:"archived"`
+	Balance        int    `json:"balance,omitempty"`       // 伺服器算的目前餘額
+	LockedThrough  string `json:"lockedThrough,omitempty"` // 對帳鎖定到哪一天(含)
+	UserID         string `json:"userID,omitempty"`
+	HouseholdID    string `json:"householdID,omitempty"`
+	CreatedBy      string `json:"createdBy,omitempty"`
+}
+
+type FinancialAccountPatch struct {
+	Name           *string `json:"name,omitempty"`
+	Type           *string `json:"type,omitempty"`
+	OpeningBalance *int    `json:"openingBalance,omitempty"`
+	Currency       *string `json:"currency,omitempty"`
+	Archived       *bool   `json:"archived,omitempty"`
+}
+
+// Transfer 幣別不同時ToAmount是轉入帳戶收到的金額
+type Transfer struct {
+	ID            string `json:"id,omitempty"`
+	FromAccountID string `json:"fromAccountID"`
+	ToAccountID   string `json:"toAccountID"`
+	Amount        int    `json:"amount"`
+	ToAmount      int    `json:"toAmount,omitempty"`
+	Date          int    `json:"date,omitempty"`
+	Note          string `json:"note,omitempty"`
+	ReconciledIn  string `json:"reconciledIn,omitempty"`
+	UserID        string `json:"userID,omitempty"`
+	HouseholdID   string `json:"householdID,omitempty"`
+	CreatedBy     string `json:"createdBy,omitempty"`
+}
+
+type LedgerEntry struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Date        int    `json:"date"`
+	Amount      int    `json:"amount"`
+	Balance     int    `json:"balance"`
+}
+
+type AccountLedger struct {
+	Account      FinancialAccount `json:"account"`
+	StartBalance int              `json:"startBalance"`
+	EndBalance   int              `json:"endBalance"`
+	Entries      []LedgerEntry    `json:"entries"`
+}
+
+// StatementLine Amount支出是負的，Status是unmatched、suggested、confirmed或ignored
+type StatementLine struct {
+	Index       int     `json:"index"`
+	Date        string  `json:"date"`
+	Description string  `json:"description"`
+	Amount      int     `json:"amount"`
+	Status      string  `json:"status"`
+	MatchKind   string  `json:"matchKind,omitempty"`
+	MatchID     string  `json:"matchID,omitempty"`
+	Score       float64 `json:"score,omitempty"`
+}
+
+// Statement 上傳的對帳單，UnmatchedEntries是帳戶在這段期間有記、對帳單上卻沒有的
+type Statement struct {
+	ID               string          `json:"id"`
+	AccountID        string          `json:"accountID"`
+	From             string          `json:"from"`
+	To               string          `json:"to"`
+	Status           string          `json:"status"`
+	Lines            []StatementLine `json:"lines"`
+	UploadedAt       int             `json:"uploadedAt"`
+	LockedAt         int             `json:"lockedAt,omitempty"`
+	UnmatchedEntries []LedgerEntry   `json:"unmatchedEntries,omitempty"`
+	UserID           string          `json:"userID,omitempty"`
+	HouseholdID      string          `json:"householdID,omitempty"`
+	CreatedBy        string          `json:"createdBy,omitempty"`
+}
+
+// StatementLinePatch Action是confirm、reject、ignore或match，match時要填Kind跟MatchID
+// StatementLinePatch Action是create的話用這一行新增花費，BudgetID沒填就用自動分類的規則
+type StatementLinePatch struct {
+	Action   string `json:"action"`
+	Kind     string `json:"kind,omitempty"`
+	MatchID  string `json:"matchID,omitempty"`
+	BudgetID string `json:"budgetID,omitempty"`
+}
+
+// RuleMatch 自動分類的條件，零值代表不限制，Weekdays的0是星期日
+type RuleMatch struct {
+	DescriptionContains string `json:"descriptionContains,omitempty"`
+	DescriptionRegex    string `json:"descriptionRegex,omitempty"`
+	MinAmount           int    `json:"minAmount,omitempty"`
+	MaxAmount           int    `json:"maxAmount,omitempty"`
+	AccountID           string `json:"accountID,omitempty"`
+	Weekdays            []int  `json:"weekdays,omitempty"`
+}
+
+// Rule Priority小的先比對，第一個符合的規則決定預算跟標籤
+type Rule struct {
+	ID          string    `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	Priority    int       `json:"priority"`
+	Match       RuleMatch `json:"match"`
+	BudgetID    string    `json:"budgetID"`
+	Tags        []string  `json:"tags,omitempty"`
+	UserID      string    `json:"userID,omitempty"`
+	HouseholdID string    `json:"householdID,omitempty"`
+	CreatedBy   string    `json:"createdBy,omitempty"`
+	CreatedAt   int       `json:"createdAt,omitempty"`
+}
+
+// RulePatch Match送的話整個換掉
+type RulePatch struct {
+	Name     *string    `json:"name,omitempty"`
+	Priority *int       `json:"priority,omitempty"`
+	Match    *RuleMatch `json:"match,omitempty"`
+	BudgetID *string    `json:"budgetID,omitempty"`
+	Tags     *[]string  `json:"tags,omitempty"`
+}
+
+type RuleChange struct {
+	ExpenseID    string   `json:"expenseID"`
+	Description  string   `json:"description"`
+	Amount       int      `json:"amount"`
+	Date         int      `json:"date"`
+	RuleID       string   `json:"ruleID,omitempty"`
+	FromBudgetID string   `json:"fromBudgetID"`
+	ToBudgetID   string   `json:"toBudgetID"`
+	AddedTags    []string `json:"addedTags,omitempty"`
+}
+
+type RuleResult struct {
+	Scanned int          `json:"scanned"`
+	Matched int          `json:"matched"`
+	Changed int          `json:"changed"`
+	Kept    int          `json:"kept"`
+	Total   int          `json:"total"`
+	Applied bool         `json:"applied"`
+	Changes []RuleChange `json:"changes"`
+}
+
+// Goal 儲蓄目標，Saved以下的欄位是伺服器從存入紀錄算的
+type Goal struct {
+	ID              string  `json:"id,omitempty"`
+	Name            string  `json:"name"`
+	TargetAmount    int     `json:"targetAmount"`
+	TargetDate      string  `json:"targetDate,omitempty"`
+	AccountID       string  `json:"accountID,omitempty"`
+	BudgetID        string  `json:"budgetID,omitempty"`
+	UserID          string  `json:"userID,omitempty"`
+	HouseholdID     string  `json:"householdID,omitempty"`
+	CreatedBy       string  `json:"createdBy,omitempty"`
+	CreatedAt       int     `json:"createdAt,omitempty"`
+	Saved           int     `json:"saved,omitempty"`
+	Remaining       int     `json:"remaining,omitempty"`
+	Progress        float64 `json:"progress,omitempty"`
+	Completed       bool    `json:"completed,omitempty"`
+	MonthlyRate     int     `json:"monthlyRate,omitempty"`
+	ProjectedDate   string  `json:"projectedDate,omitempty"`
+	RequiredMonthly int     `json:"requiredMonthly,omitempty"`
+	OnTrack         bool    `json:"onTrack,omitempty"`
+}
+
+// GoalPatch TargetDate、AccountID、BudgetID指向空字串代表取消
+type GoalPatch struct {
+	Name         *string `json:"name,omitempty"`
+	TargetAmount *int    `json:"targetAmount,omitempty"`
+	TargetDate   *string `json:"targetDate,omitempty"`
+	AccountID    *string `json:"accountID,omitempty"`
+	BudgetID     *string `json:"budgetID,omitempty"`
+}
+
+// Contribution Amount是負的代表從目標領出來
+type Contribution struct {
+	ID          string `json:"id,omitempty"`
+	GoalID      string `json:"goalID,omitempty"`
+	Amount      int    `json:"amount"`
+	Date        int    `json:"date,omitempty"`
+	Note        string `json:"note,omitempty"`
+	UserID      string `json:"userID,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+type CRUDResponse struct {
+	LogIn bool   `json:"logIn"`
+	Msg   string `json:"msg"`
+}
+
+type SignUpRequest struct {
+	Name     string `json:"name"`
+	Account  string `json:"account"`
+	Password string `json:"password"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+type SignUpResponse struct {
+	Type   bool   `json:"type"`
+	Target string `json:"target"`
+	Msg    string `json:"msg"`
+}
+
+type SignInRequest struct {
+	Account  string `json:"account"`
+	Password string `json:"password"`
+	Check    bool   `json:"check"`
+}
+
+type SignInResponse struct {
+	Type   bool   `json:"type"`
+	Target string `json:"target"`
+	Name   string `json:"name"`
+	Msg    string `json:"msg"`
+}
+
+type CSRFTokenResponse struct {
+	Token string `json:"token"`
+}
+
+type IsLoggedInResponse struct {
+	IsLoggedIn bool   `json:"isLoggedIn"`
+	UserName   string `json:"userName"`
+	TimeZone   string `json:"timeZone"`
+}
+
+// Error 是伺服器回傳非2xx時的錯誤，Code對應伺服器的錯誤代碼
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Field      string `json:"field"`
+	Message    string `json:"message"`
+	RequestID  string `json:"requestID"`
+}
+
+func (e *Error) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("budget api: %d %s (%s): %s", e.StatusCode, e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("budget api: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Language   string // 有設定就送Accept-Language，伺服器會用這個語言回覆訊息
+	Household  string // 有設定就送X-Household-ID，預算跟花費的操作都會是這個家庭的
+
+	mu        sync.Mutex
+	csrfToken string // 會改資料的request要帶的X-CSRF-Token，第一次需要時才去拿
+}
+
+// New 建立client，HTTPClient帶有cookie jar用來保存登入後的SID
+func New(baseURL string) (*Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Jar: jar},
+	}, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var token string
+	if unsafeMethod(method) {
+		var err error
+		if token, err = c.token(ctx); err != nil {
+			return err
+		}
+	}
+
+	var reader io.Reader
+	contentType := "application/json"
+	if raw, ok := body.(rawBody); ok {
+		reader, contentType = bytes.NewReader(raw.data), raw.contentType
+	} else if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Language != "" {
+		req.Header.Set("Accept-Language", c.Language)
+	}
+	if token != "" {
+		req.Header.Set("X-CSRF-Token", token)
+	}
+	if c.Household != "" {
+		req.Header.Set("X-Household-ID", c.Household)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// 登入成功時伺服器會換一個新的token
+	if rotated := res.Header.Get("X-CSRF-Token"); rotated != "" {
+		c.setToken(rotated)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var envelope struct {
+			Error *Error `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) != nil || envelope.Error == nil {
+			envelope.Error = &Error{Message: strings.TrimSpace(string(data))}
+		}
+		envelope.Error.StatusCode = res.StatusCode
+		return envelope.Error
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// rawBody 不是JSON的request body，do會原封不動送出去
+type rawBody struct {
+	contentType string
+	data        []byte
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// token 回傳目前的CSRF token，還沒有的話先跟伺服器拿
+func (c *Client) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token := c.csrfToken
+	c.mu.Unlock()
+	if token != "" {
+		return token, nil
+	}
+	res, err := c.CSRFToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+func (c *Client) setToken(token string) {
+	c.mu.Lock()
+	c.csrfToken = token
+	c.mu.Unlock()
+}
+
+func (c *Client) CSRFToken(ctx context.Context) (*CSRFTokenResponse, error) {
+	var res CSRFTokenResponse
+	if err := c.do(ctx, http.MethodGet, "/csrfToken", nil, &res); err != nil {
+		return nil, err
+	}
+	c.setToken(res.Token)
+	return &res, nil
+}
+
+func (c *Client) SignUp(ctx context.Context, req SignUpRequest) (*SignUpResponse, error) {
+	var res SignUpResponse
+	return &res, c.do(ctx, http.MethodPost, "/signUp", req, &res)
+}
+
+func (c *Client) SignIn(ctx context.Context, req SignInRequest) (*SignInResponse, error) {
+	var res SignInResponse
+	return &res, c.do(ctx, http.MethodPost, "/signIn", req, &res)
+}
+
+// LogOut 登出後session清掉了，token也跟著作廢
+func (c *Client) LogOut(ctx context.Context) error {
+	err := c.do(ctx, http.MethodPost, "/logOut", nil, nil)
+	c.setToken("")
+	return err
+}
+
+func (c *Client) IsLoggedIn(ctx context.Context) (*IsLoggedInResponse, error) {
+	var res IsLoggedInResponse
+	return &res, c.do(ctx, http.MethodGet, "/isLoggedIn", nil, &res)
+}
+
+func (c *Client) UpdateTimeZone(ctx context.Context, timeZone string) (*CRUDResponse, error) {
+	var res CRUDResponse
+	return &res, c.do(ctx, http.MethodPost, "/updateTimeZone", map[string]string{"timeZone": timeZone}, &res)
+}
+
+func (c *Client) UpdateLocale(ctx context.Context, locale string) (*CRUDResponse, error) {
+	var res CRUDResponse
+	return &res, c.do(ctx, http.MethodPost, "/updateLocale", map[string]string{"locale": locale}, &res)
+}
+
+func (c *Client) ListBudgets(ctx context.Context) ([]Budget, error) {
+	var res []Budget
+	err := c.do(ctx, http.MethodGet, "/api/v1/budgets", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateBudget(ctx context.Context, budget Budget) (*Budget, error) {
+	var res Budget
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/budgets", budget, &res)
+}
+
+func (c *Client) UpdateBudget(ctx context.Context, id string, patch BudgetPatch) (*Budget, error) {
+	var res Budget
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/budgets/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteBudget(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/budgets/"+url.PathEscape(id), nil, nil)
+}
+
+// path 把日期條件跟extra裡不是空字串的參數接在path後面
+func (q ExpenseQuery) path(path string, extra map[string]string) string {
+	values := url.Values{}
+	for key, value := range map[string]string{"from": q.From, "to": q.To, "period": q.Period, "date": q.Date,
+		"tags": strings.Join(q.Tags, ","), "tagMatch": q.TagMatch} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	for key, value := range extra {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	return path
+}
+
+func (c *Client) ListExpenses(ctx context.Context, query ExpenseQuery) ([]Expense, error) {
+	var res []Expense
+	err := c.do(ctx, http.MethodGet, query.path("/api/v1/expenses", nil), nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateExpense(ctx context.Context, expense Expense) (*Expense, error) {
+	var res Expense
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/expenses", expense, &res)
+}
+
+func (c *Client) UpdateExpense(ctx context.Context, id string, patch ExpensePatch) (*Expense, error) {
+	var res Expense
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/expenses/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteExpense(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/expenses/"+url.PathEscape(id), nil, nil)
+}
+
+// ListIncomes source不是空字串的話只列這個來源
+func (c *Client) ListIncomes(ctx context.Context, query ExpenseQuery, source string) ([]Income, error) {
+	var res []Income
+	err := c.do(ctx, http.MethodGet, query.path("/api/v1/incomes", map[string]string{"source": source}), nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateIncome(ctx context.Context, income Income) (*Income, error) {
+	var res Income
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/incomes", income, &res)
+}
+
+func (c *Client) UpdateIncome(ctx context.Context, id string, patch IncomePatch) (*Income, error) {
+	var res Income
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/incomes/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteIncome(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/incomes/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ListRecurringIncomes(ctx context.Context) ([]RecurringIncome, error) {
+	var res []RecurringIncome
+	err := c.do(ctx, http.MethodGet, "/api/v1/recurringIncomes", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateRecurringIncome(ctx context.Context, income RecurringIncome) (*RecurringIncome, error) {
+	var res RecurringIncome
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/recurringIncomes", income, &res)
+}
+
+func (c *Client) UpdateRecurringIncome(ctx context.Context, id string, patch RecurringIncomePatch) (*RecurringIncome, error) {
+	var res RecurringIncome
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/recurringIncomes/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteRecurringIncome(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/recurringIncomes/"+url.PathEscape(id), nil, nil)
+}
+
+// CashFlow interval是day、week、month或year，空字串就是month
+func (c *Client) CashFlow(ctx context.Context, query ExpenseQuery, interval string) (*CashFlow, error) {
+	var res CashFlow
+	return &res, c.do(ctx, http.MethodGet, query.path("/api/v1/cashFlow", map[string]string{"interval": interval}), nil, &res)
+}
+
+// BudgetTotals 每個預算在區間內的花費，query沒指定區間就是這個月
+func (c *Client) BudgetTotals(ctx context.Context, query ExpenseQuery) (*BudgetTotals, error) {
+	var res BudgetTotals
+	return &res, c.do(ctx, http.MethodGet, query.path("/api/v1/budgetTotals", nil), nil, &res)
+}
+
+// ListTags 用過的標籤跟花費的加總，可以用query的日期篩選
+func (c *Client) ListTags(ctx context.Context, query ExpenseQuery) ([]TagTotal, error) {
+	var res []TagTotal
+	err := c.do(ctx, http.MethodGet, query.path("/api/v1/tags", nil), nil, &res)
+	return res, err
+}
+
+// RenameTag 新名稱已經有在用的話就是合併
+func (c *Client) RenameTag(ctx context.Context, name, newName string) (*TagTotal, error) {
+	var res TagTotal
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/tags/"+url.PathEscape(name), map[string]string{"name": newName}, &res)
+}
+
+func (c *Client) MergeTags(ctx context.Context, tags []string, into string) (*TagTotal, error) {
+	var res TagTotal
+	body := map[string]interface{}{"tags": tags, "into": into}
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/tags/merge", body, &res)
+}
+
+// DeleteTag 從所有花費移除標籤，花費本身不會刪
+func (c *Client) DeleteTag(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/tags/"+url.PathEscape(name), nil, nil)
+}
+
+func (c *Client) ListAccounts(ctx context.Context) ([]FinancialAccount, error) {
+	var res []FinancialAccount
+	err := c.do(ctx, http.MethodGet, "/api/v1/accounts", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateAccount(ctx context.Context, account FinancialAccount) (*FinancialAccount, error) {
+	var res FinancialAccount
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/accounts", account, &res)
+}
+
+func (c *Client) GetAccount(ctx context.Context, id string) (*FinancialAccount, error) {
+	var res FinancialAccount
+	return &res, c.do(ctx, http.MethodGet, "/api/v1/accounts/"+url.PathEscape(id), nil, &res)
+}
+
+func (c *Client) UpdateAccount(ctx context.Context, id string, patch FinancialAccountPatch) (*FinancialAccount, error) {
+	var res FinancialAccount
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/accounts/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteAccount(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/accounts/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) AccountLedger(ctx context.Context, id string, query ExpenseQuery) (*AccountLedger, error) {
+	var res AccountLedger
+	return &res, c.do(ctx, http.MethodGet, query.path("/api/v1/accounts/"+url.PathEscape(id)+"/ledger", nil), nil, &res)
+}
+
+// ListTransfers accountID不是空字串的話只列轉入或轉出這個帳戶的
+func (c *Client) ListTransfers(ctx context.Context, query ExpenseQuery, accountID string) ([]Transfer, error) {
+	var res []Transfer
+	err := c.do(ctx, http.MethodGet, query.path("/api/v1/transfers", map[string]string{"accountID": accountID}), nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateTransfer(ctx context.Context, transfer Transfer) (*Transfer, error) {
+	var res Transfer
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/transfers", transfer, &res)
+}
+
+func (c *Client) DeleteTransfer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/transfers/"+url.PathEscape(id), nil, nil)
+}
+
+// UploadStatement csv是銀行或信用卡的對帳單，金額是正的代表支出的話outflowPositive要是true
+func (c *Client) UploadStatement(ctx context.Context, accountID string, csv []byte, outflowPositive bool) (*Statement, error) {
+	path := "/api/v1/accounts/" + url.PathEscape(accountID) + "/statements"
+	if outflowPositive {
+		path += "?outflowPositive=true"
+	}
+	var res Statement
+	return &res, c.do(ctx, http.MethodPost, path, rawBody{contentType: "text/csv", data: csv}, &res)
+}
+
+// ListStatements accountID不是空字串的話只列這個帳戶的
+func (c *Client) ListStatements(ctx context.Context, accountID string) ([]Statement, error) {
+	path := "/api/v1/statements"
+	if accountID != "" {
+		path += "?" + url.Values{"accountID": {accountID}}.Encode()
+	}
+	var res []Statement
+	err := c.do(ctx, http.MethodGet, path, nil, &res)
+	return res, err
+}
+
+func (c *Client) GetStatement(ctx context.Context, id string) (*Statement, error) {
+	var res Statement
+	return &res, c.do(ctx, http.MethodGet, "/api/v1/statements/"+url.PathEscape(id), nil, &res)
+}
+
+func (c *Client) UpdateStatementLine(ctx context.Context, id string, index int, patch StatementLinePatch) (*Statement, error) {
+	var res Statement
+	return &res, c.do(ctx, http.MethodPatch, fmt.Sprintf("/api/v1/statements/%s/lines/%d", url.PathEscape(id), index), patch, &res)
+}
+
+func (c *Client) RematchStatement(ctx context.Context, id string) (*Statement, error) {
+	var res Statement
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/statements/"+url.PathEscape(id)+"/rematch", nil, &res)
+}
+
+func (c *Client) LockStatement(ctx context.Context, id string) (*Statement, error) {
+	var res Statement
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/statements/"+url.PathEscape(id)+"/lock", nil, &res)
+}
+
+// UnlockStatement 只有家庭的擁有者可以解鎖
+func (c *Client) UnlockStatement(ctx context.Context, id string) (*Statement, error) {
+	var res Statement
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/statements/"+url.PathEscape(id)+"/unlock", nil, &res)
+}
+
+func (c *Client) DeleteStatement(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/statements/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ListGoals(ctx context.Context) ([]Goal, error) {
+	var res []Goal
+	err := c.do(ctx, http.MethodGet, "/api/v1/goals", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateGoal(ctx context.Context, goal Goal) (*Goal, error) {
+	var res Goal
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/goals", goal, &res)
+}
+
+func (c *Client) GetGoal(ctx context.Context, id string) (*Goal, error) {
+	var res Goal
+	return &res, c.do(ctx, http.MethodGet, "/api/v1/goals/"+url.PathEscape(id), nil, &res)
+}
+
+func (c *Client) UpdateGoal(ctx context.Context, id string, patch GoalPatch) (*Goal, error) {
+	var res Goal
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/goals/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteGoal(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/goals/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ListContributions(ctx context.Context, goalID string) ([]Contribution, error) {
+	var res []Contribution
+	err := c.do(ctx, http.MethodGet, "/api/v1/goals/"+url.PathEscape(goalID)+"/contributions", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateContribution(ctx context.Context, goalID string, contribution Contribution) (*Contribution, error) {
+	var res Contribution
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/goals/"+url.PathEscape(goalID)+"/contributions", contribution, &res)
+}
+
+func (c *Client) DeleteContribution(ctx context.Context, goalID, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/goals/"+url.PathEscape(goalID)+"/contributions/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ListRules(ctx context.Context) ([]Rule, error) {
+	var res []Rule
+	err := c.do(ctx, http.MethodGet, "/api/v1/rules", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateRule(ctx context.Context, rule Rule) (*Rule, error) {
+	var res Rule
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/rules", rule, &res)
+}
+
+func (c *Client) UpdateRule(ctx context.Context, id string, patch RulePatch) (*Rule, error) {
+	var res Rule
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/rules/"+url.PathEscape(id), patch, &res)
+}
+
+func (c *Client) DeleteRule(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/rules/"+url.PathEscape(id), nil, nil)
+}
+
+// TestRule 拿規則(不用先存)比對query範圍內的花費，不會改任何資料
+func (c *Client) TestRule(ctx context.Context, rule Rule, query ExpenseQuery) (*RuleResult, error) {
+	var res RuleResult
+	return &res, c.do(ctx, http.MethodPost, query.path("/api/v1/rules/test", nil), rule, &res)
+}
+
+// ApplyRules 用所有規則重新分類query範圍內的花費，dryRun的話只回傳會改什麼
+func (c *Client) ApplyRules(ctx context.Context, query ExpenseQuery, dryRun bool) (*RuleResult, error) {
+	var res RuleResult
+	extra := map[string]string{}
+	if dryRun {
+		extra["dryRun"] = "true"
+	}
+	return &res, c.do(ctx, http.MethodPost, query.path("/api/v1/rules/apply", extra), nil, &res)
+}
+
+// Balances 帶Household時算家庭成員之間的，沒帶的話算自己跟別人之間的
+func (c *Client) Balances(ctx context.Context) (*Balances, error) {
+	var res Balances
+	return &res, c.do(ctx, http.MethodGet, "/api/v1/balances", nil, &res)
+}
+
+func (c *Client) ListSettlements(ctx context.Context) ([]Settlement, error) {
+	var res []Settlement
+	err := c.do(ctx, http.MethodGet, "/api/v1/settlements", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateSettlement(ctx context.Context, settlement Settlement) (*Settlement, error) {
+	var res Settlement
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/settlements", settlement, &res)
+}
+
+func (c *Client) DeleteSettlement(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/settlements/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) ListHouseholds(ctx context.Context) ([]Household, error) {
+	var res []Household
+	err := c.do(ctx, http.MethodGet, "/api/v1/households", nil, &res)
+	return res, err
+}
+
+func (c *Client) CreateHousehold(ctx context.Context, name string) (*Household, error) {
+	var res Household
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/households", map[string]string{"name": name}, &res)
+}
+
+func (c *Client) GetHousehold(ctx context.Context, id string) (*Household, error) {
+	var res Household
+	return &res, c.do(ctx, http.MethodGet, "/api/v1/households/"+url.PathEscape(id), nil, &res)
+}
+
+func (c *Client) RenameHousehold(ctx context.Context, id, name string) (*Household, error) {
+	var res Household
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/households/"+url.PathEscape(id), map[string]string{"name": name}, &res)
+}
+
+func (c *Client) DeleteHousehold(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/households/"+url.PathEscape(id), nil, nil)
+}
+
+// Invite role是owner、editor或viewer，空字串代表editor
+func (c *Client) Invite(ctx context.Context, householdID, account, role string) (*HouseholdInvitation, error) {
+	var res HouseholdInvitation
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/households/"+url.PathEscape(householdID)+"/invitations",
+		map[string]string{"account": account, "role": role}, &res)
+}
+
+func (c *Client) RevokeInvitation(ctx context.Context, householdID, account string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/households/"+url.PathEscape(householdID)+"/invitations/"+url.PathEscape(account), nil, nil)
+}
+
+func (c *Client) UpdateMember(ctx context.Context, householdID, account, role string) (*HouseholdMember, error) {
+	var res HouseholdMember
+	return &res, c.do(ctx, http.MethodPatch, "/api/v1/households/"+url.PathEscape(householdID)+"/members/"+url.PathEscape(account),
+		map[string]string{"role": role}, &res)
+}
+
+// RemoveMember 移除成員，account是自己的話就是退出家庭
+func (c *Client) RemoveMember(ctx context.Context, householdID, account string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/households/"+url.PathEscape(householdID)+"/members/"+url.PathEscape(account), nil, nil)
+}
+
+func (c *Client) ListInvitations(ctx context.Context) ([]Invitation, error) {
+	var res []Invitation
+	err := c.do(ctx, http.MethodGet, "/api/v1/invitations", nil, &res)
+	return res, err
+}
+
+func (c *Client) AcceptInvitation(ctx context.Context, householdID string) (*Household, error) {
+	var res Household
+	return &res, c.do(ctx, http.MethodPost, "/api/v1/invitations/"+url.PathEscape(householdID)+"/accept", nil, &res)
+}
+
+func (c *Client) DeclineInvitation(ctx context.Context, householdID string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/invitations/"+url.PathEscape(householdID), nil, nil)
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+	"mongodb-budget/config"
+	"mongodb-budget/internal/testutil"
+	"mongodb-budget/server"
+)
+
+// sentTokens 記下每個request帶了哪個X-CSRF-Token
+type sentTokens struct {
+	mu   sync.Mutex
+	sent []string // "POST /signIn token"
+}
+
+func (s *sentTokens) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := s.sent
+	s.sent = nil
+	return sent
+}
+
+// newTestClient 用假資料庫啟動完整的server，client透過HTTPS連線，session cookie有Secure才送得出去
+func newTestClient(t *testing.T) (*Client, *testutil.FakeMongo, *sentTokens) {
+	t.Helper()
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	mongo := testutil.NewFakeMongo(t)
+	cfg := config.Default()
+	cfg.Database.URI = mongo.URI
+	cfg.Database.ConnectRetries = 0
+	cfg.Database.ConnectTimeout = 5 * time.Second
+	s, err := server.InitServer(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	})
+
+	tokens := &sentTokens{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens.mu.Lock()
+		tokens.sent = append(tokens.sent, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-CSRF-Token"))
+		tokens.mu.Unlock()
+		s.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := New(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := srv.Client()
+	httpClient.Jar = c.HTTPClient.Jar
+	c.HTTPClient = httpClient
+	c.Language = "en"
+	return c, mongo, tokens
+}
+
+func apiError(t *testing.T, err error) *Error {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	return e
+}
+
+func TestClientAgainstServer(t *testing.T) {
+	c, mongo, tokens := newTestClient(t)
+	ctx := context.Background()
+	hash, err := Utils.HashPassword("Passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mongo.Handle("users.find", func(bson.Raw) []any {
+		return []any{bson.M{"account": "alice", "name": "Alice", "password": hash, "timeZone": "Asia/Taipei"}}
+	})
+	mongo.Handle("budgets.find", func(bson.Raw) []any {
+		return []any{bson.M{"id": "food", "name": "Food", "max": 5000, "userID": "alice"}}
+	})
+	var mu sync.Mutex
+	var inserted []bson.Raw
+	mongo.Handle("budgets.insert", func(cmd bson.Raw) []any {
+		mu.Lock()
+		defer mu.Unlock()
+		inserted = append(inserted, cmd.Lookup("documents", "0").Document())
+		return nil
+	})
+
+	// 第一個會改資料的request之前先拿token，登入後換成新的
+	signIn, err := c.SignIn(ctx, SignInRequest{Account: "alice", Password: "Passw0rd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signIn.Type || signIn.Name != "Alice" {
+		t.Fatalf("sign in = %+v", signIn)
+	}
+	sent := tokens.take()
+	if len(sent) != 2 || sent[0] != "GET /csrfToken " || len(sent[1]) <= len("POST /signIn ") {
+		t.Fatalf("requests = %q, want the token fetched before signing in", sent)
+	}
+	before := sent[1][len("POST /signIn "):]
+	rotated, err := c.token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == "" || rotated == before {
+		t.Fatalf("token after sign in = %q, want a new one (was %q)", rotated, before)
+	}
+
+	loggedIn, err := c.IsLoggedIn(ctx)
+	if err != nil || !loggedIn.IsLoggedIn || loggedIn.UserName != "Alice" {
+		t.Fatalf("IsLoggedIn() = %+v, %v", loggedIn, err)
+	}
+
+	budget, err := c.CreateBudget(ctx, Budget{ID: "trip", Name: " Trip ", Max: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.ID != "trip" || budget.Name != "Trip" || budget.MaxMode != "own" || budget.UserID != "alice" {
+		t.Fatalf("created = %+v", budget)
+	}
+	mu.Lock()
+	if len(inserted) != 1 || inserted[0].Lookup("name").StringValue() != "Trip" {
+		t.Fatalf("inserted = %v", inserted)
+	}
+	mu.Unlock()
+
+	budgets, err := c.ListBudgets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Budget{{ID: "food", Name: "Food", Max: 5000, UserID: "alice"}}; !reflect.DeepEqual(budgets, want) {
+		t.Fatalf("budgets = %+v, want %+v", budgets, want)
+	}
+	// 登入後的request都帶換過的token，GET不帶
+	for _, got := range tokens.take() {
+		if want := "POST /api/v1/budgets " + rotated; got[:4] == "POST" && got != want {
+			t.Fatalf("request %q, want %q", got, want)
+		}
+		if got[:3] == "GET" && got[len(got)-1] != ' ' {
+			t.Fatalf("request %q sent a token", got)
+		}
+	}
+
+	// 伺服器的錯誤變成*Error
+	_, err = c.CreateBudget(ctx, Budget{ID: "empty", Name: " "})
+	if e := apiError(t, err); e.StatusCode != http.StatusBadRequest || e.Code != "validation_failed" || e.Field != "name" ||
+		e.Message != "Name is required" || e.RequestID == "" {
+		t.Fatalf("error = %+v", e)
+	}
+}
+
+func TestClientCSRFToken(t *testing.T) {
+	c, _, tokens := newTestClient(t)
+	ctx := context.Background()
+
+	// 登出後token作廢，下一個會改資料的request重新拿
+	if err := c.LogOut(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := tokens.take()
+	err := c.DeleteBudget(ctx, "food")
+	if e := apiError(t, err); e.StatusCode != http.StatusUnauthorized || e.Code != "unauthenticated" {
+		t.Fatalf("error = %+v, want 401 when not signed in", e)
+	}
+	sent := tokens.take()
+	if len(first) != 2 || len(sent) != 2 || sent[0] != "GET /csrfToken " || sent[1] == "DELETE /api/v1/budgets/food " {
+		t.Fatalf("requests = %q then %q, want a new token before the delete", first, sent)
+	}
+
+	// session裡沒有這個token
+	c.setToken("stale")
+	err = c.DeleteBudget(ctx, "food")
+	if e := apiError(t, err); e.StatusCode != http.StatusForbidden || e.Code != "forbidden" {
+		t.Fatalf("error = %+v, want 403 forbidden", e)
+	}
+}
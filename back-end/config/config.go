@@ -0,0 +1,536 @@
+// Package config 集中管理server的設定，設定檔格式見example.json。
+// 優先順序：預設值 < 設定檔(JSON) < 環境變數 < 命令列參數，載入後會檢查一次。
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DevSessionKey 是原本寫死在程式裡的session金鑰，只適合開發用，正式環境要換掉
+const DevSessionKey = "is-my-secret-key"
+
+// 有設定憑證、沒有指定middleware.hstsMaxAge時用的HSTS期限
+const defaultHSTSMaxAge = 180 * 24 * time.Hour
+
+type Config struct {
+	Server     ServerConfig
+	TLS        TLSConfig
+	Database   DatabaseConfig
+	CORS       CORSConfig
+	CSRF       CSRFConfig
+	Middleware MiddlewareConfig
+	Session    SessionConfig
+	Log        LogConfig
+	Tracing    TracingConfig
+	Metrics    MetricsConfig
+}
+
+type ServerConfig struct {
+	Addr            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration // 收到SIGTERM後最多等這麼久讓進行中的request處理完
+}
+
+// TLSConfig CertFile跟KeyFile都有設定才會用HTTPS，檔案換掉之後會自動重新載入
+type TLSConfig struct {
+	CertFile       string
+	KeyFile        string
+	MinVersion     string        // 1.2, 1.3
+	ReloadInterval time.Duration // 多久檢查一次憑證檔有沒有變，0代表不檢查
+	RedirectAddr   string        // 有設定的話在這個位址聽HTTP，把request轉到HTTPS，例如:80
+}
+
+// Enabled 有設定憑證就用HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+type DatabaseConfig struct {
+	URI                    string
+	Name                   string
+	ConnectTimeout         time.Duration // 啟動時全部重試加起來最多等多久
+	PingTimeout            time.Duration // 每次ping的時限
+	ConnectRetries         int           // 啟動時最多ping幾次，0代表只試一次
+	RetryBackoff           time.Duration // 第一次重試前等待的時間，之後每次加倍
+	RetryMaxBackoff        time.Duration
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	MaxConnIdleTime        time.Duration
+	ServerSelectionTimeout time.Duration
+	OperationTimeout       time.Duration // 每個Mongo操作的時限，request的context先到期的話以它為準
+	BreakerThreshold       int           // 連續幾次連線錯誤後打開斷路器
+	BreakerCooldown        time.Duration // 斷路器打開後多久再放一個request去試
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string // 完整的origin，或是 https://*.example.com 這樣的子網域pattern
+	AllowedMethods   []string // 實際允許的method還要看route有沒有註冊
+	AllowedHeaders   []string
+	ExposedHeaders   []string // 前端fetch讀得到的response header
+	AllowCredentials bool     // 前端要帶cookie就要打開
+	MaxAge           time.Duration
+}
+
+// CSRFConfig 會改資料的request(POST、PATCH、DELETE...)要帶token或是從允許的網域送出
+type CSRFConfig struct {
+	Enabled      bool
+	RequireToken bool // true的話Origin/Referer對了也不夠，一定要帶X-CSRF-Token
+}
+
+// MiddlewareConfig 每個middleware都可以單獨關掉或調整
+type MiddlewareConfig struct {
+	Recover               bool          // panic時回500並記錄stack trace
+	MaxBodyBytes          int           // request body上限，0代表不限制
+	Compression           []string      // 支援的壓縮方式，依照偏好排序(br、gzip)，空的代表不壓縮
+	CompressMinBytes      int           // 小於這個大小的回應不壓縮
+	SecurityHeaders       bool          // 關掉的話下面幾個header都不會送
+	HSTSMaxAge            time.Duration // 0代表不送Strict-Transport-Security，沒設定的話有TLS才預設180天
+	HSTSIncludeSubdomains bool
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+	RequestID             bool
+	TrustRequestID        bool                     // 接受client帶來的X-Request-ID，在proxy後面時很有用
+	RequestTimeout        time.Duration            // 預設的request context期限，只會取消資料庫操作，不會中斷handler，0代表不限制
+	RouteTimeouts         map[string]time.Duration // key是"GET /api/v1/expenses"或"/api/v1/expenses"
+}
+
+type SessionConfig struct {
+	Name          string // cookie名稱
+	AuthKey       string // 簽章用
+	EncryptionKey string // 加密用，長度要是16、24或32，空字串代表不加密
+	Path          string
+	Domain        string
+	Secure        bool
+	HttpOnly      bool
+	SameSite      string        // lax, strict, none, default
+	RememberFor   time.Duration // 勾選"記住我"時session的期限
+}
+
+type LogConfig struct {
+	Format string // text, json
+	Level  string // debug, info, warn, error
+}
+
+type TracingConfig struct {
+	Exporter string // none, otlp
+}
+
+// MetricsConfig /metrics不放在對外的listener上，除非設定了token
+type MetricsConfig struct {
+	Addr  string // 只提供/metrics的HTTP listener，例如127.0.0.1:9090，空字串代表不開
+	Token string // 有設定的話對外的listener也提供/metrics，要帶Authorization: Bearer <token>
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":5000",
+			ReadTimeout:     5 * time.Second,
+			WriteTimeout:    5 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		TLS: TLSConfig{
+			MinVersion:     "1.2",
+			ReloadInterval: 30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Name:                   "budget-typescript",
+			ConnectTimeout:         time.Minute,
+			PingTimeout:            2 * time.Second,
+			ConnectRetries:         8,
+			RetryBackoff:           500 * time.Millisecond,
+			RetryMaxBackoff:        15 * time.Second,
+			MaxPoolSize:            100,
+			MinPoolSize:            0,
+			MaxConnIdleTime:        5 * time.Minute,
+			ServerSelectionTimeout: 5 * time.Second,
+			OperationTimeout:       3 * time.Second,
+			BreakerThreshold:       5,
+			BreakerCooldown:        10 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   []string{"http://localhost:3000"},
+			AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE"},
+			AllowedHeaders:   []string{"Content-Type", "X-Request-ID", "X-CSRF-Token", "X-Household-ID"},
+			ExposedHeaders:   []string{"X-Request-ID", "X-CSRF-Token", "Location", "Retry-After"},
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		},
+		CSRF: CSRFConfig{
+			Enabled:      true,
+			RequireToken: false, // 現在的前端只靠Origin檢查
+		},
+		Middleware: MiddlewareConfig{
+			Recover:               true,
+			MaxBodyBytes:          1 << 20,
+			Compression:           []string{"br", "gzip"},
+			CompressMinBytes:      1024,
+			SecurityHeaders:       true,
+			HSTSMaxAge:            0, // Load時看有沒有TLS決定
+			HSTSIncludeSubdomains: true,
+			ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'", // 只回JSON，不需要載入任何資源
+			FrameOptions:          "DENY",
+			ReferrerPolicy:        "no-referrer",
+			RequestID:             true,
+			TrustRequestID:        true,
+			RequestTimeout:        4 * time.Second, // 比WriteTimeout短，才來得及回503
+			RouteTimeouts:         map[string]time.Duration{},
+		},
+		Session: SessionConfig{
+			Name:          "SID",
+			AuthKey:       DevSessionKey,
+			EncryptionKey: DevSessionKey,
+			Path:          "/",
+			Secure:        true,
+			HttpOnly:      true,
+			SameSite:      "none", // 前端跟後端不同網域，要能送cross-site cookie
+			RememberFor:   7 * 24 * time.Hour,
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		Tracing: TracingConfig{
+			Exporter: "none",
+		},
+		Metrics: MetricsConfig{
+			Addr: "127.0.0.1:9090", // Prometheus不在同一台機器的話改成:9090，再用防火牆擋
+		},
+	}
+}
+
+// Load 讀取設定，args是不含程式名稱的命令列參數，-config或BUDGET_CONFIG指定設定檔
+func Load(args []string) (Config, error) {
+	c := Default()
+	fields := c.fields()
+	// 記下哪些設定有明確指定，跟其他設定有關的預設值只套用在沒指定的設定上
+	explicit := map[string]bool{}
+	for i := range fields {
+		key, set := fields[i].key, fields[i].set
+		fields[i].set = func(s string) error {
+			explicit[key] = true
+			return set(s)
+		}
+	}
+
+	fs := flag.NewFlagSet("budget-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("BUDGET_CONFIG"), "path of a JSON config file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of budget-server:")
+		fmt.Fprintln(fs.Output(), "  budget-server devcert -h\n    \tgenerate a self-signed certificate for local HTTPS")
+		Usage(fs.Output())
+	}
+	// 命令列的值先記下來，等設定檔跟環境變數套用完才覆蓋上去
+	var fromFlags []func() error
+	for _, f := range fields {
+		f := f
+		fs.Func(f.flag, f.usage+" (env "+f.env+")", func(s string) error {
+			fromFlags = append(fromFlags, func() error { return f.set(s) })
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *configFile != "" {
+		if err := c.loadFile(*configFile, fields); err != nil {
+			return c, err
+		}
+	}
+	for _, f := range fields {
+		for _, env := range f.envs() {
+			if value, ok := os.LookupEnv(env); ok && value != "" {
+				if err := f.set(value); err != nil {
+					return c, fmt.Errorf("env %s: %w", env, err)
+				}
+			}
+		}
+	}
+	// 舊的部署只設定一個前端網址，除了預設的localhost之外也要接受它
+	if origin := os.Getenv("budget-manager-front-end-url"); origin != "" {
+		c.CORS.AllowedOrigins = append(c.CORS.AllowedOrigins, origin)
+	}
+	for _, apply := range fromFlags {
+		if err := apply(); err != nil {
+			return c, err
+		}
+	}
+
+	// 用HTTP回應的HSTS瀏覽器不會理，在TLS proxy後面要送的話自己設定
+	if !explicit["middleware.hstsMaxAge"] && c.TLS.Enabled() {
+		c.Middleware.HSTSMaxAge = defaultHSTSMaxAge
+	}
+
+	c.normalize()
+	return c, c.Validate()
+}
+
+// loadFile 設定檔的key對應fields裡的key，例如 {"server": {"addr": ":8080"}}
+func (c *Config) loadFile(path string, fields []field) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	byKey := map[string]field{}
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+	values := map[string]string{}
+	if err := flatten("", raw, values, byKey); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	for key, value := range values {
+		f, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		if err := f.set(value); err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// flatten 把巢狀的JSON攤平成 "server.addr": ":5000"，map型態的設定值變成 "key=value,key=value"
+func flatten(prefix string, raw map[string]interface{}, out map[string]string, fields map[string]field) error {
+	for key, value := range raw {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if f, ok := fields[key]; ok && f.isMap {
+				pairs := make([]string, 0, len(v))
+				for k, item := range v {
+					s, ok := item.(string)
+					if !ok {
+						return fmt.Errorf("%s: values must be strings", key)
+					}
+					pairs = append(pairs, k+"="+s)
+				}
+				out[key] = strings.Join(pairs, ",")
+				continue
+			}
+			if err := flatten(key, v, out, fields); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("%s: list items must be strings", key)
+				}
+				items[i] = s
+			}
+			out[key] = strings.Join(items, ",")
+		case string:
+			out[key] = v
+		case float64:
+			out[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			out[key] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, v)
+		}
+	}
+	return nil
+}
+
+// normalize 去掉重複跟空白的origin，網址結尾的/也拿掉，瀏覽器送的Origin不會有
+func (c *Config) normalize() {
+	seen := map[string]bool{}
+	origins := c.CORS.AllowedOrigins[:0]
+	for _, o := range c.CORS.AllowedOrigins {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		if o == "" || seen[o] {
+			continue
+		}
+		seen[o] = true
+		origins = append(origins, o)
+	}
+	c.CORS.AllowedOrigins = origins
+	for i, m := range c.CORS.AllowedMethods {
+		c.CORS.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	for i, encoding := range c.Middleware.Compression {
+		c.Middleware.Compression[i] = strings.ToLower(encoding)
+	}
+	c.Middleware.FrameOptions = strings.ToUpper(c.Middleware.FrameOptions)
+	c.TLS.MinVersion = strings.TrimPrefix(c.TLS.MinVersion, "TLS")
+	c.Session.SameSite = strings.ToLower(c.Session.SameSite)
+	c.Log.Format = strings.ToLower(c.Log.Format)
+	c.Log.Level = strings.ToLower(c.Log.Level)
+	c.Tracing.Exporter = strings.ToLower(c.Tracing.Exporter)
+}
+
+// validOriginPattern scheme://host[:port]，host最左邊可以是*代表任何子網域
+func validOriginPattern(o string) bool {
+	u, err := url.Parse(strings.Replace(o, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return false
+	}
+	return !strings.Contains(u.Host, "*")
+}
+
+// Validate 回傳所有不合法的設定，不會只回報第一個
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.ReadTimeout > 0, "server.readTimeout must be positive")
+	check(c.Server.WriteTimeout > 0, "server.writeTimeout must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idleTimeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.certFile and tls.keyFile must be set together")
+	check(c.TLS.MinVersion == "1.2" || c.TLS.MinVersion == "1.3", "tls.minVersion: unknown value %q", c.TLS.MinVersion)
+	check(c.TLS.ReloadInterval >= 0, "tls.reloadInterval must not be negative")
+	check(c.TLS.RedirectAddr == "" || c.TLS.Enabled(), "tls.redirectAddr requires tls.certFile and tls.keyFile")
+	check(c.TLS.RedirectAddr == "" || c.TLS.RedirectAddr != c.Server.Addr, "tls.redirectAddr must differ from server.addr")
+
+	check(c.Database.URI != "", "database.uri is required (env mongoDB_uri)")
+	check(c.Database.Name != "", "database.name is required")
+	check(c.Database.ConnectTimeout > 0, "database.connectTimeout must be positive")
+	check(c.Database.PingTimeout > 0, "database.pingTimeout must be positive")
+	check(c.Database.ConnectRetries >= 0, "database.connectRetries must not be negative")
+	check(c.Database.RetryBackoff > 0, "database.retryBackoff must be positive")
+	check(c.Database.RetryMaxBackoff >= c.Database.RetryBackoff, "database.retryMaxBackoff must not be less than database.retryBackoff")
+	check(c.Database.MaxPoolSize == 0 || c.Database.MinPoolSize <= c.Database.MaxPoolSize, "database.minPoolSize must not exceed database.maxPoolSize")
+	check(c.Database.MaxConnIdleTime >= 0, "database.maxConnIdleTime must not be negative")
+	check(c.Database.ServerSelectionTimeout > 0, "database.serverSelectionTimeout must be positive")
+	check(c.Database.OperationTimeout > 0, "database.operationTimeout must be positive")
+	check(c.Database.BreakerThreshold > 0, "database.breakerThreshold must be positive")
+	check(c.Database.BreakerCooldown > 0, "database.breakerCooldown must be positive")
+
+	for _, o := range c.CORS.AllowedOrigins {
+		if o == "*" {
+			// 瀏覽器不接受帶cookie的request對上Allow-Origin: *
+			check(!c.CORS.AllowCredentials, "cors.allowedOrigins: \"*\" cannot be used with cors.allowCredentials")
+			continue
+		}
+		check(validOriginPattern(o), "cors.allowedOrigins: %q is not an origin like https://example.com or https://*.example.com", o)
+	}
+	for _, m := range c.CORS.AllowedMethods {
+		check(m != "" && strings.ToUpper(m) == m && !strings.ContainsAny(m, " ,"), "cors.allowedMethods: %q is not a method", m)
+	}
+	check(c.CORS.MaxAge >= 0, "cors.maxAge must not be negative")
+
+	check(c.Middleware.MaxBodyBytes >= 0, "middleware.maxBodyBytes must not be negative")
+	for _, encoding := range c.Middleware.Compression {
+		check(encoding == "br" || encoding == "gzip", "middleware.compression: unknown encoding %q", encoding)
+	}
+	check(c.Middleware.CompressMinBytes >= 0, "middleware.compressMinBytes must not be negative")
+	check(c.Middleware.HSTSMaxAge >= 0, "middleware.hstsMaxAge must not be negative")
+	switch c.Middleware.FrameOptions {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		errs = append(errs, fmt.Errorf("middleware.frameOptions: unknown value %q", c.Middleware.FrameOptions))
+	}
+	check(c.Middleware.RequestTimeout >= 0, "middleware.requestTimeout must not be negative")
+	for route, timeout := range c.Middleware.RouteTimeouts {
+		check(strings.Contains(route, "/"), "middleware.routeTimeouts: %q is not a route like \"GET /api/v1/expenses\"", route)
+		check(timeout >= 0, "middleware.routeTimeouts: %q must not be negative", route)
+	}
+
+	check(c.Session.Name != "", "session.name is required")
+	check(c.Session.AuthKey != "", "session.authKey is required")
+	switch len(c.Session.EncryptionKey) {
+	case 0, 16, 24, 32:
+	default:
+		errs = append(errs, errors.New("session.encryptionKey must be 16, 24 or 32 bytes"))
+	}
+	switch c.Session.SameSite {
+	case "lax", "strict", "default":
+	case "none":
+		// 瀏覽器不接受沒有Secure的SameSite=None cookie
+		check(c.Session.Secure, "session.sameSite none requires session.secure")
+	default:
+		errs = append(errs, fmt.Errorf("session.sameSite: unknown value %q", c.Session.SameSite))
+	}
+	check(c.Session.RememberFor > 0, "session.rememberFor must be positive")
+
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: unknown value %q", c.Log.Format)
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level: unknown value %q", c.Log.Level))
+	}
+	check(c.Tracing.Exporter == "none" || c.Tracing.Exporter == "otlp", "tracing.exporter: unknown value %q", c.Tracing.Exporter)
+
+	check(c.Metrics.Addr == "" || c.Metrics.Addr != c.Server.Addr, "metrics.addr must differ from server.addr, use metrics.token to serve /metrics there")
+	check(c.Metrics.Addr == "" || c.Metrics.Addr != c.TLS.RedirectAddr, "metrics.addr must differ from tls.redirectAddr")
+
+	return errors.Join(errs...)
+}
+
+// Warnings 合法但不建議的設定，啟動時印出來
+func (c Config) Warnings() []string {
+	var warnings []string
+	if c.Middleware.RequestTimeout >= c.Server.WriteTimeout {
+		warnings = append(warnings, "middleware.requestTimeout is not shorter than server.writeTimeout, slow requests will be cut off without a response")
+	}
+	if !c.TLS.Enabled() && c.Session.Secure {
+		warnings = append(warnings, "session.secure is on but TLS is not configured, browsers will only send the session cookie through an HTTPS proxy")
+	}
+	if c.Session.AuthKey == DevSessionKey || c.Session.EncryptionKey == DevSessionKey {
+		warnings = append(warnings, "session keys are the built-in development defaults, set BUDGET_SESSION_AUTH_KEY and BUDGET_SESSION_ENCRYPTION_KEY")
+	}
+	return warnings
+}
+
+// LogValue 印出所有設定，密碼跟金鑰會遮掉
+// 用巢狀的group(server、session...)，key才不會因為包含session被logger整個遮掉
+func (c Config) LogValue() slog.Value {
+	var sections []string
+	groups := map[string][]slog.Attr{}
+	for _, f := range c.fields() {
+		section, name, _ := strings.Cut(f.key, ".")
+		value := f.get()
+		if f.redact != nil {
+			value = f.redact(value)
+		}
+		if _, ok := groups[section]; !ok {
+			sections = append(sections, section)
+		}
+		groups[section] = append(groups[section], slog.String(name, value))
+	}
+	attrs := make([]slog.Attr, 0, len(sections))
+	for _, section := range sections {
+		attrs = append(attrs, slog.Attr{Key: section, Value: slog.GroupValue(groups[section]...)})
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Usage 印出所有命令列參數跟對應的環境變數
+func Usage(w io.Writer) {
+	c := Default()
+	fmt.Fprintln(w, "  -config string\n    \tpath of a JSON config file (env BUDGET_CONFIG)")
+	for _, f := range c.fields() {
+		fmt.Fprintf(w, "  -%s\n    \t%s (env %s, default %q)\n", f.flag, f.usage, f.env, f.get())
+	}
+}
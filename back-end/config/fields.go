@@ -0,0 +1,242 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field 把一個設定值綁定到設定檔的key、環境變數跟命令列參數，三個來源都用set解析字串
+type field struct {
+	key    string // 設定檔裡的key，例如server.addr
+	env    string
+	flag   string
+	usage  string
+	get    func() string
+	set    func(string) error
+	redact func(string) string // 印出設定時遮掉敏感的部分，nil代表原樣印出
+	legacy []string            // 舊的環境變數名稱，還是接受
+	isMap  bool                // 設定檔裡可以寫成JSON object
+}
+
+func (f field) envs() []string {
+	return append(append([]string{}, f.legacy...), f.env)
+}
+
+func (c *Config) fields() []field {
+	return []field{
+		stringField("server.addr", "BUDGET_ADDR", "addr", "listen address", &c.Server.Addr),
+		durationField("server.readTimeout", "BUDGET_READ_TIMEOUT", "read-timeout", "maximum duration for reading a request", &c.Server.ReadTimeout),
+		durationField("server.writeTimeout", "BUDGET_WRITE_TIMEOUT", "write-timeout", "maximum duration for writing a response", &c.Server.WriteTimeout),
+		durationField("server.idleTimeout", "BUDGET_IDLE_TIMEOUT", "idle-timeout", "keep-alive idle timeout", &c.Server.IdleTimeout),
+		durationField("server.shutdownTimeout", "BUDGET_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for in-flight requests on shutdown", &c.Server.ShutdownTimeout),
+
+		stringField("tls.certFile", "BUDGET_TLS_CERT_FILE", "tls-cert", "PEM certificate chain, enables HTTPS together with -tls-key", &c.TLS.CertFile),
+		stringField("tls.keyFile", "BUDGET_TLS_KEY_FILE", "tls-key", "PEM private key for -tls-cert", &c.TLS.KeyFile),
+		stringField("tls.minVersion", "BUDGET_TLS_MIN_VERSION", "tls-min-version", "minimum TLS version: 1.2 or 1.3", &c.TLS.MinVersion),
+		durationField("tls.reloadInterval", "BUDGET_TLS_RELOAD_INTERVAL", "tls-reload-interval", "how often to check the certificate files for changes, 0 disables reloading", &c.TLS.ReloadInterval),
+		stringField("tls.redirectAddr", "BUDGET_TLS_REDIRECT_ADDR", "tls-redirect-addr", "plain HTTP address that redirects to HTTPS, e.g. :80", &c.TLS.RedirectAddr),
+
+		withLegacy(withRedact(stringField("database.uri", "BUDGET_DB_URI", "db-uri", "MongoDB connection string", &c.Database.URI), redactURI), "mongoDB_uri"),
+		stringField("database.name", "BUDGET_DB_NAME", "db-name", "database name", &c.Database.Name),
+		durationField("database.connectTimeout", "BUDGET_DB_CONNECT_TIMEOUT", "db-connect-timeout", "total time to keep retrying the initial connection", &c.Database.ConnectTimeout),
+		durationField("database.pingTimeout", "BUDGET_DB_PING_TIMEOUT", "db-ping-timeout", "timeout for each ping", &c.Database.PingTimeout),
+		intField("database.connectRetries", "BUDGET_DB_CONNECT_RETRIES", "db-connect-retries", "how many times to retry the initial connection", &c.Database.ConnectRetries),
+		durationField("database.retryBackoff", "BUDGET_DB_RETRY_BACKOFF", "db-retry-backoff", "delay before the first retry, doubled after each attempt", &c.Database.RetryBackoff),
+		durationField("database.retryMaxBackoff", "BUDGET_DB_RETRY_MAX_BACKOFF", "db-retry-max-backoff", "upper bound of the retry delay", &c.Database.RetryMaxBackoff),
+		uintField("database.maxPoolSize", "BUDGET_DB_MAX_POOL_SIZE", "db-max-pool-size", "maximum connections per server, 0 means unlimited", &c.Database.MaxPoolSize),
+		uintField("database.minPoolSize", "BUDGET_DB_MIN_POOL_SIZE", "db-min-pool-size", "connections kept open per server", &c.Database.MinPoolSize),
+		durationField("database.maxConnIdleTime", "BUDGET_DB_MAX_CONN_IDLE_TIME", "db-max-conn-idle-time", "close pooled connections idle for longer than this, 0 means never", &c.Database.MaxConnIdleTime),
+		durationField("database.serverSelectionTimeout", "BUDGET_DB_SERVER_SELECTION_TIMEOUT", "db-server-selection-timeout", "how long an operation waits for a usable server", &c.Database.ServerSelectionTimeout),
+		durationField("database.operationTimeout", "BUDGET_DB_OPERATION_TIMEOUT", "db-operation-timeout", "deadline for each database operation", &c.Database.OperationTimeout),
+		intField("database.breakerThreshold", "BUDGET_DB_BREAKER_THRESHOLD", "db-breaker-threshold", "consecutive connection failures that open the circuit breaker", &c.Database.BreakerThreshold),
+		durationField("database.breakerCooldown", "BUDGET_DB_BREAKER_COOLDOWN", "db-breaker-cooldown", "how long the circuit stays open before a trial request", &c.Database.BreakerCooldown),
+
+		listField("cors.allowedOrigins", "BUDGET_CORS_ORIGINS", "cors-origins", "comma separated origins allowed to call the API, https://*.example.com matches any subdomain", &c.CORS.AllowedOrigins),
+		listField("cors.allowedMethods", "BUDGET_CORS_METHODS", "cors-methods", "methods allowed cross-origin, further limited to the methods each route accepts", &c.CORS.AllowedMethods),
+		listField("cors.allowedHeaders", "BUDGET_CORS_HEADERS", "cors-headers", "request headers allowed cross-origin", &c.CORS.AllowedHeaders),
+		listField("cors.exposedHeaders", "BUDGET_CORS_EXPOSED_HEADERS", "cors-exposed-headers", "response headers readable by the browser", &c.CORS.ExposedHeaders),
+		boolField("cors.allowCredentials", "BUDGET_CORS_CREDENTIALS", "cors-credentials", "allow cookies on cross-origin requests", &c.CORS.AllowCredentials),
+		durationField("cors.maxAge", "BUDGET_CORS_MAX_AGE", "cors-max-age", "how long browsers may cache a preflight response", &c.CORS.MaxAge),
+
+		boolField("csrf.enabled", "BUDGET_CSRF", "csrf", "reject state-changing requests that lack a CSRF token or a trusted Origin", &c.CSRF.Enabled),
+		boolField("csrf.requireToken", "BUDGET_CSRF_REQUIRE_TOKEN", "csrf-require-token", "require the X-CSRF-Token header even when the Origin is trusted", &c.CSRF.RequireToken),
+
+		boolField("middleware.recover", "BUDGET_RECOVER", "recover", "turn panics into 500 responses and log the stack trace", &c.Middleware.Recover),
+		intField("middleware.maxBodyBytes", "BUDGET_MAX_BODY_BYTES", "max-body-bytes", "maximum request body size, 0 means unlimited", &c.Middleware.MaxBodyBytes),
+		listField("middleware.compression", "BUDGET_COMPRESSION", "compression", "response encodings in order of preference (br, gzip), empty disables compression", &c.Middleware.Compression),
+		intField("middleware.compressMinBytes", "BUDGET_COMPRESS_MIN_BYTES", "compress-min-bytes", "responses smaller than this are not compressed", &c.Middleware.CompressMinBytes),
+		boolField("middleware.securityHeaders", "BUDGET_SECURITY_HEADERS", "security-headers", "send HSTS, CSP and other security headers", &c.Middleware.SecurityHeaders),
+		durationField("middleware.hstsMaxAge", "BUDGET_HSTS_MAX_AGE", "hsts-max-age", "Strict-Transport-Security max-age, 0 disables the header (default 4320h when TLS is enabled, otherwise 0)", &c.Middleware.HSTSMaxAge),
+		boolField("middleware.hstsIncludeSubdomains", "BUDGET_HSTS_INCLUDE_SUBDOMAINS", "hsts-include-subdomains", "add includeSubDomains to Strict-Transport-Security", &c.Middleware.HSTSIncludeSubdomains),
+		stringField("middleware.contentSecurityPolicy", "BUDGET_CSP", "csp", "Content-Security-Policy header, empty disables it", &c.Middleware.ContentSecurityPolicy),
+		stringField("middleware.frameOptions", "BUDGET_FRAME_OPTIONS", "frame-options", "X-Frame-Options header: DENY, SAMEORIGIN or empty", &c.Middleware.FrameOptions),
+		stringField("middleware.referrerPolicy", "BUDGET_REFERRER_POLICY", "referrer-policy", "Referrer-Policy header, empty disables it", &c.Middleware.ReferrerPolicy),
+		boolField("middleware.requestID", "BUDGET_REQUEST_ID", "request-id", "assign every request an ID returned in X-Request-ID", &c.Middleware.RequestID),
+		boolField("middleware.trustRequestID", "BUDGET_TRUST_REQUEST_ID", "trust-request-id", "reuse a well-formed X-Request-ID sent by the client", &c.Middleware.TrustRequestID),
+		durationField("middleware.requestTimeout", "BUDGET_REQUEST_TIMEOUT", "request-timeout", "default request context deadline (cancels database calls, does not abort the handler), 0 means none", &c.Middleware.RequestTimeout),
+		durationMapField("middleware.routeTimeouts", "BUDGET_ROUTE_TIMEOUTS", "route-timeouts", "per-route deadlines like \"GET /api/v1/expenses=5s,/signIn=2s\"", &c.Middleware.RouteTimeouts),
+
+		stringField("session.name", "BUDGET_SESSION_NAME", "session-name", "session cookie name", &c.Session.Name),
+		withRedact(stringField("session.authKey", "BUDGET_SESSION_AUTH_KEY", "session-auth-key", "key used to sign session cookies", &c.Session.AuthKey), redactSecret),
+		withRedact(stringField("session.encryptionKey", "BUDGET_SESSION_ENCRYPTION_KEY", "session-encryption-key", "key used to encrypt session cookies (16, 24 or 32 bytes)", &c.Session.EncryptionKey), redactSecret),
+		stringField("session.path", "BUDGET_SESSION_PATH", "session-path", "session cookie path", &c.Session.Path),
+		stringField("session.domain", "BUDGET_SESSION_DOMAIN", "session-domain", "session cookie domain", &c.Session.Domain),
+		boolField("session.secure", "BUDGET_SESSION_SECURE", "session-secure", "only send the session cookie over HTTPS", &c.Session.Secure),
+		boolField("session.httpOnly", "BUDGET_SESSION_HTTP_ONLY", "session-http-only", "hide the session cookie from JavaScript", &c.Session.HttpOnly),
+		stringField("session.sameSite", "BUDGET_SESSION_SAME_SITE", "session-same-site", "SameSite attribute: lax, strict, none or default", &c.Session.SameSite),
+		durationField("session.rememberFor", "BUDGET_SESSION_REMEMBER_FOR", "session-remember-for", "session lifetime when \"remember me\" is checked", &c.Session.RememberFor),
+
+		withLegacy(stringField("log.format", "BUDGET_LOG_FORMAT", "log-format", "log format: text or json", &c.Log.Format), "LOG_FORMAT"),
+		withLegacy(stringField("log.level", "BUDGET_LOG_LEVEL", "log-level", "log level: debug, info, warn or error", &c.Log.Level), "LOG_LEVEL"),
+
+		withLegacy(stringField("tracing.exporter", "BUDGET_TRACING_EXPORTER", "tracing-exporter", "trace exporter: none or otlp", &c.Tracing.Exporter), "TRACING_EXPORTER"),
+
+		stringField("metrics.addr", "BUDGET_METRICS_ADDR", "metrics-addr", "separate plain HTTP address serving only /metrics, empty disables it", &c.Metrics.Addr),
+		withRedact(stringField("metrics.token", "BUDGET_METRICS_TOKEN", "metrics-token", "also serve /metrics on the main listener to requests with Authorization: Bearer <token>", &c.Metrics.Token), redactSecret),
+	}
+}
+
+func stringField(key, env, flag, usage string, p *string) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return *p },
+		set: func(s string) error { *p = s; return nil },
+	}
+}
+
+func durationField(key, env, flag, usage string, p *time.Duration) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return p.String() },
+		set: func(s string) error {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			*p = d
+			return nil
+		},
+	}
+}
+
+func boolField(key, env, flag, usage string, p *bool) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return strconv.FormatBool(*p) },
+		set: func(s string) error {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			*p = b
+			return nil
+		},
+	}
+}
+
+func intField(key, env, flag, usage string, p *int) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return strconv.Itoa(*p) },
+		set: func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+func uintField(key, env, flag, usage string, p *uint64) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return strconv.FormatUint(*p, 10) },
+		set: func(s string) error {
+			n, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+// listField 用逗號分隔，後面的來源會整個取代前面的列表
+func listField(key, env, flag, usage string, p *[]string) field {
+	return field{key: key, env: env, flag: flag, usage: usage,
+		get: func() string { return strings.Join(*p, ",") },
+		set: func(s string) error {
+			*p = nil
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*p = append(*p, item)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// durationMapField 格式是 "key=5s,key=10s"，後面的來源會整個取代前面的設定
+func durationMapField(key, env, flag, usage string, p *map[string]time.Duration) field {
+	return field{key: key, env: env, flag: flag, usage: usage, isMap: true,
+		get: func() string {
+			pairs := make([]string, 0, len(*p))
+			for k, d := range *p {
+				pairs = append(pairs, k+"="+d.String())
+			}
+			sort.Strings(pairs)
+			return strings.Join(pairs, ",")
+		},
+		set: func(s string) error {
+			m := map[string]time.Duration{}
+			for _, pair := range strings.Split(s, ",") {
+				if strings.TrimSpace(pair) == "" {
+					continue
+				}
+				k, v, ok := strings.Cut(pair, "=")
+				if !ok {
+					return fmt.Errorf("%q is not key=duration", pair)
+				}
+				d, err := time.ParseDuration(strings.TrimSpace(v))
+				if err != nil {
+					return err
+				}
+				m[strings.TrimSpace(k)] = d
+			}
+			*p = m
+			return nil
+		},
+	}
+}
+
+func withRedact(f field, redact func(string) string) field {
+	f.redact = redact
+	return f
+}
+
+func withLegacy(f field, envs ...string) field {
+	f.legacy = envs
+	return f
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+// redactURI 只遮掉連線字串裡的密碼，host跟參數留著方便除錯
+func redactURI(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactSecret(s)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	return fmt.Sprint(u)
+}
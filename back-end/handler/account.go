@@ -0,0 +1,680 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/DB"
+	"mongodb-budget/Utils"
+)
+
+// 資金帳戶：現金、金融卡、信用卡等等，跟登入用的帳號(account)是兩回事
+// 花費跟收入可以記在某個帳戶，帳戶之間的轉帳不算花費也不算收入
+// 餘額不另外存，每次從期初餘額加上收入、轉入，減掉花費、轉出算出來
+
+const (
+	AccountCash    = "cash"
+	AccountDebit   = "debit"
+	AccountCredit  = "credit" // 餘額通常是負的，代表欠銀行的錢
+	AccountSavings = "savings"
+	AccountOther   = "other"
+)
+
+const (
+	defaultCurrency   = "TWD"
+	maxAccountNameLen = 20
+)
+
+// 帳戶明細的種類
+const (
+	EntryExpense     = "expense"
+	EntryIncome      = "income"
+	EntryTransferIn  = "transferIn"
+	EntryTransferOut = "transferOut"
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+type FinancialAccount struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	OpeningBalance int    `json:"openingBalance"`          // 開始記帳時的餘額，信用卡欠款是負的
+	Currency       string `json:"currency"`                // ISO 4217，預設TWD
+	Archived       bool   `json:"archived"`                // 不用了但是還有紀錄的帳戶，不能再記新的花費
+	Balance        int    `json:"balance"`                 // 算出來的目前餘額，不會存進資料庫
+	LockedThrough  string `json:"lockedThrough,omitempty"` // 對帳鎖定到哪一天(含)，這天以前的紀錄不能再改
+	UserID         string `json:"userID,omitempty"`
+	HouseholdID    string `json:"householdID,omitempty"`
+	CreatedBy      string `json:"createdBy,omitempty"`
+}
+
+type FinancialAccountPatch struct {
+	Name           *string `json:"name"`
+	Type           *string `json:"type"`
+	OpeningBalance *int    `json:"openingBalance"`
+	Currency       *string `json:"currency"`
+	Archived       *bool   `json:"archived"`
+}
+
+// TransferObject 從FromAccountID轉Amount到ToAccountID，幣別不同的話ToAmount是轉入帳戶收到的金額
+type TransferObject struct {
+	ID            string `json:"id"`
+	FromAccountID string `json:"fromAccountID"`
+	ToAccountID   string `json:"toAccountID"`
+	Amount        int    `json:"amount"`
+	ToAmount      int    `json:"toAmount"` // 幣別相同時等於Amount
+	Date          int    `json:"date"`
+	Note          string `json:"note"`
+	ReconciledIn  string `json:"reconciledIn,omitempty"` // 對帳鎖定時配對到的對帳單
+	UserID        string `json:"userID,omitempty"`
+	HouseholdID   string `json:"householdID,omitempty"`
+	CreatedBy     string `json:"createdBy,omitempty"`
+}
+
+// LedgerEntry 帳戶明細的一筆，Amount是對這個帳戶的影響(花費、轉出是負的)，Balance是這筆之後的餘額
+type LedgerEntry struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Date        int    `json:"date"`
+	Amount      int    `json:"amount"`
+	Balance     int    `json:"balance"`
+}
+
+type AccountLedger struct {
+	Account      FinancialAccount `json:"account"`
+	StartBalance int              `json:"startBalance"` // 區間開始前的餘額
+	EndBalance   int              `json:"endBalance"`
+	Entries      []LedgerEntry    `json:"entries"` // 舊的在前
+}
+
+func validAccountType(t string) bool {
+	switch t {
+	case AccountCash, AccountDebit, AccountCredit, AccountSavings, AccountOther:
+		return true
+	}
+	return false
+}
+
+func validateFinancialAccount(data FinancialAccount) (string, string) {
+	if strings.TrimSpace(data.Name) == "" {
+		return "name", "financialAccount.nameRequired"
+	}
+	if len([]rune(strings.TrimSpace(data.Name))) > maxAccountNameLen {
+		return "name", "financialAccount.nameTooLong"
+	}
+	if !validAccountType(data.Type) {
+		return "type", "financialAccount.typeInvalid"
+	}
+	if !currencyPattern.MatchString(data.Currency) {
+		return "currency", "financialAccount.currencyInvalid"
+	}
+	return "", ""
+}
+
+// findAccount 找出範圍內的帳戶，找不到的話回傳mongo.ErrNoDocuments
+func (h *handlerWithDB) findAccount(r *http.Request, sc scope, id string) (FinancialAccount, error) {
+	var account FinancialAccount
+	err := h.AColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&account)
+	return account, err
+}
+
+// checkAccountLink 花費跟收入要記在的帳戶必須在同一個範圍而且沒有封存，field是回覆錯誤時的欄位
+// 有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkAccountLink(w http.ResponseWriter, r *http.Request, sc scope, field, id string) (FinancialAccount, bool) {
+	account, err := h.findAccount(r, sc, id)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, CodeValidation, field, "financialAccount.notFound")
+		return account, false
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return account, false
+	}
+	if account.Archived {
+		writeError(w, r, CodeValidation, field, "financialAccount.archived")
+		return account, false
+	}
+	return account, true
+}
+
+// patchAccountLink 處理PATCH送來的accountID，空字串代表不記在任何帳戶，換帳戶的話一樣要檢查
+// 要更新的欄位放進set或unset，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) patchAccountLink(w http.ResponseWriter, r *http.Request, sc scope, patch, current *string, set, unset bson.M) bool {
+	if patch == nil || *patch == *current {
+		return true
+	}
+	if *patch == "" {
+		*current = ""
+		unset["accountID"] = ""
+		return true
+	}
+	if _, ok := h.checkAccountLink(w, r, sc, "accountID", *patch); !ok {
+		return false
+	}
+	*current = *patch
+	set["accountID"] = *current
+	return true
+}
+
+// updateDoc 把要設定跟要移除的欄位組成update，都沒有的話回傳空的bson.M
+func updateDoc(set, unset bson.M) bson.M {
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// accountMovements 帳戶的每一筆進出，依照帳戶分開，ids是空的話就是範圍內所有帳戶
+// 固定收入只算到今天
+func (h *handlerWithDB) accountMovements(r *http.Request, sc scope, loc *time.Location, ids []string) (map[string][]LedgerEntry, error) {
+	linked := bson.M{"$exists": true}
+	if len(ids) > 0 {
+		linked = bson.M{"$in": ids}
+	}
+	movements := map[string][]LedgerEntry{}
+	projection := options.Find().SetProjection(bson.M{"id": 1, "description": 1, "amount": 1, "date": 1, "accountID": 1})
+
+	var expenses []ExpenseObject
+	cursor, err := h.EColl.Find(r.Context(), sc.filter(bson.M{"accountID": linked}), projection)
+	if err == nil {
+		err = cursor.All(r.Context(), &expenses)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range expenses {
+		movements[e.AccountID] = append(movements[e.AccountID], LedgerEntry{Kind: EntryExpense, ID: e.ID,
+			Description: e.Description, Date: e.Date, Amount: -e.Amount})
+	}
+
+	var incomes []IncomeObject
+	cursor, err = h.IColl.Find(r.Context(), sc.filter(bson.M{"accountID": linked}))
+	if err == nil {
+		err = cursor.All(r.Context(), &incomes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recurring []RecurringIncomeObject
+	cursor, err = h.RColl.Find(r.Context(), sc.filter(bson.M{"accountID": linked}))
+	if err == nil {
+		err = cursor.All(r.Context(), &recurring)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, today, _ := Utils.PeriodRange("day", time.Now(), loc)
+	for _, ri := range recurring {
+		incomes = append(incomes, ri.expand(loc, time.Time{}, today)...)
+	}
+	for _, i := range incomes {
+		movements[i.AccountID] = append(movements[i.AccountID], LedgerEntry{Kind: EntryIncome, ID: i.ID,
+			Description: i.Source + " " + i.Description, Date: i.Date, Amount: i.Amount})
+	}
+
+	var transfers []TransferObject
+	cursor, err = h.TColl.Find(r.Context(), sc.filter(bson.M{"$or": bson.A{bson.M{"fromAccountID": linked}, bson.M{"toAccountID": linked}}}))
+	if err == nil {
+		err = cursor.All(r.Context(), &transfers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range transfers {
+		movements[t.FromAccountID] = append(movements[t.FromAccountID], LedgerEntry{Kind: EntryTransferOut, ID: t.ID,
+			Description: t.Note, Date: t.Date, Amount: -t.Amount})
+		movements[t.ToAccountID] = append(movements[t.ToAccountID], LedgerEntry{Kind: EntryTransferIn, ID: t.ID,
+			Description: t.Note, Date: t.Date, Amount: t.ToAmount})
+	}
+	for id := range movements {
+		entries := movements[id]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return Utils.UnixToTime(entries[i].Date).Before(Utils.UnixToTime(entries[j].Date))
+		})
+		for i := range entries {
+			entries[i].Description = strings.TrimSpace(entries[i].Description)
+		}
+	}
+	return movements, nil
+}
+
+// withBalances 幫帳戶填上目前的餘額
+func (h *handlerWithDB) withBalances(r *http.Request, sc scope, accounts []FinancialAccount) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(accounts))
+	for i, a := range accounts {
+		ids[i] = a.ID
+	}
+	movements, err := h.accountMovements(r, sc, loc, ids)
+	if err != nil {
+		return err
+	}
+	for i := range accounts {
+		accounts[i].Balance = accounts[i].OpeningBalance
+		for _, m := range movements[accounts[i].ID] {
+			accounts[i].Balance += m.Amount
+		}
+	}
+	return nil
+}
+
+func (h *handlerWithDB) ListAccounts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		data := []FinancialAccount{}
+		cursor, err := h.AColl.Find(r.Context(), sc.filter(nil), options.Find().SetSort(bson.M{"name": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err == nil {
+			err = h.withBalances(r, sc, data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data FinancialAccount
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Currency = strings.ToUpper(strings.TrimSpace(data.Currency))
+		if data.Currency == "" {
+			data.Currency = defaultCurrency
+		}
+		if field, msg := validateFinancialAccount(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.Name = strings.TrimSpace(data.Name)
+		data.Balance = data.OpeningBalance
+		data.LockedThrough = ""
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		_, err := h.AColl.InsertOne(r.Context(), sc.owned(bson.M{"id": data.ID, "name": data.Name, "type": data.Type,
+			"openingBalance": data.OpeningBalance, "currency": data.Currency, "archived": data.Archived, "createdBy": sc.account}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/accounts/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) GetAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		account, err := h.findAccount(r, sc, mux.Vars(r)["id"])
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "financialAccount.notFound")
+			return
+		}
+		accounts := []FinancialAccount{account}
+		if err == nil {
+			err = h.withBalances(r, sc, accounts)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, accounts[0])
+	}
+}
+
+func (h *handlerWithDB) PatchAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		var patch FinancialAccountPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		current, err := h.findAccount(r, sc, id)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "financialAccount.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		set := bson.M{}
+		if patch.Name != nil {
+			current.Name = strings.TrimSpace(*patch.Name)
+			set["name"] = current.Name
+		}
+		if patch.Type != nil {
+			current.Type = *patch.Type
+			set["type"] = current.Type
+		}
+		if patch.OpeningBalance != nil {
+			current.OpeningBalance = *patch.OpeningBalance
+			set["openingBalance"] = current.OpeningBalance
+		}
+		currencyChanged := false
+		if patch.Currency != nil {
+			currency := strings.ToUpper(strings.TrimSpace(*patch.Currency))
+			currencyChanged = currency != current.Currency
+			current.Currency = currency
+			set["currency"] = current.Currency
+		}
+		if patch.Archived != nil {
+			current.Archived = *patch.Archived
+			set["archived"] = current.Archived
+		}
+		if field, msg := validateFinancialAccount(current); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		// 對帳過的帳戶改期初餘額或幣別，已經鎖定的餘額就對不上了
+		if current.LockedThrough != "" && (set["openingBalance"] != nil || set["currency"] != nil) {
+			field := "openingBalance"
+			if set["openingBalance"] == nil {
+				field = "currency"
+			}
+			writeError(w, r, CodeConflict, field, "reconcile.periodLocked")
+			return
+		}
+		// 轉帳記的toAmount是依照當時兩邊的幣別，改了幣別金額就不對了
+		if currencyChanged {
+			count, err := h.TColl.CountDocuments(r.Context(),
+				sc.filter(bson.M{"$or": bson.A{bson.M{"fromAccountID": id}, bson.M{"toAccountID": id}}}), options.Count().SetLimit(1))
+			if err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
+			if count > 0 {
+				writeError(w, r, CodeConflict, "currency", "financialAccount.currencyInUse")
+				return
+			}
+		}
+		if len(set) > 0 {
+			_, err = h.AColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": id}), bson.M{"$set": set})
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		accounts := []FinancialAccount{current}
+		if err := h.withBalances(r, sc, accounts); err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, accounts[0])
+	}
+}
+
+// RemoveAccount 還有花費、收入、轉帳、對帳單或儲蓄目標記在這個帳戶的話不能刪，不用的帳戶可以封存
+func (h *handlerWithDB) RemoveAccount() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		if _, err := h.findAccount(r, sc, id); err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "financialAccount.notFound")
+			return
+		} else if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		checks := []struct {
+			coll   *DB.Collection
+			filter bson.M
+		}{
+			{h.EColl, sc.filter(bson.M{"accountID": id})},
+			{h.IColl, sc.filter(bson.M{"accountID": id})},
+			{h.RColl, sc.filter(bson.M{"accountID": id})},
+			{h.TColl, sc.filter(bson.M{"$or": bson.A{bson.M{"fromAccountID": id}, bson.M{"toAccountID": id}}})},
+			{h.StColl, sc.filter(bson.M{"accountID": id})},
+			{h.GColl, sc.filter(bson.M{"accountID": id})},
+			{h.RuColl, sc.filter(bson.M{"match.accountID": id})},
+		}
+		for _, c := range checks {
+			count, err := c.coll.CountDocuments(r.Context(), c.filter, options.Count().SetLimit(1))
+			if err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
+			if count > 0 {
+				writeError(w, r, CodeConflict, "id", "financialAccount.inUse")
+				return
+			}
+		}
+
+		if _, err := h.AColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": id})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AccountLedger 帳戶明細跟每一筆之後的餘額，可以用?from=&to=或?period=&date=篩選
+func (h *handlerWithDB) AccountLedger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		account, err := h.findAccount(r, sc, mux.Vars(r)["id"])
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "financialAccount.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		loc, err := h.userLocation(r.Context(), sc.account)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		start, end, err := periodFromQuery(r.URL.Query(), loc)
+		if err != nil {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		movements, err := h.accountMovements(r, sc, loc, []string{account.ID})
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		res := AccountLedger{Account: account, StartBalance: account.OpeningBalance, Entries: []LedgerEntry{}}
+		balance := account.OpeningBalance
+		for _, m := range movements[account.ID] {
+			t := Utils.UnixToTime(m.Date)
+			balance += m.Amount
+			m.Balance = balance
+			if !start.IsZero() && t.Before(start) {
+				res.StartBalance = balance
+				continue
+			}
+			if end.IsZero() || t.Before(end) {
+				res.Entries = append(res.Entries, m)
+				res.EndBalance = balance
+			}
+		}
+		if len(res.Entries) == 0 {
+			res.EndBalance = res.StartBalance
+		}
+		res.Account.Balance = balance
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// ListTransfers 可以用?accountID=只看某個帳戶的轉帳，日期條件跟花費一樣
+func (h *handlerWithDB) ListTransfers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		filter, err := h.expenseFilter(r, sc)
+		if err == errInvalidDateRange {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		if id := r.URL.Query().Get("accountID"); id != "" && err == nil {
+			filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{bson.M{"fromAccountID": id}, bson.M{"toAccountID": id}}}}}
+		}
+		data := []TransferObject{}
+		if err == nil {
+			var cursor *mongo.Cursor
+			cursor, err = h.TColl.Find(r.Context(), filter, options.Find().SetSort(bson.M{"date": -1}))
+			if err == nil {
+				err = cursor.All(r.Context(), &data)
+			}
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data TransferObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Note = strings.TrimSpace(data.Note)
+		switch {
+		case data.FromAccountID == "":
+			writeError(w, r, CodeValidation, "fromAccountID", "financialAccount.required")
+			return
+		case data.ToAccountID == "":
+			writeError(w, r, CodeValidation, "toAccountID", "financialAccount.required")
+			return
+		case data.FromAccountID == data.ToAccountID:
+			writeError(w, r, CodeValidation, "toAccountID", "transfer.sameAccount")
+			return
+		case data.Amount <= 0:
+			writeError(w, r, CodeValidation, "amount", "transfer.amountInvalid")
+			return
+		case data.ToAmount < 0:
+			writeError(w, r, CodeValidation, "toAmount", "transfer.amountInvalid")
+			return
+		case data.Date < 0:
+			writeError(w, r, CodeValidation, "date", "expense.dateInvalid")
+			return
+		}
+		from, ok := h.checkAccountLink(w, r, sc, "fromAccountID", data.FromAccountID)
+		if !ok {
+			return
+		}
+		to, ok := h.checkAccountLink(w, r, sc, "toAccountID", data.ToAccountID)
+		if !ok {
+			return
+		}
+		// 同幣別一定是同樣的金額，不同幣別要自己填收到多少
+		if from.Currency == to.Currency {
+			data.ToAmount = data.Amount
+		} else if data.ToAmount == 0 {
+			writeError(w, r, CodeValidation, "toAmount", "transfer.toAmountRequired")
+			return
+		}
+		if data.Date == 0 {
+			data.Date = int(time.Now().Unix())
+		}
+		if !h.checkPeriodOpen(w, r, sc, "date", data.FromAccountID, data.Date) ||
+			!h.checkPeriodOpen(w, r, sc, "date", data.ToAccountID, data.Date) {
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.ReconciledIn = ""
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		_, err := h.TColl.InsertOne(r.Context(), sc.owned(bson.M{"id": data.ID, "fromAccountID": data.FromAccountID,
+			"toAccountID": data.ToAccountID, "amount": data.Amount, "toAmount": data.ToAmount, "date": data.Date,
+			"note": data.Note, "createdBy": sc.account}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/transfers/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) RemoveTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		filter := sc.filter(bson.M{"id": mux.Vars(r)["id"]})
+		if !h.checkEntriesOpen(w, r, sc, h.TColl, filter) {
+			return
+		}
+		res, err := h.TColl.DeleteOne(r.Context(), filter)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "transfer.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
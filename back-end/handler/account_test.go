@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/internal/testutil"
+)
+
+func taipei(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.FixedZone("CST", 8*3600))
+}
+
+// ledgerFixture 帳戶a1期初1000，三月有花費、收入跟轉出到a2，日期有秒也有毫秒，順序也是亂的
+func ledgerFixture(t *testing.T) (*handlerWithDB, *testutil.FakeMongo) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("accounts.find", docs(
+		bson.M{"id": "a1", "name": "bank", "type": AccountDebit, "openingBalance": 1000, "currency": "TWD"},
+		bson.M{"id": "a2", "name": "cash", "type": AccountCash, "openingBalance": 0, "currency": "TWD"},
+		bson.M{"id": "a3", "name": "usd", "type": AccountSavings, "openingBalance": 0, "currency": "USD"},
+	))
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e3", "description": "dinner", "amount": 200, "date": taipei(2024, 3, 10, 19).Unix(), "accountID": "a1"},
+		bson.M{"id": "e1", "description": "coffee", "amount": 50, "date": taipei(2024, 3, 1, 9).UnixMilli(), "accountID": "a1"},
+	))
+	mongo.Handle("incomes.find", docs(
+		bson.M{"id": "i2", "source": "salary", "amount": 3000, "date": taipei(2024, 3, 5, 9).Unix(), "accountID": "a1"},
+	))
+	mongo.Handle("transfers.find", docs(
+		bson.M{"id": "t4", "fromAccountID": "a1", "toAccountID": "a2", "amount": 500, "toAmount": 500,
+			"date": taipei(2024, 3, 15, 12).UnixMilli(), "note": "ATM"},
+	))
+	return h, mongo
+}
+
+func TestAccountLedgerRunningBalance(t *testing.T) {
+	h, _ := ledgerFixture(t)
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/accounts/a1/ledger", nil), "alice", map[string]string{"id": "a1"})
+	rec := serve(h.AccountLedger(), req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var res AccountLedger
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		ID      string
+		Kind    string
+		Amount  int
+		Balance int
+	}
+	want := []entry{
+		{"e1", EntryExpense, -50, 950},
+		{"i2", EntryIncome, 3000, 3950},
+		{"e3", EntryExpense, -200, 3750},
+		{"t4", EntryTransferOut, -500, 3250},
+	}
+	var got []entry
+	for _, e := range res.Entries {
+		got = append(got, entry{e.ID, e.Kind, e.Amount, e.Balance})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+	if res.StartBalance != 1000 || res.EndBalance != 3250 || res.Account.Balance != 3250 {
+		t.Fatalf("balances = start %d, end %d, account %d, want 1000, 3250, 3250", res.StartBalance, res.EndBalance, res.Account.Balance)
+	}
+}
+
+func TestAccountLedgerRange(t *testing.T) {
+	h, _ := ledgerFixture(t)
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/accounts/a1/ledger?from=2024-03-05&to=2024-03-10", nil),
+		"alice", map[string]string{"id": "a1"})
+	rec := serve(h.AccountLedger(), req)
+	var res AccountLedger
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 2 || res.Entries[0].ID != "i2" || res.Entries[1].ID != "e3" {
+		t.Fatalf("entries = %+v, want i2 and e3", res.Entries)
+	}
+	// 區間前的花費算進期初，區間後的轉帳只影響目前餘額
+	if res.StartBalance != 950 || res.EndBalance != 3750 || res.Account.Balance != 3250 {
+		t.Fatalf("balances = start %d, end %d, account %d, want 950, 3750, 3250", res.StartBalance, res.EndBalance, res.Account.Balance)
+	}
+}
+
+// 轉帳讓錢從一個帳戶到另一個帳戶，總額不變，也不算進花費
+func TestTransferIsNotSpending(t *testing.T) {
+	h, _ := ledgerFixture(t)
+	rec := serve(h.ListAccounts(), loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/accounts", nil), "alice", nil))
+	var accounts []FinancialAccount
+	if err := json.NewDecoder(rec.Body).Decode(&accounts); err != nil {
+		t.Fatal(err)
+	}
+	balances := map[string]int{}
+	for _, a := range accounts {
+		balances[a.ID] = a.Balance
+	}
+	if want := map[string]int{"a1": 3250, "a2": 500, "a3": 0}; !reflect.DeepEqual(balances, want) {
+		t.Fatalf("balances = %v, want %v", balances, want)
+	}
+
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/cashflow?from=2024-03-01&to=2024-03-31", nil), "alice", nil)
+	rec = serve(h.CashFlow(), req)
+	var flow CashFlowResponse
+	if err := json.NewDecoder(rec.Body).Decode(&flow); err != nil {
+		t.Fatal(err)
+	}
+	if flow.Total.Expenses != 250 || flow.Total.Income != 3000 {
+		t.Fatalf("cash flow = expenses %d, income %d, want 250 and 3000", flow.Total.Expenses, flow.Total.Income)
+	}
+}
+
+func TestPostTransferCurrencies(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		status       int
+		wantToAmount int
+		key          string
+	}{
+		{"same currency ignores toAmount", `{"fromAccountID":"a1","toAccountID":"a2","amount":500,"toAmount":999}`, http.StatusCreated, 500, ""},
+		{"different currency needs toAmount", `{"fromAccountID":"a1","toAccountID":"a3","amount":3200}`, http.StatusBadRequest, 0, "transfer.toAmountRequired"},
+		{"different currency", `{"fromAccountID":"a1","toAccountID":"a3","amount":3200,"toAmount":100}`, http.StatusCreated, 100, ""},
+		{"same account", `{"fromAccountID":"a1","toAccountID":"a1","amount":100}`, http.StatusBadRequest, 0, "transfer.sameAccount"},
+		{"unknown account", `{"fromAccountID":"a1","toAccountID":"a9","amount":100}`, http.StatusBadRequest, 0, "financialAccount.notFound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := ledgerFixture(t)
+			var mu sync.Mutex
+			var inserted bson.Raw
+			mongo.Handle("transfers.insert", func(cmd bson.Raw) []any {
+				mu.Lock()
+				defer mu.Unlock()
+				inserted = cmd.Lookup("documents", "0").Document()
+				return nil
+			})
+			req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/transfers", strings.NewReader(tt.body)), "alice", nil)
+			rec := serve(h.PostTransfer(), req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.key != "" {
+				if e := decodeError(t, rec); e.Message != T(req, tt.key) {
+					t.Fatalf("message = %q, want %q", e.Message, T(req, tt.key))
+				}
+				if inserted != nil {
+					t.Fatal("transfer inserted although it was rejected")
+				}
+				return
+			}
+			if got := inserted.Lookup("toAmount").AsInt64(); got != int64(tt.wantToAmount) {
+				t.Fatalf("stored toAmount = %d, want %d", got, tt.wantToAmount)
+			}
+		})
+	}
+}
+
+func TestRemoveAccountInUse(t *testing.T) {
+	for _, coll := range []string{"expenses", "incomes", "recurringIncomes", "transfers", "statements", "goals", "rules", ""} {
+		name := coll
+		if name == "" {
+			name = "unused"
+		}
+		t.Run(name, func(t *testing.T) {
+			h, mongo := ledgerFixture(t)
+			if coll != "" {
+				mongo.Handle(coll+".aggregate", count(1))
+			}
+			req := loggedIn(t, httptest.NewRequest(http.MethodDelete, "/api/v1/accounts/a1", nil), "alice", map[string]string{"id": "a1"})
+			rec := serve(h.RemoveAccount(), req)
+			deleted := false
+			for _, c := range mongo.Commands() {
+				deleted = deleted || c == "accounts.delete"
+			}
+			if coll == "" {
+				if rec.Code != http.StatusNoContent || !deleted {
+					t.Fatalf("status = %d, deleted = %v, want 204 and deleted: %s", rec.Code, deleted, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != http.StatusConflict || deleted {
+				t.Fatalf("status = %d, deleted = %v, want 409 and kept", rec.Code, deleted)
+			}
+			if e := decodeError(t, rec); e.Message != T(req, "financialAccount.inUse") {
+				t.Fatalf("message = %q", e.Message)
+			}
+		})
+	}
+}
+
+func TestPatchAccountCurrencyWithTransfers(t *testing.T) {
+	tests := []struct {
+		name      string
+		account   string
+		body      string
+		transfers int
+		status    int
+	}{
+		{"change with transfers", "a1", `{"currency":"usd"}`, 1, http.StatusConflict},
+		{"change without transfers", "a3", `{"currency":"JPY"}`, 0, http.StatusOK},
+		{"same currency with transfers", "a1", `{"currency":"twd","name":"main"}`, 1, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := ledgerFixture(t)
+			mongo.Handle("transfers.aggregate", count(tt.transfers))
+			req := loggedIn(t, httptest.NewRequest(http.MethodPatch, "/api/v1/accounts/"+tt.account, strings.NewReader(tt.body)),
+				"alice", map[string]string{"id": tt.account})
+			rec := serve(h.PatchAccount(), req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusConflict {
+				if e := decodeError(t, rec); e.Field != "currency" || e.Message != T(req, "financialAccount.currencyInUse") {
+					t.Fatalf("error = %+v", e)
+				}
+			}
+		})
+	}
+}
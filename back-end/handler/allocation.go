@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 一筆花費分到好幾個預算(例如超市的發票有食物也有日用品)
+// budgetID還是會留著，是第一行的預算，舊的前端跟只看budgetID的地方照樣可以用
+
+const maxAllocations = 10
+
+// BudgetAllocation 分到某個預算的金額
+type BudgetAllocation struct {
+	BudgetID string `json:"budgetID"`
+	Amount   int    `json:"amount"`
+}
+
+func allocationsDoc(lines []BudgetAllocation) bson.A {
+	res := bson.A{}
+	for _, line := range lines {
+		res = append(res, bson.M{"budgetID": line.BudgetID, "amount": line.Amount})
+	}
+	return res
+}
+
+// normalizeAllocations 檢查分配，每行金額要是正的、預算不能重複、加起來要等於花費金額
+// 回傳有問題的欄位跟訊息
+func normalizeAllocations(amount int, lines []BudgetAllocation) ([]BudgetAllocation, string, string) {
+	if len(lines) < 2 {
+		return nil, "allocations", "allocation.tooFew"
+	}
+	if len(lines) > maxAllocations {
+		return nil, "allocations", "allocation.tooMany"
+	}
+	res := make([]BudgetAllocation, len(lines))
+	seen := map[string]bool{}
+	sum := 0
+	for i, line := range lines {
+		line.BudgetID = strings.TrimSpace(line.BudgetID)
+		if line.BudgetID == "" {
+			return nil, "allocations", "expense.budgetRequired"
+		}
+		if seen[line.BudgetID] {
+			return nil, "allocations", "allocation.duplicateBudget"
+		}
+		if line.Amount <= 0 {
+			return nil, "allocations", "allocation.amountInvalid"
+		}
+		seen[line.BudgetID] = true
+		sum += line.Amount
+		res[i] = line
+	}
+	if sum != amount {
+		return nil, "allocations", "allocation.sumMismatch"
+	}
+	return res, "", ""
+}
+
+// checkAllocations 檢查分配跟每個預算都存在，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkAllocations(w http.ResponseWriter, r *http.Request, sc scope, amount int, lines *[]BudgetAllocation) bool {
+	normalized, field, msg := normalizeAllocations(amount, *lines)
+	if msg != "" {
+		writeError(w, r, CodeValidation, field, msg)
+		return false
+	}
+	ids := make([]string, len(normalized))
+	for i, line := range normalized {
+		ids[i] = line.BudgetID
+	}
+	count, err := h.BColl.CountDocuments(r.Context(), sc.filter(bson.M{"id": bson.M{"$in": ids}}))
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	if int(count) != len(ids) {
+		writeError(w, r, CodeValidation, "allocations", "budget.notFound")
+		return false
+	}
+	*lines = normalized
+	return true
+}
+
+// budgetAmounts 花費在各個預算的金額，沒有分配的話整筆都是budgetID的
+func (e ExpenseObject) budgetAmounts() []BudgetAllocation {
+	if len(e.Allocations) > 0 {
+		return e.Allocations
+	}
+	return []BudgetAllocation{{BudgetID: e.BudgetID, Amount: e.Amount}}
+}
+
+// detachBudget 刪除預算前，把有分配到這個預算的花費的那一行拿掉，金額併到剩下的第一行
+// 只剩一行的話就不用分配了，整筆記在那個預算；金額沒變，對帳鎖定的花費也可以改
+func (h *handlerWithDB) detachBudget(r *http.Request, sc scope, budgetID string) error {
+	var expenses []ExpenseObject
+	cursor, err := h.EColl.Find(r.Context(), sc.filter(bson.M{"allocations.budgetID": budgetID}),
+		options.Find().SetProjection(bson.M{"id": 1, "allocations": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &expenses)
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range expenses {
+		var rest []BudgetAllocation
+		moved := 0
+		for _, line := range e.Allocations {
+			if line.BudgetID == budgetID {
+				moved += line.Amount
+			} else {
+				rest = append(rest, line)
+			}
+		}
+		if len(rest) == 0 {
+			continue
+		}
+		rest[0].Amount += moved
+		update := bson.M{"$set": bson.M{"budgetID": rest[0].BudgetID, "allocations": allocationsDoc(rest)}}
+		if len(rest) == 1 {
+			update = bson.M{"$set": bson.M{"budgetID": rest[0].BudgetID}, "$unset": bson.M{"allocations": ""}}
+		}
+		if _, err := h.EColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": e.ID}), update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
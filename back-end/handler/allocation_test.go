@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNormalizeAllocations(t *testing.T) {
+	many := make([]BudgetAllocation, maxAllocations+1)
+	for i := range many {
+		many[i] = BudgetAllocation{BudgetID: string(rune('a' + i)), Amount: 1}
+	}
+	tests := []struct {
+		name   string
+		amount int
+		lines  []BudgetAllocation
+		want   []BudgetAllocation
+		msg    string
+	}{
+		{"trimmed", 100, []BudgetAllocation{{" food ", 70}, {"home", 30}}, []BudgetAllocation{{"food", 70}, {"home", 30}}, ""},
+		{"one line", 100, []BudgetAllocation{{"food", 100}}, nil, "allocation.tooFew"},
+		{"too many", len(many), many, nil, "allocation.tooMany"},
+		{"sum too small", 100, []BudgetAllocation{{"food", 60}, {"home", 30}}, nil, "allocation.sumMismatch"},
+		{"sum too large", 100, []BudgetAllocation{{"food", 80}, {"home", 30}}, nil, "allocation.sumMismatch"},
+		{"duplicate budget", 100, []BudgetAllocation{{"food", 50}, {"food", 50}}, nil, "allocation.duplicateBudget"},
+		{"duplicate after trimming", 100, []BudgetAllocation{{"food", 50}, {" food", 50}}, nil, "allocation.duplicateBudget"},
+		{"zero amount", 100, []BudgetAllocation{{"food", 100}, {"home", 0}}, nil, "allocation.amountInvalid"},
+		{"negative amount", 100, []BudgetAllocation{{"food", 120}, {"home", -20}}, nil, "allocation.amountInvalid"},
+		{"blank budget", 100, []BudgetAllocation{{"food", 50}, {" ", 50}}, nil, "expense.budgetRequired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, field, msg := normalizeAllocations(tt.amount, tt.lines)
+			if msg != tt.msg || (msg != "" && field != "allocations") {
+				t.Fatalf("normalizeAllocations = (%q, %q), want %q", field, msg, tt.msg)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("lines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAllocationsBudgetsExist(t *testing.T) {
+	tests := []struct {
+		name  string
+		found int
+		ok    bool
+	}{
+		{"all found", 2, true},
+		{"one missing", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := newTestHandler(t)
+			mongo.Handle("budgets.aggregate", count(tt.found))
+			lines := []BudgetAllocation{{" food", 70}, {"home", 30}}
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			rec := httptest.NewRecorder()
+			if ok := h.checkAllocations(rec, req, scope{account: "alice"}, 100, &lines); ok != tt.ok {
+				t.Fatalf("ok = %v, want %v (status %d: %s)", ok, tt.ok, rec.Code, rec.Body.String())
+			}
+			if !tt.ok {
+				if e := decodeError(t, rec); e.Field != "allocations" || e.Message != T(req, "budget.notFound") {
+					t.Fatalf("error = %+v", e)
+				}
+				return
+			}
+			if lines[0].BudgetID != "food" {
+				t.Fatalf("lines = %v, want the normalized lines", lines)
+			}
+		})
+	}
+}
+
+func TestPostExpenseAllocations(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("budgets.aggregate", count(2))
+	var mu sync.Mutex
+	var inserted bson.Raw
+	mongo.Handle("expenses.insert", func(cmd bson.Raw) []any {
+		mu.Lock()
+		defer mu.Unlock()
+		inserted = cmd.Lookup("documents", "0").Document()
+		return nil
+	})
+	body := `{"id":"e1","budgetID":"ignored","description":"market","amount":100,"allocations":[{"budgetID":" food","amount":70},{"budgetID":"home","amount":30}]}`
+	req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/expenses", strings.NewReader(body)), "alice", nil)
+	rec := serve(h.PostExpense(), req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// budgetID是第一行的預算，只看budgetID的地方也能用
+	if got := inserted.Lookup("budgetID").StringValue(); got != "food" {
+		t.Fatalf("budgetID = %q, want food", got)
+	}
+	var stored struct {
+		Allocations []BudgetAllocation `bson:"allocations"`
+	}
+	if err := bson.Unmarshal(inserted, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := []BudgetAllocation{{"food", 70}, {"home", 30}}; !reflect.DeepEqual(stored.Allocations, want) {
+		t.Fatalf("allocations = %v, want %v", stored.Allocations, want)
+	}
+}
+
+func TestDetachBudget(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e1", "allocations": bson.A{
+			bson.M{"budgetID": "food", "amount": 50}, bson.M{"budgetID": "home", "amount": 30}, bson.M{"budgetID": "fun", "amount": 20}}},
+		bson.M{"id": "e2", "allocations": bson.A{
+			bson.M{"budgetID": "home", "amount": 40}, bson.M{"budgetID": "food", "amount": 60}}},
+	))
+	var mu sync.Mutex
+	updates := map[string]bson.Raw{}
+	mongo.Handle("expenses.update", func(cmd bson.Raw) []any {
+		mu.Lock()
+		defer mu.Unlock()
+		id := cmd.Lookup("updates", "0", "q", "id").StringValue()
+		updates[id] = cmd.Lookup("updates", "0", "u").Document()
+		return []any{bson.M{"n": 1, "nModified": 1}}
+	})
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	if err := h.detachBudget(req, scope{account: "alice"}, "food"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != 2 {
+		t.Fatalf("%d expenses updated, want 2", len(updates))
+	}
+	// 拿掉的金額併到剩下的第一行，budgetID也跟著改
+	var e1 struct {
+		Set struct {
+			BudgetID    string             `bson:"budgetID"`
+			Allocations []BudgetAllocation `bson:"allocations"`
+		} `bson:"$set"`
+	}
+	if err := bson.Unmarshal(updates["e1"], &e1); err != nil {
+		t.Fatal(err)
+	}
+	if want := []BudgetAllocation{{"home", 80}, {"fun", 20}}; e1.Set.BudgetID != "home" || !reflect.DeepEqual(e1.Set.Allocations, want) {
+		t.Fatalf("e1 = %+v, want budgetID home and %v", e1.Set, want)
+	}
+	// 只剩一行就整筆記在那個預算
+	e2 := updates["e2"]
+	if got := e2.Lookup("$set", "budgetID").StringValue(); got != "home" {
+		t.Fatalf("e2 budgetID = %q, want home", got)
+	}
+	if _, err := e2.LookupErr("$unset", "allocations"); err != nil {
+		t.Fatalf("e2 allocations not removed: %v", e2)
+	}
+}
+
+// 分到好幾個預算的花費每一行算在各自的預算，總花費只算一次
+func TestBudgetTotalsAllocations(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("budgets.find", docs(
+		bson.M{"id": "food", "name": "food", "max": 1000},
+		bson.M{"id": "home", "name": "home", "max": 1000},
+		bson.M{"id": "snacks", "name": "snacks", "max": 500, "parentID": "food"},
+	))
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e1", "budgetID": "snacks", "amount": 100, "date": taipei(2024, 3, 1, 9).Unix(), "allocations": bson.A{
+			bson.M{"budgetID": "snacks", "amount": 60}, bson.M{"budgetID": "home", "amount": 30}, bson.M{"budgetID": "gone", "amount": 10}}},
+		bson.M{"id": "e2", "budgetID": "food", "amount": 200, "date": taipei(2024, 3, 2, 9).Unix()},
+	))
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/budgetTotals?from=2024-03-01&to=2024-03-31", nil), "alice", nil)
+	rec := serve(h.BudgetTotals(), req)
+	var res BudgetTotalsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	totals := map[string]int{}
+	spent := map[string]int{}
+	var walk func([]BudgetTotal)
+	walk = func(list []BudgetTotal) {
+		for _, b := range list {
+			totals[b.ID], spent[b.ID] = b.Total, b.Spent
+			walk(b.Children)
+		}
+	}
+	walk(res.Budgets)
+	if want := map[string]int{"food": 200, "snacks": 60, "home": 30}; !reflect.DeepEqual(spent, want) {
+		t.Fatalf("spent = %v, want %v", spent, want)
+	}
+	if want := map[string]int{"food": 260, "snacks": 60, "home": 30}; !reflect.DeepEqual(totals, want) {
+		t.Fatalf("totals = %v, want %v", totals, want)
+	}
+	if res.Total != 300 || res.Uncategorized != 10 {
+		t.Fatalf("total = %d, uncategorized = %d, want 300 and 10", res.Total, res.Uncategorized)
+	}
+}
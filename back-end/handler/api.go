@@ -0,0 +1,530 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/metrics"
+)
+
+// /api/v1 的RESTful handler，舊的RPC風格route(/createBudget等)保留給還沒遷移的前端使用
+
+// PATCH的body，只有有送的欄位才會更新
+type BudgetPatch struct {
+	Name     *string `json:"name"`
+	Max      *int    `json:"max"`
+	ParentID *string `json:"parentID"` // 空字串代表移到最上層
+	MaxMode  *string `json:"maxMode"`
+}
+
+type ExpensePatch struct {
+	BudgetID    *string       `json:"budgetID"`
+	Description *string       `json:"description"`
+	Amount      *int          `json:"amount"`
+	Date        *int          `json:"date"`
+	Split       *ExpenseSplit `json:"split"`     // participants是空的代表取消分帳
+	AccountID   *string       `json:"accountID"` // 空字串代表不記在任何帳戶
+	Tags        *[]string     `json:"tags"`      // 整個換掉，空陣列代表清掉所有標籤
+	// Allocations 整個換掉，空陣列代表取消分配，整筆記在budgetID；改了budgetID也會取消分配
+	Allocations *[]BudgetAllocation `json:"allocations"`
+}
+
+// onlyTags 只改標籤，對帳鎖定的花費也可以改
+func (p ExpensePatch) onlyTags() bool {
+	return p.Tags != nil && p.BudgetID == nil && p.Description == nil && p.Amount == nil &&
+		p.Date == nil && p.Split == nil && p.AccountID == nil && p.Allocations == nil
+}
+
+func (h *handlerWithDB) ListBudgets() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		data := []BudgetObject{}
+		cursor, err := h.BColl.Find(r.Context(), sc.filter(nil))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostBudget() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data BudgetObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if field, msg := validateBudget(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if field, msg := validateMaxMode(data.MaxMode); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+
+		tree, err := h.budgetTree(r, sc)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if _, ok := tree.byID[data.ID]; ok {
+			writeError(w, r, CodeConflict, "id", "budget.exists")
+			return
+		}
+		data.ParentID = strings.TrimSpace(data.ParentID)
+		if msg := tree.checkParent("", data.ParentID); msg != "" {
+			writeError(w, r, CodeValidation, "parentID", msg)
+			return
+		}
+
+		data.Name = strings.TrimSpace(data.Name)
+		if data.MaxMode == "" {
+			data.MaxMode = BudgetMaxOwn
+		}
+		data.UserID, data.HouseholdID = sc.owner()
+		doc := bson.M{"id": data.ID, "name": data.Name, "max": data.Max, "maxMode": data.MaxMode}
+		if data.ParentID != "" {
+			doc["parentID"] = data.ParentID
+		}
+		_, err = h.BColl.InsertOne(r.Context(), sc.owned(doc))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		metrics.BudgetsCreated.Inc()
+		w.Header().Set("Location", "/api/v1/budgets/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) PatchBudget() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		var patch BudgetPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		var current BudgetObject
+		err := h.BColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "budget.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		set := bson.M{}
+		if patch.Name != nil {
+			current.Name = strings.TrimSpace(*patch.Name)
+			set["name"] = current.Name
+		}
+		if patch.Max != nil {
+			current.Max = *patch.Max
+			set["max"] = current.Max
+		}
+		if patch.MaxMode != nil {
+			current.MaxMode = *patch.MaxMode
+			set["maxMode"] = current.MaxMode
+		}
+		if field, msg := validateBudgetFields(current.Name, current.Max); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if field, msg := validateMaxMode(current.MaxMode); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		unset := bson.M{}
+		if patch.ParentID != nil {
+			// 花費還是記在這個預算，搬移後加總會自動算到新的上層
+			current.ParentID = strings.TrimSpace(*patch.ParentID)
+			tree, err := h.budgetTree(r, sc)
+			if err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
+			if msg := tree.checkParent(id, current.ParentID); msg != "" {
+				writeError(w, r, CodeValidation, "parentID", msg)
+				return
+			}
+			if current.ParentID == "" {
+				unset["parentID"] = ""
+			} else {
+				set["parentID"] = current.ParentID
+			}
+		}
+		if len(set) > 0 || len(unset) > 0 {
+			_, err = h.BColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": id}), updateDoc(set, unset))
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+func (h *handlerWithDB) RemoveBudget() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+
+		// 對帳鎖定的花費不能跟著刪，分到好幾個預算的花費不會刪
+		if !h.checkEntriesOpen(w, r, sc, h.EColl, sc.filter(bson.M{"budgetID": id, "allocations": bson.M{"$exists": false}})) {
+			return
+		}
+		var current BudgetObject
+		err := h.BColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "budget.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if err := h.detachBudget(r, sc, id); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.EColl.DeleteMany(r.Context(), sc.filter(bson.M{"budgetID": id})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if err := h.reparentChildren(r, sc, current); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		// 連到這個預算的儲蓄目標保留，只取消連結
+		if _, err := h.GColl.UpdateMany(r.Context(), sc.filter(bson.M{"budgetID": id}), bson.M{"$unset": bson.M{"budgetID": ""}}); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		// 分類到這個預算的規則沒有用了
+		if _, err := h.RuColl.DeleteMany(r.Context(), sc.filter(bson.M{"budgetID": id})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		// 預算最後才刪，前面失敗的話重試還找得到這筆預算，不會留下沒有預算的花費
+		res, err := h.BColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": id}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "budget.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handlerWithDB) ListExpenses() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		filter, err := h.expenseFilter(r, sc)
+		if err == errInvalidDateRange {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		tags, field, msg := tagFilter(r)
+		if msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if tags != nil {
+			filter = bson.M{"$and": bson.A{filter, tags}}
+		}
+		data := []ExpenseObject{}
+		cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetSort(bson.M{"date": -1}))
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if err := cursor.All(r.Context(), &data); err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+// budgetExists 確認預算屬於該使用者或家庭
+func (h *handlerWithDB) budgetExists(r *http.Request, sc scope, budgetID string) (bool, error) {
+	count, err := h.BColl.CountDocuments(r.Context(), sc.filter(bson.M{"id": budgetID}))
+	return count > 0, err
+}
+
+func (h *handlerWithDB) PostExpense() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data ExpenseObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if len(data.Allocations) > 0 {
+			data.BudgetID = strings.TrimSpace(data.Allocations[0].BudgetID)
+		}
+		// 沒指定預算的話用自動分類的規則，沒有符合的規則一樣回覆要填預算
+		if strings.TrimSpace(data.BudgetID) == "" {
+			if _, err := h.categorize(r, sc, &data); err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
+		}
+		if field, msg := validateExpense(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		tags, msg := normalizeTags(data.Tags)
+		if msg != "" {
+			writeError(w, r, CodeValidation, "tags", msg)
+			return
+		}
+
+		exists, err := h.budgetExists(r, sc, data.BudgetID)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if !exists {
+			writeError(w, r, CodeValidation, "budgetID", "budget.notFound")
+			return
+		}
+		count, err := h.EColl.CountDocuments(r.Context(), sc.filter(bson.M{"id": data.ID}))
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if count > 0 {
+			writeError(w, r, CodeConflict, "id", "expense.exists")
+			return
+		}
+		if data.Split != nil && !h.checkSplit(w, r, sc, data.Amount, data.Split) {
+			return
+		}
+		if len(data.Allocations) > 0 && !h.checkAllocations(w, r, sc, data.Amount, &data.Allocations) {
+			return
+		}
+		if data.AccountID != "" {
+			if _, ok := h.checkAccountLink(w, r, sc, "accountID", data.AccountID); !ok {
+				return
+			}
+			if !h.checkPeriodOpen(w, r, sc, "date", data.AccountID, data.Date) {
+				return
+			}
+		}
+
+		data.Description = strings.TrimSpace(data.Description)
+		data.ReconciledIn = ""
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		doc := sc.owned(bson.M{"id": data.ID, "budgetID": data.BudgetID,
+			"description": data.Description, "amount": data.Amount, "date": data.Date, "createdBy": sc.account})
+		if data.Split != nil {
+			doc["split"] = data.Split.doc()
+		}
+		if data.AccountID != "" {
+			doc["accountID"] = data.AccountID
+		}
+		data.Tags = nil
+		if len(tags) > 0 {
+			data.Tags = tags
+			doc["tags"] = tags
+		}
+		if len(data.Allocations) > 0 {
+			doc["allocations"] = allocationsDoc(data.Allocations)
+		}
+		_, err = h.EColl.InsertOne(r.Context(), doc)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		metrics.ExpensesCreated.Inc()
+		w.Header().Set("Location", "/api/v1/expenses/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) PatchExpense() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		var patch ExpensePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		var current ExpenseObject
+		err := h.EColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "expense.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if !patch.onlyTags() && !h.checkEntriesOpen(w, r, sc, h.EColl, sc.filter(bson.M{"id": id})) {
+			return
+		}
+
+		set := bson.M{}
+		unset := bson.M{}
+		if patch.Tags != nil {
+			tags, msg := normalizeTags(*patch.Tags)
+			if msg != "" {
+				writeError(w, r, CodeValidation, "tags", msg)
+				return
+			}
+			current.Tags = nil
+			if len(tags) > 0 {
+				current.Tags = tags
+				set["tags"] = tags
+			} else {
+				unset["tags"] = ""
+			}
+		}
+		if patch.Allocations != nil && len(*patch.Allocations) > 0 {
+			current.Allocations = *patch.Allocations
+			budgetID := strings.TrimSpace(current.Allocations[0].BudgetID)
+			patch.BudgetID = &budgetID
+		} else if patch.Allocations != nil || (patch.BudgetID != nil && *patch.BudgetID != current.BudgetID) {
+			if len(current.Allocations) > 0 {
+				current.Allocations = nil
+				unset["allocations"] = ""
+			}
+		}
+		if patch.BudgetID != nil && *patch.BudgetID != current.BudgetID {
+			exists, err := h.budgetExists(r, sc, *patch.BudgetID)
+			if err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
+			if !exists {
+				writeError(w, r, CodeValidation, "budgetID", "budget.notFound")
+				return
+			}
+			current.BudgetID = *patch.BudgetID
+			set["budgetID"] = current.BudgetID
+		}
+		if patch.Description != nil {
+			current.Description = strings.TrimSpace(*patch.Description)
+			set["description"] = current.Description
+		}
+		if patch.Amount != nil {
+			current.Amount = *patch.Amount
+			set["amount"] = current.Amount
+		}
+		if patch.Date != nil {
+			current.Date = *patch.Date
+			set["date"] = current.Date
+		}
+		if field, msg := validateExpense(current); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if patch.Split != nil {
+			current.Split = patch.Split
+			if len(patch.Split.Participants) == 0 {
+				current.Split = nil
+				unset["split"] = ""
+			}
+		}
+		// 金額改了分配也要加起來一樣
+		if len(current.Allocations) > 0 && (patch.Allocations != nil || patch.Amount != nil) {
+			if !h.checkAllocations(w, r, sc, current.Amount, &current.Allocations) {
+				return
+			}
+			set["allocations"] = allocationsDoc(current.Allocations)
+		}
+		// 金額改了也要重新檢查，exact的總和要對得上
+		if current.Split != nil && (patch.Split != nil || patch.Amount != nil) {
+			if !h.checkSplit(w, r, sc, current.Amount, current.Split) {
+				return
+			}
+			set["split"] = current.Split.doc()
+		}
+		if !h.patchAccountLink(w, r, sc, patch.AccountID, &current.AccountID, set, unset) {
+			return
+		}
+		if (patch.Date != nil || patch.AccountID != nil) && !h.checkPeriodOpen(w, r, sc, "date", current.AccountID, current.Date) {
+			return
+		}
+		if update := updateDoc(set, unset); len(update) > 0 {
+			_, err = h.EColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": id}), update)
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+func (h *handlerWithDB) RemoveExpense() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		filter := sc.filter(bson.M{"id": mux.Vars(r)["id"]})
+		if !h.checkEntriesOpen(w, r, sc, h.EColl, filter) {
+			return
+		}
+		res, err := h.EColl.DeleteOne(r.Context(), filter)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "expense.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// limitedBody 記下body有沒有超過上限，writeInvalidJSON用它決定回413還是400
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// BodyLimit 限制request body的大小，Content-Length已經超過的話直接回413
+func BodyLimit(maxBytes int64) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeError(w, r, CodePayloadTooLarge, "", "request.tooLarge")
+				return
+			}
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBytes)}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+func bodyTooLarge(r *http.Request) bool {
+	b, ok := r.Body.(*limitedBody)
+	return ok && b.exceeded
+}
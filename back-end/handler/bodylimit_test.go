@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeHandler 跟一般的handler一樣解JSON，失敗就writeInvalidJSON
+var decodeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+})
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	var res ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("decode error response: %v", err)
+	}
+	return res.Error
+}
+
+func TestBodyLimitContentLength(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 20)))
+	rec := httptest.NewRecorder()
+	BodyLimit(10)(next).ServeHTTP(rec, req)
+
+	if called {
+		t.Fatal("handler called for an oversized body")
+	}
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if e := decodeError(t, rec); e.Code != CodePayloadTooLarge {
+		t.Fatalf("code = %q, want %q", e.Code, CodePayloadTooLarge)
+	}
+}
+
+// 沒有Content-Length(chunked)的話要讀到超過上限才知道，handler解JSON失敗時回413
+func TestBodyLimitStreamed(t *testing.T) {
+	body := `{"description":"` + strings.Repeat("a", 100) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	BodyLimit(50)(decodeHandler).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if e := decodeError(t, rec); e.Code != CodePayloadTooLarge {
+		t.Fatalf("code = %q, want %q", e.Code, CodePayloadTooLarge)
+	}
+}
+
+func TestBodyLimitWithinLimit(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":"b"}`))
+	rec := httptest.NewRecorder()
+	BodyLimit(50)(decodeHandler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	// 沒超過上限的壞JSON還是400
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":`))
+	rec = httptest.NewRecorder()
+	BodyLimit(50)(decodeHandler).ServeHTTP(rec, req)
+	if e := decodeError(t, rec); rec.Code != http.StatusBadRequest || e.Code != CodeInvalidJSON {
+		t.Fatalf("status = %d code = %q, want 400 %q", rec.Code, e.Code, CodeInvalidJSON)
+	}
+}
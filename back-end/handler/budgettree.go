@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/Utils"
+)
+
+// 預算可以有上下層(例如 飲食 → 早餐/午餐/晚餐)，花費還是記在原本的budgetID
+// 所以搬移預算不會影響歷史資料，加總時才依照目前的上下層計算
+
+const (
+	BudgetMaxOwn      = "own"      // Max是自己的上限(預設)
+	BudgetMaxChildren = "children" // 上限是子預算上限的總和，沒有子預算時用自己的Max
+
+	maxBudgetDepth = 4
+)
+
+// BudgetTotal 預算跟所有子預算的花費加總
+type BudgetTotal struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ParentID  string `json:"parentID,omitempty"`
+	MaxMode   string `json:"maxMode"`
+	Max       int    `json:"max"`       // 實際的上限，maxMode是children時是子預算的總和
+	Spent     int    `json:"spent"`     // 直接記在這個預算的花費
+	Total     int    `json:"total"`     // 包含所有子預算的花費
+	Remaining int    `json:"remaining"` // Max - Total，超支時是負的
+	// Overallocated 自己的上限比子預算上限的總和還小
+	Overallocated bool          `json:"overallocated,omitempty"`
+	Children      []BudgetTotal `json:"children"`
+}
+
+type BudgetTotalsResponse struct {
+	From          string        `json:"from,omitempty"`
+	To            string        `json:"to,omitempty"`
+	Max           int           `json:"max"`           // 最上層預算的上限總和
+	Total         int           `json:"total"`         // 所有花費，包含沒有預算的
+	Uncategorized int           `json:"uncategorized"` // 預算已經不存在的花費
+	Budgets       []BudgetTotal `json:"budgets"`
+	Tags          []TagTotal    `json:"tags"` // 一筆花費有好幾個標籤的話每個標籤都會算到
+}
+
+// budgetTree 目前的上下層關係，上層不存在的預算當成最上層
+type budgetTree struct {
+	byID     map[string]BudgetObject
+	children map[string][]string
+	roots    []string
+}
+
+func newBudgetTree(budgets []BudgetObject) *budgetTree {
+	sort.Slice(budgets, func(i, j int) bool {
+		if budgets[i].Name != budgets[j].Name {
+			return budgets[i].Name < budgets[j].Name
+		}
+		return budgets[i].ID < budgets[j].ID
+	})
+	t := &budgetTree{byID: map[string]BudgetObject{}, children: map[string][]string{}}
+	for _, b := range budgets {
+		t.byID[b.ID] = b
+	}
+	for _, b := range budgets {
+		if t.inCycle(b.ID) {
+			// 同時搬移造成的環，當成最上層顯示，讓使用者可以改回來
+			t.roots = append(t.roots, b.ID)
+		} else if _, ok := t.byID[b.ParentID]; ok {
+			t.children[b.ParentID] = append(t.children[b.ParentID], b.ID)
+		} else {
+			t.roots = append(t.roots, b.ID)
+		}
+	}
+	return t
+}
+
+// inCycle 往上層走會不會回到自己
+func (t *budgetTree) inCycle(id string) bool {
+	seen := map[string]bool{}
+	for b, ok := t.byID[id]; ok && !seen[b.ID]; b, ok = t.byID[b.ParentID] {
+		if b.ParentID == id {
+			return true
+		}
+		seen[b.ID] = true
+	}
+	return false
+}
+
+// ancestors 從上層往上走到最上層，遇到重複的就停下來，避免資料有環時跑不完
+func (t *budgetTree) ancestors(id string) []string {
+	var res []string
+	seen := map[string]bool{id: true}
+	for b, ok := t.byID[id]; ok; b, ok = t.byID[b.ParentID] {
+		if b.ParentID == "" || seen[b.ParentID] {
+			break
+		}
+		if _, exists := t.byID[b.ParentID]; !exists {
+			break
+		}
+		seen[b.ParentID] = true
+		res = append(res, b.ParentID)
+	}
+	return res
+}
+
+// height 這個預算往下有幾層，沒有子預算是1
+func (t *budgetTree) height(id string) int {
+	h := 0
+	for _, child := range t.children[id] {
+		h = max(h, t.height(child))
+	}
+	return h + 1
+}
+
+// checkParent 確認id可以放到parentID底下，回傳錯誤訊息，空字串代表沒問題
+// id是空字串代表新增的預算
+func (t *budgetTree) checkParent(id, parentID string) string {
+	if parentID == "" {
+		return ""
+	}
+	if _, ok := t.byID[parentID]; !ok {
+		return "budget.parentNotFound"
+	}
+	if parentID == id {
+		return "budget.parentCycle"
+	}
+	ancestors := t.ancestors(parentID)
+	for _, a := range ancestors {
+		if a == id {
+			return "budget.parentCycle"
+		}
+	}
+	height := 1
+	if id != "" {
+		height = t.height(id)
+	}
+	if len(ancestors)+1+height > maxBudgetDepth {
+		return "budget.tooDeep"
+	}
+	return ""
+}
+
+// effectiveMax maxMode是children而且有子預算時，上限是子預算的總和
+func (t *budgetTree) effectiveMax(id string) int {
+	b := t.byID[id]
+	if b.MaxMode != BudgetMaxChildren || len(t.children[id]) == 0 {
+		return b.Max
+	}
+	sum := 0
+	for _, child := range t.children[id] {
+		sum += t.effectiveMax(child)
+	}
+	return sum
+}
+
+// rootsMax 最上層預算的上限總和，子預算的上限已經包含在上層裡了
+func (t *budgetTree) rootsMax() int {
+	sum := 0
+	for _, id := range t.roots {
+		sum += t.effectiveMax(id)
+	}
+	return sum
+}
+
+// total 把子預算的花費加到上層
+func (t *budgetTree) total(id string, spent map[string]int) BudgetTotal {
+	b := t.byID[id]
+	res := BudgetTotal{ID: b.ID, Name: b.Name, ParentID: b.ParentID, MaxMode: b.MaxMode, Max: t.effectiveMax(id),
+		Spent: spent[id], Total: spent[id], Children: []BudgetTotal{}}
+	if res.MaxMode == "" {
+		res.MaxMode = BudgetMaxOwn
+	}
+	childrenMax := 0
+	for _, child := range t.children[id] {
+		c := t.total(child, spent)
+		res.Total += c.Total
+		childrenMax += c.Max
+		res.Children = append(res.Children, c)
+	}
+	res.Remaining = res.Max - res.Total
+	res.Overallocated = res.MaxMode == BudgetMaxOwn && childrenMax > res.Max
+	return res
+}
+
+// budgetTree 讀取使用者或家庭目前所有的預算
+func (h *handlerWithDB) budgetTree(r *http.Request, sc scope) (*budgetTree, error) {
+	var budgets []BudgetObject
+	cursor, err := h.BColl.Find(r.Context(), sc.filter(nil), options.Find().SetProjection(bson.M{"id": 1, "name": 1, "max": 1, "parentID": 1, "maxMode": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &budgets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBudgetTree(budgets), nil
+}
+
+// reparentChildren 刪除預算時，子預算移到被刪除的預算的上層
+func (h *handlerWithDB) reparentChildren(r *http.Request, sc scope, deleted BudgetObject) error {
+	update := bson.M{"$unset": bson.M{"parentID": ""}}
+	if deleted.ParentID != "" {
+		update = bson.M{"$set": bson.M{"parentID": deleted.ParentID}}
+	}
+	_, err := h.BColl.UpdateMany(r.Context(), sc.filter(bson.M{"parentID": deleted.ID}), update)
+	return err
+}
+
+// BudgetTotals 每個預算在區間內的花費，子預算的花費會算進上層
+// 區間跟花費一樣用?from=&to=或?period=&date=指定，都沒有的話就是這個月
+func (h *handlerWithDB) BudgetTotals() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		loc, err := h.userLocation(r.Context(), sc.account)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		start, end, err := periodFromQuery(r.URL.Query(), loc)
+		if err != nil {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		if start.IsZero() && end.IsZero() {
+			start, end, _ = Utils.PeriodRange("month", time.Now(), loc)
+		}
+
+		tree, err := h.budgetTree(r, sc)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		filter := bson.M{"$and": bson.A{sc.filter(nil), dateRangeFilter(start, end)}}
+		var expenses []ExpenseObject
+		cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"budgetID": 1, "amount": 1, "tags": 1, "allocations": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &expenses)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		res := BudgetTotalsResponse{Max: tree.rootsMax(), Budgets: []BudgetTotal{}}
+		if !start.IsZero() {
+			res.From = start.In(loc).Format(Utils.DayLayout)
+		}
+		if !end.IsZero() {
+			res.To = end.In(loc).AddDate(0, 0, -1).Format(Utils.DayLayout)
+		}
+		spent := map[string]int{}
+		for _, e := range expenses {
+			res.Total += e.Amount
+			// 分到好幾個預算的花費每一行各自算
+			for _, line := range e.budgetAmounts() {
+				if _, ok := tree.byID[line.BudgetID]; ok {
+					spent[line.BudgetID] += line.Amount
+				} else {
+					res.Uncategorized += line.Amount
+				}
+			}
+		}
+		for _, id := range tree.roots {
+			res.Budgets = append(res.Budgets, tree.total(id, spent))
+		}
+		res.Tags = tagTotals(expenses)
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 四層的 a → b → c → d，另外有兩層的 x → y
+func chainTree() *budgetTree {
+	return newBudgetTree([]BudgetObject{
+		{ID: "a", Name: "a"},
+		{ID: "b", Name: "b", ParentID: "a"},
+		{ID: "c", Name: "c", ParentID: "b"},
+		{ID: "d", Name: "d", ParentID: "c"},
+		{ID: "x", Name: "x"},
+		{ID: "y", Name: "y", ParentID: "x"},
+	})
+}
+
+func TestCheckParent(t *testing.T) {
+	tests := []struct {
+		name         string
+		id, parentID string
+		want         string
+	}{
+		{"top level", "b", "", ""},
+		{"new under third level", "", "c", ""},
+		{"new at depth 5", "", "d", "budget.tooDeep"},
+		{"under itself", "b", "b", "budget.parentCycle"},
+		{"under its child", "a", "b", "budget.parentCycle"},
+		{"under a descendant", "a", "d", "budget.parentCycle"},
+		{"unknown parent", "b", "zzz", "budget.parentNotFound"},
+		{"two levels under the second", "x", "b", ""},
+		{"two levels under the third", "x", "c", "budget.tooDeep"},
+		{"subtree keeps its height", "b", "y", "budget.tooDeep"},
+		{"leaf under the deepest", "y", "d", "budget.tooDeep"},
+		{"move up", "d", "a", ""},
+	}
+	tree := chainTree()
+	for _, tt := range tests {
+		if got := tree.checkParent(tt.id, tt.parentID); got != tt.want {
+			t.Errorf("%s: checkParent(%q, %q) = %q, want %q", tt.name, tt.id, tt.parentID, got, tt.want)
+		}
+	}
+}
+
+// 兩個預算同時搬到對方底下造成的環，兩個都當成最上層，而且不會跑不完
+func TestBudgetTreeCycleInData(t *testing.T) {
+	tree := newBudgetTree([]BudgetObject{
+		{ID: "p", Name: "p", ParentID: "q"},
+		{ID: "q", Name: "q", ParentID: "p"},
+		{ID: "r", Name: "r", ParentID: "p"},
+	})
+	if want := []string{"p", "q"}; !reflect.DeepEqual(tree.roots, want) {
+		t.Fatalf("roots = %v, want %v", tree.roots, want)
+	}
+	if got := tree.ancestors("r"); len(got) > 2 {
+		t.Fatalf("ancestors(r) = %v", got)
+	}
+	if msg := tree.checkParent("q", ""); msg != "" {
+		t.Fatalf("moving out of the cycle: %q", msg)
+	}
+}
+
+func TestEffectiveMax(t *testing.T) {
+	tree := newBudgetTree([]BudgetObject{
+		{ID: "food", Name: "food", Max: 9000, MaxMode: BudgetMaxChildren},
+		{ID: "breakfast", Name: "breakfast", Max: 2000, ParentID: "food"},
+		{ID: "lunch", Name: "lunch", Max: 500, MaxMode: BudgetMaxChildren, ParentID: "food"},
+		{ID: "bento", Name: "bento", Max: 1500, ParentID: "lunch"},
+		{ID: "noodles", Name: "noodles", Max: 1000, ParentID: "lunch"},
+		{ID: "travel", Name: "travel", Max: 3000, MaxMode: BudgetMaxChildren}, // 沒有子預算，用自己的上限
+		{ID: "home", Name: "home", Max: 1000},
+		{ID: "rent", Name: "rent", Max: 8000, ParentID: "home"}, // 自己的上限比子預算小，不會被改掉
+	})
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"lunch", 2500},
+		{"food", 4500},
+		{"travel", 3000},
+		{"home", 1000},
+	}
+	for _, tt := range tests {
+		if got := tree.effectiveMax(tt.id); got != tt.want {
+			t.Errorf("effectiveMax(%s) = %d, want %d", tt.id, got, tt.want)
+		}
+	}
+	if got := tree.rootsMax(); got != 4500+3000+1000 {
+		t.Errorf("rootsMax = %d, want %d", got, 4500+3000+1000)
+	}
+	if home := tree.total("home", nil); !home.Overallocated {
+		t.Error("home is not overallocated")
+	}
+	if food := tree.total("food", nil); food.Overallocated {
+		t.Error("food uses the sum of its children, it cannot be overallocated")
+	}
+}
+
+func TestPatchBudgetUnderDescendant(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("budgets.find", docs(
+		bson.M{"id": "a", "name": "a", "max": 100},
+		bson.M{"id": "b", "name": "b", "max": 100, "parentID": "a"},
+		bson.M{"id": "c", "name": "c", "max": 100, "parentID": "b"},
+	))
+	req := loggedIn(t, httptest.NewRequest(http.MethodPatch, "/api/v1/budgets/a", strings.NewReader(`{"parentID":"c"}`)),
+		"alice", map[string]string{"id": "a"})
+	rec := serve(h.PatchBudget(), req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body.String())
+	}
+	if e := decodeError(t, rec); e.Field != "parentID" || e.Message != T(req, "budget.parentCycle") {
+		t.Fatalf("error = %+v", e)
+	}
+	for _, c := range mongo.Commands() {
+		if c == "budgets.update" {
+			t.Fatal("budget moved under its own descendant")
+		}
+	}
+}
+
+func TestBudgetTotalsRollUp(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("budgets.find", docs(
+		bson.M{"id": "food", "name": "food", "max": 9000, "maxMode": BudgetMaxChildren},
+		bson.M{"id": "lunch", "name": "lunch", "max": 3000, "parentID": "food"},
+		bson.M{"id": "bento", "name": "bento", "max": 1000, "parentID": "lunch"},
+		bson.M{"id": "fun", "name": "fun", "max": 2000},
+	))
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e1", "budgetID": "food", "amount": 100, "date": taipei(2024, 3, 1, 9).Unix()},
+		bson.M{"id": "e2", "budgetID": "lunch", "amount": 200, "date": taipei(2024, 3, 2, 12).Unix()},
+		bson.M{"id": "e3", "budgetID": "bento", "amount": 300, "date": taipei(2024, 3, 3, 12).Unix()},
+		bson.M{"id": "e4", "budgetID": "gone", "amount": 50, "date": taipei(2024, 3, 4, 12).Unix()},
+	))
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/budgetTotals?period=month&date=2024-03-15", nil), "alice", nil)
+	rec := serve(h.BudgetTotals(), req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var res BudgetTotalsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.From != "2024-03-01" || res.To != "2024-03-31" {
+		t.Fatalf("range = %s..%s, want the whole of March", res.From, res.To)
+	}
+	if res.Total != 650 || res.Uncategorized != 50 || res.Max != 3000+2000 {
+		t.Fatalf("total = %d, uncategorized = %d, max = %d, want 650, 50, 5000", res.Total, res.Uncategorized, res.Max)
+	}
+	if len(res.Budgets) != 2 || res.Budgets[0].ID != "food" || res.Budgets[1].ID != "fun" {
+		t.Fatalf("roots = %+v, want food and fun", res.Budgets)
+	}
+	food := res.Budgets[0]
+	lunch := food.Children[0]
+	bento := lunch.Children[0]
+	type total struct{ Spent, Total, Max, Remaining int }
+	got := []total{
+		{food.Spent, food.Total, food.Max, food.Remaining},
+		{lunch.Spent, lunch.Total, lunch.Max, lunch.Remaining},
+		{bento.Spent, bento.Total, bento.Max, bento.Remaining},
+	}
+	want := []total{
+		{100, 600, 3000, 2400},
+		{200, 500, 3000, 2500},
+		{300, 300, 1000, 700},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("food, lunch, bento = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// 只壓縮文字類的回應，圖片之類本來就壓縮過了
+var compressibleTypes = []string{"application/json", "text/", "application/javascript", "image/svg+xml"}
+
+// Compress 依照Accept-Encoding用br或gzip壓縮回應，encodings是伺服器的偏好順序
+// 回應小於minBytes就不壓縮，壓縮反而會變大
+func Compress(encodings []string, minBytes int) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		}
+	}
+}
+
+// negotiateEncoding 從client接受(q>0)的編碼裡挑伺服器最偏好的一個，都不接受就回傳空字串
+func negotiateEncoding(header string, encodings []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+	for _, encoding := range encodings {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter 先把回應暫存到minBytes，確定夠大而且是文字類才開始壓縮
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser // nil代表不壓縮
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.decided {
+		return c.write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.minBytes {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *compressWriter) write(b []byte) (int, error) {
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// decide 送出header並決定要不要壓縮，之後就不能再改了
+func (c *compressWriter) decide(large bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	h := c.Header()
+	if large && c.shouldCompress() {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		switch c.encoding {
+		case "br":
+			c.enc = brotli.NewWriter(c.ResponseWriter)
+		case "gzip":
+			c.enc = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := c.write(buf)
+	return err
+}
+
+func (c *compressWriter) shouldCompress() bool {
+	if c.status < 200 || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+	// handler自己壓縮過了
+	if c.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.Header().Get("Content-Type"))
+	if mediaType == "" {
+		mediaType = http.DetectContentType(c.buf)
+	}
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush 串流的時候不再等minBytes，直接開始送
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		c.decide(true)
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Close handler結束時呼叫，把暫存的內容跟壓縮器裡剩下的資料送出去
+func (c *compressWriter) Close() error {
+	if !c.decided {
+		if c.status == 0 {
+			// handler什麼都沒寫，交給net/http回200
+			return nil
+		}
+		if err := c.decide(false); err != nil {
+			return err
+		}
+	}
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+// Unwrap 讓http.ResponseController可以拿到原本的ResponseWriter
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func serveCompressed(t *testing.T, accept, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	rec := httptest.NewRecorder()
+	Compress([]string{"br", "gzip"}, 100)(next).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCompressMinBytes(t *testing.T) {
+	small := `{"ok":true}`
+	rec := serveCompressed(t, "gzip", "application/json", small)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("small response compressed with %q", enc)
+	}
+	if rec.Body.String() != small {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), small)
+	}
+
+	large := `{"data":"` + strings.Repeat("a", 200) + `"}`
+	rec = serveCompressed(t, "gzip", "application/json", large)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != large {
+		t.Fatalf("decompressed body = %q, want %q", got, large)
+	}
+}
+
+func TestCompressPrefersServerOrder(t *testing.T) {
+	large := strings.Repeat("hello ", 50)
+	rec := serveCompressed(t, "gzip, br", "text/plain", large)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", enc)
+	}
+	got, err := io.ReadAll(brotli.NewReader(rec.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != large {
+		t.Fatalf("decompressed body = %q, want %q", got, large)
+	}
+
+	rec = serveCompressed(t, "br;q=0, gzip", "text/plain", large)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding with br;q=0 = %q, want gzip", enc)
+	}
+}
+
+func TestCompressExcludedTypes(t *testing.T) {
+	large := strings.Repeat("\x89PNG", 100)
+	rec := serveCompressed(t, "gzip", "image/png", large)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("image compressed with %q", enc)
+	}
+	if rec.Body.String() != large {
+		t.Fatal("image body changed")
+	}
+}
+
+func TestCompressVary(t *testing.T) {
+	for _, accept := range []string{"", "identity", "gzip"} {
+		rec := serveCompressed(t, accept, "application/json", `{}`)
+		if vary := rec.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", accept, vary)
+		}
+	}
+}
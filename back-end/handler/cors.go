@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"mongodb-budget/config"
+)
+
+// originMatcher 比對完整的origin或 https://*.example.com 這種子網域pattern
+type originMatcher struct {
+	any      bool
+	exact    map[string]bool
+	patterns []originPattern
+}
+
+type originPattern struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+func newOriginMatcher(origins []string) originMatcher {
+	m := originMatcher{exact: map[string]bool{}}
+	for _, o := range origins {
+		o = strings.ToLower(o)
+		switch {
+		case o == "*":
+			m.any = true
+		case strings.Contains(o, "://*."):
+			u, err := url.Parse(strings.Replace(o, "://*.", "://wildcard.", 1))
+			if err != nil {
+				continue
+			}
+			m.patterns = append(m.patterns, originPattern{
+				scheme: u.Scheme,
+				suffix: strings.TrimPrefix(u.Hostname(), "wildcard"),
+				port:   u.Port(),
+			})
+		default:
+			m.exact[o] = true
+		}
+	}
+	return m
+}
+
+// match 空字串或"null"(例如file://、sandbox iframe)一律不接受
+func (m originMatcher) match(origin string) bool {
+	origin = strings.ToLower(origin)
+	if origin == "" || origin == "null" {
+		return false
+	}
+	if m.any || m.exact[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Path != "" {
+		return false
+	}
+	for _, p := range m.patterns {
+		// *.example.com 只比對子網域，不包含example.com本身
+		if u.Scheme == p.scheme && u.Port() == p.port &&
+			strings.HasSuffix(u.Hostname(), p.suffix) && len(u.Hostname()) > len(p.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cors 依照設定處理跨網域request，router用來查出preflight的path實際接受哪些method
+// 舊的route沒有限制method，所以會回傳設定裡全部的method
+func Cors(cfg config.CORSConfig, router *mux.Router) func(http.Handler) http.HandlerFunc {
+	origins := newOriginMatcher(cfg.AllowedOrigins)
+	allowedHeaders := map[string]bool{}
+	for _, h := range cfg.AllowedHeaders {
+		allowedHeaders[strings.ToLower(h)] = true
+	}
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// 不管origin接不接受，回應內容都跟Origin有關，cache要分開存
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !origins.match(origin) {
+				if preflight {
+					logFor(r).Debug("cors origin rejected", "origin", origin)
+					writeError(w, r, CodeForbidden, "", "cors.originNotAllowed")
+					return
+				}
+				// 一般request照樣處理，沒有CORS header瀏覽器就不會讓前端讀到回應
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposed)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if methods := routeMethods(router, r, cfg.AllowedMethods); len(methods) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			}
+			// 只回傳有被允許的header，瀏覽器發現少了哪個就會擋下來
+			var headers []string
+			for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+				if h = strings.TrimSpace(h); h != "" && allowedHeaders[strings.ToLower(h)] {
+					headers = append(headers, h)
+				}
+			}
+			if len(headers) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			}
+			if cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// routeMethods 回傳candidates裡router對這個path有註冊的method
+func routeMethods(router *mux.Router, r *http.Request, candidates []string) []string {
+	var methods []string
+	for _, method := range candidates {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
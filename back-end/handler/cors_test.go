@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mongodb-budget/config"
+)
+
+func TestOriginMatcher(t *testing.T) {
+	m := newOriginMatcher([]string{"https://*.example.com", "http://*.dev.test:8080", "http://localhost:3000"})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://a.example.com", true},
+		{"https://a.b.example.com", true},
+		{"HTTPS://A.Example.COM", true},
+		{"https://example.com", false},     // 不包含本身
+		{"https://evilexample.com", false}, // 不是子網域
+		{"https://a.example.com.evil.com", false},
+		{"http://a.example.com", false},       // scheme不同
+		{"https://a.example.com:8443", false}, // port不同
+		{"https://a.example.com/path", false},
+		{"http://a.dev.test:8080", true},
+		{"http://a.dev.test", false},
+		{"http://a.dev.test:9090", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.origin); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+	if any := newOriginMatcher([]string{"*"}); !any.match("https://anything.test") || any.match("null") {
+		t.Error(`"*" should match every origin except null`)
+	}
+}
+
+func corsFixture() http.Handler {
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/api/v1/budgets", ok).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/api/v1/budgets/{id}", ok).Methods(http.MethodGet, http.MethodPatch, http.MethodDelete)
+	router.HandleFunc("/legacy", ok) // 沒有限制method的舊route
+	cfg := config.CORSConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete},
+		AllowedHeaders:   []string{"Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"X-Request-ID", "Location"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	return Cors(cfg, router)(router)
+}
+
+func preflight(path, origin, method, headers string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	rec := httptest.NewRecorder()
+	corsFixture().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCorsPreflight(t *testing.T) {
+	tests := []struct {
+		path    string
+		methods string
+	}{
+		{"/api/v1/budgets", "GET, POST"},
+		{"/api/v1/budgets/b1", "GET, PATCH, DELETE"},
+		{"/legacy", "GET, POST, PATCH, DELETE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := preflight(tt.path, "https://app.example.com", http.MethodPost, "content-type, X-Evil")
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want 204", rec.Code)
+			}
+			want := map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     tt.methods,
+				"Access-Control-Allow-Headers":     "content-type", // 沒允許的header不回傳
+				"Access-Control-Max-Age":           "600",
+			}
+			for k, v := range want {
+				if got := rec.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			if got, want := rec.Header().Values("Vary"), []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Vary = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCorsRejectedOrigin(t *testing.T) {
+	for _, origin := range []string{"https://example.com", "https://evilexample.com", "http://app.example.com", "https://app.example.com:8443"} {
+		rec := preflight("/api/v1/budgets", origin, http.MethodPost, "")
+		if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: status = %d, allow origin %q, want 403 without CORS headers", origin, rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if got := rec.Header().Values("Vary"); !reflect.DeepEqual(got, []string{"Origin"}) {
+			t.Errorf("%s: Vary = %v, want Origin", origin, got)
+		}
+	}
+}
+
+func TestCorsSimpleRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		allow  string
+	}{
+		{"allowed", "https://app.example.com", "https://app.example.com"},
+		{"not allowed", "https://evil.test", ""},
+		{"no origin", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/budgets", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			corsFixture().ServeHTTP(rec, req)
+			// 不接受的origin一樣會處理，只是沒有CORS header
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Fatalf("allow origin = %q, want %q", got, tt.allow)
+			}
+			if got := rec.Header().Get("Vary"); got != "Origin" {
+				t.Fatalf("Vary = %q, want Origin", got)
+			}
+			exposed := rec.Header().Get("Access-Control-Expose-Headers")
+			if (exposed == "X-Request-ID, Location") != (tt.allow != "") {
+				t.Fatalf("expose headers = %q", exposed)
+			}
+			if rec.Header().Get("Access-Control-Max-Age") != "" || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+				t.Fatal("preflight headers on a simple request")
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+
+	"mongodb-budget/config"
+)
+
+// session cookie是SameSite=None，別的網站的表單也會帶著它送過來，所以會改資料的request都要通過CSRF檢查：
+//  1. 有帶X-CSRF-Token就要跟session裡的token一樣
+//  2. 沒帶token的話，Origin(沒有的話看Referer)要是CORS允許的網域或是同一個host
+// token從GET /csrfToken取得，登入時會換一個新的並放在回應的X-CSRF-Token header
+
+const (
+	csrfHeader     = "X-CSRF-Token"
+	csrfSessionKey = "csrf"
+)
+
+type csrfTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// CSRF origins是CORS允許的網域，"*"不算在內
+func CSRF(cfg config.CSRFConfig, origins []string) func(http.Handler) http.HandlerFunc {
+	var explicit []string
+	for _, o := range origins {
+		if o != "*" {
+			explicit = append(explicit, o)
+		}
+	}
+	trusted := newOriginMatcher(explicit)
+
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if safeMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if token := r.Header.Get(csrfHeader); token != "" {
+				if !validCSRFToken(r, token) {
+					rejectCSRF(w, r, "csrf.tokenInvalid", "")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			origin := requestOrigin(r)
+			if cfg.RequireToken {
+				rejectCSRF(w, r, "csrf.tokenInvalid", origin)
+				return
+			}
+			if origin == "" || !(trusted.match(origin) || sameHost(origin, r)) {
+				rejectCSRF(w, r, "csrf.originRejected", origin)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+func rejectCSRF(w http.ResponseWriter, r *http.Request, key, origin string) {
+	logFor(r).Warn("csrf check failed", "reason", key, "origin", origin)
+	writeError(w, r, CodeForbidden, "", key)
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// requestOrigin 回傳Origin，沒有的話從Referer取出scheme://host
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+	if u, err := url.Parse(r.Referer()); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return ""
+}
+
+func sameHost(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+func validCSRFToken(r *http.Request, token string) bool {
+	session, err := Store.Get(r, sessionConfig.Name)
+	if err != nil {
+		return false
+	}
+	expected, _ := session.Values[csrfSessionKey].(string)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// issueCSRFToken 在session裡放一個新的token，呼叫的人要負責存session
+func issueCSRFToken(w http.ResponseWriter, session *sessions.Session) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Values[csrfSessionKey] = token
+	w.Header().Set(csrfHeader, token)
+	return token
+}
+
+// CSRFToken 回傳目前session的CSRF token，還沒有的話就發一個，沒登入也可以拿
+func CSRFToken(w http.ResponseWriter, r *http.Request) {
+	session, err := Store.Get(r, sessionConfig.Name)
+	if err != nil {
+		// 解不開的舊cookie會被新的session取代
+		logFor(r).Warn("session decode failed, issuing a new one", "err", err)
+	}
+	token, _ := session.Values[csrfSessionKey].(string)
+	if token == "" {
+		token = issueCSRFToken(w, session)
+		maxAge, _ := session.Values["maxAge"].(int)
+		session.Options = sessionOptions(maxAge)
+		if err := session.Save(r, w); err != nil {
+			logFor(r).Error("save session failed", "err", err)
+			writeInternal(w, r, "server.internal")
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, csrfTokenResponse{Token: token})
+}
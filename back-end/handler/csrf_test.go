@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+	"mongodb-budget/config"
+)
+
+const trustedOrigin = "https://app.example.com"
+
+// withCSRFToken 帶著session裡有token的cookie
+func withCSRFToken(t *testing.T, req *http.Request, token string) *http.Request {
+	t.Helper()
+	session, err := Store.New(req, sessionConfig.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values[csrfSessionKey] = token
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestCSRF(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		session      string // session裡的token
+		header       map[string]string
+		requireToken bool
+		key          string // 空字串代表通過
+	}{
+		{"safe method", http.MethodGet, "", nil, true, ""},
+		{"matching token", http.MethodPost, "tok", map[string]string{csrfHeader: "tok"}, false, ""},
+		{"matching token from a foreign origin", http.MethodPost, "tok", map[string]string{csrfHeader: "tok", "Origin": "https://evil.example"}, false, ""},
+		{"wrong token", http.MethodPost, "tok", map[string]string{csrfHeader: "other", "Origin": trustedOrigin}, false, "csrf.tokenInvalid"},
+		{"token without a session", http.MethodDelete, "", map[string]string{csrfHeader: "tok"}, false, "csrf.tokenInvalid"},
+		{"trusted origin", http.MethodPost, "", map[string]string{"Origin": trustedOrigin}, false, ""},
+		{"foreign origin", http.MethodPost, "", map[string]string{"Origin": "https://evil.example"}, false, "csrf.originRejected"},
+		{"same host", http.MethodPatch, "", map[string]string{"Origin": "http://example.com"}, false, ""},
+		{"no origin", http.MethodPost, "", nil, false, "csrf.originRejected"},
+		{"null origin", http.MethodPost, "", map[string]string{"Origin": "null"}, false, "csrf.originRejected"},
+		{"trusted referer", http.MethodPost, "", map[string]string{"Referer": trustedOrigin + "/budgets?x=1"}, false, ""},
+		{"foreign referer", http.MethodPost, "", map[string]string{"Referer": "https://evil.example/app.example.com"}, false, "csrf.originRejected"},
+		{"origin wins over referer", http.MethodPost, "", map[string]string{"Origin": "https://evil.example", "Referer": trustedOrigin + "/"}, false, "csrf.originRejected"},
+		{"require token with a trusted origin", http.MethodPost, "", map[string]string{"Origin": trustedOrigin}, true, "csrf.tokenInvalid"},
+		{"require token with the token", http.MethodPost, "tok", map[string]string{csrfHeader: "tok"}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.CSRFConfig{Enabled: true, RequireToken: tt.requireToken}
+			mw := CSRF(cfg, []string{"*", trustedOrigin})
+			reached := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusNoContent)
+			})
+			req := httptest.NewRequest(tt.method, "http://example.com/api/v1/budgets", nil)
+			if tt.session != "" {
+				req = withCSRFToken(t, req, tt.session)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := serve(mw(next), req)
+			if reached != (tt.key == "") {
+				t.Fatalf("reached = %v, want %v (status %d: %s)", reached, tt.key == "", rec.Code, rec.Body.String())
+			}
+			if tt.key == "" {
+				return
+			}
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403", rec.Code)
+			}
+			if e := decodeError(t, rec); e.Message != T(req, tt.key) {
+				t.Fatalf("message = %q, want %q", e.Message, T(req, tt.key))
+			}
+		})
+	}
+}
+
+// "*"不算是允許的網域，不然任何網站都能送表單過來
+func TestCSRFIgnoresWildcardOrigin(t *testing.T) {
+	mw := CSRF(config.CSRFConfig{Enabled: true}, []string{"*"})
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/api/v1/budgets", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	rec := serve(mw(http.NotFoundHandler()), req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	rec := serve(CSRFToken, httptest.NewRequest(http.MethodGet, "/csrfToken", nil))
+	token := rec.Header().Get(csrfHeader)
+	if rec.Code != http.StatusOK || token == "" || !strings.Contains(rec.Body.String(), token) {
+		t.Fatalf("status = %d, header %q, body %s", rec.Code, token, rec.Body.String())
+	}
+	// 同一個session再拿一次是同一個token
+	req := httptest.NewRequest(http.MethodGet, "/csrfToken", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	again := serve(CSRFToken, req)
+	if !strings.Contains(again.Body.String(), token) || again.Header().Get(csrfHeader) != "" {
+		t.Fatalf("second call = %s, header %q, want the same token without a new one", again.Body.String(), again.Header().Get(csrfHeader))
+	}
+	if !validCSRFToken(req, token) {
+		t.Fatal("issued token does not validate")
+	}
+}
+
+// 登入後換新的token，登入前拿到的就不能用了
+func TestSignInRotatesCSRFToken(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	hash, err := Utils.HashPassword("Passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mongo.Handle("users.find", docs(bson.M{"account": "alice", "password": hash}))
+
+	req := httptest.NewRequest(http.MethodPost, "/signIn", strings.NewReader(`{"account":"alice","password":"Passw0rd"}`))
+	req = withCSRFToken(t, req, "before-sign-in")
+	rec := serve(h.SignIn, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	token := rec.Header().Get(csrfHeader)
+	if token == "" || token == "before-sign-in" {
+		t.Fatalf("token = %q, want a new token", token)
+	}
+
+	next := httptest.NewRequest(http.MethodPost, "/api/v1/budgets", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		next.AddCookie(cookie)
+	}
+	if validCSRFToken(next, "before-sign-in") {
+		t.Fatal("the token from before sign-in still works")
+	}
+	if !validCSRFToken(next, token) {
+		t.Fatal("the new token does not validate")
+	}
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mongodb-budget/DB"
+	"mongodb-budget/metrics"
+)
+
+// 錯誤代碼，client應該用code判斷錯誤種類，不要去比對message字串
+const (
+	CodeInvalidJSON        = "invalid_json"        // body不是合法的JSON
+	CodeValidation         = "validation_failed"   // 欄位檢查沒過，field會指出哪個欄位
+	CodeUnauthenticated    = "unauthenticated"     // 沒登入或session過期，前端要登出
+	CodeInvalidCredentials = "invalid_credentials" // 帳號不存在或密碼錯誤
+	CodeForbidden          = "forbidden"           // 有登入但沒有權限
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict" // 資料已存在，例如帳號或ID重複
+	CodeInternal           = "internal_error"
+	CodeUnavailable        = "service_unavailable" // 資料庫暫時連不上，可以稍後重試
+	CodeTimeout            = "request_timeout"     // 超過這個route的處理時限
+	CodePayloadTooLarge    = "payload_too_large"
+)
+
+// 每個錯誤代碼對應的HTTP status
+var codeStatus = map[string]int{
+	CodeInvalidJSON:        http.StatusBadRequest,
+	CodeValidation:         http.StatusBadRequest,
+	CodeUnauthenticated:    http.StatusUnauthorized,
+	CodeInvalidCredentials: http.StatusUnauthorized,
+	CodeForbidden:          http.StatusForbidden,
+	CodeNotFound:           http.StatusNotFound,
+	CodeConflict:           http.StatusConflict,
+	CodeInternal:           http.StatusInternalServerError,
+	CodeUnavailable:        http.StatusServiceUnavailable,
+	CodeTimeout:            http.StatusServiceUnavailable,
+	CodePayloadTooLarge:    http.StatusRequestEntityTooLarge,
+}
+
+// 資料庫連不上時Retry-After的秒數，Inithandler會換成斷路器的cooldown
+var dbRetryAfter = 10 * time.Second
+
+type APIError struct {
+	Code      string `json:"code"`
+	Field     string `json:"field,omitempty"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestID,omitempty"`
+}
+
+// 所有handler的錯誤回應都是這個格式 {"error": {...}}
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("json encoding failed", "err", err)
+	}
+}
+
+// writeError 依照code決定status，寫出統一格式的錯誤，key是i18n訊息目錄的key
+func writeError(w http.ResponseWriter, r *http.Request, code, field, key string) {
+	status, ok := codeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	logFor(r).Debug("request error", "code", code, "field", field, "key", key)
+	writeJSON(w, status, ErrorResponse{Error: APIError{
+		Code:      code,
+		Field:     field,
+		Message:   T(r, key),
+		RequestID: RequestIDFromContext(r.Context()),
+	}})
+}
+
+// 下面是幾個常用的錯誤
+
+func writeUnauthenticated(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, CodeUnauthenticated, "", "auth.unauthenticated")
+}
+
+// writeInvalidJSON body解不開時呼叫，如果是因為超過BodyLimit就回413
+func writeInvalidJSON(w http.ResponseWriter, r *http.Request) {
+	if bodyTooLarge(r) {
+		writeError(w, r, CodePayloadTooLarge, "", "request.tooLarge")
+		return
+	}
+	writeError(w, r, CodeInvalidJSON, "", "request.invalidJSON")
+}
+
+func writeInternal(w http.ResponseWriter, r *http.Request, key string) {
+	writeError(w, r, CodeInternal, "", key)
+}
+
+// writeDBError 資料庫暫時連不上(斷路器打開、逾時)回503，其他錯誤回500，key是500時的訊息
+func writeDBError(w http.ResponseWriter, r *http.Request, msg string, err error, key string) {
+	// Timeout middleware設定的期限到了，不是資料庫的問題
+	if r.Context().Err() == context.DeadlineExceeded {
+		logFor(r).Warn(msg, "err", err)
+		writeError(w, r, CodeTimeout, "", "request.timeout")
+		return
+	}
+	if DB.IsUnavailable(err) {
+		logFor(r).Warn(msg, "err", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(dbRetryAfter.Seconds())))
+		writeError(w, r, CodeUnavailable, "", "db.unavailable")
+		return
+	}
+	logFor(r).Error(msg, "err", err)
+	writeInternal(w, r, key)
+}
+
+// requireAccount 取得登入的帳號，沒登入就回401
+func requireAccount(w http.ResponseWriter, r *http.Request) (string, bool) {
+	account, err := checkSessionExpiredOrNotExist(r)
+	if err != nil || account == "" {
+		writeUnauthenticated(w, r)
+		return "", false
+	}
+	setLogUser(r, account)
+	metrics.SeenSession(account)
+	return account, true
+}
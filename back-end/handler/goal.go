@@ -0,0 +1,496 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/Utils"
+)
+
+// 儲蓄目標：例如旅行基金、緊急預備金，每次存進去(或領出來)記一筆contribution
+// 進度、預計達成日跟每個月要存多少都是讀取時從存入紀錄算出來的，不另外存
+
+const (
+	maxGoalNameLen = 20
+	avgMonthDays   = 365.2425 / 12
+)
+
+type GoalObject struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	TargetAmount int    `json:"targetAmount"`
+	TargetDate   string `json:"targetDate,omitempty"` // 2006-01-02，空字串代表沒有期限
+	AccountID    string `json:"accountID,omitempty"`  // 錢存在哪個資金帳戶，跟BudgetID只能擇一
+	BudgetID     string `json:"budgetID,omitempty"`   // 從哪個預算撥出來的
+	UserID       string `json:"userID,omitempty"`
+	HouseholdID  string `json:"householdID,omitempty"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	CreatedAt    int    `json:"createdAt"`
+
+	// 以下是算出來的，不會存進資料庫
+	Saved           int     `json:"saved"`
+	Remaining       int     `json:"remaining"`
+	Progress        float64 `json:"progress"` // Saved/TargetAmount，超過目標會大於1
+	Completed       bool    `json:"completed"`
+	MonthlyRate     int     `json:"monthlyRate"`             // 從第一筆存入到今天平均每個月存多少
+	ProjectedDate   string  `json:"projectedDate,omitempty"` // 照目前的速度哪天會達成，已經達成的話是達成那天，存不到的話是空字串
+	RequiredMonthly int     `json:"requiredMonthly"`         // 要在期限前達成每個月還要存多少，沒有期限或已經達成是0
+	OnTrack         bool    `json:"onTrack"`                 // 有期限而且照目前的速度來得及
+}
+
+// GoalPatch TargetDate、AccountID、BudgetID送空字串代表取消
+type GoalPatch struct {
+	Name         *string `json:"name"`
+	TargetAmount *int    `json:"targetAmount"`
+	TargetDate   *string `json:"targetDate"`
+	AccountID    *string `json:"accountID"`
+	BudgetID     *string `json:"budgetID"`
+}
+
+// GoalContribution Amount是負的代表從目標領出來
+type GoalContribution struct {
+	ID          string `json:"id"`
+	GoalID      string `json:"goalID"`
+	Amount      int    `json:"amount"`
+	Date        int    `json:"date"` // 跟花費一樣，秒或毫秒都可以，沒給就是現在，不能晚於今天
+	Note        string `json:"note"`
+	UserID      string `json:"userID,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+func validateGoal(data GoalObject) (string, string) {
+	if strings.TrimSpace(data.Name) == "" {
+		return "name", "goal.nameRequired"
+	}
+	if len([]rune(strings.TrimSpace(data.Name))) > maxGoalNameLen {
+		return "name", "goal.nameTooLong"
+	}
+	if data.TargetAmount <= 0 {
+		return "targetAmount", "goal.targetInvalid"
+	}
+	if data.TargetDate != "" {
+		if _, err := time.Parse(Utils.DayLayout, data.TargetDate); err != nil {
+			return "targetDate", "goal.targetDateInvalid"
+		}
+	}
+	if data.AccountID != "" && data.BudgetID != "" {
+		return "budgetID", "goal.linkConflict"
+	}
+	return "", ""
+}
+
+// monthsBetween 兩個時間之間差幾個月，用平均每個月的天數算，可以有小數
+func monthsBetween(from, to time.Time) float64 {
+	return to.Sub(from).Hours() / 24 / avgMonthDays
+}
+
+// progress 從存入紀錄算出進度跟預估，contributions不用排序
+func (g *GoalObject) progress(contributions []GoalContribution, loc *time.Location, now time.Time) {
+	sort.SliceStable(contributions, func(i, j int) bool {
+		return Utils.UnixToTime(contributions[i].Date).Before(Utils.UnixToTime(contributions[j].Date))
+	})
+	g.Saved, g.ProjectedDate = 0, ""
+	for _, c := range contributions {
+		g.Saved += c.Amount
+		// 領出來之後又沒達成的話，要重新算達成日
+		if g.Saved >= g.TargetAmount && g.ProjectedDate == "" {
+			g.ProjectedDate = Utils.LocalDay(c.Date, loc)
+		} else if g.Saved < g.TargetAmount {
+			g.ProjectedDate = ""
+		}
+	}
+	g.Remaining = max(g.TargetAmount-g.Saved, 0)
+	g.Progress = math.Round(float64(g.Saved)/float64(g.TargetAmount)*1000) / 1000
+	g.Completed = g.Saved >= g.TargetAmount
+	g.MonthlyRate, g.RequiredMonthly, g.OnTrack = 0, 0, false
+
+	today := Utils.StartOfDay(now, loc)
+	if len(contributions) > 0 {
+		// 不到一個月的話當成一個月，不然第一天存的會被放大
+		months := max(monthsBetween(Utils.StartOfDay(Utils.UnixToTime(contributions[0].Date), loc), today), 1)
+		rate := float64(g.Saved) / months
+		g.MonthlyRate = int(math.Round(rate))
+		if !g.Completed && rate > 0 {
+			days := float64(g.Remaining) / rate * avgMonthDays
+			g.ProjectedDate = today.AddDate(0, 0, int(math.Ceil(days))).Format(Utils.DayLayout)
+		}
+	}
+	if g.TargetDate == "" {
+		return
+	}
+	if !g.Completed {
+		deadline, err := Utils.ParseDay(g.TargetDate, loc)
+		if err != nil {
+			return
+		}
+		// 期限已經過了或不到一個月的話，剩下的這個月就要存完
+		months := max(monthsBetween(today, deadline), 1)
+		g.RequiredMonthly = int(math.Ceil(float64(g.Remaining) / months))
+	}
+	g.OnTrack = g.ProjectedDate != "" && g.ProjectedDate <= g.TargetDate
+}
+
+// checkGoalLinks 連結的帳戶跟預算要在同一個範圍，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkGoalLinks(w http.ResponseWriter, r *http.Request, sc scope, accountID, budgetID string) bool {
+	if accountID != "" {
+		if _, ok := h.checkAccountLink(w, r, sc, "accountID", accountID); !ok {
+			return false
+		}
+	}
+	if budgetID != "" {
+		exists, err := h.budgetExists(r, sc, budgetID)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return false
+		}
+		if !exists {
+			writeError(w, r, CodeValidation, "budgetID", "budget.notFound")
+			return false
+		}
+	}
+	return true
+}
+
+// withProgress 幫目標填上進度，一次把所有存入紀錄讀出來再依照目標分開
+func (h *handlerWithDB) withProgress(r *http.Request, sc scope, goals []GoalObject) error {
+	if len(goals) == 0 {
+		return nil
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(goals))
+	for i, g := range goals {
+		ids[i] = g.ID
+	}
+	var contributions []GoalContribution
+	cursor, err := h.CColl.Find(r.Context(), sc.filter(bson.M{"goalID": bson.M{"$in": ids}}),
+		options.Find().SetProjection(bson.M{"goalID": 1, "amount": 1, "date": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &contributions)
+	}
+	if err != nil {
+		return err
+	}
+	byGoal := map[string][]GoalContribution{}
+	for _, c := range contributions {
+		byGoal[c.GoalID] = append(byGoal[c.GoalID], c)
+	}
+	now := time.Now()
+	for i := range goals {
+		goals[i].progress(byGoal[goals[i].ID], loc, now)
+	}
+	return nil
+}
+
+func (h *handlerWithDB) findGoal(r *http.Request, sc scope, id string) (GoalObject, error) {
+	var goal GoalObject
+	err := h.GColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&goal)
+	return goal, err
+}
+
+// writeGoal 算好進度後回覆
+func (h *handlerWithDB) writeGoal(w http.ResponseWriter, r *http.Request, sc scope, status int, goal GoalObject) {
+	goals := []GoalObject{goal}
+	if err := h.withProgress(r, sc, goals); err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	writeJSON(w, status, goals[0])
+}
+
+// goalFor 讀取網址上的目標，找不到的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) goalFor(w http.ResponseWriter, r *http.Request, sc scope) (GoalObject, bool) {
+	goal, err := h.findGoal(r, sc, mux.Vars(r)["id"])
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, CodeNotFound, "id", "goal.notFound")
+		return goal, false
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return goal, false
+	}
+	return goal, true
+}
+
+func (h *handlerWithDB) ListGoals() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		data := []GoalObject{}
+		cursor, err := h.GColl.Find(r.Context(), sc.filter(nil), options.Find().SetSort(bson.M{"createdAt": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err == nil {
+			err = h.withProgress(r, sc, data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostGoal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data GoalObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if field, msg := validateGoal(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if !h.checkGoalLinks(w, r, sc, data.AccountID, data.BudgetID) {
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.Name = strings.TrimSpace(data.Name)
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		data.CreatedAt = int(time.Now().Unix())
+		doc := sc.owned(bson.M{"id": data.ID, "name": data.Name, "targetAmount": data.TargetAmount,
+			"createdBy": sc.account, "createdAt": data.CreatedAt})
+		for field, value := range map[string]string{"targetDate": data.TargetDate, "accountID": data.AccountID, "budgetID": data.BudgetID} {
+			if value != "" {
+				doc[field] = value
+			}
+		}
+		if _, err := h.GColl.InsertOne(r.Context(), doc); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/goals/"+data.ID)
+		h.writeGoal(w, r, sc, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) GetGoal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		goal, ok := h.goalFor(w, r, sc)
+		if !ok {
+			return
+		}
+		h.writeGoal(w, r, sc, http.StatusOK, goal)
+	}
+}
+
+func (h *handlerWithDB) PatchGoal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var patch GoalPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		current, ok := h.goalFor(w, r, sc)
+		if !ok {
+			return
+		}
+
+		set, unset := bson.M{}, bson.M{}
+		if patch.Name != nil {
+			current.Name = strings.TrimSpace(*patch.Name)
+			set["name"] = current.Name
+		}
+		if patch.TargetAmount != nil {
+			current.TargetAmount = *patch.TargetAmount
+			set["targetAmount"] = current.TargetAmount
+		}
+		// 可以取消的欄位，空字串就從資料庫移除
+		optional := []struct {
+			field string
+			patch *string
+			value *string
+		}{
+			{"targetDate", patch.TargetDate, &current.TargetDate},
+			{"accountID", patch.AccountID, &current.AccountID},
+			{"budgetID", patch.BudgetID, &current.BudgetID},
+		}
+		for _, o := range optional {
+			if o.patch == nil {
+				continue
+			}
+			*o.value = *o.patch
+			if *o.value == "" {
+				unset[o.field] = ""
+			} else {
+				set[o.field] = *o.value
+			}
+		}
+		if field, msg := validateGoal(current); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		// 只檢查有換的連結，原本連著已經封存的帳戶不影響改其他欄位
+		var accountID, budgetID string
+		if set["accountID"] != nil {
+			accountID = current.AccountID
+		}
+		if set["budgetID"] != nil {
+			budgetID = current.BudgetID
+		}
+		if !h.checkGoalLinks(w, r, sc, accountID, budgetID) {
+			return
+		}
+		if update := updateDoc(set, unset); len(update) > 0 {
+			if _, err := h.GColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": current.ID}), update); err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		h.writeGoal(w, r, sc, http.StatusOK, current)
+	}
+}
+
+// RemoveGoal 存入紀錄一起刪掉，錢本身還在帳戶裡
+func (h *handlerWithDB) RemoveGoal() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		res, err := h.GColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": id}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "goal.notFound")
+			return
+		}
+		if _, err := h.CColl.DeleteMany(r.Context(), sc.filter(bson.M{"goalID": id})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListContributions 新的在前
+func (h *handlerWithDB) ListContributions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		goal, ok := h.goalFor(w, r, sc)
+		if !ok {
+			return
+		}
+		data := []GoalContribution{}
+		cursor, err := h.CColl.Find(r.Context(), sc.filter(bson.M{"goalID": goal.ID}), options.Find().SetSort(bson.M{"date": -1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostContribution() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data GoalContribution
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if data.Amount == 0 {
+			writeError(w, r, CodeValidation, "amount", "contribution.amountInvalid")
+			return
+		}
+		if data.Date < 0 {
+			writeError(w, r, CodeValidation, "date", "expense.dateInvalid")
+			return
+		}
+		goal, ok := h.goalFor(w, r, sc)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		if data.Date == 0 {
+			data.Date = int(now.Unix())
+		}
+		// 未來的存入會讓平均速度算錯，只看日期，今天稍晚的時間還是可以
+		loc, err := h.userLocation(r.Context(), sc.account)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if Utils.LocalDay(data.Date, loc) > now.In(loc).Format(Utils.DayLayout) {
+			writeError(w, r, CodeValidation, "date", "contribution.dateInFuture")
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.GoalID = goal.ID
+		data.Note = strings.TrimSpace(data.Note)
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		_, err = h.CColl.InsertOne(r.Context(), sc.owned(bson.M{"id": data.ID, "goalID": data.GoalID,
+			"amount": data.Amount, "date": data.Date, "note": data.Note, "createdBy": sc.account}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/goals/"+goal.ID+"/contributions/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) RemoveContribution() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		res, err := h.CColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": vars["contributionID"], "goalID": vars["id"]}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "contributionID", "contribution.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
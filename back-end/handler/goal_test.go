@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+)
+
+func contribution(amount int, date time.Time) GoalContribution {
+	return GoalContribution{Amount: amount, Date: int(date.Unix())}
+}
+
+func TestGoalProgress(t *testing.T) {
+	loc := mustLocation(t, Utils.DefaultTimeZone)
+	now := taipei(2024, 3, 10, 15)
+	tests := []struct {
+		name          string
+		goal          GoalObject
+		contributions []GoalContribution
+		saved         int
+		completed     bool
+		monthlyRate   int
+		projected     string
+		required      int
+		onTrack       bool
+	}{
+		{
+			name:  "nothing saved",
+			goal:  GoalObject{TargetAmount: 1000, TargetDate: "2024-06-10"},
+			saved: 0, required: 331,
+		},
+		{
+			// 不到一個月當成一個月，預計 3/10 + ceil(700/300個月) = 5/21
+			name:          "less than a month of history",
+			goal:          GoalObject{TargetAmount: 1000},
+			contributions: []GoalContribution{contribution(300, taipei(2024, 3, 1, 9))},
+			saved:         300, monthlyRate: 300, projected: "2024-05-21",
+		},
+		{
+			name:          "reached on the day of the last contribution",
+			goal:          GoalObject{TargetAmount: 1000, TargetDate: "2024-01-31"},
+			contributions: []GoalContribution{contribution(600, taipei(2024, 2, 1, 23)), contribution(500, taipei(2024, 1, 1, 9))},
+			saved:         1100, completed: true, monthlyRate: 485, projected: "2024-02-01", onTrack: false,
+		},
+		{
+			name: "withdrawal below the target",
+			goal: GoalObject{TargetAmount: 1000},
+			contributions: []GoalContribution{
+				contribution(1000, taipei(2024, 1, 10, 9)), contribution(-400, taipei(2024, 2, 10, 9)),
+			},
+			// 兩個月存了600，剩下的400照這個速度大約要40天
+			saved: 600, monthlyRate: 304, projected: "2024-04-19",
+		},
+		{
+			name: "reached again after a withdrawal",
+			goal: GoalObject{TargetAmount: 1000},
+			contributions: []GoalContribution{
+				contribution(1000, taipei(2024, 1, 10, 9)), contribution(-400, taipei(2024, 2, 10, 9)), contribution(500, taipei(2024, 3, 1, 9)),
+			},
+			saved: 1100, completed: true, monthlyRate: 558, projected: "2024-03-01",
+		},
+		{
+			name:          "target date passed",
+			goal:          GoalObject{TargetAmount: 1000, TargetDate: "2024-01-31"},
+			contributions: []GoalContribution{contribution(300, taipei(2024, 3, 1, 9))},
+			saved:         300, monthlyRate: 300, projected: "2024-05-21", required: 700,
+		},
+		{
+			name:          "target date in three months",
+			goal:          GoalObject{TargetAmount: 1000, TargetDate: "2024-06-10"},
+			contributions: []GoalContribution{contribution(300, taipei(2024, 3, 1, 9))},
+			saved:         300, monthlyRate: 300, projected: "2024-05-21", required: 232, onTrack: true,
+		},
+		{
+			name:          "target date before the projection",
+			goal:          GoalObject{TargetAmount: 1000, TargetDate: "2024-04-10"},
+			contributions: []GoalContribution{contribution(300, taipei(2024, 3, 1, 9))},
+			saved:         300, monthlyRate: 300, projected: "2024-05-21", required: 688,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := tt.goal
+			g.progress(tt.contributions, loc, now)
+			got := fmt.Sprintf("saved %d, completed %v, rate %d, projected %q, required %d, on track %v",
+				g.Saved, g.Completed, g.MonthlyRate, g.ProjectedDate, g.RequiredMonthly, g.OnTrack)
+			want := fmt.Sprintf("saved %d, completed %v, rate %d, projected %q, required %d, on track %v",
+				tt.saved, tt.completed, tt.monthlyRate, tt.projected, tt.required, tt.onTrack)
+			if got != want {
+				t.Fatalf("progress = %s\nwant %s", got, want)
+			}
+			if g.Remaining != max(g.TargetAmount-g.Saved, 0) {
+				t.Fatalf("remaining = %d", g.Remaining)
+			}
+		})
+	}
+}
+
+func TestPostContributionDate(t *testing.T) {
+	loc := mustLocation(t, Utils.DefaultTimeZone)
+	now := time.Now()
+	tomorrow := Utils.StartOfDay(now, loc).AddDate(0, 0, 1)
+	tests := []struct {
+		name   string
+		date   int64
+		status int
+	}{
+		{"now", 0, http.StatusCreated},
+		{"yesterday", now.AddDate(0, 0, -1).UnixMilli(), http.StatusCreated},
+		{"end of today", tomorrow.Add(-time.Second).Unix(), http.StatusCreated},
+		{"tomorrow", tomorrow.Unix(), http.StatusBadRequest},
+		{"tomorrow in milliseconds", tomorrow.UnixMilli(), http.StatusBadRequest},
+		{"next year", now.AddDate(1, 0, 0).Unix(), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := newTestHandler(t)
+			mongo.Handle("goals.find", docs(bson.M{"id": "g1", "name": "trip", "targetAmount": 1000}))
+			var mu sync.Mutex
+			inserted := false
+			mongo.Handle("goalContributions.insert", func(bson.Raw) []any {
+				mu.Lock()
+				defer mu.Unlock()
+				inserted = true
+				return nil
+			})
+			body := fmt.Sprintf(`{"amount":100,"date":%d}`, tt.date)
+			req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/goals/g1/contributions", strings.NewReader(body)),
+				"alice", map[string]string{"id": "g1"})
+			rec := serve(h.PostContribution(), req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if inserted != (tt.status == http.StatusCreated) {
+				t.Fatalf("inserted = %v", inserted)
+			}
+			if tt.status == http.StatusBadRequest {
+				if e := decodeError(t, rec); e.Field != "date" || e.Message != T(req, "contribution.dateInFuture") {
+					t.Fatalf("error = %+v", e)
+				}
+			}
+		})
+	}
+}
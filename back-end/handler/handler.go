@@ -1,34 +1,55 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"mongodb-budget/DB"
 	"net/http"
-	"os"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gorilla/sessions"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"mongodb-budget/Utils"
+	"mongodb-budget/config"
+	"mongodb-budget/metrics"
 )
 
 // var Store *sessions.CookieStore = sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
-var Store *sessions.CookieStore = sessions.NewCookieStore([]byte("is-my-secret-key"), []byte("is-my-secret-key"))
+var Store *sessions.CookieStore = sessions.NewCookieStore([]byte(config.DevSessionKey), []byte(config.DevSessionKey))
+
+// session cookie的名稱跟屬性，Inithandler會換成設定檔的值
+var sessionConfig = config.Default().Session
 
 type handlerWithDB struct {
-	DB    *mongo.Client
-	UColl *mongo.Collection // 儲存collection，這樣就不用每次都重找一次 users
-	BColl *mongo.Collection // budgets collection
-	EColl *mongo.Collection // expenses collection
+	DB      *mongo.Client
+	UColl   *DB.Collection // 儲存collection，這樣就不用每次都重找一次 users
+	BColl   *DB.Collection // budgets collection
+	EColl   *DB.Collection // expenses collection
+	HColl   *DB.Collection // households collection
+	SColl   *DB.Collection // settlements collection，分帳的還款紀錄
+	IColl   *DB.Collection // incomes collection
+	RColl   *DB.Collection // recurringIncomes collection，固定收入
+	AColl   *DB.Collection // accounts collection，資金帳戶(現金、信用卡等)
+	TColl   *DB.Collection // transfers collection，帳戶之間的轉帳
+	StColl  *DB.Collection // statements collection，上傳的對帳單
+	GColl   *DB.Collection // goals collection，儲蓄目標
+	CColl   *DB.Collection // goalContributions collection，存進儲蓄目標的紀錄
+	RuColl  *DB.Collection // rules collection，自動分類花費的規則
+	breaker *DB.Breaker    // 所有collection共用，資料庫掛掉時直接回503
+
+	draining *atomic.Bool // 關機中，/readyz回503讓load balancer不再送request過來
 }
 
 type isLoggedInResponse struct {
 	IsLoggedIn bool `json:"isLoggedIn"`
 	UserName string `json:"userName"`
+	TimeZone string `json:"timeZone"`
 }
 
 type signUpResponse struct {
@@ -44,7 +65,7 @@ type signInResponse struct {
 	Msg    string `json:"msg"`
 }
 
-// 這是給budget/expense CRUD統一用來回報錯誤或提示成功的
+// 這是給budget/expense CRUD提示成功的，錯誤統一用ErrorResponse
 type CRUDResponse struct {
 	LogIn bool   `json:"logIn"`
 	Msg   string `json:"msg"`
@@ -55,6 +76,8 @@ type UserObject struct {
 	Name     string `json:"name"`
 	Account  string `json:"account"`
 	Password string `json:"password"`
+	TimeZone string `json:"timeZone"` // IANA時區名稱 例如Asia/Taipei，用來決定使用者的"一天"
+	Locale   string `json:"locale"`   // 偏好的語言，空字串代表跟著瀏覽器的Accept-Language
 }
 
 // this is for the sign in
@@ -64,20 +87,40 @@ type SignInObject struct {
 	Check    bool   `json:"check"`
 }
 
-type BudgetObject struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Max    int    `json:"max"`
-	UserID string `json:"userID"`
+// LogValue 寫log時不要帶出密碼(或密碼的hash)
+func (u UserObject) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("name", u.Name), slog.String("account", u.Account), slog.String("timeZone", u.TimeZone))
 }
 
-type ExpenseObject struct {
+func (s SignInObject) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("account", s.Account), slog.Bool("check", s.Check))
+}
+
+type BudgetObject struct {
 	ID          string `json:"id"`
-	BudgetID    string `json:"budgetID"`
-	Description string `json:"description"`
-	Amount      int    `json:"amount"`
-	Date        int    `json:"date"` // 單位是秒 所以是int
+	Name        string `json:"name"`
+	Max         int    `json:"max"`
 	UserID      string `json:"userID"`
+	HouseholdID string `json:"householdID,omitempty"` // 家庭的預算才有，這時候沒有userID
+	ParentID    string `json:"parentID,omitempty"`    // 上層預算，沒有的話就是最上層
+	MaxMode     string `json:"maxMode,omitempty"`     // own或children，舊資料沒有，當成own
+}
+
+type ExpenseObject struct {
+	ID           string        `json:"id"`
+	BudgetID     string        `json:"budgetID"`
+	Description  string        `json:"description"`
+	Amount       int           `json:"amount"`
+	Date         int           `json:"date"` // 單位是秒 所以是int
+	UserID       string        `json:"userID"`
+	HouseholdID  string        `json:"householdID,omitempty"`
+	CreatedBy    string        `json:"createdBy,omitempty"`    // 新增這筆花費的帳號，舊資料沒有
+	Split        *ExpenseSplit `json:"split,omitempty"`        // 分帳，沒有的話就是自己付自己的
+	AccountID    string        `json:"accountID,omitempty"`    // 從哪個資金帳戶付的
+	ReconciledIn string        `json:"reconciledIn,omitempty"` // 對帳鎖定時配對到的對帳單，有的話不能改也不能刪
+	Tags         []string      `json:"tags,omitempty"`         // 標籤，可以跨預算統計
+	// Allocations 分到好幾個預算時每個預算的金額，加起來等於Amount，BudgetID是第一行的預算
+	Allocations []BudgetAllocation `json:"allocations,omitempty"`
 }
 
 type UpdateBudgetObject struct {
@@ -91,6 +134,7 @@ type UpdateExpenseObject struct {
 	ID          string
 	Description string
 	Amount      int
+	Date        int // 0代表不更新日期
 }
 
 type DeleteBudgetObject struct {
@@ -101,72 +145,51 @@ type DeleteExpenseObject struct {
 	ExpenseID string
 }
 
-// 一次連接只能開一個CORS，所以這邊列出所有可以接受的網址
-var allowedOrigins = []string{
-    "http://localhost:3000",
-    os.Getenv("budget-manager-front-end-url"),
-}
-
-// middleware for Cors issue
-func Cors(next http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 取得該連接的網址
-		origin := r.Header.Get("Origin")
-
-        // Check if the Origin is in the allowedOrigins list
-        for _, o := range allowedOrigins {
-            if o == origin {
-                w.Header().Set("Access-Control-Allow-Origin", o)
-                break
-            }
-        }
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		// 如果要讓fetch request去挾帶cookie就要設定這個
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
+func Inithandler(ctx context.Context, cfg config.Config) (handlerWithDB, error) {
+	sessionConfig = cfg.Session
+	keys := [][]byte{[]byte(cfg.Session.AuthKey)}
+	if cfg.Session.EncryptionKey != "" {
+		keys = append(keys, []byte(cfg.Session.EncryptionKey))
 	}
-}
-
-// middleware to print out path name
-func PrintPath(next http.Handler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("enter path: %s\n", r.URL.Path)
-
-		next.ServeHTTP(w, r)
-	}
-}
+	Store = sessions.NewCookieStore(keys...)
+	dbRetryAfter = cfg.Database.BreakerCooldown
 
-func Inithandler() handlerWithDB {
-	DB := DB.InitDB()
-
-	h := handlerWithDB{DB: DB}
-	h.UColl = DB.Database("budget-typescript").Collection("users")
-	h.BColl = DB.Database("budget-typescript").Collection("budgets")
-	h.EColl = DB.Database("budget-typescript").Collection("expenses")
-
-	return h
+	client, err := DB.InitDB(ctx, cfg.Database)
+	if err != nil {
+		return handlerWithDB{}, err
+	}
+
+	h := handlerWithDB{DB: client, draining: &atomic.Bool{}}
+	h.breaker = DB.NewBreaker(cfg.Database.BreakerThreshold, cfg.Database.BreakerCooldown)
+	collection := func(name string) *DB.Collection {
+		return DB.NewCollection(client.Database(cfg.Database.Name).Collection(name), cfg.Database.OperationTimeout, h.breaker)
+	}
+	h.UColl = collection("users")
+	h.BColl = collection("budgets")
+	h.EColl = collection("expenses")
+	h.HColl = collection("households")
+	h.SColl = collection("settlements")
+	h.IColl = collection("incomes")
+	h.RColl = collection("recurringIncomes")
+	h.AColl = collection("accounts")
+	h.TColl = collection("transfers")
+	h.StColl = collection("statements")
+	h.GColl = collection("goals")
+	h.CColl = collection("goalContributions")
+	h.RuColl = collection("rules")
+
+	return h, nil
 }
 
 // just a testing endpoint
 func (h *handlerWithDB) Home() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		session, err := Store.Get(r, "SID")
+		session, err := Store.Get(r, sessionConfig.Name)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeUnauthenticated(w, r)
 			return
 		}
-		fmt.Println("is session new?", session.IsNew)
-		if !session.IsNew {
-			fmt.Println(session.Values)
-		}
 		session.Values["password"] = "123"
 		session.Save(r, w)
 		json.NewEncoder(w).Encode("Hello World")
@@ -175,9 +198,9 @@ func (h *handlerWithDB) Home() http.HandlerFunc {
 
 // 因為沒用到db，所以不用變成h的member function
 func LogOut(w http.ResponseWriter, r *http.Request) {
-	session, err := Store.Get(r, "SID")
+	session, err := Store.Get(r, sessionConfig.Name)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeUnauthenticated(w, r)
 		return
 	}
 
@@ -195,20 +218,44 @@ func LogOut(w http.ResponseWriter, r *http.Request) {
 	// Save session to update client's cookie
 	err = session.Save(r, w)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logFor(r).Error("save session failed", "err", err)
+		writeInternal(w, r, "logOut.failed")
 		return
 	}
-	fmt.Println("Log Out")
+	logFor(r).Info("user signed out")
+}
+
+// sessionOptions 登入時發行的session cookie設定，maxAge是0代表關掉瀏覽器就失效
+func sessionOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     sessionConfig.Path,
+		Domain:   sessionConfig.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: sessionConfig.HttpOnly,
+		// 預設是None，確保可以接受corss-site cookie
+		SameSite: sameSiteMode(sessionConfig.SameSite),
+		Secure:   sessionConfig.Secure, // Set to true if served over HTTPS
+	}
+}
+
+func sameSiteMode(s string) http.SameSite {
+	switch s {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
 }
 
 func checkSessionExpiredOrNotExist(r *http.Request) (string, error) {
-	session, err := Store.Get(r, "SID")
+	session, err := Store.Get(r, sessionConfig.Name)
 	if err != nil {
-		fmt.Println("session decode error in checkSessionExpiredOrNotExist", err.Error())
+		logFor(r).Warn("session decode failed", "err", err)
 		return "", err
 	}
-	fmt.Println("session.Values:", session.Values)
-	fmt.Println("check session checkSessionExpiredOrNotExist", session.IsNew)
 	if session.Values["account"] == nil {
 		return "", nil
 	}
@@ -217,25 +264,21 @@ func checkSessionExpiredOrNotExist(r *http.Request) (string, error) {
 
 func (h *handlerWithDB) IsLoggedIn(w http.ResponseWriter, r *http.Request) {
 	userAccount, err := checkSessionExpiredOrNotExist(r)
-	fmt.Println("userAccount:", userAccount)
 	if err != nil {
-		fmt.Println("error ouccrs in isLoggedIn", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeUnauthenticated(w, r)
 		return
 	}
-	w.Header().Set("Cotent-Type", "application/json")
 	response := isLoggedInResponse{}
 	if userAccount != "" {
 		res := h.UColl.FindOne(r.Context(), bson.M{"account": userAccount})
 		if res.Err() != nil {
 			// 如果是除了ErrNoDocuments的其他錯誤就直接報錯
 			if res.Err() != mongo.ErrNoDocuments {
-				http.Error(w, res.Err().Error(), http.StatusInternalServerError)
-				fmt.Println("database findOne error", res.Err().Error())
+				writeDBError(w, r, "find user failed", res.Err(), "db.readFailed")
 				return
 			} else {
 				// 報ErrNoDocuments代表查無此帳號
-				json.NewEncoder(w).Encode(&response)
+				writeJSON(w, http.StatusOK, &response)
 				return
 			}
 		}
@@ -243,54 +286,57 @@ func (h *handlerWithDB) IsLoggedIn(w http.ResponseWriter, r *http.Request) {
 		var user UserObject
 		err = res.Decode(&user)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Println("database decode error", err.Error())
+			writeDBError(w, r, "decode user failed", err, "db.readFailed")
 			return
 		}
-		response = isLoggedInResponse{IsLoggedIn: true, UserName: user.Name}
-	} 
-	fmt.Println("response from IsLoggedIn:", response)
-	json.NewEncoder(w).Encode(&response)
+		if user.TimeZone == "" {
+			user.TimeZone = Utils.DefaultTimeZone
+		}
+		response = isLoggedInResponse{IsLoggedIn: true, UserName: user.Name, TimeZone: user.TimeZone}
+	}
+	writeJSON(w, http.StatusOK, &response)
+}
+
+// validatePassword 註冊跟登入共用的密碼格式檢查
+func validatePassword(password string) string {
+	if password == "" {
+		return "password.required"
+	}
+	if Utils.ContainsNonEnglishOrNumber(password) {
+		return "password.invalidChars"
+	}
+	if !Utils.ContainsLowerUpperCaseAndNumber(password) {
+		return "password.weak"
+	}
+	return ""
 }
 
 func (h *handlerWithDB) SignUp(w http.ResponseWriter, r *http.Request) {
 
-	fmt.Println("call SignUp")
 	var data UserObject
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("decode error", err)
+		logFor(r).Debug("invalid JSON body", "err", err)
+		writeInvalidJSON(w, r)
 		return
 	}
 
-	fmt.Println("data received", data)
-	w.Header().Set("Content-Type", "application/json")
-	// 預設出錯 成功的話再改就好
-	var response signUpResponse = signUpResponse{Type: false}
 
 	// 檢查註冊資料是否有誤
 	// 名稱為空白
 	if data.Name == "" {
-		response.Target = "name"
-		response.Msg = "名稱不得為空"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeValidation, "name", "name.required")
 		return
 	}
 	// 名稱超過10個字
 	if len([]rune(data.Name)) > 10 {
-		response.Target = "name"
-		response.Msg = "名稱不得多於10個字"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeValidation, "name", "name.tooLong")
 		return
 	}
-	fmt.Println("name is valid")
 
 	// 帳號為空白
 	if data.Account == "" {
-		response.Target = "account"
-		response.Msg = "帳號不得為空"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeValidation, "account", "account.required")
 		return
 	}
 	// 帳號重複
@@ -298,98 +344,74 @@ func (h *handlerWithDB) SignUp(w http.ResponseWriter, r *http.Request) {
 	if res.Err() != nil {
 		// 如果是除了ErrNoDocuments的其他錯誤就直接報錯
 		if res.Err() != mongo.ErrNoDocuments {
-			http.Error(w, res.Err().Error(), http.StatusInternalServerError)
-			fmt.Println("database findOne error", res.Err().Error())
+			writeDBError(w, r, "find user failed", res.Err(), "db.readFailed")
 			return
 		}
 	} else {
 		// 沒報錯就代表有找到，也就是帳號重複了
-		response.Target = "account"
-		response.Msg = "帳號已被取用 請換一個"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeConflict, "account", "account.taken")
 		return
 	}
-	fmt.Println("account is valid")
 
 	// 檢查密碼
-	if data.Password == "" {
-		response.Target = "password"
-		response.Msg = "密碼不得為空"
-		json.NewEncoder(w).Encode(&response)
+	if msg := validatePassword(data.Password); msg != "" {
+		writeError(w, r, CodeValidation, "password", msg)
 		return
 	}
 
-	if Utils.ContainsNonEnglishOrNumber(data.Password) {
-		response.Target = "password"
-		response.Msg = "密碼只能包含英文字母和數字"
-		json.NewEncoder(w).Encode(&response)
-		return
+	// 時區可以不填，不填就用預設時區
+	if data.TimeZone == "" {
+		data.TimeZone = Utils.DefaultTimeZone
 	}
-
-	if !Utils.ContainsLowerUpperCaseAndNumber(data.Password) {
-		response.Target = "password"
-		response.Msg = "密碼必須包含至少一個大寫、小寫英文字母和數字"
-		json.NewEncoder(w).Encode(&response)
+	if _, err := Utils.LoadLocation(data.TimeZone); err != nil {
+		writeError(w, r, CodeValidation, "timeZone", "timeZone.invalid")
 		return
 	}
-	fmt.Println("password is valid")
 
 	// hash the password
 	data.Password, err = Utils.HashPassword(data.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("hash password error", err)
+		logFor(r).Error("hash password failed", "err", err)
+		writeInternal(w, r, "signUp.failed")
 		return
 	}
 
 	//store user into the database
-	insertedRow, err := h.UColl.InsertOne(r.Context(), data)
+	_, err = h.UColl.InsertOne(r.Context(), data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("insertOne error", err)
+		writeDBError(w, r, "insert user failed", err, "db.writeFailed")
 		return
 	}
-	fmt.Println("New User, inserted data id", insertedRow.InsertedID)
+	logFor(r).Info("user signed up", "account", data.Account)
+	metrics.Signups.Inc()
 
 	// store a default budget into the database
 	// 這裡要跟前端溝通好default budget的名稱跟ID，我都是用"其他"
-	insertedRow, err = h.BColl.InsertOne(r.Context(), bson.M{"id": "其他", "name": "其他", "max": 0, "userID": data.Account})
+	_, err = h.BColl.InsertOne(r.Context(), bson.M{"id": "其他", "name": "其他", "max": 0, "userID": data.Account})
 	if err != nil {
-		fmt.Println("default budget insertOne error", err)
+		writeDBError(w, r, "insert default budget failed", err, "db.writeFailed")
 		return
 	}
-	fmt.Println("New default budget, inserted data id", insertedRow.InsertedID)
 
 	// set success response
-	response.Type = true
-	response.Msg = "註冊成功!"
-
-	json.NewEncoder(w).Encode(&response)
-
+	writeJSON(w, http.StatusOK, &signUpResponse{Type: true, Msg: T(r, "signUp.success")})
 }
 
 func (h *handlerWithDB) SignIn(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("call SignIn")
 	var data SignInObject
 	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("decode error", err)
+		logFor(r).Debug("invalid JSON body", "err", err)
+		writeInvalidJSON(w, r)
 		return
 	}
 
-	fmt.Println("data received", data)
-	w.Header().Set("Content-Type", "application/json")
-	// 預設出錯 成功的話再改就好
-	var response signInResponse = signInResponse{Type: false}
 
 	// 檢查登入資料格式是否有誤
 
 	// 帳號為空白
 	if data.Account == "" {
-		response.Target = "account"
-		response.Msg = "帳號不得為空"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeValidation, "account", "account.required")
 		return
 	}
 
@@ -398,612 +420,480 @@ func (h *handlerWithDB) SignIn(w http.ResponseWriter, r *http.Request) {
 	if res.Err() != nil {
 		// 如果是除了ErrNoDocuments的其他錯誤就直接報錯
 		if res.Err() != mongo.ErrNoDocuments {
-			http.Error(w, res.Err().Error(), http.StatusInternalServerError)
-			fmt.Println("database findOne error", res.Err().Error())
+			writeDBError(w, r, "find user failed", res.Err(), "db.readFailed")
 			return
 		} else {
 			// 報ErrNoDocuments代表查無此帳號
-			response.Target = "account"
-			response.Msg = "查無此帳號 請重新輸入"
-			json.NewEncoder(w).Encode(&response)
+			writeError(w, r, CodeInvalidCredentials, "account", "account.notFound")
 			return
 		}
 	}
-	fmt.Println("account is valid")
 
 	// 檢查密碼
-	if data.Password == "" {
-		response.Target = "password"
-		response.Msg = "密碼不得為空"
-		json.NewEncoder(w).Encode(&response)
-		return
-	}
-
-	if Utils.ContainsNonEnglishOrNumber(data.Password) {
-		response.Target = "password"
-		response.Msg = "密碼只能包含英文字母和數字"
-		json.NewEncoder(w).Encode(&response)
-		return
-	}
-
-	if !Utils.ContainsLowerUpperCaseAndNumber(data.Password) {
-		response.Target = "password"
-		response.Msg = "密碼必須包含至少一個大寫、小寫英文字母和數字"
-		json.NewEncoder(w).Encode(&response)
+	if msg := validatePassword(data.Password); msg != "" {
+		writeError(w, r, CodeValidation, "password", msg)
 		return
 	}
-	fmt.Println("password is valid")
 
 	// 檢查該用戶的密碼是否正確 使用上面查找到的res(存在的使用者)
 	var user UserObject
 	err = res.Decode(&user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		fmt.Println("database decode error", err.Error())
+		writeDBError(w, r, "decode user failed", err, "db.readFailed")
 		return
 	}
 
 	if match := Utils.CheckPasswordHash(data.Password, user.Password); !match {
-		response.Target = "password"
-		response.Msg = "密碼錯誤!"
-		json.NewEncoder(w).Encode(&response)
+		writeError(w, r, CodeInvalidCredentials, "password", "password.wrong")
 		return
 	}
 
-	fmt.Println("密碼輸入正確")
 
-	fmt.Println("user log in", user)
 
-	// 查看有沒有勾選"記住我" 有就發行一個持續30天的session，否則一個一次性的session
-	if data.Check {
-		fmt.Println("issue a persistent session")
-		session, err := Store.Get(r, "SID")
-		if err != nil {
-			fmt.Println(err.Error(), http.StatusBadRequest)
-			return
-		}
-		fmt.Println("is session new?", session.IsNew)
-		session.Values["account"] = data.Account
-		// Set session options for persistent session
-        session.Options = &sessions.Options{
-            Path:     "/",
-            MaxAge:   86400 * 7, // 7 days
-            HttpOnly: true,
-            // Set SameSite as needed
-            SameSite: http.SameSiteNoneMode, // or SameSiteStrictMode, SameSiteNoneMode, 確保可以接受corss-site cookie
-            Secure:   true, // Set to true if served over HTTPS
-        }
-		// Save session
-		if err := session.Save(r, w); err != nil {
-			fmt.Println("Error saving session:", err.Error())
-		}
-	} else {
-		fmt.Println("issue a one-time session")
-		session, err := Store.Get(r, "SID")
-		if err != nil {
-			fmt.Println(err.Error(), http.StatusBadRequest)
-			return
-		}
-		fmt.Println("is session new?", session.IsNew)
-		session.Values["account"] = data.Account
-		// Set session options for one-time session
-        session.Options = &sessions.Options{
-            Path:     "/",
-            MaxAge:   0, // Session expires when the browser closes
-            HttpOnly: true,
-            // Set SameSite as needed
-            SameSite: http.SameSiteNoneMode, // or SameSiteStrictMode, SameSiteNoneMode
-            Secure:   true, // Set to true if served over HTTPS
-        }
-		
-		// Save session
-		if err := session.Save(r, w); err != nil {
-			fmt.Println("Error saving session:", err.Error())
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		}
+	session, err := Store.Get(r, sessionConfig.Name)
+	if err != nil {
+		// 舊的憑證解不開(例如換過金鑰)也沒關係，Store.Get還是會給一個新的session
+		logFor(r).Warn("session decode failed, issuing a new one", "err", err)
 	}
+	session.Values["account"] = data.Account
+	// 登入後換一個新的CSRF token，登入前拿到的token就不能用了
+	issueCSRFToken(w, session)
+	// 使用者設定過語言就記在session裡，之後的訊息都用這個語言
+	session.Values["locale"] = user.Locale
 
-	fmt.Println("登入成功")
+	// 查看有沒有勾選"記住我" 有就發行一個持續7天的session，否則一個一次性的session
+	maxAge := 0 // Session expires when the browser closes
+	if data.Check {
+		maxAge = int(sessionConfig.RememberFor.Seconds()) // 預設7天
+	}
+	session.Values["maxAge"] = maxAge // 之後重新存session時要沿用同樣的期限
+	session.Options = sessionOptions(maxAge)
 
-	// set success response
-	response.Type = true
-	response.Msg = "登入成功!"
-	response.Name = user.Name
-
-	// Encode response to JSON and write to response body
-	if err := json.NewEncoder(w).Encode(&response); err != nil {
-		fmt.Println("Error encoding JSON:", err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Save session
+	if err := session.Save(r, w); err != nil {
+		logFor(r).Error("save session failed", "err", err)
+		writeInternal(w, r, "signIn.failed")
 		return
 	}
+
+	logFor(r).Info("user signed in", "account", data.Account, "persistent", data.Check)
+
+	// set success response
+	writeJSON(w, http.StatusOK, &signInResponse{Type: true, Msg: T(r, "signIn.success"), Name: user.Name})
 }
 
 func (h *handlerWithDB) GetBudgets() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session, err := Store.Get(r, "SID")
-		if err != nil {
-			fmt.Println("GetBudgets decode session error", err.Error())
-			http.Error(w, "Decode session error", http.StatusInternalServerError)
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
 		}
 
-		account := session.Values["account"]
-		fmt.Println("userID", account)
-		cursor, err := h.BColl.Find(r.Context(), bson.M{"userID": account})
+		cursor, err := h.BColl.Find(r.Context(), sc.filter(nil))
 		if err != nil {
-			fmt.Println("GetBudgets DB query error", err.Error())
-			http.Error(w, "DB query error", http.StatusInternalServerError)
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
 		}
 
 		var data []BudgetObject
 		err = cursor.All(r.Context(), &data)
 		if err != nil {
-			fmt.Println("GetBudgets cursor iterate and decode error", err.Error())
-			http.Error(w, "cursor iterate and decode error", http.StatusInternalServerError)
-		}
-		fmt.Println("cursor", cursor, "data", data)
-		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(&data)
-		if err != nil {
-			fmt.Println("GetBudgets json encoding error", err.Error())
-			http.Error(w, "json encoding error", http.StatusInternalServerError)
+			writeDBError(w, r, "db cursor decode failed", err, "db.readFailed")
+			return
 		}
+		writeJSON(w, http.StatusOK, &data)
 	}
 }
 
 func (h *handlerWithDB) GetExpenses() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		session, err := Store.Get(r, "SID")
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+
+		filter, err := h.expenseFilter(r, sc)
+		if err == errInvalidDateRange {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
 		if err != nil {
-			fmt.Println("GetExpenses decode session error", err.Error())
-			http.Error(w, "Decode session error", http.StatusInternalServerError)
+			writeDBError(w, r, "load user location failed", err, "db.readFailed")
+			return
+		}
+		tags, field, msg := tagFilter(r)
+		if msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if tags != nil {
+			filter = bson.M{"$and": bson.A{filter, tags}}
 		}
 
-		account := session.Values["account"]
-		fmt.Println("userID", account)
-		cursor, err := h.EColl.Find(r.Context(), bson.M{"userID": account})
+		cursor, err := h.EColl.Find(r.Context(), filter)
 		if err != nil {
-			fmt.Println("GetExpenses DB query error", err.Error())
-			http.Error(w, "DB query error", http.StatusInternalServerError)
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
 		}
 
 		var data []ExpenseObject
 		err = cursor.All(r.Context(), &data)
 		if err != nil {
-			fmt.Println("GetExpenses cursor iterate and decode error", err.Error())
-			http.Error(w, "cursor iterate and decode error", http.StatusInternalServerError)
+			writeDBError(w, r, "db cursor decode failed", err, "db.readFailed")
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(&data)
-		if err != nil {
-			fmt.Println("GetExpenses json encoding error", err.Error())
-			http.Error(w, "json encoding error", http.StatusInternalServerError)
-		}
+		writeJSON(w, http.StatusOK, &data)
 	}
 }
 
 func (h *handlerWithDB) CreatBudget() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data BudgetObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
 		// 判斷資料正確性
-		response.LogIn = true
-		if strings.TrimSpace(data.ID) == "" {
-			fmt.Println("預算ID不得為空")
-			http.Error(w, "預算ID不得為空", http.StatusBadRequest)
-			return
-		}
-
-		if strings.TrimSpace(data.Name) == "" {
-			fmt.Println("名稱不得為空")
-			http.Error(w, "名稱不得為空", http.StatusBadRequest)
-			return
-		}
-
-		if len([]rune(strings.TrimSpace(data.Name))) > 12 {
-			fmt.Println("名稱不得超過12個字元")
-			http.Error(w, "名稱不得超過12個字元", http.StatusBadRequest)
-			return
-		}
-
-		if data.Max < 0 {
-			fmt.Println("上限額度必須為正整數")
-			http.Error(w, "上限額度必須為正整數", http.StatusBadRequest)
+		if field, msg := validateBudget(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
 			return
 		}
 
-		session, err := Store.Get(r, "SID")
+		_, err := h.BColl.InsertOne(r.Context(), sc.owned(bson.M{"id": data.ID, "name": data.Name, "max": data.Max}))
 		if err != nil {
-			fmt.Println("憑證錯誤 請重新登入", err)
-			response.LogIn = false
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-
-		res, err := h.BColl.InsertOne(r.Context(), bson.M{"id": data.ID, "name": data.Name, "max": data.Max, "userID": session.Values["account"]})
-		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
 
 		// 最後要記得送出成功的提示，因為前端會做response.json
-		response.Msg = "成功新增預算"
-		json.NewEncoder(w).Encode(&response)
-		fmt.Println("data created successfully, id:", res.InsertedID)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "budget.created")})
+		logFor(r).Info("budget created", "id", data.ID)
+		metrics.BudgetsCreated.Inc()
 	}
 }
 
 func (h *handlerWithDB) CreateExpense() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data ExpenseObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
-
-		// 檢查data有沒有違規
-		response.LogIn = true
-
-		if strings.TrimSpace(data.ID) == "" {
-			fmt.Println("花費ID不得為空")
-			http.Error(w, "花費ID不得為空", http.StatusBadRequest)
-			return
-		}
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
+		// 沒指定預算的話跟/api/v1一樣用自動分類的規則
 		if strings.TrimSpace(data.BudgetID) == "" {
-			fmt.Println("預算分類不得為空")
-			http.Error(w, "預算分類不得為空", http.StatusBadRequest)
-			return
+			if _, err := h.categorize(r, sc, &data); err != nil {
+				writeDBError(w, r, "db query failed", err, "db.readFailed")
+				return
+			}
 		}
 
-		if strings.TrimSpace(data.Description) == "" {
-			fmt.Println("預算描述不得為空")
-			http.Error(w, "預算描述不得為空", http.StatusBadRequest)
+		// 檢查data有沒有違規
+		if field, msg := validateExpense(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
 			return
 		}
-
-		if data.Amount < 0 {
-			fmt.Println("預算金額必須為正整數")
-			http.Error(w, "預算金額必須為正整數", http.StatusBadRequest)
+		tags, msg := normalizeTags(data.Tags)
+		if msg != "" {
+			writeError(w, r, CodeValidation, "tags", msg)
 			return
 		}
 
-		session, err := Store.Get(r, "SID")
-
-		if err != nil {
-			fmt.Println("憑證錯誤 請重新登入", err)
-			response.LogIn = false
-			json.NewEncoder(w).Encode(&response)
-			return
+		doc := sc.owned(bson.M{"id": data.ID, "budgetID": data.BudgetID,
+			"description": data.Description, "amount": data.Amount, "date": data.Date, "createdBy": sc.account})
+		if len(tags) > 0 {
+			doc["tags"] = tags
 		}
-
-		res, err := h.EColl.InsertOne(r.Context(), bson.M{"id": data.ID, "budgetID": data.BudgetID,
-			"description": data.Description, "amount": data.Amount, "date": data.Date, "userID": session.Values["account"]})
+		_, err := h.EColl.InsertOne(r.Context(), doc)
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
 
-		response.Msg = "成功新增花費"
-		json.NewEncoder(w).Encode(&response)
-		fmt.Println("data created successfully, id:", res.InsertedID)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "expense.created")})
+		logFor(r).Info("expense created", "id", data.ID)
+		metrics.ExpensesCreated.Inc()
 	}
 }
 
 func (h *handlerWithDB) UpdateBudget() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data UpdateBudgetObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
 		// 檢查data有沒有違規
-		response.LogIn = true
-
 		if strings.TrimSpace(data.BudgetID) == "" {
-			fmt.Println("預算ID不得為空")
-			http.Error(w, "預算ID不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "budgetID", "budget.idRequired")
 			return
 		}
 
 		if len(strings.TrimSpace(data.Name)) > 12 {
-			fmt.Println("預算名稱不得超過12個字元")
-			http.Error(w, "預算名稱不得超過12個字元", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "name", "budget.nameTooLong")
 			return
 		}
 
 		if strings.TrimSpace(data.Name) == "總計" {
-			fmt.Println("預算名稱不得為總計")
-			http.Error(w, "預算名稱不得為總計", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "name", "budget.nameReserved")
 			return
 		}
 
 		var res *mongo.UpdateResult
+		var err error
 		if strings.TrimSpace(data.Name) == "" && data.Max == -1 { // 都不更新
-			fmt.Println("budget資料不用更新~")
+			res = &mongo.UpdateResult{}
 		} else if strings.TrimSpace(data.Name) == "" { // 名稱空白就不更新名稱
-			fmt.Println("只更新金額")
-			res, err = h.BColl.UpdateOne(r.Context(), bson.M{"userID": SID, "id": data.BudgetID}, bson.M{"$set": bson.M{"max": data.Max}})
+			res, err = h.BColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": data.BudgetID}), bson.M{"$set": bson.M{"max": data.Max}})
 		} else if data.Max < 0 { // max金額小於0就不更新金額
-			fmt.Println("只更新名稱")
-			res, err = h.BColl.UpdateOne(r.Context(), bson.M{"userID": SID, "id": data.BudgetID}, bson.M{"$set": bson.M{"name": data.Name}})
+			res, err = h.BColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": data.BudgetID}), bson.M{"$set": bson.M{"name": data.Name}})
 		} else {
-			fmt.Println("更新名稱、金額")
-			res, err = h.BColl.UpdateOne(r.Context(), bson.M{"userID": SID, "id": data.BudgetID}, bson.M{"$set": bson.M{"name": data.Name, "max": data.Max}})
+			res, err = h.BColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": data.BudgetID}), bson.M{"$set": bson.M{"name": data.Name, "max": data.Max}})
 		}
 
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
 
-		response.Msg = "成功更新預算"
-		json.NewEncoder(w).Encode(&response)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "budget.updated")})
 
-		fmt.Println("更新row數量:", res.ModifiedCount)
+		logFor(r).Info("budget updated", "id", data.BudgetID, "modified", res.ModifiedCount)
 	}
 }
 
 func (h *handlerWithDB) UpdateExpense() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data UpdateExpenseObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
 		// 檢查data有沒有違規
-		response.LogIn = true
-
 		if strings.TrimSpace(data.NewBudgetID) == "" {
-			fmt.Println("新預算ID不得為空")
-			http.Error(w, "新預算ID不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "newBudgetID", "budget.newIDRequired")
 			return
 		}
 
 		if strings.TrimSpace(data.ID) == "" {
-			fmt.Println("預算ID不得為空")
-			http.Error(w, "預算ID不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "id", "expense.idRequired")
 			return
 		}
 
 		if strings.TrimSpace(data.Description) == "" {
-			fmt.Println("花費描述不得為空")
-			http.Error(w, "花費描述不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "description", "expense.descriptionRequired")
 			return
 		}
 
 		if data.Amount <= 0 {
-			fmt.Println("花費金額必須為正整數")
-			http.Error(w, "花費金額必須為正整數", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "amount", "expense.amountInvalid")
 			return
 		}
 
-		var res *mongo.UpdateResult
-		res, err = h.EColl.UpdateOne(r.Context(), bson.M{"userID": SID, "id": data.ID}, bson.M{"$set": bson.M{"budgetID": data.NewBudgetID, "description": data.Description, "amount": data.Amount}})
+		if data.Date < 0 {
+			writeError(w, r, CodeValidation, "date", "expense.dateInvalid")
+			return
+		}
+
+		if !h.checkEntriesOpen(w, r, sc, h.EColl, sc.filter(bson.M{"id": data.ID})) {
+			return
+		}
+
+		var current ExpenseObject
+		err := h.EColl.FindOne(r.Context(), sc.filter(bson.M{"id": data.ID}),
+			options.FindOne().SetProjection(bson.M{"budgetID": 1, "amount": 1, "allocations": 1, "split": 1})).Decode(&current)
+		if err != nil && err != mongo.ErrNoDocuments {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		update := bson.M{"budgetID": data.NewBudgetID, "description": data.Description, "amount": data.Amount}
+		if data.Date > 0 {
+			update["date"] = data.Date
+		}
+		unset := bson.M{}
+		// 舊的前端不認得allocations跟split，預算或金額改了就取消分配
+		if len(current.Allocations) > 0 && (current.BudgetID != data.NewBudgetID || current.Amount != data.Amount) {
+			unset["allocations"] = ""
+		}
+		// 金額改了，平分跟依份數的分帳照新的金額重算，指定金額的加起來對不上了只能取消
+		if current.Split != nil && current.Amount != data.Amount {
+			if current.Split.Method == SplitExact {
+				unset["split"] = ""
+			} else {
+				// 存著的分帳已經檢查過了，只要依照新的金額重算每個人的部分
+				split := *current.Split
+				for i, owed := range splitAmounts(data.Amount, split) {
+					split.Participants[i].Amount = owed
+				}
+				update["split"] = split.doc()
+			}
+		}
 
+		res, err := h.EColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": data.ID}), updateDoc(update, unset))
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
 
-		response.Msg = "成功更新花費"
-		json.NewEncoder(w).Encode(&response)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "expense.updated")})
 
-		fmt.Println("更新row數量:", res.ModifiedCount)
+		logFor(r).Info("expense updated", "id", data.ID, "modified", res.ModifiedCount)
 	}
 }
 
 func (h *handlerWithDB) DeleteBudget() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data DeleteBudgetObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
 		// 檢查data有沒有違規
-		response.LogIn = true
-
 		if strings.TrimSpace(data.BudgetID) == "" {
-			fmt.Println("預算ID不得為空")
-			http.Error(w, "預算ID不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "budgetID", "budget.idRequired")
+			return
+		}
+
+		// 對帳鎖定的花費不能跟著刪
+		if !h.checkEntriesOpen(w, r, sc, h.EColl, sc.filter(bson.M{"budgetID": data.BudgetID, "allocations": bson.M{"$exists": false}})) {
+			return
+		}
+
+		// 分到好幾個預算的花費只拿掉這個預算的那一行
+		if err := h.detachBudget(r, sc, data.BudgetID); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
 
 		// 先移除所有相關花費
-		var res *mongo.DeleteResult
-		res, err = h.EColl.DeleteMany(r.Context(), bson.M{"userID": SID, "budgetID": data.BudgetID})
+		res, err := h.EColl.DeleteMany(r.Context(), sc.filter(bson.M{"budgetID": data.BudgetID}))
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("expenses deleted", "budget_id", data.BudgetID, "count", res.DeletedCount)
+
+		// 連到這個預算的儲蓄目標保留，只取消連結
+		if _, err := h.GColl.UpdateMany(r.Context(), sc.filter(bson.M{"budgetID": data.BudgetID}), bson.M{"$unset": bson.M{"budgetID": ""}}); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+
+		// 分類到這個預算的規則也刪掉
+		if _, err := h.RuColl.DeleteMany(r.Context(), sc.filter(bson.M{"budgetID": data.BudgetID})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+
+		// 子預算移到被刪除的預算的上層
+		var current BudgetObject
+		err = h.BColl.FindOne(r.Context(), sc.filter(bson.M{"id": data.BudgetID})).Decode(&current)
+		if err == nil {
+			err = h.reparentChildren(r, sc, current)
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
-		fmt.Println("deleted expenses number:", res.DeletedCount)
 
 		// 再移除該筆預算
-		res, err = h.BColl.DeleteOne(r.Context(), bson.M{"userID": SID, "id": data.BudgetID})
+		res, err = h.BColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": data.BudgetID}))
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
-		fmt.Println("deleted budget number:", res.DeletedCount)
+		logFor(r).Info("budget deleted", "id", data.BudgetID, "count", res.DeletedCount)
 
-		response.Msg = "成功刪除預算"
-		json.NewEncoder(w).Encode(&response)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "budget.deleted")})
 	}
 }
 
 func (h *handlerWithDB) DeleteExpense() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var response CRUDResponse
-		SID, err := checkSessionExpiredOrNotExist(r)
-		if err != nil {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
-			return
-		}
-		if SID == "" {
-			// 通知front-end去log out並提醒使用者要重新登入
-			fmt.Println("憑證錯誤 請重新登入")
-			response.Msg = "憑證錯誤 請重新登入"
-			json.NewEncoder(w).Encode(&response)
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			// 沒登入的話通知front-end去log out並提醒使用者要重新登入
 			return
 		}
 
 		var data DeleteExpenseObject
 		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			fmt.Println("JSON資料型態轉換錯誤")
-			http.Error(w, "JSON資料型態轉換錯誤", http.StatusBadRequest)
+			writeInvalidJSON(w, r)
 			return
 		}
 
-		// Print received data (for demonstration purposes)
-		fmt.Printf("Received data: %+v\n", data)
+		// 收到的資料，debug level才會印出來
+		logFor(r).Debug("request body", "data", data)
 
 		// 檢查data有沒有違規
-		response.LogIn = true
-
 		if strings.TrimSpace(data.ExpenseID) == "" {
-			fmt.Println("花費ID不得為空")
-			http.Error(w, "花費ID不得為空", http.StatusBadRequest)
+			writeError(w, r, CodeValidation, "expenseID", "expense.idRequired")
+			return
+		}
+
+		if !h.checkEntriesOpen(w, r, sc, h.EColl, sc.filter(bson.M{"id": data.ExpenseID})) {
 			return
 		}
 
 		// 移除該筆花費
-		var res *mongo.DeleteResult
-		res, err = h.EColl.DeleteOne(r.Context(), bson.M{"userID": SID, "id": data.ExpenseID})
+		res, err := h.EColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": data.ExpenseID}))
 		if err != nil {
-			fmt.Println("資料寫入錯誤 請稍後再試", err)
-			http.Error(w, "資料寫入錯誤 請稍後再試", http.StatusBadRequest)
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
 			return
 		}
-		fmt.Println("deleted expense number:", res.DeletedCount)
+		logFor(r).Info("expense deleted", "id", data.ExpenseID, "count", res.DeletedCount)
 
-		response.Msg = "成功刪除花費"
-		json.NewEncoder(w).Encode(&response)
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "expense.deleted")})
 	}
 }
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/config"
+	"mongodb-budget/internal/testutil"
+)
+
+// newTestHandler 連到假資料庫的handler，需要資料的測試用mongo.Handle指定查詢結果
+func newTestHandler(t *testing.T) (*handlerWithDB, *testutil.FakeMongo) {
+	t.Helper()
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	mongo := testutil.NewFakeMongo(t)
+	cfg := config.Default()
+	cfg.Database.URI = mongo.URI
+	cfg.Database.ConnectRetries = 0
+	cfg.Database.ConnectTimeout = 5 * time.Second
+	h, err := Inithandler(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close(context.Background()) })
+	return &h, mongo
+}
+
+// loggedIn 帶著account登入的session cookie，vars是route上的參數
+func loggedIn(t *testing.T, req *http.Request, account string, vars map[string]string) *http.Request {
+	t.Helper()
+	session, err := Store.New(req, sessionConfig.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["account"] = account
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return mux.SetURLVars(req, vars)
+}
+
+// serve 執行handler，回傳response
+func serve(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// docs 給mongo.Handle用的查詢結果，filter有指定id的話只回傳那一筆，其他條件都不看
+func docs(list ...bson.M) func(bson.Raw) []any {
+	return func(cmd bson.Raw) []any {
+		id, byID := cmd.Lookup("filter", "id").StringValueOK()
+		var res []any
+		for _, doc := range list {
+			if !byID || doc["id"] == id {
+				res = append(res, doc)
+			}
+		}
+		return res
+	}
+}
+
+// count 給mongo.Handle("coll.aggregate", ...)用，CountDocuments的結果
+func count(n int) func(bson.Raw) []any {
+	return func(bson.Raw) []any {
+		if n == 0 {
+			return nil
+		}
+		return []any{bson.M{"_id": 1, "n": n}}
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// /healthz跟/readyz給部署環境的probe用，不需要登入，回應也不做翻譯
+
+const readyTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz 只代表process還活著，不檢查資料庫，避免資料庫掛掉時整個服務被重啟
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Readyz 確認資料庫連得到而且沒有在關機，否則回503
+func (h *handlerWithDB) Readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.draining.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "draining"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		checks := map[string]string{"database": "ok", "circuit": "closed"}
+		if h.breaker.Open() {
+			checks["circuit"] = "open"
+		}
+		// 直接ping不經過斷路器，資料庫恢復後probe馬上就會知道
+		if err := h.DB.Ping(ctx, nil); err != nil {
+			logFor(r).Warn("readiness check failed", "err", err)
+			checks["database"] = "unreachable"
+			writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "unavailable", Checks: checks})
+			return
+		}
+		writeJSON(w, http.StatusOK, HealthResponse{Status: "ready", Checks: checks})
+	}
+}
+
+// Drain 讓/readyz開始回503，關機的第一步
+func (h *handlerWithDB) Drain() {
+	h.draining.Store(true)
+}
+
+// Close 關閉資料庫連線，要在http server停止之後才呼叫
+func (h *handlerWithDB) Close(ctx context.Context) error {
+	return h.DB.Disconnect(ctx)
+}
@@ -0,0 +1,621 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 家庭(household)可以讓好幾個帳號共用預算跟花費
+// request帶X-Household-ID header就是操作那個家庭的資料，沒帶就是自己的資料(跟以前一樣用userID)
+// 家庭的預算/花費文件沒有userID，改用householdID，花費另外用createdBy記錄是誰新增的
+
+const householdHeader = "X-Household-ID"
+
+// 角色，權限由低到高
+const (
+	RoleViewer = "viewer" // 只能看
+	RoleEditor = "editor" // 可以新增、修改、刪除預算跟花費
+	RoleOwner  = "owner"  // 還可以管理成員跟邀請、刪除家庭
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+type HouseholdMember struct {
+	Account  string `json:"account"`
+	Role     string `json:"role"`
+	JoinedAt int64  `json:"joinedAt"` // Unix時間(秒)
+}
+
+type HouseholdInvitation struct {
+	Account   string `json:"account"`
+	Role      string `json:"role"`
+	InvitedBy string `json:"invitedBy"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+type HouseholdObject struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	Members     []HouseholdMember     `json:"members"`
+	Invitations []HouseholdInvitation `json:"invitations"`
+	CreatedAt   int64                 `json:"createdAt"`
+	Role        string                `json:"role,omitempty"` // 目前登入的人在這個家庭的角色，不會存進資料庫
+}
+
+type HouseholdPatch struct {
+	Name *string `json:"name"`
+}
+
+type InviteObject struct {
+	Account string `json:"account"`
+	Role    string `json:"role"`
+}
+
+type MemberPatch struct {
+	Role string `json:"role"`
+}
+
+// InvitationObject 是GET /invitations回傳的，收到的邀請
+type InvitationObject struct {
+	HouseholdID   string `json:"householdID"`
+	HouseholdName string `json:"householdName"`
+	Role          string `json:"role"`
+	InvitedBy     string `json:"invitedBy"`
+	CreatedAt     int64  `json:"createdAt"`
+}
+
+// scope 是這個request可以操作的資料範圍
+type scope struct {
+	account     string
+	householdID string // 空字串代表自己的資料
+	role        string
+}
+
+// filter 在查詢條件加上資料範圍
+func (s scope) filter(extra bson.M) bson.M {
+	filter := bson.M{}
+	for k, v := range extra {
+		filter[k] = v
+	}
+	if s.householdID != "" {
+		filter["householdID"] = s.householdID
+	} else {
+		filter["userID"] = s.account
+	}
+	return filter
+}
+
+// owner 回傳(userID, householdID)，只會有一個不是空字串
+func (s scope) owner() (string, string) {
+	if s.householdID != "" {
+		return "", s.householdID
+	}
+	return s.account, ""
+}
+
+// owned 新增的文件標上屬於誰
+func (s scope) owned(doc bson.M) bson.M {
+	if s.householdID != "" {
+		doc["householdID"] = s.householdID
+	} else {
+		doc["userID"] = s.account
+	}
+	return doc
+}
+
+// requireScope 取得登入的帳號跟要操作的資料範圍，角色低於role就回403
+// 不是成員的話一律回404，不透露這個家庭存不存在
+func (h *handlerWithDB) requireScope(w http.ResponseWriter, r *http.Request, role string) (scope, bool) {
+	account, ok := requireAccount(w, r)
+	if !ok {
+		return scope{}, false
+	}
+	householdID := strings.TrimSpace(r.Header.Get(householdHeader))
+	if householdID == "" {
+		return scope{account: account, role: RoleOwner}, true
+	}
+	household, ok := h.memberHousehold(w, r, householdID, account)
+	if !ok {
+		return scope{}, false
+	}
+	s := scope{account: account, householdID: householdID, role: household.Role}
+	if roleRank[s.role] < roleRank[role] {
+		writeError(w, r, CodeForbidden, "", "household.forbidden")
+		return scope{}, false
+	}
+	return s, true
+}
+
+// memberHousehold 讀取account所屬的家庭，Role會填上account的角色
+func (h *handlerWithDB) memberHousehold(w http.ResponseWriter, r *http.Request, id, account string) (HouseholdObject, bool) {
+	var household HouseholdObject
+	err := h.HColl.FindOne(r.Context(), bson.M{"id": id, "members.account": account}).Decode(&household)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, CodeNotFound, "", "household.notFound")
+		return household, false
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return household, false
+	}
+	for _, m := range household.Members {
+		if m.Account == account {
+			household.Role = m.Role
+		}
+	}
+	if household.Invitations == nil {
+		household.Invitations = []HouseholdInvitation{}
+	}
+	return household, true
+}
+
+// requireHouseholdRole 路徑裡{householdID}的家庭，角色低於role就回403
+func (h *handlerWithDB) requireHouseholdRole(w http.ResponseWriter, r *http.Request, role string) (string, HouseholdObject, bool) {
+	account, ok := requireAccount(w, r)
+	if !ok {
+		return "", HouseholdObject{}, false
+	}
+	household, ok := h.memberHousehold(w, r, mux.Vars(r)["householdID"], account)
+	if !ok {
+		return "", household, false
+	}
+	if roleRank[household.Role] < roleRank[role] {
+		writeError(w, r, CodeForbidden, "", "household.forbidden")
+		return "", household, false
+	}
+	return account, household, true
+}
+
+func validateHouseholdName(name string) string {
+	if name == "" {
+		return "household.nameRequired"
+	}
+	if len([]rune(name)) > 20 {
+		return "household.nameTooLong"
+	}
+	return ""
+}
+
+func validRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+func countOwners(household HouseholdObject) int {
+	owners := 0
+	for _, m := range household.Members {
+		if m.Role == RoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+func (h *handlerWithDB) ListHouseholds() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := requireAccount(w, r)
+		if !ok {
+			return
+		}
+		data := []HouseholdObject{}
+		cursor, err := h.HColl.Find(r.Context(), bson.M{"members.account": account})
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		for i := range data {
+			for _, m := range data[i].Members {
+				if m.Account == account {
+					data[i].Role = m.Role
+				}
+			}
+			if data[i].Invitations == nil {
+				data[i].Invitations = []HouseholdInvitation{}
+			}
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostHousehold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := requireAccount(w, r)
+		if !ok {
+			return
+		}
+		var data HouseholdObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Name = strings.TrimSpace(data.Name)
+		if msg := validateHouseholdName(data.Name); msg != "" {
+			writeError(w, r, CodeValidation, "name", msg)
+			return
+		}
+
+		now := time.Now().Unix()
+		household := HouseholdObject{
+			ID:          primitive.NewObjectID().Hex(),
+			Name:        data.Name,
+			Members:     []HouseholdMember{{Account: account, Role: RoleOwner, JoinedAt: now}},
+			Invitations: []HouseholdInvitation{},
+			CreatedAt:   now,
+		}
+		_, err := h.HColl.InsertOne(r.Context(), bson.M{"id": household.ID, "name": household.Name,
+			"members":     bson.A{bson.M{"account": account, "role": RoleOwner, "joinedAt": now}},
+			"invitations": bson.A{}, "createdAt": now})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		// 跟註冊時一樣放一個預設的"其他"預算，前端會用到
+		_, err = h.BColl.InsertOne(r.Context(), bson.M{"id": "其他", "name": "其他", "max": 0, "householdID": household.ID})
+		if err != nil {
+			writeDBError(w, r, "insert default budget failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("household created", "household_id", household.ID)
+
+		household.Role = RoleOwner
+		w.Header().Set("Location", "/api/v1/households/"+household.ID)
+		writeJSON(w, http.StatusCreated, household)
+	}
+}
+
+func (h *handlerWithDB) GetHousehold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, household, ok := h.requireHouseholdRole(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, household)
+	}
+}
+
+func (h *handlerWithDB) PatchHousehold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, household, ok := h.requireHouseholdRole(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		var patch HouseholdPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if patch.Name != nil {
+			household.Name = strings.TrimSpace(*patch.Name)
+			if msg := validateHouseholdName(household.Name); msg != "" {
+				writeError(w, r, CodeValidation, "name", msg)
+				return
+			}
+			_, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": household.ID}, bson.M{"$set": bson.M{"name": household.Name}})
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, household)
+	}
+}
+
+// RemoveHousehold 連同家庭的預算、花費、收入、帳戶、轉帳跟還款紀錄一起刪除
+func (h *handlerWithDB) RemoveHousehold() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, household, ok := h.requireHouseholdRole(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		// 先刪資料，中途失敗的話家庭還在，可以再刪一次
+		filter := bson.M{"householdID": household.ID}
+		if _, err := h.EColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.BColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.SColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.IColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.RColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.TColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.CColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.GColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.StColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.RuColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.AColl.DeleteMany(r.Context(), filter); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if _, err := h.HColl.DeleteOne(r.Context(), bson.M{"id": household.ID}); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("household deleted", "household_id", household.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PostInvitation 用帳號邀請別人加入，對方接受之後才會變成成員
+func (h *handlerWithDB) PostInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, household, ok := h.requireHouseholdRole(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		var data InviteObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Account = strings.TrimSpace(data.Account)
+		if data.Account == "" {
+			writeError(w, r, CodeValidation, "account", "account.required")
+			return
+		}
+		if data.Role == "" {
+			data.Role = RoleEditor
+		}
+		if !validRole(data.Role) {
+			writeError(w, r, CodeValidation, "role", "household.roleInvalid")
+			return
+		}
+
+		// 不檢查帳號存不存在，不然可以用邀請來猜有哪些帳號；邀請會留著，之後註冊這個帳號就能接受
+		invitation := HouseholdInvitation{Account: data.Account, Role: data.Role, InvitedBy: account, CreatedAt: time.Now().Unix()}
+		// 已經是成員或已經邀請過就不會match
+		res, err := h.HColl.UpdateOne(r.Context(),
+			bson.M{"id": household.ID, "members.account": bson.M{"$ne": data.Account}, "invitations.account": bson.M{"$ne": data.Account}},
+			bson.M{"$push": bson.M{"invitations": bson.M{"account": invitation.Account, "role": invitation.Role,
+				"invitedBy": invitation.InvitedBy, "createdAt": invitation.CreatedAt}}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, r, CodeConflict, "account", "household.alreadyInvited")
+			return
+		}
+		logFor(r).Info("household invitation sent", "household_id", household.ID, "invitee", data.Account, "role", data.Role)
+		writeJSON(w, http.StatusCreated, invitation)
+	}
+}
+
+// RemoveInvitation 擁有者收回邀請
+func (h *handlerWithDB) RemoveInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, household, ok := h.requireHouseholdRole(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		invitee := mux.Vars(r)["account"]
+		res, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": household.ID, "invitations.account": invitee},
+			bson.M{"$pull": bson.M{"invitations": bson.M{"account": invitee}}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, r, CodeNotFound, "account", "household.invitationNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PatchMember 擁有者修改成員的角色，最後一個擁有者不能降級
+func (h *handlerWithDB) PatchMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, household, ok := h.requireHouseholdRole(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		var patch MemberPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if !validRole(patch.Role) {
+			writeError(w, r, CodeValidation, "role", "household.roleInvalid")
+			return
+		}
+		member := mux.Vars(r)["account"]
+		var target *HouseholdMember
+		for i := range household.Members {
+			if household.Members[i].Account == member {
+				target = &household.Members[i]
+			}
+		}
+		if target == nil {
+			writeError(w, r, CodeNotFound, "account", "household.memberNotFound")
+			return
+		}
+		if target.Role == RoleOwner && patch.Role != RoleOwner && countOwners(household) == 1 {
+			writeError(w, r, CodeConflict, "role", "household.lastOwner")
+			return
+		}
+		_, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": household.ID, "members.account": member},
+			bson.M{"$set": bson.M{"members.$.role": patch.Role}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		target.Role = patch.Role
+		logFor(r).Info("household member role changed", "household_id", household.ID, "member", member, "role", patch.Role)
+		writeJSON(w, http.StatusOK, *target)
+	}
+}
+
+// RemoveMember 擁有者可以移除任何成員，其他人只能移除自己(退出家庭)
+func (h *handlerWithDB) RemoveMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, household, ok := h.requireHouseholdRole(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		member := mux.Vars(r)["account"]
+		if member != account && household.Role != RoleOwner {
+			writeError(w, r, CodeForbidden, "", "household.forbidden")
+			return
+		}
+		role := ""
+		for _, m := range household.Members {
+			if m.Account == member {
+				role = m.Role
+			}
+		}
+		if role == "" {
+			writeError(w, r, CodeNotFound, "account", "household.memberNotFound")
+			return
+		}
+		if role == RoleOwner && countOwners(household) == 1 {
+			writeError(w, r, CodeConflict, "account", "household.lastOwner")
+			return
+		}
+		_, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": household.ID},
+			bson.M{"$pull": bson.M{"members": bson.M{"account": member}}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("household member removed", "household_id", household.ID, "member", member)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListInvitations 列出別人邀請自己的
+func (h *handlerWithDB) ListInvitations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := requireAccount(w, r)
+		if !ok {
+			return
+		}
+		var households []HouseholdObject
+		cursor, err := h.HColl.Find(r.Context(), bson.M{"invitations.account": account})
+		if err == nil {
+			err = cursor.All(r.Context(), &households)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		data := []InvitationObject{}
+		for _, household := range households {
+			for _, inv := range household.Invitations {
+				if inv.Account == account {
+					data = append(data, InvitationObject{HouseholdID: household.ID, HouseholdName: household.Name,
+						Role: inv.Role, InvitedBy: inv.InvitedBy, CreatedAt: inv.CreatedAt})
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+// AcceptInvitation 接受邀請，用邀請時指定的角色加入
+func (h *handlerWithDB) AcceptInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := requireAccount(w, r)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["householdID"]
+		var household HouseholdObject
+		err := h.HColl.FindOne(r.Context(), bson.M{"id": id, "invitations.account": account}).Decode(&household)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "", "household.invitationNotFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		var role string
+		pending := []HouseholdInvitation{}
+		for _, inv := range household.Invitations {
+			if inv.Account == account {
+				role = inv.Role
+			} else {
+				pending = append(pending, inv)
+			}
+		}
+
+		member := HouseholdMember{Account: account, Role: role, JoinedAt: time.Now().Unix()}
+		// 邀請在這之間被收回的話就不會match
+		res, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": id, "invitations.account": account, "members.account": bson.M{"$ne": account}},
+			bson.M{
+				"$pull": bson.M{"invitations": bson.M{"account": account}},
+				"$push": bson.M{"members": bson.M{"account": member.Account, "role": member.Role, "joinedAt": member.JoinedAt}},
+			})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, r, CodeNotFound, "", "household.invitationNotFound")
+			return
+		}
+		logFor(r).Info("household invitation accepted", "household_id", id, "role", role)
+
+		household.Members = append(household.Members, member)
+		household.Invitations = pending
+		household.Role = role
+		writeJSON(w, http.StatusOK, household)
+	}
+}
+
+// DeclineInvitation 拒絕邀請
+func (h *handlerWithDB) DeclineInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := requireAccount(w, r)
+		if !ok {
+			return
+		}
+		res, err := h.HColl.UpdateOne(r.Context(), bson.M{"id": mux.Vars(r)["householdID"], "invitations.account": account},
+			bson.M{"$pull": bson.M{"invitations": bson.M{"account": account}}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, r, CodeNotFound, "", "household.invitationNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,801 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/Utils"
+	"mongodb-budget/metrics"
+)
+
+// 收入：單筆的收入存在incomes，固定的收入(薪水之類)存在recurringIncomes
+// 固定收入的每一次入帳不另外存，查詢時依照頻率算出來，之後的日期標成projected
+
+const (
+	FrequencyWeekly   = "weekly"
+	FrequencyBiweekly = "biweekly"
+	FrequencyMonthly  = "monthly" // 每個月的同一天，那個月沒有這一天的話就是月底
+	FrequencyYearly   = "yearly"
+)
+
+const (
+	maxSourceLength = 20
+	maxCashFlowRows = 400  // 以天為單位大約一年多
+	minIncomeYear   = 1970 // 日期存的是Unix時間，跟花費一樣不能早於1970
+)
+
+type IncomeObject struct {
+	ID           string `json:"id"`
+	Source       string `json:"source"` // 收入來源，例如薪水、獎金
+	Description  string `json:"description"`
+	Amount       int    `json:"amount"`
+	Date         int    `json:"date"`                // 跟花費一樣，秒或毫秒都可以
+	AccountID    string `json:"accountID,omitempty"` // 存進哪個資金帳戶
+	UserID       string `json:"userID,omitempty"`
+	HouseholdID  string `json:"householdID,omitempty"`
+	CreatedBy    string `json:"createdBy,omitempty"`
+	RecurringID  string `json:"recurringID,omitempty"`  // 由固定收入算出來的才有，不能單獨修改或刪除
+	Projected    bool   `json:"projected,omitempty"`    // 還沒到的固定收入
+	ReconciledIn string `json:"reconciledIn,omitempty"` // 對帳鎖定時配對到的對帳單
+}
+
+// IncomePatch AccountID送空字串代表不記在任何帳戶
+type IncomePatch struct {
+	Source      *string `json:"source"`
+	Description *string `json:"description"`
+	Amount      *int    `json:"amount"`
+	Date        *int    `json:"date"`
+	AccountID   *string `json:"accountID"`
+}
+
+type RecurringIncomeObject struct {
+	ID          string `json:"id"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+	Amount      int    `json:"amount"`
+	Frequency   string `json:"frequency"`
+	StartDate   string `json:"startDate"`         // 第一次入帳的日期 2006-01-02，之後依照頻率推算
+	EndDate     string `json:"endDate,omitempty"` // 最後一天(含)，空字串代表沒有結束
+	AccountID   string `json:"accountID,omitempty"`
+	UserID      string `json:"userID,omitempty"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy,omitempty"`
+}
+
+// RecurringIncomePatch EndDate送空字串代表取消結束日，AccountID送空字串代表不記在任何帳戶
+type RecurringIncomePatch struct {
+	Source      *string `json:"source"`
+	Description *string `json:"description"`
+	Amount      *int    `json:"amount"`
+	Frequency   *string `json:"frequency"`
+	StartDate   *string `json:"startDate"`
+	EndDate     *string `json:"endDate"`
+	AccountID   *string `json:"accountID"`
+}
+
+// CashFlowRow 一段期間的收支，End是最後一天(含)
+type CashFlowRow struct {
+	Start           string  `json:"start"`
+	End             string  `json:"end"`
+	Income          int     `json:"income"`
+	ProjectedIncome int     `json:"projectedIncome"` // Income裡面還沒入帳的固定收入
+	Expenses        int     `json:"expenses"`
+	Net             int     `json:"net"`
+	SavingsRate     float64 `json:"savingsRate"` // Net/Income，沒有收入時是0
+}
+
+type SourceTotal struct {
+	Source string `json:"source"`
+	Amount int    `json:"amount"`
+}
+
+// CashFlowResponse 預算的max當作每個月的上限，跟區間內平均每個月的收入比較看負不負擔得起
+type CashFlowResponse struct {
+	Interval               string        `json:"interval"`
+	Periods                []CashFlowRow `json:"periods"`
+	Total                  CashFlowRow   `json:"total"`
+	BySource               []SourceTotal `json:"bySource"`
+	Budgeted               int           `json:"budgeted"`
+	AverageMonthlyIncome   int           `json:"averageMonthlyIncome"`
+	AverageMonthlyExpenses int           `json:"averageMonthlyExpenses"`
+	Affordable             bool          `json:"affordable"`
+}
+
+func validFrequency(frequency string) bool {
+	switch frequency {
+	case FrequencyWeekly, FrequencyBiweekly, FrequencyMonthly, FrequencyYearly:
+		return true
+	}
+	return false
+}
+
+func validateIncomeFields(source string, amount int) (string, string) {
+	if strings.TrimSpace(source) == "" {
+		return "source", "income.sourceRequired"
+	}
+	if len([]rune(strings.TrimSpace(source))) > maxSourceLength {
+		return "source", "income.sourceTooLong"
+	}
+	if amount <= 0 {
+		return "amount", "income.amountInvalid"
+	}
+	return "", ""
+}
+
+func validateIncome(data IncomeObject) (string, string) {
+	if field, msg := validateIncomeFields(data.Source, data.Amount); msg != "" {
+		return field, msg
+	}
+	if data.Date < 0 {
+		return "date", "expense.dateInvalid"
+	}
+	return "", ""
+}
+
+func validateRecurringIncome(data RecurringIncomeObject) (string, string) {
+	if field, msg := validateIncomeFields(data.Source, data.Amount); msg != "" {
+		return field, msg
+	}
+	if !validFrequency(data.Frequency) {
+		return "frequency", "income.frequencyInvalid"
+	}
+	start, err := time.Parse(Utils.DayLayout, data.StartDate)
+	if err != nil {
+		return "startDate", "income.startDateInvalid"
+	}
+	if start.Year() < minIncomeYear {
+		return "startDate", "income.startDateTooEarly"
+	}
+	if data.EndDate != "" {
+		end, err := time.Parse(Utils.DayLayout, data.EndDate)
+		if err != nil || end.Before(start) {
+			return "endDate", "income.endDateInvalid"
+		}
+	}
+	return "", ""
+}
+
+// addMonths 加幾個月，day是原本的日期，超過那個月的天數就用月底
+func addMonths(t time.Time, months, day int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, last)-1)
+}
+
+// occurrences 固定收入在[start, end)之間每一次入帳的日期，都是loc時區當天的00:00
+func (ri RecurringIncomeObject) occurrences(loc *time.Location, start, end time.Time) []time.Time {
+	first, err := Utils.ParseDay(ri.StartDate, loc)
+	if err != nil {
+		return nil
+	}
+	if ri.EndDate != "" {
+		last, err := Utils.ParseDay(ri.EndDate, loc)
+		if err != nil {
+			return nil
+		}
+		if last = last.AddDate(0, 0, 1); end.IsZero() || last.Before(end) {
+			end = last
+		}
+	}
+	nth := func(i int) (time.Time, bool) {
+		switch ri.Frequency {
+		case FrequencyWeekly:
+			return first.AddDate(0, 0, 7*i), true
+		case FrequencyBiweekly:
+			return first.AddDate(0, 0, 14*i), true
+		case FrequencyMonthly:
+			return addMonths(first, i, first.Day()), true
+		case FrequencyYearly:
+			return addMonths(first, 12*i, first.Day()), true
+		}
+		return time.Time{}, false
+	}
+	// 直接跳到start附近，開始日期很早的話不用從第一次一個一個算
+	// 日數用時間差算，遇到夏令時間可能差一天，所以少跳一次，剩下的交給迴圈
+	i := 0
+	if start.After(first) {
+		days := int(start.Sub(first).Hours() / 24)
+		months := (start.Year()-first.Year())*12 + int(start.Month()-first.Month())
+		switch ri.Frequency {
+		case FrequencyWeekly:
+			i = days/7 - 1
+		case FrequencyBiweekly:
+			i = days/14 - 1
+		case FrequencyMonthly:
+			i = months - 1
+		case FrequencyYearly:
+			i = months/12 - 1
+		}
+		i = max(i, 0)
+	}
+	var dates []time.Time
+	for ; ; i++ {
+		t, ok := nth(i)
+		if !ok || !t.Before(end) {
+			return dates
+		}
+		if !t.Before(start) {
+			dates = append(dates, t)
+		}
+	}
+}
+
+// expand 把固定收入在區間內的每一次入帳變成IncomeObject
+func (ri RecurringIncomeObject) expand(loc *time.Location, start, end time.Time) []IncomeObject {
+	var incomes []IncomeObject
+	now := time.Now()
+	for _, t := range ri.occurrences(loc, start, end) {
+		incomes = append(incomes, IncomeObject{
+			ID: ri.ID + "-" + t.Format(Utils.DayLayout), Source: ri.Source, Description: ri.Description,
+			Amount: ri.Amount, Date: int(t.Unix()), AccountID: ri.AccountID, UserID: ri.UserID, HouseholdID: ri.HouseholdID,
+			CreatedBy: ri.CreatedBy, RecurringID: ri.ID, Projected: t.After(now),
+		})
+	}
+	return incomes
+}
+
+// incomesBetween 區間內的收入，包含固定收入算出來的，end是zero value的話只算到今天
+func (h *handlerWithDB) incomesBetween(r *http.Request, sc scope, loc *time.Location, start, end time.Time, source string) ([]IncomeObject, error) {
+	extra := bson.M{}
+	if source != "" {
+		extra["source"] = source
+	}
+	filter := sc.filter(extra)
+	if f := dateRangeFilter(start, end); f != nil {
+		filter = bson.M{"$and": bson.A{filter, f}}
+	}
+	incomes := []IncomeObject{}
+	cursor, err := h.IColl.Find(r.Context(), filter)
+	if err == nil {
+		err = cursor.All(r.Context(), &incomes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recurring []RecurringIncomeObject
+	cursor, err = h.RColl.Find(r.Context(), sc.filter(extra))
+	if err == nil {
+		err = cursor.All(r.Context(), &recurring)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if end.IsZero() {
+		_, end, _ = Utils.PeriodRange("day", time.Now(), loc)
+	}
+	for _, ri := range recurring {
+		incomes = append(incomes, ri.expand(loc, start, end)...)
+	}
+	sort.SliceStable(incomes, func(i, j int) bool {
+		return Utils.UnixToTime(incomes[i].Date).After(Utils.UnixToTime(incomes[j].Date))
+	})
+	return incomes, nil
+}
+
+// ListIncomes 跟花費一樣可以用?from=&to=或?period=&date=篩選，也可以用?source=只看某個來源
+// 沒有指定區間時固定收入只列到今天
+func (h *handlerWithDB) ListIncomes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		loc, err := h.userLocation(r.Context(), sc.account)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		start, end, err := periodFromQuery(r.URL.Query(), loc)
+		if err != nil {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		data, err := h.incomesBetween(r, sc, loc, start, end, strings.TrimSpace(r.URL.Query().Get("source")))
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data IncomeObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		if field, msg := validateIncome(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if data.AccountID != "" {
+			if _, ok := h.checkAccountLink(w, r, sc, "accountID", data.AccountID); !ok {
+				return
+			}
+		}
+		if data.Date == 0 {
+			data.Date = int(time.Now().Unix())
+		}
+		if !h.checkPeriodOpen(w, r, sc, "date", data.AccountID, data.Date) {
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.Source = strings.TrimSpace(data.Source)
+		data.Description = strings.TrimSpace(data.Description)
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		data.RecurringID, data.Projected, data.ReconciledIn = "", false, ""
+		doc := sc.owned(bson.M{"id": data.ID, "source": data.Source,
+			"description": data.Description, "amount": data.Amount, "date": data.Date, "createdBy": sc.account})
+		if data.AccountID != "" {
+			doc["accountID"] = data.AccountID
+		}
+		if _, err := h.IColl.InsertOne(r.Context(), doc); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		metrics.IncomesCreated.Inc()
+		w.Header().Set("Location", "/api/v1/incomes/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) PatchIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		var patch IncomePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		var current IncomeObject
+		err := h.IColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "income.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if !h.checkEntriesOpen(w, r, sc, h.IColl, sc.filter(bson.M{"id": id})) {
+			return
+		}
+
+		set := bson.M{}
+		if patch.Source != nil {
+			current.Source = strings.TrimSpace(*patch.Source)
+			set["source"] = current.Source
+		}
+		if patch.Description != nil {
+			current.Description = strings.TrimSpace(*patch.Description)
+			set["description"] = current.Description
+		}
+		if patch.Amount != nil {
+			current.Amount = *patch.Amount
+			set["amount"] = current.Amount
+		}
+		if patch.Date != nil {
+			current.Date = *patch.Date
+			set["date"] = current.Date
+		}
+		if field, msg := validateIncome(current); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		unset := bson.M{}
+		if !h.patchAccountLink(w, r, sc, patch.AccountID, &current.AccountID, set, unset) {
+			return
+		}
+		if (patch.Date != nil || patch.AccountID != nil) && !h.checkPeriodOpen(w, r, sc, "date", current.AccountID, current.Date) {
+			return
+		}
+		if update := updateDoc(set, unset); len(update) > 0 {
+			_, err = h.IColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": id}), update)
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+func (h *handlerWithDB) RemoveIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		filter := sc.filter(bson.M{"id": mux.Vars(r)["id"]})
+		if !h.checkEntriesOpen(w, r, sc, h.IColl, filter) {
+			return
+		}
+		res, err := h.IColl.DeleteOne(r.Context(), filter)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "income.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handlerWithDB) ListRecurringIncomes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		data := []RecurringIncomeObject{}
+		cursor, err := h.RColl.Find(r.Context(), sc.filter(nil), options.Find().SetSort(bson.M{"startDate": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) PostRecurringIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data RecurringIncomeObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Frequency = strings.TrimSpace(data.Frequency)
+		if data.Frequency == "" {
+			data.Frequency = FrequencyMonthly
+		}
+		if field, msg := validateRecurringIncome(data); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if data.AccountID != "" {
+			if _, ok := h.checkAccountLink(w, r, sc, "accountID", data.AccountID); !ok {
+				return
+			}
+		}
+		// 從鎖定的期間開始的話，已經對帳的餘額會多出入帳
+		locked, err := h.recurringLockedThrough(r, sc, data)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if locked != "" {
+			writeError(w, r, CodeConflict, "startDate", "reconcile.periodLocked")
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.Source = strings.TrimSpace(data.Source)
+		data.Description = strings.TrimSpace(data.Description)
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		doc := sc.owned(bson.M{"id": data.ID, "source": data.Source, "description": data.Description,
+			"amount": data.Amount, "frequency": data.Frequency, "startDate": data.StartDate, "createdBy": sc.account})
+		if data.EndDate != "" {
+			doc["endDate"] = data.EndDate
+		}
+		if data.AccountID != "" {
+			doc["accountID"] = data.AccountID
+		}
+		if _, err = h.RColl.InsertOne(r.Context(), doc); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/recurringIncomes/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+// PatchRecurringIncome 改了之後過去跟未來的每一次入帳都會跟著變，只想改之後的話要設結束日再新增一筆
+func (h *handlerWithDB) PatchRecurringIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		var patch RecurringIncomePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		var current RecurringIncomeObject
+		err := h.RColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "income.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		before := current
+
+		set, unset := bson.M{}, bson.M{}
+		if patch.Source != nil {
+			current.Source = strings.TrimSpace(*patch.Source)
+			set["source"] = current.Source
+		}
+		if patch.Description != nil {
+			current.Description = strings.TrimSpace(*patch.Description)
+			set["description"] = current.Description
+		}
+		if patch.Amount != nil {
+			current.Amount = *patch.Amount
+			set["amount"] = current.Amount
+		}
+		if patch.Frequency != nil {
+			current.Frequency = strings.TrimSpace(*patch.Frequency)
+			set["frequency"] = current.Frequency
+		}
+		if patch.StartDate != nil {
+			current.StartDate = *patch.StartDate
+			set["startDate"] = current.StartDate
+		}
+		if patch.EndDate != nil {
+			current.EndDate = *patch.EndDate
+			if current.EndDate == "" {
+				unset["endDate"] = ""
+			} else {
+				set["endDate"] = current.EndDate
+			}
+		}
+		if field, msg := validateRecurringIncome(current); msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if !h.patchAccountLink(w, r, sc, patch.AccountID, &current.AccountID, set, unset) {
+			return
+		}
+		// 改之前或改之後落在對帳鎖定的期間，都只能改不影響金額的欄位
+		lockedBefore, err := h.recurringLockedThrough(r, sc, before)
+		var lockedAfter string
+		if err == nil {
+			lockedAfter, err = h.recurringLockedThrough(r, sc, current)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if field := recurringChangeLocked(before, current, max(lockedBefore, lockedAfter)); field != "" {
+			writeError(w, r, CodeConflict, field, "reconcile.periodLocked")
+			return
+		}
+		if update := updateDoc(set, unset); len(update) > 0 {
+			_, err = h.RColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": id}), update)
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+func (h *handlerWithDB) RemoveRecurringIncome() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var current RecurringIncomeObject
+		err := h.RColl.FindOne(r.Context(), sc.filter(bson.M{"id": mux.Vars(r)["id"]})).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "income.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		locked, err := h.recurringLockedThrough(r, sc, current)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if locked != "" {
+			writeError(w, r, CodeConflict, "id", "reconcile.periodLocked")
+			return
+		}
+		res, err := h.RColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": current.ID}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "income.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// cashFlowRange 決定報表的區間，沒指定就是今年，只給了一端的話另一端往前或往後推12個interval
+func cashFlowRange(start, end time.Time, interval string, loc *time.Location) (time.Time, time.Time) {
+	if start.IsZero() && end.IsZero() {
+		start, end, _ = Utils.PeriodRange("year", time.Now(), loc)
+		return start, end
+	}
+	if end.IsZero() {
+		end = start
+		for i := 0; i < 12; i++ {
+			_, end, _ = Utils.PeriodRange(interval, end, loc)
+		}
+	}
+	if start.IsZero() {
+		start = end
+		for i := 0; i < 12; i++ {
+			start, _, _ = Utils.PeriodRange(interval, start.AddDate(0, 0, -1), loc)
+		}
+	}
+	return start, end
+}
+
+// cashFlowRows 把[start, end)依照interval切開，頭尾不完整的期間只算區間內的部分
+func cashFlowRows(start, end time.Time, interval string, loc *time.Location) ([]time.Time, bool) {
+	var bounds []time.Time
+	for t := start; t.Before(end); {
+		if len(bounds) == maxCashFlowRows {
+			return nil, false
+		}
+		bounds = append(bounds, t)
+		_, t, _ = Utils.PeriodRange(interval, t, loc)
+	}
+	return append(bounds, end), true
+}
+
+func (row *CashFlowRow) finish() {
+	row.Net = row.Income - row.Expenses
+	if row.Income > 0 {
+		row.SavingsRate = math.Round(float64(row.Net)/float64(row.Income)*10000) / 10000
+	}
+}
+
+// CashFlow 每段期間的收入、花費跟存下來的錢，?interval=day|week|month|year(預設month)
+// 區間跟花費一樣用?from=&to=或?period=&date=指定
+func (h *handlerWithDB) CashFlow() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = "month"
+		}
+		if _, _, err := Utils.PeriodRange(interval, time.Now(), time.UTC); err != nil {
+			writeError(w, r, CodeValidation, "interval", "cashFlow.intervalInvalid")
+			return
+		}
+		loc, err := h.userLocation(r.Context(), sc.account)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		start, end, err := periodFromQuery(r.URL.Query(), loc)
+		if err != nil {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		start, end = cashFlowRange(start, end, interval, loc)
+		bounds, ok := cashFlowRows(start, end, interval, loc)
+		if !ok {
+			writeError(w, r, CodeValidation, "interval", "cashFlow.tooManyPeriods")
+			return
+		}
+
+		incomes, err := h.incomesBetween(r, sc, loc, start, end, "")
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		filter := bson.M{"$and": bson.A{sc.filter(nil), dateRangeFilter(start, end)}}
+		var expenses []ExpenseObject
+		cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"amount": 1, "date": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &expenses)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		tree, err := h.budgetTree(r, sc)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		rows := make([]CashFlowRow, len(bounds)-1)
+		for i := range rows {
+			rows[i].Start = bounds[i].Format(Utils.DayLayout)
+			rows[i].End = bounds[i+1].AddDate(0, 0, -1).Format(Utils.DayLayout)
+		}
+		rowFor := func(date int) *CashFlowRow {
+			t := Utils.UnixToTime(date)
+			i := sort.Search(len(bounds), func(i int) bool { return bounds[i].After(t) }) - 1
+			if i < 0 || i >= len(rows) {
+				return nil
+			}
+			return &rows[i]
+		}
+		sources := map[string]int{}
+		for _, income := range incomes {
+			if row := rowFor(income.Date); row != nil {
+				row.Income += income.Amount
+				if income.Projected {
+					row.ProjectedIncome += income.Amount
+				}
+				sources[income.Source] += income.Amount
+			}
+		}
+		for _, e := range expenses {
+			if row := rowFor(e.Date); row != nil {
+				row.Expenses += e.Amount
+			}
+		}
+
+		res := CashFlowResponse{Interval: interval, Periods: rows, BySource: []SourceTotal{}}
+		res.Total.Start, res.Total.End = rows[0].Start, rows[len(rows)-1].End
+		for i := range rows {
+			rows[i].finish()
+			res.Total.Income += rows[i].Income
+			res.Total.ProjectedIncome += rows[i].ProjectedIncome
+			res.Total.Expenses += rows[i].Expenses
+		}
+		res.Total.finish()
+		for source, amount := range sources {
+			res.BySource = append(res.BySource, SourceTotal{Source: source, Amount: amount})
+		}
+		sort.Slice(res.BySource, func(i, j int) bool {
+			if res.BySource[i].Amount != res.BySource[j].Amount {
+				return res.BySource[i].Amount > res.BySource[j].Amount
+			}
+			return res.BySource[i].Source < res.BySource[j].Source
+		})
+		// 子預算的上限已經包含在上層裡，只算最上層
+		res.Budgeted = tree.rootsMax()
+		months := end.Sub(start).Hours() / 24 / (365.2425 / 12)
+		res.AverageMonthlyIncome = int(math.Round(float64(res.Total.Income) / months))
+		res.AverageMonthlyExpenses = int(math.Round(float64(res.Total.Expenses) / months))
+		res.Affordable = res.Budgeted <= res.AverageMonthlyIncome
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+)
+
+func days(list []time.Time) []string {
+	var res []string
+	for _, t := range list {
+		res = append(res, t.Format(Utils.DayLayout))
+	}
+	return res
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestOccurrences(t *testing.T) {
+	loc := mustLocation(t, Utils.DefaultTimeZone)
+	day := func(s string) time.Time {
+		d, err := Utils.ParseDay(s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		name       string
+		ri         RecurringIncomeObject
+		start, end string
+		want       []string
+	}{
+		{
+			"month-end salary", RecurringIncomeObject{Frequency: FrequencyMonthly, StartDate: "2023-12-31"}, "2023-12-01", "2024-05-01",
+			[]string{"2023-12-31", "2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"},
+		},
+		{
+			"month-end salary in a common year", RecurringIncomeObject{Frequency: FrequencyMonthly, StartDate: "2023-01-31"}, "2023-02-01", "2023-04-01",
+			[]string{"2023-02-28", "2023-03-31"},
+		},
+		{
+			"long after the first occurrence", RecurringIncomeObject{Frequency: FrequencyMonthly, StartDate: "1990-01-31"}, "2024-02-01", "2024-04-01",
+			[]string{"2024-02-29", "2024-03-31"},
+		},
+		{
+			"weekly long after", RecurringIncomeObject{Frequency: FrequencyWeekly, StartDate: "2000-01-03"}, "2024-03-01", "2024-03-19",
+			[]string{"2024-03-04", "2024-03-11", "2024-03-18"},
+		},
+		{
+			"biweekly long after", RecurringIncomeObject{Frequency: FrequencyBiweekly, StartDate: "2000-01-03"}, "2024-03-01", "2024-04-01",
+			[]string{"2024-03-11", "2024-03-25"},
+		},
+		{
+			"yearly on leap day", RecurringIncomeObject{Frequency: FrequencyYearly, StartDate: "2000-02-29"}, "2023-01-01", "2025-01-01",
+			[]string{"2023-02-28", "2024-02-29"},
+		},
+		{
+			"range before the start", RecurringIncomeObject{Frequency: FrequencyMonthly, StartDate: "2024-05-10"}, "2024-01-01", "2024-06-01",
+			[]string{"2024-05-10"},
+		},
+		{
+			"end date is included", RecurringIncomeObject{Frequency: FrequencyMonthly, StartDate: "2024-01-31", EndDate: "2024-03-31"}, "2024-01-01", "2025-01-01",
+			[]string{"2024-01-31", "2024-02-29", "2024-03-31"},
+		},
+		{
+			"ended before the range", RecurringIncomeObject{Frequency: FrequencyWeekly, StartDate: "2024-01-01", EndDate: "2024-01-31"}, "2024-02-01", "2024-03-01",
+			nil,
+		},
+		{
+			"range end is excluded", RecurringIncomeObject{Frequency: FrequencyWeekly, StartDate: "2024-01-01"}, "2024-01-01", "2024-01-15",
+			[]string{"2024-01-01", "2024-01-08"},
+		},
+		{
+			"unknown frequency", RecurringIncomeObject{Frequency: "daily", StartDate: "2024-01-01"}, "2024-01-01", "2024-02-01",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := days(tt.ri.occurrences(loc, day(tt.start), day(tt.end)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("occurrences = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 直接跳到start附近算出來的，要跟從第一次一個一個算的一樣，有夏令時間的時區也是
+func TestOccurrencesJumpAhead(t *testing.T) {
+	for _, name := range []string{Utils.DefaultTimeZone, "America/New_York", "Australia/Sydney"} {
+		loc := mustLocation(t, name)
+		for _, frequency := range []string{FrequencyWeekly, FrequencyBiweekly, FrequencyMonthly, FrequencyYearly} {
+			for _, first := range []string{"2001-01-31", "2003-03-09", "2004-02-29", "2010-11-07"} {
+				ri := RecurringIncomeObject{Frequency: frequency, StartDate: first}
+				end := time.Date(2025, 1, 1, 0, 0, 0, 0, loc)
+				all := ri.occurrences(loc, time.Time{}, end)
+				for start := time.Date(2024, 1, 1, 0, 0, 0, 0, loc); start.Before(end); start = start.AddDate(0, 0, 5) {
+					var want []time.Time
+					for _, d := range all {
+						if !d.Before(start) {
+							want = append(want, d)
+						}
+					}
+					if got := ri.occurrences(loc, start, end); !reflect.DeepEqual(days(got), days(want)) {
+						t.Fatalf("%s %s from %s in %s: occurrences = %v, want %v", frequency, first, start.Format(Utils.DayLayout), name, days(got), days(want))
+					}
+				}
+			}
+		}
+	}
+}
+
+// 每一次入帳都是當地的00:00，跨過夏令時間也一樣
+func TestOccurrencesAcrossDST(t *testing.T) {
+	loc := mustLocation(t, "America/New_York")
+	ri := RecurringIncomeObject{Frequency: FrequencyWeekly, StartDate: "2024-03-03"}
+	got := ri.occurrences(loc, time.Date(2024, 3, 1, 0, 0, 0, 0, loc), time.Date(2024, 3, 18, 0, 0, 0, 0, loc))
+	if want := []string{"2024-03-03", "2024-03-10", "2024-03-17"}; !reflect.DeepEqual(days(got), want) {
+		t.Fatalf("occurrences = %v, want %v", days(got), want)
+	}
+	for _, d := range got {
+		if d.Hour() != 0 || d.Minute() != 0 {
+			t.Errorf("%v is not midnight", d)
+		}
+	}
+}
+
+func TestCashFlowRows(t *testing.T) {
+	loc := mustLocation(t, Utils.DefaultTimeZone)
+	start := time.Date(2024, 1, 15, 0, 0, 0, 0, loc)
+	bounds, ok := cashFlowRows(start, time.Date(2024, 4, 10, 0, 0, 0, 0, loc), "month", loc)
+	if !ok {
+		t.Fatal("rows rejected")
+	}
+	// 頭尾不完整的月份只算區間內的部分
+	if want := []string{"2024-01-15", "2024-02-01", "2024-03-01", "2024-04-01", "2024-04-10"}; !reflect.DeepEqual(days(bounds), want) {
+		t.Fatalf("bounds = %v, want %v", days(bounds), want)
+	}
+	if bounds, ok := cashFlowRows(start, start.AddDate(0, 0, maxCashFlowRows), "day", loc); !ok || len(bounds) != maxCashFlowRows+1 {
+		t.Fatalf("%d days: %d bounds, ok = %v, want %d rows", maxCashFlowRows, len(bounds), ok, maxCashFlowRows)
+	}
+	if _, ok := cashFlowRows(start, start.AddDate(0, 0, maxCashFlowRows+1), "day", loc); ok {
+		t.Fatalf("%d days accepted", maxCashFlowRows+1)
+	}
+}
+
+func TestCashFlow(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("recurringIncomes.find", docs(
+		bson.M{"id": "r1", "source": "salary", "amount": 50000, "frequency": FrequencyMonthly, "startDate": "2020-01-31", "endDate": "2024-03-31"},
+	))
+	mongo.Handle("incomes.find", docs(
+		bson.M{"id": "i1", "source": "bonus", "amount": 10000, "date": taipei(2024, 2, 1, 0).Unix()},
+	))
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e1", "amount": 30000, "date": taipei(2024, 1, 31, 23).UnixMilli()},
+		bson.M{"id": "e2", "amount": 20000, "date": taipei(2024, 4, 30, 23).Unix()},
+	))
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/cashflow?from=2024-01-01&to=2024-04-30", nil), "alice", nil)
+	rec := serve(h.CashFlow(), req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var res CashFlowResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		Start            string
+		Income, Expenses int
+	}
+	want := []row{
+		{"2024-01-01", 50000, 30000},
+		{"2024-02-01", 60000, 0},
+		{"2024-03-01", 50000, 0},
+		{"2024-04-01", 0, 20000}, // 結束日是3/31，四月沒有薪水
+	}
+	var got []row
+	for _, p := range res.Periods {
+		got = append(got, row{p.Start, p.Income, p.Expenses})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("periods = %v, want %v", got, want)
+	}
+	if res.Total.Income != 160000 || res.Total.Expenses != 50000 || res.Total.Net != 110000 {
+		t.Fatalf("total = %+v", res.Total)
+	}
+	if want := []SourceTotal{{"salary", 150000}, {"bonus", 10000}}; !reflect.DeepEqual(res.BySource, want) {
+		t.Fatalf("by source = %v, want %v", res.BySource, want)
+	}
+}
+
+func TestCashFlowTooManyPeriods(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	req := loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/cashflow?interval=day&from=2023-01-01&to=2024-12-31", nil), "alice", nil)
+	rec := serve(h.CashFlow(), req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if e := decodeError(t, rec); e.Field != "interval" || e.Message != T(req, "cashFlow.tooManyPeriods") {
+		t.Fatalf("error = %+v", e)
+	}
+	for _, c := range mongo.Commands() {
+		if c == "incomes.find" || c == "expenses.find" {
+			t.Fatalf("%s ran although the range was rejected", c)
+		}
+	}
+
+	req = loggedIn(t, httptest.NewRequest(http.MethodGet, "/api/v1/cashflow?interval=week&from=2023-01-01&to=2024-12-31", nil), "alice", nil)
+	if rec := serve(h.CashFlow(), req); rec.Code != http.StatusOK {
+		t.Fatalf("weekly: status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
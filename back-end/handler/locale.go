@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/i18n"
+)
+
+type UpdateLocaleObject struct {
+	Locale string `json:"locale"` // 空字串代表清除設定，改回跟著Accept-Language
+}
+
+// localeFor 決定這個request要用哪個語言回覆：使用者設定的語言優先，其次是Accept-Language
+func localeFor(r *http.Request) string {
+	if session, err := Store.Get(r, sessionConfig.Name); err == nil {
+		if locale, ok := session.Values["locale"].(string); ok {
+			if locale, ok := i18n.Supported(locale); ok {
+				return locale
+			}
+		}
+	}
+	return i18n.Match(r.Header.Get("Accept-Language"))
+}
+
+// T 把訊息key翻譯成這個request的語言
+func T(r *http.Request, key string) string {
+	if !i18n.Has(key) {
+		logFor(r).Warn("missing message key", "key", key)
+	}
+	return i18n.T(localeFor(r), key)
+}
+
+func (h *handlerWithDB) UpdateLocale() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		SID, ok := requireAccount(w, r)
+		if !ok {
+			// 通知front-end去log out並提醒使用者要重新登入
+			return
+		}
+
+		var data UpdateLocaleObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		locale := strings.TrimSpace(data.Locale)
+		if locale != "" {
+			var supported bool
+			if locale, supported = i18n.Supported(locale); !supported {
+				writeError(w, r, CodeValidation, "locale", "locale.invalid")
+				return
+			}
+		}
+
+		res, err := h.UColl.UpdateOne(r.Context(), bson.M{"account": SID}, bson.M{"$set": bson.M{"locale": locale}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			logFor(r).Warn("signed-in account not found")
+			writeError(w, r, CodeNotFound, "", "user.notFound")
+			return
+		}
+
+		// session裡也要更新，之後的回應才會換語言
+		session, err := Store.Get(r, sessionConfig.Name)
+		if err == nil {
+			session.Values["locale"] = locale
+			maxAge, _ := session.Values["maxAge"].(int)
+			session.Options = sessionOptions(maxAge)
+			if err := session.Save(r, w); err != nil {
+				logFor(r).Error("save session failed", "err", err)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "locale.updated")})
+	}
+}
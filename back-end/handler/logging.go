@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+
+	"mongodb-budget/logger"
+)
+
+// 每個request的log欄位，handler跑完之後access log才知道的資訊放這裡
+type requestLog struct {
+	route   string
+	user    string
+	traceID string
+}
+
+type requestLogKey struct{}
+
+// statusRecorder 記下handler寫出的status code跟大小
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap 讓http.ResponseController可以拿到原本的ResponseWriter
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// middleware 每個request結束時寫一筆access log (request ID、使用者、route、status、花費時間)
+// 也會把帶有request ID的logger放進context，handler裡用logFor(r)取得
+func AccessLog(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := logger.FromContext(r.Context()).With(
+			"request_id", RequestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+		)
+		info := &requestLog{}
+		ctx := logger.WithContext(r.Context(), l)
+		ctx = contextWithRequestLog(ctx, info)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		switch {
+		case rec.Status() >= 500:
+			level = slog.LevelError
+		case rec.Status() >= 400:
+			level = slog.LevelWarn
+		}
+		l.Log(ctx, level, "request",
+			"trace_id", info.traceID,
+			"route", info.route,
+			"user", info.user,
+			"status", rec.Status(),
+			"bytes", rec.bytes,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	}
+}
+
+// RouteName 給router.Use用的middleware，route比對完才知道是哪個route template
+func RouteName(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := requestLogFromContext(r); info != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.route, _ = route.GetPathTemplate()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func contextWithRequestLog(ctx context.Context, info *requestLog) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, info)
+}
+
+func requestLogFromContext(r *http.Request) *requestLog {
+	info, _ := r.Context().Value(requestLogKey{}).(*requestLog)
+	return info
+}
+
+// setLogUser 確認登入的帳號之後記到access log裡
+func setLogUser(r *http.Request, account string) {
+	if info := requestLogFromContext(r); info != nil {
+		info.user = account
+	}
+}
+
+// logFor 取得這個request的logger，已經知道使用者的話會帶上user欄位
+func logFor(r *http.Request) *slog.Logger {
+	l := logger.FromContext(r.Context())
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	if info := requestLogFromContext(r); info != nil && info.user != "" {
+		return l.With("user", info.user)
+	}
+	return l
+}
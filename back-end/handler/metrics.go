@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mongodb-budget/metrics"
+)
+
+// middleware 記錄每個route的request數量跟花費時間，要放在AccessLog裡面才拿得到route template
+func Metrics(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// 沒有比對到route的request(404、CORS preflight)統一歸在一起，避免label數量爆掉
+		route := "unmatched"
+		if info := requestLogFromContext(r); info != nil && info.route != "" {
+			route = info.route
+		}
+		status := strconv.Itoa(rec.Status())
+		method := metricMethod(r.Method)
+		metrics.HTTPRequests.WithLabelValues(route, method, status).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricMethod client可以送任意的method，不認識的都算成other
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// MetricsAuth 對外的listener上的/metrics要帶Authorization: Bearer <token>
+func MetricsAuth(token string) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				writeError(w, r, CodeUnauthenticated, "", "metrics.tokenInvalid")
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"mongodb-budget/config"
+	"mongodb-budget/metrics"
+)
+
+// 對外的listener只有設定token時才提供/metrics
+func TestMetricsEndpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		auth   string
+		status int
+	}{
+		{"no token configured", "", "", http.StatusNotFound},
+		{"no token configured with a header", "", "Bearer anything", http.StatusNotFound},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"token as a prefix", "s3cret", "Bearer s3cret2", http.StatusUnauthorized},
+		{"basic auth", "s3cret", "Basic czNjcmV0", http.StatusUnauthorized},
+		{"right token", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(c *config.Config) { c.Metrics.Token = tt.token })
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := s.do(req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			exposed := strings.Contains(rec.Body.String(), "budget_http_requests_total")
+			if exposed != (tt.status == http.StatusOK) {
+				t.Fatalf("metrics exposed = %v with status %d", exposed, rec.Code)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+// client送來的任意method不會變成新的label
+func TestMetricsUnknownMethod(t *testing.T) {
+	s := newTestServer(t)
+	// 先送一次拿到status，label才對得上
+	rec := s.do(httptest.NewRequest("PROPFIND", "/nothing", nil))
+	status := strconv.Itoa(rec.Code)
+	before := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("unmatched", "other", status))
+	s.do(httptest.NewRequest("BREW", "/nothing", nil))
+	if got := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("unmatched", "other", status)); got != before+1 {
+		t.Fatalf("other = %v, want %v", got, before+1)
+	}
+}
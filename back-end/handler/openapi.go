@@ -0,0 +1,80 @@
+package handler
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// API的OpenAPI 3文件，新增或修改/api/v1的route時要一起更新，client package也是照著這份文件寫的
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// CheckOpenAPI 比對router上/api/v1的route跟OpenAPI文件是否一致，回傳所有不一致的地方
+func CheckOpenAPI(router *mux.Router) ([]string, error) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, err
+	}
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths {
+		if !strings.HasPrefix(path, "/api/v1") {
+			continue
+		}
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	registered := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/v1") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			registered[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for route := range registered {
+		if !documented[route] {
+			problems = append(problems, fmt.Sprintf("%s is registered but not documented", route))
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			problems = append(problems, fmt.Sprintf("%s is documented but not registered", route))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
@@ -0,0 +1,339 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"mongodb-budget/handler"
+)
+
+// 跟OpenAPI文件對照：每個文件裡的operation都用httptest打一次完整的server，
+// 沒登入跟登入後各一次，回應的status要是文件列出來的，body要符合對應的schema
+// 資料庫是空的假資料庫，所以大多是列表、新增成功、找不到跟欄位錯誤這幾種回應
+
+type schema = map[string]any
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]schema `json:"schemas"`
+		Responses map[string]schema `json:"responses"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Security    *[]any `json:"security"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]schema `json:"responses"`
+}
+
+// path參數的值，沒列出來的用"test"
+var pathValues = map[string]string{"index": "0", "account": "bob"}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+func TestOpenAPIOperations(t *testing.T) {
+	s := newTestServer(t)
+
+	problems, err := handler.CheckOpenAPI(s.Router())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("route mismatch: %s", p)
+	}
+
+	rec := s.do(httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	var doc openAPIDoc
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode OpenAPI document: %v", err)
+	}
+	v := &validator{doc: &doc}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for method, raw := range doc.Paths[path] {
+			if method == "parameters" {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+			method = strings.ToUpper(method)
+			target := pathParam.ReplaceAllStringFunc(path, func(m string) string {
+				if value, ok := pathValues[m[1:len(m)-1]]; ok {
+					return value
+				}
+				return "test"
+			})
+			for _, loggedIn := range []bool{false, true} {
+				name := method + " " + path
+				if loggedIn {
+					name += " (logged in)"
+				}
+				t.Run(name, func(t *testing.T) {
+					req := httptest.NewRequest(method, target, v.requestBody(&op))
+					if op.RequestBody != nil {
+						for contentType := range op.RequestBody.Content {
+							req.Header.Set("Content-Type", contentType)
+						}
+					}
+					if loggedIn {
+						s.login(t, req, "alice")
+					}
+					v.checkResponse(t, &op, s.do(req))
+				})
+			}
+		}
+	}
+}
+
+type validator struct {
+	doc *openAPIDoc
+}
+
+// resolve 展開$ref，支援#/components/schemas/跟#/components/responses/
+func (v *validator) resolve(s schema) schema {
+	for {
+		ref, ok := s["$ref"].(string)
+		if !ok {
+			return s
+		}
+		name := ref[strings.LastIndex(ref, "/")+1:]
+		switch {
+		case strings.HasPrefix(ref, "#/components/schemas/"):
+			s = v.doc.Components.Schemas[name]
+		case strings.HasPrefix(ref, "#/components/responses/"):
+			s = v.doc.Components.Responses[name]
+		default:
+			return nil
+		}
+	}
+}
+
+// requestBody 依照schema產生一個request body，必填欄位都會有值
+func (v *validator) requestBody(op *operation) io.Reader {
+	if op.RequestBody == nil {
+		return nil
+	}
+	for contentType, media := range op.RequestBody.Content {
+		if contentType == "text/csv" {
+			return strings.NewReader("date,description,amount\n2026-01-15,coffee,-120\n")
+		}
+		body, _ := json.Marshal(v.example(media.Schema))
+		return strings.NewReader(string(body))
+	}
+	return nil
+}
+
+func (v *validator) example(s schema) any {
+	s = v.resolve(s)
+	if example, ok := s["example"]; ok {
+		return example
+	}
+	if enum, ok := s["enum"].([]any); ok && len(enum) > 0 {
+		return enum[0]
+	}
+	switch s["type"] {
+	case "object":
+		obj := map[string]any{}
+		props, _ := s["properties"].(map[string]any)
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			prop, _ := props[name.(string)].(map[string]any)
+			if ro, _ := v.resolve(prop)["readOnly"].(bool); !ro {
+				obj[name.(string)] = v.example(prop)
+			}
+		}
+		return obj
+	case "array":
+		items, _ := s["items"].(map[string]any)
+		minItems, _ := s["minItems"].(float64)
+		arr := []any{}
+		for i := 0; i < int(minItems); i++ {
+			arr = append(arr, v.example(items))
+		}
+		return arr
+	case "integer", "number":
+		n := 100.0
+		if minimum, ok := s["minimum"].(float64); ok {
+			n = math.Max(n, minimum)
+		}
+		if maximum, ok := s["maximum"].(float64); ok {
+			n = math.Min(n, maximum)
+		}
+		return n
+	case "boolean":
+		return false
+	}
+	switch s["format"] {
+	case "date":
+		return "2026-01-15"
+	case "date-time":
+		return "2026-01-15T08:00:00Z"
+	}
+	return "test"
+}
+
+// checkResponse status要在文件裡，body要符合那個status的schema
+func (v *validator) checkResponse(t *testing.T, op *operation, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	status := fmt.Sprint(rec.Code)
+	resp, ok := op.Responses[status]
+	if !ok {
+		t.Fatalf("undocumented status %s: %s", status, rec.Body.String())
+	}
+	resp = v.resolve(resp)
+	content, _ := resp["content"].(map[string]any)
+	if len(content) == 0 {
+		if rec.Body.Len() > 0 {
+			t.Errorf("status %s is documented without a body, got %q", status, rec.Body.String())
+		}
+		return
+	}
+	media, ok := content["application/json"].(map[string]any)
+	if !ok {
+		return
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("status %s: Content-Type = %q, want application/json", status, ct)
+	}
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status %s: decode body: %v: %s", status, err, rec.Body.String())
+	}
+	schema, _ := media["schema"].(map[string]any)
+	for _, p := range v.validate(schema, body, "body") {
+		t.Errorf("status %s: %s", status, p)
+	}
+}
+
+// validate 檢查value符合schema，支援文件裡用到的關鍵字，回傳所有不符合的地方
+// 回應裡多出文件沒有的欄位也算錯，除非schema有additionalProperties或是完全沒列properties
+func (v *validator) validate(s schema, value any, at string) []string {
+	s = v.resolve(s)
+	if s == nil {
+		return []string{at + ": unresolved schema"}
+	}
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == value
+		}
+		if !found {
+			fail("%v is not one of %v", value, enum)
+		}
+	}
+	switch s["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			fail("want object, got %T", value)
+			return problems
+		}
+		props, _ := s["properties"].(map[string]any)
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := props[name].(map[string]any); ok {
+				if wo, _ := v.resolve(prop)["writeOnly"].(bool); wo {
+					fail("writeOnly property %q in response", name)
+				}
+				problems = append(problems, v.validate(prop, obj[name], at+"."+name)...)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case map[string]any:
+				problems = append(problems, v.validate(extra, obj[name], at+"."+name)...)
+			case bool:
+				if !extra {
+					fail("undocumented property %q", name)
+				}
+			default:
+				if props != nil {
+					fail("undocumented property %q", name)
+				}
+			}
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			fail("want array, got %T", value)
+			return problems
+		}
+		if maxItems, ok := s["maxItems"].(float64); ok && len(arr) > int(maxItems) {
+			fail("%d items, want at most %v", len(arr), maxItems)
+		}
+		if minItems, ok := s["minItems"].(float64); ok && len(arr) < int(minItems) {
+			fail("%d items, want at least %v", len(arr), minItems)
+		}
+		items, _ := s["items"].(map[string]any)
+		for i, item := range arr {
+			problems = append(problems, v.validate(items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("want string, got %T", value)
+			return problems
+		}
+		if maxLength, ok := s["maxLength"].(float64); ok && len([]rune(str)) > int(maxLength) {
+			fail("%q is longer than %v", str, maxLength)
+		}
+		layout := map[any]string{"date": "2006-01-02", "date-time": time.RFC3339}[s["format"]]
+		if _, err := time.Parse(layout, str); layout != "" && err != nil {
+			fail("%q is not a %v", str, s["format"])
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			fail("want %v, got %T", s["type"], value)
+			return problems
+		}
+		if s["type"] == "integer" && n != math.Trunc(n) {
+			fail("%v is not an integer", n)
+		}
+		if minimum, ok := s["minimum"].(float64); ok && n < minimum {
+			fail("%v is less than %v", n, minimum)
+		}
+		if maximum, ok := s["maximum"].(float64); ok && n > maximum {
+			fail("%v is greater than %v", n, maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("want boolean, got %T", value)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,1071 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/DB"
+	"mongodb-budget/Utils"
+	"mongodb-budget/metrics"
+)
+
+// 對帳：上傳銀行或信用卡的對帳單，每一行跟帳戶裡記的花費、收入、轉帳配對
+// 伺服器先依照金額、日期跟說明猜一個配對(suggested)，使用者確認或自己指定之後才算數(confirmed)
+// 每一行都處理完、帳戶這段期間也沒有多出來的紀錄，就可以鎖定，鎖定後配對到的紀錄跟帳戶鎖定日(含)以前的紀錄都不能再改
+
+const (
+	StatementOpen   = "open"
+	StatementLocked = "locked"
+)
+
+// 對帳單每一行的狀態
+const (
+	LineUnmatched = "unmatched"
+	LineSuggested = "suggested" // 伺服器猜的，還沒確認
+	LineConfirmed = "confirmed"
+	LineIgnored   = "ignored" // 不用記帳的，例如帳戶內部的調整
+)
+
+const (
+	matchWindowDays = 3   // 銀行入帳日跟實際消費日常常差幾天
+	matchThreshold  = 0.5 // 同一天金額一樣就會超過，差一天以上要說明也有點像
+	dateWeight      = 0.6
+	maxAssignSize   = 200 // 匈牙利演算法是O(n³)，同金額的筆數超過這個就用greedy
+)
+
+type StatementLine struct {
+	Index       int     `json:"index"`
+	Date        string  `json:"date"` // 2006-01-02
+	Description string  `json:"description"`
+	Amount      int     `json:"amount"` // 對帳戶的影響，支出是負的，跟LedgerEntry一樣
+	Status      string  `json:"status"`
+	MatchKind   string  `json:"matchKind,omitempty"` // LedgerEntry的kind
+	MatchID     string  `json:"matchID,omitempty"`
+	Score       float64 `json:"score,omitempty"` // 0~1，越高越像
+}
+
+type StatementObject struct {
+	ID               string          `json:"id"`
+	AccountID        string          `json:"accountID"`
+	From             string          `json:"from"` // 對帳單第一天跟最後一天(含)
+	To               string          `json:"to"`
+	Status           string          `json:"status"`
+	Lines            []StatementLine `json:"lines"`
+	UploadedAt       int             `json:"uploadedAt"`
+	LockedAt         int             `json:"lockedAt,omitempty"`
+	UnmatchedEntries []LedgerEntry   `json:"unmatchedEntries,omitempty"` // 帳戶在這段期間有記、對帳單上卻沒有的，不會存進資料庫
+	UserID           string          `json:"userID,omitempty"`
+	HouseholdID      string          `json:"householdID,omitempty"`
+	CreatedBy        string          `json:"createdBy,omitempty"`
+}
+
+// StatementLinePatch Action是confirm(接受建議)、reject、ignore、match(自己指定Kind跟MatchID)
+// 或create(帳上沒有這筆支出，直接新增一筆花費，BudgetID沒填就用自動分類的規則)
+type StatementLinePatch struct {
+	Action   string `json:"action"`
+	Kind     string `json:"kind"`
+	MatchID  string `json:"matchID"`
+	BudgetID string `json:"budgetID"`
+}
+
+// candidate 可以配對的帳戶明細，Day是使用者時區的日期
+type candidate struct {
+	LedgerEntry
+	Day string
+}
+
+func entryKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+func (l StatementLine) key() string {
+	return entryKey(l.MatchKind, l.MatchID)
+}
+
+func (l StatementLine) doc() bson.M {
+	doc := bson.M{"index": l.Index, "date": l.Date, "description": l.Description, "amount": l.Amount, "status": l.Status}
+	if l.MatchID != "" {
+		doc["matchKind"], doc["matchID"], doc["score"] = l.MatchKind, l.MatchID, l.Score
+	}
+	return doc
+}
+
+func linesDoc(lines []StatementLine) bson.A {
+	docs := bson.A{}
+	for _, l := range lines {
+		docs = append(docs, l.doc())
+	}
+	return docs
+}
+
+// clearMatch 回到還沒配對的狀態
+func (l *StatementLine) clearMatch(status string) {
+	l.Status, l.MatchKind, l.MatchID, l.Score = status, "", "", 0
+}
+
+// bigrams 說明的相鄰兩個字，只看字母跟數字，大小寫不分
+func bigrams(s string) map[string]int {
+	var runes []rune
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes = append(runes, r)
+		}
+	}
+	grams := map[string]int{}
+	if len(runes) == 1 {
+		grams[string(runes)]++
+	}
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])]++
+	}
+	return grams
+}
+
+// descriptionSimilarity Dice係數，中文沒有空白分詞，用bigram比較不用斷詞
+func descriptionSimilarity(a, b string) float64 {
+	ga, gb := bigrams(a), bigrams(b)
+	total, common := 0, 0
+	for g, n := range ga {
+		total += n
+		common += min(n, gb[g])
+	}
+	for _, n := range gb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+// dayDiff 兩個2006-01-02之間差幾天，格式不對的話回傳很大的數字
+func dayDiff(a, b string) int {
+	ta, errA := time.Parse(Utils.DayLayout, a)
+	tb, errB := time.Parse(Utils.DayLayout, b)
+	if errA != nil || errB != nil {
+		return math.MaxInt32
+	}
+	d := int(math.Round(ta.Sub(tb).Hours() / 24))
+	if d < 0 {
+		d = -d
+	}
+	return d
+}
+
+func shiftDay(day string, days int) string {
+	t, err := time.Parse(Utils.DayLayout, day)
+	if err != nil {
+		return day
+	}
+	return t.AddDate(0, 0, days).Format(Utils.DayLayout)
+}
+
+// matchScore 日期越近、說明越像分數越高，金額不用比，一定要一樣
+func matchScore(line StatementLine, c candidate) float64 {
+	closeness := 1 - float64(dayDiff(line.Date, c.Day))/float64(matchWindowDays+1)
+	if closeness < 0 {
+		closeness = 0
+	}
+	score := dateWeight*closeness + (1-dateWeight)*descriptionSimilarity(line.Description, c.Description)
+	return math.Round(score*100) / 100
+}
+
+// suggestMatches 幫還沒確認的行重新找配對，taken是已經被確認配對走的明細
+// 金額一樣的行跟明細分成一組，組內取總分最高的一對一配對，太大的組才用分數由高到低分配
+func suggestMatches(lines []StatementLine, candidates []candidate, taken map[string]bool) {
+	used := map[string]bool{}
+	for k := range taken {
+		used[k] = true
+	}
+	for i := range lines {
+		switch lines[i].Status {
+		case LineConfirmed:
+			used[lines[i].key()] = true
+		case LineSuggested:
+			lines[i].clearMatch(LineUnmatched)
+		}
+	}
+
+	rowsByAmount, colsByAmount := map[int][]int{}, map[int][]int{}
+	var amounts []int
+	for i, l := range lines {
+		if l.Status != LineUnmatched {
+			continue
+		}
+		if _, ok := rowsByAmount[l.Amount]; !ok {
+			amounts = append(amounts, l.Amount)
+		}
+		rowsByAmount[l.Amount] = append(rowsByAmount[l.Amount], i)
+	}
+	for j, c := range candidates {
+		if _, ok := rowsByAmount[c.Amount]; ok && !used[entryKey(c.Kind, c.ID)] {
+			colsByAmount[c.Amount] = append(colsByAmount[c.Amount], j)
+		}
+	}
+	for _, amount := range amounts {
+		rows, cols := rowsByAmount[amount], colsByAmount[amount]
+		if len(cols) == 0 {
+			continue
+		}
+		scores := make([][]float64, len(rows))
+		for a, i := range rows {
+			scores[a] = make([]float64, len(cols))
+			for b, j := range cols {
+				if dayDiff(lines[i].Date, candidates[j].Day) > matchWindowDays {
+					continue
+				}
+				if score := matchScore(lines[i], candidates[j]); score >= matchThreshold {
+					scores[a][b] = score
+				}
+			}
+		}
+		var matched []int
+		if len(rows) <= maxAssignSize && len(cols) <= maxAssignSize {
+			matched = assign(scores)
+		} else {
+			matched = assignGreedy(scores)
+		}
+		for a, b := range matched {
+			if b < 0 || scores[a][b] == 0 {
+				continue
+			}
+			l, c := &lines[rows[a]], candidates[cols[b]]
+			l.Status, l.MatchKind, l.MatchID, l.Score = LineSuggested, c.Kind, c.ID, scores[a][b]
+		}
+	}
+}
+
+// assign 總分最高的一對一配對(匈牙利演算法)，回傳每一列配到第幾欄，-1代表沒配到
+func assign(scores [][]float64) []int {
+	n := len(scores)
+	if n == 0 {
+		return nil
+	}
+	m := len(scores[0])
+	if n > m {
+		// 演算法要求列不比欄多，轉置之後再轉回來
+		transposed := make([][]float64, m)
+		for b := range transposed {
+			transposed[b] = make([]float64, n)
+			for a := range scores {
+				transposed[b][a] = scores[a][b]
+			}
+		}
+		res := make([]int, n)
+		for a := range res {
+			res[a] = -1
+		}
+		for b, a := range assign(transposed) {
+			if a >= 0 {
+				res[a] = b
+			}
+		}
+		return res
+	}
+
+	// 下標從1開始，p[j]是第j欄配到的列，成本是負的分數
+	u, v := make([]float64, n+1), make([]float64, m+1)
+	p, way := make([]int, m+1), make([]int, m+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		usedCol := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for p[j0] != 0 {
+			usedCol[j0] = true
+			i0, delta, j1 := p[j0], math.Inf(1), 0
+			for j := 1; j <= m; j++ {
+				if usedCol[j] {
+					continue
+				}
+				if cur := -scores[i0-1][j-1] - u[i0] - v[j]; cur < minv[j] {
+					minv[j], way[j] = cur, j0
+				}
+				if minv[j] < delta {
+					delta, j1 = minv[j], j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if usedCol[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+	res := make([]int, n)
+	for a := range res {
+		res[a] = -1
+	}
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			res[p[j]-1] = j - 1
+		}
+	}
+	return res
+}
+
+// assignGreedy 分數由高到低一對一分配，同分的話前面的列優先
+func assignGreedy(scores [][]float64) []int {
+	type pair struct {
+		row, col int
+		score    float64
+	}
+	var pairs []pair
+	for a := range scores {
+		for b, score := range scores[a] {
+			if score > 0 {
+				pairs = append(pairs, pair{a, b, score})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(x, y int) bool {
+		if pairs[x].score != pairs[y].score {
+			return pairs[x].score > pairs[y].score
+		}
+		return pairs[x].row < pairs[y].row
+	})
+	res := make([]int, len(scores))
+	for a := range res {
+		res[a] = -1
+	}
+	usedCol := map[int]bool{}
+	for _, p := range pairs {
+		if res[p.row] < 0 && !usedCol[p.col] {
+			res[p.row] = p.col
+			usedCol[p.col] = true
+		}
+	}
+	return res
+}
+
+// unmatchedEntries 對帳單期間內帳戶有記、但是沒有配對到任何一行的明細
+func unmatchedEntries(st StatementObject, candidates []candidate, taken map[string]bool) []LedgerEntry {
+	matched := map[string]bool{}
+	for _, l := range st.Lines {
+		if l.MatchID != "" {
+			matched[l.key()] = true
+		}
+	}
+	entries := []LedgerEntry{}
+	for _, c := range candidates {
+		key := entryKey(c.Kind, c.ID)
+		if c.Day < st.From || c.Day > st.To || matched[key] || taken[key] {
+			continue
+		}
+		entries = append(entries, c.LedgerEntry)
+	}
+	return entries
+}
+
+func (h *handlerWithDB) findStatement(r *http.Request, sc scope, id string) (StatementObject, error) {
+	var st StatementObject
+	err := h.StColl.FindOne(r.Context(), sc.filter(bson.M{"id": id})).Decode(&st)
+	return st, err
+}
+
+// statementCandidates 帳戶所有的明細跟其他對帳單已經確認配對走的
+func (h *handlerWithDB) statementCandidates(r *http.Request, sc scope, st StatementObject) ([]candidate, map[string]bool, error) {
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		return nil, nil, err
+	}
+	movements, err := h.accountMovements(r, sc, loc, []string{st.AccountID})
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := make([]candidate, len(movements[st.AccountID]))
+	for i, m := range movements[st.AccountID] {
+		candidates[i] = candidate{LedgerEntry: m, Day: Utils.LocalDay(m.Date, loc)}
+	}
+
+	var others []StatementObject
+	cursor, err := h.StColl.Find(r.Context(), sc.filter(bson.M{"accountID": st.AccountID, "id": bson.M{"$ne": st.ID}}))
+	if err == nil {
+		err = cursor.All(r.Context(), &others)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	taken := map[string]bool{}
+	for _, other := range others {
+		for _, l := range other.Lines {
+			if l.Status == LineConfirmed {
+				taken[l.key()] = true
+			}
+		}
+	}
+	return candidates, taken, nil
+}
+
+// nearby 對帳單期間前後幾天的明細，自動配對只看這些
+func nearby(st StatementObject, candidates []candidate) []candidate {
+	from, to := shiftDay(st.From, -matchWindowDays), shiftDay(st.To, matchWindowDays)
+	var res []candidate
+	for _, c := range candidates {
+		if c.Day >= from && c.Day <= to {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// writeStatement 回覆對帳單，順便算出帳戶多出來的明細
+func (h *handlerWithDB) writeStatement(w http.ResponseWriter, r *http.Request, sc scope, status int, st StatementObject) {
+	candidates, taken, err := h.statementCandidates(r, sc, st)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	st.UnmatchedEntries = unmatchedEntries(st, candidates, taken)
+	writeJSON(w, status, st)
+}
+
+// statementFor 讀取對帳單，找不到或是已經鎖定(要改的時候)都已經回覆錯誤，回傳false
+func (h *handlerWithDB) statementFor(w http.ResponseWriter, r *http.Request, sc scope, mustBeOpen bool) (StatementObject, bool) {
+	st, err := h.findStatement(r, sc, mux.Vars(r)["id"])
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, CodeNotFound, "id", "statement.notFound")
+		return st, false
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return st, false
+	}
+	if mustBeOpen && st.Status == StatementLocked {
+		writeError(w, r, CodeConflict, "id", "statement.locked")
+		return st, false
+	}
+	return st, true
+}
+
+// PostStatement body是CSV，第一列(或前幾列說明之後)要有表頭
+// 信用卡帳單的金額通常是正的代表消費，這時候要加?outflowPositive=true
+func (h *handlerWithDB) PostStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		account, err := h.findAccount(r, sc, mux.Vars(r)["id"])
+		if err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeNotFound, "id", "financialAccount.notFound")
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		outflowPositive := false
+		if v := r.URL.Query().Get("outflowPositive"); v != "" {
+			if outflowPositive, err = strconv.ParseBool(v); err != nil {
+				writeError(w, r, CodeValidation, "outflowPositive", "statement.outflowPositiveInvalid")
+				return
+			}
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if bodyTooLarge(r) {
+				writeError(w, r, CodePayloadTooLarge, "", "request.tooLarge")
+				return
+			}
+			writeError(w, r, CodeValidation, "csv", "statement.csvInvalid")
+			return
+		}
+		rows, err := parseStatementCSV(body, outflowPositive)
+		var invalid *csvError
+		if errors.As(err, &invalid) {
+			logFor(r).Debug("statement rejected", "err", err)
+			writeError(w, r, CodeValidation, invalid.field(), invalid.Key)
+			return
+		}
+
+		st := StatementObject{ID: primitive.NewObjectID().Hex(), AccountID: account.ID, Status: StatementOpen,
+			UploadedAt: int(time.Now().Unix()), CreatedBy: sc.account}
+		st.UserID, st.HouseholdID = sc.owner()
+		for i, row := range rows {
+			st.Lines = append(st.Lines, StatementLine{Index: i, Date: row.Day, Description: row.Description,
+				Amount: row.Amount, Status: LineUnmatched})
+			if st.From == "" || row.Day < st.From {
+				st.From = row.Day
+			}
+			if row.Day > st.To {
+				st.To = row.Day
+			}
+		}
+		candidates, taken, err := h.statementCandidates(r, sc, st)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		suggestMatches(st.Lines, nearby(st, candidates), taken)
+
+		_, err = h.StColl.InsertOne(r.Context(), sc.owned(bson.M{"id": st.ID, "accountID": st.AccountID, "from": st.From,
+			"to": st.To, "status": st.Status, "lines": linesDoc(st.Lines), "uploadedAt": st.UploadedAt, "createdBy": sc.account}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("statement uploaded", "id", st.ID, "account_id", st.AccountID, "lines", len(st.Lines))
+		st.UnmatchedEntries = unmatchedEntries(st, candidates, taken)
+		w.Header().Set("Location", "/api/v1/statements/"+st.ID)
+		writeJSON(w, http.StatusCreated, st)
+	}
+}
+
+// ListStatements 可以用?accountID=只看某個帳戶的，新的在前
+func (h *handlerWithDB) ListStatements() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		extra := bson.M{}
+		if id := r.URL.Query().Get("accountID"); id != "" {
+			extra["accountID"] = id
+		}
+		data := []StatementObject{}
+		cursor, err := h.StColl.Find(r.Context(), sc.filter(extra), options.Find().SetSort(bson.M{"uploadedAt": -1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+func (h *handlerWithDB) GetStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, false)
+		if !ok {
+			return
+		}
+		h.writeStatement(w, r, sc, http.StatusOK, st)
+	}
+}
+
+// saveLines 把改過的行寫回去
+func (h *handlerWithDB) saveLines(w http.ResponseWriter, r *http.Request, sc scope, st StatementObject) bool {
+	_, err := h.StColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": st.ID}), bson.M{"$set": bson.M{"lines": linesDoc(st.Lines)}})
+	if err != nil {
+		writeDBError(w, r, "db write failed", err, "db.writeFailed")
+		return false
+	}
+	return true
+}
+
+func (h *handlerWithDB) PatchStatementLine() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var patch StatementLinePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, true)
+		if !ok {
+			return
+		}
+		index, err := strconv.Atoi(mux.Vars(r)["index"])
+		if err != nil || index < 0 || index >= len(st.Lines) {
+			writeError(w, r, CodeNotFound, "index", "statement.lineNotFound")
+			return
+		}
+		candidates, taken, err := h.statementCandidates(r, sc, st)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		line := &st.Lines[index]
+		switch patch.Action {
+		case "confirm":
+			if line.Status != LineSuggested {
+				writeError(w, r, CodeConflict, "action", "reconcile.nothingToConfirm")
+				return
+			}
+			if taken[line.key()] {
+				writeError(w, r, CodeConflict, "matchID", "reconcile.alreadyMatched")
+				return
+			}
+			line.Status = LineConfirmed
+		case "reject":
+			line.clearMatch(LineUnmatched)
+		case "ignore":
+			line.clearMatch(LineIgnored)
+		case "match":
+			if patch.Kind == "" || patch.MatchID == "" {
+				writeError(w, r, CodeValidation, "matchID", "reconcile.matchRequired")
+				return
+			}
+			key := entryKey(patch.Kind, patch.MatchID)
+			var found *candidate
+			for i := range candidates {
+				if entryKey(candidates[i].Kind, candidates[i].ID) == key {
+					found = &candidates[i]
+				}
+			}
+			if found == nil {
+				writeError(w, r, CodeValidation, "matchID", "reconcile.entryNotFound")
+				return
+			}
+			if found.Amount != line.Amount {
+				writeError(w, r, CodeValidation, "matchID", "reconcile.amountMismatch")
+				return
+			}
+			if taken[key] {
+				writeError(w, r, CodeConflict, "matchID", "reconcile.alreadyMatched")
+				return
+			}
+			for i := range st.Lines {
+				if i == index || st.Lines[i].MatchID == "" || st.Lines[i].key() != key {
+					continue
+				}
+				// 別行只是建議的話讓給這一行，已經確認的要先取消
+				if st.Lines[i].Status == LineConfirmed {
+					writeError(w, r, CodeConflict, "matchID", "reconcile.alreadyMatched")
+					return
+				}
+				st.Lines[i].clearMatch(LineUnmatched)
+			}
+			line.Status, line.MatchKind, line.MatchID, line.Score = LineConfirmed, found.Kind, found.ID, matchScore(*line, *found)
+		case "create":
+			if !h.importLine(w, r, sc, st.AccountID, line, patch.BudgetID) {
+				return
+			}
+		default:
+			writeError(w, r, CodeValidation, "action", "reconcile.actionInvalid")
+			return
+		}
+		if !h.saveLines(w, r, sc, st) {
+			return
+		}
+		st.UnmatchedEntries = unmatchedEntries(st, candidates, taken)
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// importLine 用對帳單的一行新增花費並配對上去，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) importLine(w http.ResponseWriter, r *http.Request, sc scope, accountID string, line *StatementLine, budgetID string) bool {
+	if line.MatchID != "" {
+		writeError(w, r, CodeConflict, "action", "reconcile.lineMatched")
+		return false
+	}
+	if line.Amount >= 0 {
+		writeError(w, r, CodeValidation, "action", "reconcile.createInflow")
+		return false
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	day, err := Utils.ParseDay(line.Date, loc)
+	if err != nil {
+		writeError(w, r, CodeValidation, "date", "expense.dateInvalid")
+		return false
+	}
+	data := ExpenseObject{ID: primitive.NewObjectID().Hex(), BudgetID: strings.TrimSpace(budgetID),
+		Description: line.Description, Amount: -line.Amount, Date: int(day.Unix()), AccountID: accountID}
+	if data.Description == "" {
+		data.Description = T(r, "statement.importedDescription")
+	}
+	if data.BudgetID == "" {
+		rule, err := h.categorize(r, sc, &data)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return false
+		}
+		if rule == nil {
+			writeError(w, r, CodeValidation, "budgetID", "rule.noMatch")
+			return false
+		}
+	} else {
+		exists, err := h.budgetExists(r, sc, data.BudgetID)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return false
+		}
+		if !exists {
+			writeError(w, r, CodeValidation, "budgetID", "budget.notFound")
+			return false
+		}
+	}
+	if !h.checkPeriodOpen(w, r, sc, "date", accountID, data.Date) {
+		return false
+	}
+
+	doc := sc.owned(bson.M{"id": data.ID, "budgetID": data.BudgetID, "description": data.Description,
+		"amount": data.Amount, "date": data.Date, "createdBy": sc.account, "accountID": accountID})
+	if len(data.Tags) > 0 {
+		doc["tags"] = data.Tags
+	}
+	if _, err := h.EColl.InsertOne(r.Context(), doc); err != nil {
+		writeDBError(w, r, "db write failed", err, "db.writeFailed")
+		return false
+	}
+	metrics.ExpensesCreated.Inc()
+	line.Status, line.MatchKind, line.MatchID, line.Score = LineConfirmed, EntryExpense, data.ID, 1
+	return true
+}
+
+// RematchStatement 補記了漏掉的花費之後，幫還沒確認的行重新找配對
+func (h *handlerWithDB) RematchStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, true)
+		if !ok {
+			return
+		}
+		candidates, taken, err := h.statementCandidates(r, sc, st)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		suggestMatches(st.Lines, nearby(st, candidates), taken)
+		if !h.saveLines(w, r, sc, st) {
+			return
+		}
+		st.UnmatchedEntries = unmatchedEntries(st, candidates, taken)
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// reconciledColls 每種明細存在哪個collection，固定收入算出來的沒有自己的紀錄，靠帳戶的鎖定日保護
+func (h *handlerWithDB) reconciledColls() map[string]*DB.Collection {
+	return map[string]*DB.Collection{
+		EntryExpense:     h.EColl,
+		EntryIncome:      h.IColl,
+		EntryTransferIn:  h.TColl,
+		EntryTransferOut: h.TColl,
+	}
+}
+
+// LockStatement 每一行都確認或略過、帳戶在這段期間也沒有對不到的明細才能鎖定
+func (h *handlerWithDB) LockStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, true)
+		if !ok {
+			return
+		}
+		account, err := h.findAccount(r, sc, st.AccountID)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		candidates, taken, err := h.statementCandidates(r, sc, st)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		current := map[string]candidate{}
+		for _, c := range candidates {
+			current[entryKey(c.Kind, c.ID)] = c
+		}
+
+		ids := map[string][]string{}
+		for _, l := range st.Lines {
+			field := fmt.Sprintf("lines[%d]", l.Index)
+			switch l.Status {
+			case LineIgnored:
+				continue
+			case LineConfirmed:
+			default:
+				writeError(w, r, CodeConflict, field, "reconcile.unresolvedLines")
+				return
+			}
+			// 確認之後紀錄可能又被改了或刪了
+			if c, ok := current[l.key()]; !ok || c.Amount != l.Amount {
+				writeError(w, r, CodeConflict, field, "reconcile.matchStale")
+				return
+			}
+			ids[l.MatchKind] = append(ids[l.MatchKind], l.MatchID)
+		}
+		if len(unmatchedEntries(st, candidates, taken)) > 0 {
+			writeError(w, r, CodeConflict, "id", "reconcile.unmatchedEntries")
+			return
+		}
+
+		for kind, coll := range h.reconciledColls() {
+			if len(ids[kind]) == 0 {
+				continue
+			}
+			_, err := coll.UpdateMany(r.Context(), sc.filter(bson.M{"id": bson.M{"$in": ids[kind]}}),
+				bson.M{"$set": bson.M{"reconciledIn": st.ID}})
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		st.Status, st.LockedAt = StatementLocked, int(time.Now().Unix())
+		_, err = h.StColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": st.ID}),
+			bson.M{"$set": bson.M{"status": st.Status, "lockedAt": st.LockedAt}})
+		if err == nil && st.To > account.LockedThrough {
+			_, err = h.AColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": account.ID}), bson.M{"$set": bson.M{"lockedThrough": st.To}})
+		}
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("statement locked", "id", st.ID, "account_id", st.AccountID, "through", st.To)
+		st.UnmatchedEntries = []LedgerEntry{}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// UnlockStatement 發現鎖定的期間有錯要改的時候用，只有擁有者可以解鎖
+func (h *handlerWithDB) UnlockStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleOwner)
+		if !ok {
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, false)
+		if !ok {
+			return
+		}
+		if st.Status != StatementLocked {
+			writeError(w, r, CodeConflict, "id", "statement.notLocked")
+			return
+		}
+		for _, coll := range []*DB.Collection{h.EColl, h.IColl, h.TColl} {
+			_, err := coll.UpdateMany(r.Context(), sc.filter(bson.M{"reconciledIn": st.ID}), bson.M{"$unset": bson.M{"reconciledIn": ""}})
+			if err != nil {
+				writeDBError(w, r, "db write failed", err, "db.writeFailed")
+				return
+			}
+		}
+		st.Status, st.LockedAt = StatementOpen, 0
+		_, err := h.StColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": st.ID}),
+			bson.M{"$set": bson.M{"status": st.Status}, "$unset": bson.M{"lockedAt": ""}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+
+		// 帳戶的鎖定日退回到其他還鎖著的對帳單最後一天
+		var others []StatementObject
+		cursor, err := h.StColl.Find(r.Context(), sc.filter(bson.M{"accountID": st.AccountID, "status": StatementLocked}),
+			options.Find().SetProjection(bson.M{"to": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &others)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		through := ""
+		for _, other := range others {
+			if other.To > through {
+				through = other.To
+			}
+		}
+		update := bson.M{"$set": bson.M{"lockedThrough": through}}
+		if through == "" {
+			update = bson.M{"$unset": bson.M{"lockedThrough": ""}}
+		}
+		if _, err := h.AColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": st.AccountID}), update); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("statement unlocked", "id", st.ID, "account_id", st.AccountID, "through", through)
+		h.writeStatement(w, r, sc, http.StatusOK, st)
+	}
+}
+
+// RemoveStatement 鎖定的要先解鎖才能刪
+func (h *handlerWithDB) RemoveStatement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		st, ok := h.statementFor(w, r, sc, true)
+		if !ok {
+			return
+		}
+		if _, err := h.StColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": st.ID, "status": StatementOpen})); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ledgerDoc 花費、收入、轉帳共用的欄位，檢查鎖定用
+type ledgerDoc struct {
+	AccountID     string
+	FromAccountID string
+	ToAccountID   string
+	Date          int
+	ReconciledIn  string
+}
+
+// lockedAccounts 範圍內有鎖定的帳戶跟鎖定到哪一天
+func (h *handlerWithDB) lockedAccounts(r *http.Request, sc scope) (map[string]string, error) {
+	var accounts []FinancialAccount
+	cursor, err := h.AColl.Find(r.Context(), sc.filter(bson.M{"lockedThrough": bson.M{"$exists": true}}),
+		options.Find().SetProjection(bson.M{"id": 1, "lockedThrough": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &accounts)
+	}
+	locked := map[string]string{}
+	for _, a := range accounts {
+		locked[a.ID] = a.LockedThrough
+	}
+	return locked, err
+}
+
+// checkEntriesOpen filter找到的花費、收入或轉帳要改或刪之前檢查，已經對帳或是落在帳戶鎖定期間的話回覆409
+// 有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkEntriesOpen(w http.ResponseWriter, r *http.Request, sc scope, coll *DB.Collection, filter bson.M) bool {
+	var docs []ledgerDoc
+	cursor, err := coll.Find(r.Context(), filter, options.Find().SetProjection(
+		bson.M{"accountID": 1, "fromAccountID": 1, "toAccountID": 1, "date": 1, "reconciledIn": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &docs)
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	if len(docs) == 0 {
+		return true
+	}
+	for _, d := range docs {
+		if d.ReconciledIn != "" {
+			writeError(w, r, CodeConflict, "id", "reconcile.entryLocked")
+			return false
+		}
+	}
+	locked, err := h.lockedAccounts(r, sc)
+	if err != nil || len(locked) == 0 {
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+		}
+		return err == nil
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	for _, d := range docs {
+		day := Utils.LocalDay(d.Date, loc)
+		for _, id := range []string{d.AccountID, d.FromAccountID, d.ToAccountID} {
+			if through, ok := locked[id]; ok && day <= through {
+				writeError(w, r, CodeConflict, "id", "reconcile.periodLocked")
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkPeriodOpen 新增或移動到帳戶已經鎖定的期間(鎖定日當天也算)的話回覆409，date是0代表現在
+// 有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkPeriodOpen(w http.ResponseWriter, r *http.Request, sc scope, field, accountID string, date int) bool {
+	if accountID == "" {
+		return true
+	}
+	account, err := h.findAccount(r, sc, accountID)
+	if err == mongo.ErrNoDocuments || (err == nil && account.LockedThrough == "") {
+		return true
+	}
+	var loc *time.Location
+	if err == nil {
+		loc, err = h.userLocation(r.Context(), sc.account)
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	if date == 0 {
+		date = int(time.Now().Unix())
+	}
+	if Utils.LocalDay(date, loc) <= account.LockedThrough {
+		writeError(w, r, CodeConflict, field, "reconcile.periodLocked")
+		return false
+	}
+	return true
+}
+
+// recurringLockedThrough 固定收入的帳戶鎖定的期間裡已經有入帳的話，回傳鎖定到哪一天，否則是空字串
+func (h *handlerWithDB) recurringLockedThrough(r *http.Request, sc scope, ri RecurringIncomeObject) (string, error) {
+	if ri.AccountID == "" {
+		return "", nil
+	}
+	account, err := h.findAccount(r, sc, ri.AccountID)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil || ri.StartDate > account.LockedThrough {
+		return "", err
+	}
+	return account.LockedThrough, nil
+}
+
+// recurringChangeLocked 鎖定期間內已經入帳過的固定收入，只能改來源、說明，結束日前後都要在鎖定日之後
+// 回傳不能改的欄位，都可以改的話是空字串
+func recurringChangeLocked(before, after RecurringIncomeObject, lockedThrough string) string {
+	if lockedThrough == "" {
+		return ""
+	}
+	switch {
+	case before.Amount != after.Amount:
+		return "amount"
+	case before.Frequency != after.Frequency:
+		return "frequency"
+	case before.StartDate != after.StartDate:
+		return "startDate"
+	case before.AccountID != after.AccountID:
+		return "accountID"
+	case before.EndDate != after.EndDate &&
+		((before.EndDate != "" && before.EndDate <= lockedThrough) || (after.EndDate != "" && after.EndDate <= lockedThrough)):
+		return "endDate"
+	}
+	return ""
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDescriptionSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Starbucks", "starbucks", 1},
+		{"STAR BUCKS!", "starbucks", 1}, // 只看字母跟數字
+		{"全聯福利中心", "全聯福利中心", 1},
+		{"", "starbucks", 0},
+		{"", "", 0},
+		{"ab", "cd", 0},
+		{"a", "a", 1}, // 一個字也可以比
+	}
+	for _, tt := range tests {
+		if got := descriptionSimilarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("descriptionSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if partial := descriptionSimilarity("全聯福利中心 台北店", "全聯福利中心"); partial <= descriptionSimilarity("全聯福利中心", "7-ELEVEN") || partial >= 1 {
+		t.Errorf("partial match scored %v", partial)
+	}
+	if a, b := descriptionSimilarity("Uber Eats", "uber"), descriptionSimilarity("uber", "Uber Eats"); a != b {
+		t.Errorf("similarity is not symmetric: %v vs %v", a, b)
+	}
+}
+
+func assignmentTotal(scores [][]float64, res []int) float64 {
+	total := 0.0
+	for a, b := range res {
+		if b >= 0 {
+			total += scores[a][b]
+		}
+	}
+	return total
+}
+
+// bestAssignment 暴力列舉所有一對一配對的最高總分
+func bestAssignment(scores [][]float64, row int, usedCol map[int]bool) float64 {
+	if row == len(scores) {
+		return 0
+	}
+	best := bestAssignment(scores, row+1, usedCol) // 這一列不配
+	for b, score := range scores[row] {
+		if usedCol[b] {
+			continue
+		}
+		usedCol[b] = true
+		best = math.Max(best, score+bestAssignment(scores, row+1, usedCol))
+		usedCol[b] = false
+	}
+	return best
+}
+
+func TestAssignBeatsGreedy(t *testing.T) {
+	// greedy先拿0.9，第二列就沒得配；最好的是0.8+0.7
+	scores := [][]float64{
+		{0.9, 0.8},
+		{0.7, 0},
+	}
+	if got := assign(scores); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Errorf("assign = %v, want [1 0]", got)
+	}
+	if got := assignGreedy(scores); !reflect.DeepEqual(got, []int{0, -1}) {
+		t.Errorf("assignGreedy = %v, want [0 -1]", got)
+	}
+}
+
+func TestAssignRectangular(t *testing.T) {
+	tests := []struct {
+		scores [][]float64
+		want   []int
+	}{
+		{[][]float64{{0.5}, {0.9}}, []int{-1, 0}}, // 列比欄多
+		{[][]float64{{0.5, 0.9, 0.6}}, []int{1}},  // 欄比列多
+		{[][]float64{{0.6, 0.9}, {0.9, 0.6}, {0.7, 0.7}}, []int{1, 0, -1}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := assign(tt.scores); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("assign(%v) = %v, want %v", tt.scores, got, tt.want)
+		}
+	}
+}
+
+func TestAssignOptimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		n, m := 1+rng.Intn(5), 1+rng.Intn(5)
+		scores := make([][]float64, n)
+		for a := range scores {
+			scores[a] = make([]float64, m)
+			for b := range scores[a] {
+				if rng.Intn(3) > 0 {
+					scores[a][b] = float64(50+rng.Intn(50)) / 100
+				}
+			}
+		}
+		res := assign(scores)
+		usedCol := map[int]bool{}
+		for _, b := range res {
+			if b >= 0 && usedCol[b] {
+				t.Fatalf("assign(%v) = %v uses a column twice", scores, res)
+			}
+			usedCol[b] = true
+		}
+		want := bestAssignment(scores, 0, map[int]bool{})
+		if got := assignmentTotal(scores, res); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("assign(%v) = %v scores %v, best is %v", scores, res, got, want)
+		}
+		if greedy := assignmentTotal(scores, assignGreedy(scores)); greedy > want+1e-9 {
+			t.Fatalf("greedy scores %v, more than the best %v", greedy, want)
+		}
+	}
+}
+
+func TestSuggestMatches(t *testing.T) {
+	lines := []StatementLine{
+		{Index: 0, Date: "2024-01-05", Description: "Coffee", Amount: -120, Status: LineUnmatched},
+		{Index: 1, Date: "2024-01-06", Description: "Lunch", Amount: -120, Status: LineUnmatched},
+		{Index: 2, Date: "2024-01-10", Description: "Rent", Amount: -20000, Status: LineConfirmed, MatchKind: "expense", MatchID: "rent"},
+		{Index: 3, Date: "2024-01-20", Description: "Books", Amount: -300, Status: LineSuggested, MatchKind: "expense", MatchID: "old"},
+		{Index: 4, Date: "2024-01-25", Description: "Gym", Amount: -900, Status: LineUnmatched},
+		{Index: 5, Date: "2024-01-28", Description: "Taxi", Amount: -250, Status: LineIgnored},
+	}
+	candidates := []candidate{
+		{LedgerEntry{Kind: "expense", ID: "lunch", Description: "lunch", Amount: -120}, "2024-01-06"},
+		{LedgerEntry{Kind: "expense", ID: "coffee", Description: "coffee", Amount: -120}, "2024-01-05"},
+		{LedgerEntry{Kind: "expense", ID: "rent", Description: "rent", Amount: -20000}, "2024-01-10"},
+		{LedgerEntry{Kind: "expense", ID: "books", Description: "books", Amount: -300}, "2024-01-30"}, // 超過matchWindowDays
+		{LedgerEntry{Kind: "expense", ID: "gym", Description: "gym", Amount: -900}, "2024-01-25"},
+		{LedgerEntry{Kind: "expense", ID: "taxi", Description: "taxi", Amount: -250}, "2024-01-28"},
+	}
+	taken := map[string]bool{entryKey("expense", "gym"): true} // 另一張對帳單確認過了
+
+	suggestMatches(lines, candidates, taken)
+
+	want := []struct {
+		status, id string
+	}{
+		{LineSuggested, "coffee"},
+		{LineSuggested, "lunch"},
+		{LineConfirmed, "rent"},
+		{LineUnmatched, ""}, // 舊的建議清掉，新的日期差太多
+		{LineUnmatched, ""}, // 被別的對帳單配走了
+		{LineIgnored, ""},
+	}
+	for i, w := range want {
+		if lines[i].Status != w.status || lines[i].MatchID != w.id {
+			t.Errorf("line %d = (%s, %q), want (%s, %q)", i, lines[i].Status, lines[i].MatchID, w.status, w.id)
+		}
+	}
+	if lines[0].Score < matchThreshold || lines[0].Score > 1 {
+		t.Errorf("score = %v, want between %v and 1", lines[0].Score, matchThreshold)
+	}
+}
+
+// 台北時間2024-01-31 23:30跟2024-02-01 00:30，UTC都還是1/31
+var (
+	lastLockedDay = int(time.Date(2024, 1, 31, 23, 30, 0, 0, time.FixedZone("CST", 8*3600)).Unix())
+	firstOpenDay  = int(time.Date(2024, 2, 1, 0, 30, 0, 0, time.FixedZone("CST", 8*3600)).Unix())
+)
+
+// lockedAccount 帳戶a1鎖定到1/31，使用者沒設時區所以用預設的台北時間，entry是花費的查詢結果
+func lockedAccount(t *testing.T, entry bson.M) *handlerWithDB {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("accounts.find", func(bson.Raw) []any {
+		return []any{bson.M{"id": "a1", "name": "bank", "lockedThrough": "2024-01-31"}}
+	})
+	mongo.Handle("expenses.find", func(bson.Raw) []any {
+		if entry == nil {
+			return nil
+		}
+		return []any{entry}
+	})
+	return h
+}
+
+func TestCheckEntriesOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry bson.M
+		key   string // 空字串代表可以改
+	}{
+		{"missing", nil, ""},
+		{"reconciled", bson.M{"id": "e1", "accountID": "a2", "date": firstOpenDay, "reconciledIn": "s1"}, "reconcile.entryLocked"},
+		{"locked day", bson.M{"id": "e1", "accountID": "a1", "date": lastLockedDay}, "reconcile.periodLocked"},
+		{"after lock", bson.M{"id": "e1", "accountID": "a1", "date": firstOpenDay}, ""},
+		{"other account", bson.M{"id": "e1", "accountID": "a2", "date": lastLockedDay}, ""},
+		{"no account", bson.M{"id": "e1", "date": lastLockedDay}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := lockedAccount(t, tt.entry)
+			req := httptest.NewRequest(http.MethodPut, "/", nil)
+			rec := httptest.NewRecorder()
+			ok := h.checkEntriesOpen(rec, req, scope{account: "alice"}, h.EColl, bson.M{"id": "e1"})
+			checkLocked(t, rec, req, ok, tt.key)
+		})
+	}
+}
+
+func TestCheckPeriodOpen(t *testing.T) {
+	tests := []struct {
+		name      string
+		accountID string
+		date      int
+		key       string
+	}{
+		{"no account", "", lastLockedDay, ""},
+		{"locked day", "a1", lastLockedDay, "reconcile.periodLocked"},
+		{"long ago", "a1", int(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()), "reconcile.periodLocked"},
+		{"after lock", "a1", firstOpenDay, ""},
+		{"now", "a1", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := lockedAccount(t, nil)
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			rec := httptest.NewRecorder()
+			ok := h.checkPeriodOpen(rec, req, scope{account: "alice"}, "date", tt.accountID, tt.date)
+			checkLocked(t, rec, req, ok, tt.key)
+		})
+	}
+}
+
+func checkLocked(t *testing.T, rec *httptest.ResponseRecorder, req *http.Request, ok bool, key string) {
+	t.Helper()
+	if ok != (key == "") {
+		t.Fatalf("open = %v, want %v (status %d: %s)", ok, key == "", rec.Code, rec.Body.String())
+	}
+	if key == "" {
+		return
+	}
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", rec.Code)
+	}
+	if e := decodeError(t, rec); e.Message != T(req, key) {
+		t.Fatalf("message = %q, want %q", e.Message, T(req, key))
+	}
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// middleware handler panic時記錄stack trace並回500，不會讓整個server掛掉
+// 要放在AccessLog跟Tracing裡面，這樣500才會被記到log跟span
+func Recover(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// ErrAbortHandler是故意中斷連線用的，交給net/http處理
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			logFor(r).Error("handler panic", "panic", v, "stack", string(debug.Stack()))
+			// 已經開始寫回應的話就沒辦法再改status了
+			if rec.status == 0 {
+				writeInternal(rec, r, "server.internal")
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	}
+}
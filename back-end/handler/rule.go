@@ -0,0 +1,589 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"mongodb-budget/Utils"
+)
+
+// 自動分類：新增花費沒指定預算、或是從對帳單匯入時，依照規則決定預算跟標籤
+// 規則照priority由小到大比對，第一個符合的規則決定結果，條件都是AND
+
+const (
+	maxRuleNameLen  = 20
+	maxRuleRegexLen = 200
+	maxRuleChanges  = 100 // 測試跟重新套用時回傳的明細筆數上限
+)
+
+// RuleMatch 規則的條件，沒填的條件不限制，至少要有一個
+type RuleMatch struct {
+	DescriptionContains string `json:"descriptionContains,omitempty"` // 不分大小寫
+	DescriptionRegex    string `json:"descriptionRegex,omitempty"`    // Go的regexp語法，要不分大小寫的話加(?i)
+	MinAmount           int    `json:"minAmount,omitempty"`           // 含，0代表不限
+	MaxAmount           int    `json:"maxAmount,omitempty"`           // 含，0代表不限
+	AccountID           string `json:"accountID,omitempty"`
+	Weekdays            []int  `json:"weekdays,omitempty"` // 0是星期日，依照使用者的時區
+}
+
+type RuleObject struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Priority    int       `json:"priority"` // 小的先比對，一樣的話先建立的先
+	Match       RuleMatch `json:"match"`
+	BudgetID    string    `json:"budgetID"`
+	Tags        []string  `json:"tags,omitempty"` // 加到花費上，原本的標籤會保留
+	UserID      string    `json:"userID,omitempty"`
+	HouseholdID string    `json:"householdID,omitempty"`
+	CreatedBy   string    `json:"createdBy,omitempty"`
+	CreatedAt   int       `json:"createdAt"`
+}
+
+// RulePatch Match送的話整個換掉
+type RulePatch struct {
+	Name     *string    `json:"name"`
+	Priority *int       `json:"priority"`
+	Match    *RuleMatch `json:"match"`
+	BudgetID *string    `json:"budgetID"`
+	Tags     *[]string  `json:"tags"`
+}
+
+// RuleChange 套用規則後某筆花費會怎麼改
+type RuleChange struct {
+	ExpenseID    string   `json:"expenseID"`
+	Description  string   `json:"description"`
+	Amount       int      `json:"amount"`
+	Date         int      `json:"date"`
+	RuleID       string   `json:"ruleID,omitempty"`
+	FromBudgetID string   `json:"fromBudgetID"`
+	ToBudgetID   string   `json:"toBudgetID"` // 跟FromBudgetID一樣代表預算不變
+	AddedTags    []string `json:"addedTags,omitempty"`
+}
+
+// RuleResult 測試或重新套用的結果，Changes最多maxRuleChanges筆，新的在前
+type RuleResult struct {
+	Scanned int `json:"scanned"` // 看了幾筆花費
+	Matched int `json:"matched"` // 符合規則的
+	Changed int `json:"changed"` // 預算或標籤會改變的
+	// Kept 符合規則但是預算沒有改的，已經對帳、在帳戶鎖定期間內或分到好幾個預算的花費只會加標籤
+	Kept    int          `json:"kept"`
+	Total   int          `json:"total"` // 符合規則的花費金額加總
+	Applied bool         `json:"applied"`
+	Changes []RuleChange `json:"changes"`
+}
+
+func (m RuleMatch) doc() bson.M {
+	doc := bson.M{}
+	for field, value := range map[string]string{"descriptionContains": m.DescriptionContains,
+		"descriptionRegex": m.DescriptionRegex, "accountID": m.AccountID} {
+		if value != "" {
+			doc[field] = value
+		}
+	}
+	if m.MinAmount > 0 {
+		doc["minAmount"] = m.MinAmount
+	}
+	if m.MaxAmount > 0 {
+		doc["maxAmount"] = m.MaxAmount
+	}
+	if len(m.Weekdays) > 0 {
+		doc["weekdays"] = m.Weekdays
+	}
+	return doc
+}
+
+// normalizeRule 檢查規則並整理格式，回傳有問題的欄位跟訊息
+func normalizeRule(data RuleObject) (RuleObject, string, string) {
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		return data, "name", "rule.nameRequired"
+	}
+	if len([]rune(data.Name)) > maxRuleNameLen {
+		return data, "name", "rule.nameTooLong"
+	}
+	data.BudgetID = strings.TrimSpace(data.BudgetID)
+	if data.BudgetID == "" {
+		return data, "budgetID", "rule.budgetRequired"
+	}
+	m := &data.Match
+	m.DescriptionContains = strings.TrimSpace(m.DescriptionContains)
+	m.AccountID = strings.TrimSpace(m.AccountID)
+	if m.DescriptionContains == "" && m.DescriptionRegex == "" && m.MinAmount == 0 && m.MaxAmount == 0 &&
+		m.AccountID == "" && len(m.Weekdays) == 0 {
+		return data, "match", "rule.matchRequired"
+	}
+	if m.DescriptionRegex != "" {
+		// 先檢查長度，太長的就不用編譯了
+		if len(m.DescriptionRegex) > maxRuleRegexLen {
+			return data, "match.descriptionRegex", "rule.regexInvalid"
+		}
+		if _, err := regexp.Compile(m.DescriptionRegex); err != nil {
+			return data, "match.descriptionRegex", "rule.regexInvalid"
+		}
+	}
+	if m.MinAmount < 0 || m.MaxAmount < 0 || (m.MaxAmount > 0 && m.MinAmount > m.MaxAmount) {
+		return data, "match.minAmount", "rule.amountRangeInvalid"
+	}
+	seen := map[int]bool{}
+	var weekdays []int
+	for _, d := range m.Weekdays {
+		if d < 0 || d > 6 {
+			return data, "match.weekdays", "rule.weekdayInvalid"
+		}
+		if !seen[d] {
+			seen[d] = true
+			weekdays = append(weekdays, d)
+		}
+	}
+	sort.Ints(weekdays)
+	m.Weekdays = weekdays
+	tags, msg := normalizeTags(data.Tags)
+	if msg != "" {
+		return data, "tags", msg
+	}
+	data.Tags = nil
+	if len(tags) > 0 {
+		data.Tags = tags
+	}
+	return data, "", ""
+}
+
+// checkRuleLinks 預算跟帳戶要在同一個範圍，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkRuleLinks(w http.ResponseWriter, r *http.Request, sc scope, data RuleObject) bool {
+	exists, err := h.budgetExists(r, sc, data.BudgetID)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	if !exists {
+		writeError(w, r, CodeValidation, "budgetID", "budget.notFound")
+		return false
+	}
+	if data.Match.AccountID != "" {
+		if _, err := h.findAccount(r, sc, data.Match.AccountID); err == mongo.ErrNoDocuments {
+			writeError(w, r, CodeValidation, "match.accountID", "financialAccount.notFound")
+			return false
+		} else if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return false
+		}
+	}
+	return true
+}
+
+// ruleMatcher 先把regexp編譯好，比對很多筆花費時不用每次重編
+type ruleMatcher struct {
+	rule     RuleObject
+	contains string
+	re       *regexp.Regexp
+	weekdays map[time.Weekday]bool
+}
+
+func newRuleMatcher(rule RuleObject) (ruleMatcher, bool) {
+	m := ruleMatcher{rule: rule, contains: strings.ToLower(rule.Match.DescriptionContains)}
+	if rule.Match.DescriptionRegex != "" {
+		re, err := regexp.Compile(rule.Match.DescriptionRegex)
+		if err != nil {
+			return m, false
+		}
+		m.re = re
+	}
+	if len(rule.Match.Weekdays) > 0 {
+		m.weekdays = map[time.Weekday]bool{}
+		for _, d := range rule.Match.Weekdays {
+			m.weekdays[time.Weekday(d)] = true
+		}
+	}
+	return m, true
+}
+
+// newRuleMatchers 資料庫裡的regexp有問題的規則直接略過
+func newRuleMatchers(rules []RuleObject) []ruleMatcher {
+	var res []ruleMatcher
+	for _, rule := range rules {
+		if m, ok := newRuleMatcher(rule); ok {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (m ruleMatcher) matches(e ExpenseObject, loc *time.Location) bool {
+	c := m.rule.Match
+	if m.contains != "" && !strings.Contains(strings.ToLower(e.Description), m.contains) {
+		return false
+	}
+	if m.re != nil && !m.re.MatchString(e.Description) {
+		return false
+	}
+	if c.MinAmount > 0 && e.Amount < c.MinAmount {
+		return false
+	}
+	if c.MaxAmount > 0 && e.Amount > c.MaxAmount {
+		return false
+	}
+	if c.AccountID != "" && e.AccountID != c.AccountID {
+		return false
+	}
+	if m.weekdays != nil && !m.weekdays[Utils.UnixToTime(e.Date).In(loc).Weekday()] {
+		return false
+	}
+	return true
+}
+
+// firstMatch 照順序找第一個符合的規則
+func firstMatch(matchers []ruleMatcher, e ExpenseObject, loc *time.Location) *RuleObject {
+	for i := range matchers {
+		if matchers[i].matches(e, loc) {
+			return &matchers[i].rule
+		}
+	}
+	return nil
+}
+
+// addTags 把規則的標籤加到花費原本的標籤後面，超過上限的不加
+func addTags(current, add []string) ([]string, []string) {
+	seen := map[string]bool{}
+	for _, tag := range current {
+		seen[tag] = true
+	}
+	var added []string
+	for _, tag := range add {
+		if seen[tag] || len(current)+len(added) >= maxTagsPerExpense {
+			continue
+		}
+		seen[tag] = true
+		added = append(added, tag)
+	}
+	return append(append([]string{}, current...), added...), added
+}
+
+func sortRules(rules []RuleObject) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		if rules[i].CreatedAt != rules[j].CreatedAt {
+			return rules[i].CreatedAt < rules[j].CreatedAt
+		}
+		return rules[i].ID < rules[j].ID
+	})
+}
+
+// loadRules 依照比對的順序排好
+func (h *handlerWithDB) loadRules(r *http.Request, sc scope) ([]RuleObject, error) {
+	rules := []RuleObject{}
+	cursor, err := h.RuColl.Find(r.Context(), sc.filter(nil))
+	if err == nil {
+		err = cursor.All(r.Context(), &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortRules(rules)
+	return rules, nil
+}
+
+// categorize 沒有預算的花費套用規則，符合的話填上預算跟標籤，沒有符合的規則回傳nil
+func (h *handlerWithDB) categorize(r *http.Request, sc scope, e *ExpenseObject) (*RuleObject, error) {
+	rules, err := h.loadRules(r, sc)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		return nil, err
+	}
+	rule := firstMatch(newRuleMatchers(rules), *e, loc)
+	if rule != nil {
+		e.BudgetID = rule.BudgetID
+		e.Tags, _ = addTags(e.Tags, rule.Tags)
+	}
+	return rule, nil
+}
+
+// runRules 用matchers比對範圍內的花費，apply是true的話真的寫回資料庫
+func (h *handlerWithDB) runRules(w http.ResponseWriter, r *http.Request, sc scope, matchers []ruleMatcher, apply bool) {
+	filter, err := h.expenseFilter(r, sc)
+	if err == errInvalidDateRange {
+		writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	var expenses []ExpenseObject
+	cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetSort(bson.M{"date": -1}).SetProjection(bson.M{
+		"id": 1, "budgetID": 1, "description": 1, "amount": 1, "date": 1, "accountID": 1, "tags": 1,
+		"allocations": 1, "reconciledIn": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &expenses)
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	// 帳戶鎖定期間內的花費跟已經對帳的一樣，不能換預算
+	locked, err := h.lockedAccounts(r, sc)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+
+	res := RuleResult{Scanned: len(expenses), Applied: apply, Changes: []RuleChange{}}
+	var updates []mongo.WriteModel
+	for _, e := range expenses {
+		rule := firstMatch(matchers, e, loc)
+		if rule == nil {
+			continue
+		}
+		res.Matched++
+		res.Total += e.Amount
+		change := RuleChange{ExpenseID: e.ID, Description: e.Description, Amount: e.Amount, Date: e.Date,
+			RuleID: rule.ID, FromBudgetID: e.BudgetID, ToBudgetID: e.BudgetID}
+		// 對帳鎖定的花費不能換預算，分到好幾個預算的是使用者自己分的，標籤還是可以加
+		through, inLocked := locked[e.AccountID]
+		inLocked = inLocked && Utils.LocalDay(e.Date, loc) <= through
+		if e.ReconciledIn == "" && !inLocked && len(e.Allocations) == 0 {
+			change.ToBudgetID = rule.BudgetID
+		} else if rule.BudgetID != e.BudgetID {
+			res.Kept++
+		}
+		_, change.AddedTags = addTags(e.Tags, rule.Tags)
+		if change.ToBudgetID == change.FromBudgetID && len(change.AddedTags) == 0 {
+			continue
+		}
+		res.Changed++
+		if len(res.Changes) < maxRuleChanges {
+			res.Changes = append(res.Changes, change)
+		}
+		if !apply {
+			continue
+		}
+		update := bson.M{}
+		if change.ToBudgetID != change.FromBudgetID {
+			update["$set"] = bson.M{"budgetID": change.ToBudgetID}
+		}
+		if len(change.AddedTags) > 0 {
+			update["$addToSet"] = bson.M{"tags": bson.M{"$each": change.AddedTags}}
+		}
+		updates = append(updates, mongo.NewUpdateOneModel().SetFilter(sc.filter(bson.M{"id": e.ID})).SetUpdate(update))
+	}
+	// 全部一次送出，不用在request的時限內一筆一筆改；還是失敗的話記下已經改了幾筆
+	if len(updates) > 0 {
+		written, err := h.EColl.BulkWrite(r.Context(), updates, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			if written != nil {
+				logFor(r).Error("rules partially applied", "changed", res.Changed, "modified", written.ModifiedCount)
+			}
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+	}
+	if apply {
+		logFor(r).Info("rules applied", "scanned", res.Scanned, "changed", res.Changed)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *handlerWithDB) findRule(w http.ResponseWriter, r *http.Request, sc scope) (RuleObject, bool) {
+	var rule RuleObject
+	err := h.RuColl.FindOne(r.Context(), sc.filter(bson.M{"id": mux.Vars(r)["id"]})).Decode(&rule)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, r, CodeNotFound, "id", "rule.notFound")
+		return rule, false
+	}
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return rule, false
+	}
+	return rule, true
+}
+
+// ListRules 依照比對的順序
+func (h *handlerWithDB) ListRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		rules, err := h.loadRules(r, sc)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, rules)
+	}
+}
+
+func (h *handlerWithDB) PostRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data RuleObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data, field, msg := normalizeRule(data)
+		if msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if !h.checkRuleLinks(w, r, sc, data) {
+			return
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.UserID, data.HouseholdID = sc.owner()
+		data.CreatedBy = sc.account
+		data.CreatedAt = int(time.Now().Unix())
+		doc := sc.owned(bson.M{"id": data.ID, "name": data.Name, "priority": data.Priority, "match": data.Match.doc(),
+			"budgetID": data.BudgetID, "createdBy": sc.account, "createdAt": data.CreatedAt})
+		if len(data.Tags) > 0 {
+			doc["tags"] = data.Tags
+		}
+		if _, err := h.RuColl.InsertOne(r.Context(), doc); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		w.Header().Set("Location", "/api/v1/rules/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+func (h *handlerWithDB) PatchRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var patch RulePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		current, ok := h.findRule(w, r, sc)
+		if !ok {
+			return
+		}
+		if patch.Name != nil {
+			current.Name = *patch.Name
+		}
+		if patch.Priority != nil {
+			current.Priority = *patch.Priority
+		}
+		if patch.Match != nil {
+			current.Match = *patch.Match
+		}
+		if patch.BudgetID != nil {
+			current.BudgetID = *patch.BudgetID
+		}
+		if patch.Tags != nil {
+			current.Tags = *patch.Tags
+		}
+		current, field, msg := normalizeRule(current)
+		if msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		if (patch.BudgetID != nil || patch.Match != nil) && !h.checkRuleLinks(w, r, sc, current) {
+			return
+		}
+
+		set := bson.M{"name": current.Name, "priority": current.Priority, "match": current.Match.doc(), "budgetID": current.BudgetID}
+		unset := bson.M{}
+		if len(current.Tags) > 0 {
+			set["tags"] = current.Tags
+		} else {
+			unset["tags"] = ""
+		}
+		if _, err := h.RuColl.UpdateOne(r.Context(), sc.filter(bson.M{"id": current.ID}), updateDoc(set, unset)); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, current)
+	}
+}
+
+// RemoveRule 已經分類好的花費不受影響
+func (h *handlerWithDB) RemoveRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		res, err := h.RuColl.DeleteOne(r.Context(), sc.filter(bson.M{"id": mux.Vars(r)["id"]}))
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "rule.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TestRule 還沒存的規則拿來比對過去的花費，不會改任何資料，日期條件跟花費一樣，不填就是全部
+// 只看這一條規則，不考慮其他規則的順序
+func (h *handlerWithDB) TestRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		var data RuleObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data, field, msg := normalizeRule(data)
+		if msg != "" {
+			writeError(w, r, CodeValidation, field, msg)
+			return
+		}
+		m, _ := newRuleMatcher(data)
+		h.runRules(w, r, sc, []ruleMatcher{m}, false)
+	}
+}
+
+// ApplyRules 用目前所有的規則重新分類範圍內的花費，?dryRun=true只回傳會改什麼
+func (h *handlerWithDB) ApplyRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+		role := RoleEditor
+		if dryRun {
+			role = RoleViewer
+		}
+		sc, ok := h.requireScope(w, r, role)
+		if !ok {
+			return
+		}
+		rules, err := h.loadRules(r, sc)
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		h.runRules(w, r, sc, newRuleMatchers(rules), !dryRun)
+	}
+}
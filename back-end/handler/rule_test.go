@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+	"mongodb-budget/internal/testutil"
+)
+
+func TestNormalizeRuleRegex(t *testing.T) {
+	tests := []struct {
+		name  string
+		regex string
+		ok    bool
+	}{
+		{"valid", `(?i)^uber\s*eats`, true},
+		{"invalid", `(unclosed`, false},
+		{"at the limit", strings.Repeat("a", maxRuleRegexLen), true},
+		{"too long", strings.Repeat("a", maxRuleRegexLen+1), false},
+		{"too long and invalid", strings.Repeat("(", maxRuleRegexLen+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := RuleObject{Name: "r", BudgetID: "b1", Match: RuleMatch{DescriptionRegex: tt.regex}}
+			_, field, msg := normalizeRule(rule)
+			if (msg == "") != tt.ok {
+				t.Fatalf("normalizeRule = (%q, %q), want ok = %v", field, msg, tt.ok)
+			}
+			if !tt.ok && (field != "match.descriptionRegex" || msg != "rule.regexInvalid") {
+				t.Fatalf("normalizeRule = (%q, %q)", field, msg)
+			}
+		})
+	}
+}
+
+func matcher(t *testing.T, rule RuleObject) ruleMatcher {
+	t.Helper()
+	m, ok := newRuleMatcher(rule)
+	if !ok {
+		t.Fatalf("rule %+v does not compile", rule)
+	}
+	return m
+}
+
+// 台北時間2024-03-04(星期一)01:00，UTC還是星期日
+var mondayInTaipei = int(taipei(2024, 3, 4, 1).Unix())
+
+func TestRuleMatches(t *testing.T) {
+	taipeiLoc := mustLocation(t, Utils.DefaultTimeZone)
+	expense := ExpenseObject{Description: "Uber Eats 訂單", Amount: 350, AccountID: "a1", Date: mondayInTaipei}
+	tests := []struct {
+		name  string
+		match RuleMatch
+		loc   *time.Location
+		want  bool
+	}{
+		{"contains ignores case", RuleMatch{DescriptionContains: "uber eats"}, taipeiLoc, true},
+		{"contains", RuleMatch{DescriptionContains: "foodpanda"}, taipeiLoc, false},
+		{"regex", RuleMatch{DescriptionRegex: `^Uber`}, taipeiLoc, true},
+		{"regex is case sensitive", RuleMatch{DescriptionRegex: `^uber`}, taipeiLoc, false},
+		{"min amount is inclusive", RuleMatch{MinAmount: 350}, taipeiLoc, true},
+		{"below min amount", RuleMatch{MinAmount: 351}, taipeiLoc, false},
+		{"max amount is inclusive", RuleMatch{MaxAmount: 350}, taipeiLoc, true},
+		{"above max amount", RuleMatch{MaxAmount: 349}, taipeiLoc, false},
+		{"account", RuleMatch{AccountID: "a1"}, taipeiLoc, true},
+		{"other account", RuleMatch{AccountID: "a2"}, taipeiLoc, false},
+		{"weekday in the user's time zone", RuleMatch{Weekdays: []int{1}}, taipeiLoc, true},
+		{"weekday in UTC", RuleMatch{Weekdays: []int{1}}, time.UTC, false},
+		{"sunday in UTC", RuleMatch{Weekdays: []int{0, 6}}, time.UTC, true},
+		{"all conditions", RuleMatch{DescriptionContains: "uber", MinAmount: 100, MaxAmount: 500, AccountID: "a1", Weekdays: []int{1, 2}}, taipeiLoc, true},
+		{"one condition fails", RuleMatch{DescriptionContains: "uber", MinAmount: 100, MaxAmount: 500, AccountID: "a2"}, taipeiLoc, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := matcher(t, RuleObject{Match: tt.match})
+			if got := m.matches(expense, tt.loc); got != tt.want {
+				t.Fatalf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 毫秒的日期也一樣
+	millis := expense
+	millis.Date = int(taipei(2024, 3, 4, 1).UnixMilli())
+	if !matcher(t, RuleObject{Match: RuleMatch{Weekdays: []int{1}}}).matches(millis, taipeiLoc) {
+		t.Fatal("date in milliseconds does not match its weekday")
+	}
+}
+
+func TestFirstMatchPriority(t *testing.T) {
+	rules := []RuleObject{
+		{ID: "late", Priority: 1, CreatedAt: 200, BudgetID: "late", Match: RuleMatch{DescriptionContains: "coffee"}},
+		{ID: "general", Priority: 5, CreatedAt: 100, BudgetID: "general", Match: RuleMatch{MinAmount: 1}},
+		{ID: "early", Priority: 1, CreatedAt: 100, BudgetID: "early", Match: RuleMatch{DescriptionContains: "coffee"}},
+		{ID: "first", Priority: -1, CreatedAt: 300, BudgetID: "first", Match: RuleMatch{AccountID: "card"}},
+		{ID: "broken", Priority: -5, BudgetID: "broken", Match: RuleMatch{DescriptionRegex: "("}}, // 資料庫裡的壞規則略過
+	}
+	sortRules(rules)
+	var order []string
+	for _, r := range rules {
+		order = append(order, r.ID)
+	}
+	if want := []string{"broken", "first", "early", "late", "general"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	matchers := newRuleMatchers(rules)
+	if len(matchers) != 4 {
+		t.Fatalf("%d matchers, want 4 without the broken rule", len(matchers))
+	}
+	tests := []struct {
+		expense ExpenseObject
+		want    string
+	}{
+		{ExpenseObject{Description: "coffee", Amount: 100, AccountID: "card"}, "first"},
+		{ExpenseObject{Description: "coffee", Amount: 100}, "early"},
+		{ExpenseObject{Description: "tea", Amount: 100}, "general"},
+		{ExpenseObject{Description: "tea"}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := firstMatch(matchers, tt.expense, time.UTC); rule != nil {
+			got = rule.ID
+		}
+		if got != tt.want {
+			t.Errorf("firstMatch(%+v) = %q, want %q", tt.expense, got, tt.want)
+		}
+	}
+}
+
+func TestAddTags(t *testing.T) {
+	full := make([]string, maxTagsPerExpense-1)
+	for i := range full {
+		full[i] = fmt.Sprint("t", i)
+	}
+	tests := []struct {
+		name      string
+		current   []string
+		add       []string
+		want      []string
+		wantAdded []string
+	}{
+		{"none", nil, nil, []string{}, nil},
+		{"new tags", []string{"food"}, []string{"delivery", "late"}, []string{"food", "delivery", "late"}, []string{"delivery", "late"}},
+		{"already there", []string{"food", "delivery"}, []string{"delivery"}, []string{"food", "delivery"}, nil},
+		{"duplicates in the rule", nil, []string{"a", "a"}, []string{"a"}, []string{"a"}},
+		{"up to the limit", full, []string{"x", "y"}, append(append([]string{}, full...), "x"), []string{"x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := append([]string{}, tt.current...)
+			got, added := addTags(tt.current, tt.add)
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(added, tt.wantAdded) {
+				t.Fatalf("addTags = (%v, %v), want (%v, %v)", got, added, tt.want, tt.wantAdded)
+			}
+			if !reflect.DeepEqual(tt.current, before) && len(before) > 0 {
+				t.Fatalf("current tags changed to %v", tt.current)
+			}
+		})
+	}
+}
+
+// rulesFixture 兩條規則，花費有會換預算的、只加標籤的、已經對帳的跟不符合的
+func rulesFixture(t *testing.T) (*handlerWithDB, *testutil.FakeMongo) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("rules.find", docs(
+		bson.M{"id": "r2", "name": "food", "priority": 2, "budgetID": "food", "match": bson.M{"descriptionContains": "lunch"}},
+		bson.M{"id": "r1", "name": "delivery", "priority": 1, "budgetID": "delivery", "tags": bson.A{"app"},
+			"match": bson.M{"descriptionContains": "uber"}},
+	))
+	mongo.Handle("expenses.find", docs(
+		bson.M{"id": "e1", "budgetID": "misc", "description": "Uber Eats lunch", "amount": 300, "date": mondayInTaipei},
+		bson.M{"id": "e2", "budgetID": "delivery", "description": "uber", "amount": 100, "date": mondayInTaipei},
+		bson.M{"id": "e3", "budgetID": "misc", "description": "lunch", "amount": 120, "date": mondayInTaipei, "reconciledIn": "s1"},
+		bson.M{"id": "e4", "budgetID": "food", "description": "lunch", "amount": 80, "date": mondayInTaipei},
+		bson.M{"id": "e5", "budgetID": "misc", "description": "rent", "amount": 9000, "date": mondayInTaipei},
+	))
+	return h, mongo
+}
+
+func TestApplyRules(t *testing.T) {
+	h, mongo := rulesFixture(t)
+	var mu sync.Mutex
+	var commands []bson.Raw
+	mongo.Handle("expenses.update", func(cmd bson.Raw) []any {
+		mu.Lock()
+		defer mu.Unlock()
+		commands = append(commands, cmd)
+		values, _ := cmd.Lookup("updates").Array().Values()
+		return []any{bson.M{"n": len(values), "nModified": len(values)}}
+	})
+	req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/rules/apply", nil), "alice", nil)
+	rec := serve(h.ApplyRules(), req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var res RuleResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 5 || res.Matched != 4 || res.Changed != 2 || res.Kept != 1 || !res.Applied {
+		t.Fatalf("result = %+v", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 所有的修改在同一個update指令裡
+	if len(commands) != 1 {
+		t.Fatalf("%d update commands, want 1", len(commands))
+	}
+	values, err := commands[0].Lookup("updates").Array().Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type update struct {
+		BudgetID string
+		Tags     []string
+	}
+	got := map[string]update{}
+	for _, v := range values {
+		u := v.Document()
+		var set struct {
+			Set      struct{ BudgetID string } `bson:"$set"`
+			AddToSet struct {
+				Tags struct {
+					Each []string `bson:"$each"`
+				}
+			} `bson:"$addToSet"`
+		}
+		if err := bson.Unmarshal(u.Lookup("u").Document(), &set); err != nil {
+			t.Fatal(err)
+		}
+		got[u.Lookup("q", "id").StringValue()] = update{set.Set.BudgetID, set.AddToSet.Tags.Each}
+	}
+	// e3已經對帳只能加標籤，但是r2沒有標籤；e4本來就在food
+	want := map[string]update{
+		"e1": {"delivery", []string{"app"}},
+		"e2": {"", []string{"app"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("updates = %v, want %v", got, want)
+	}
+}
+
+func TestApplyRulesDryRun(t *testing.T) {
+	h, mongo := rulesFixture(t)
+	req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/rules/apply?dryRun=true", nil), "alice", nil)
+	rec := serve(h.ApplyRules(), req)
+	var res RuleResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed != 2 || res.Applied || len(res.Changes) != 2 {
+		t.Fatalf("result = %+v", res)
+	}
+	for _, c := range mongo.Commands() {
+		if c == "expenses.update" {
+			t.Fatal("dry run updated expenses")
+		}
+	}
+}
+
+func TestApplyRulesWriteFailed(t *testing.T) {
+	h, mongo := rulesFixture(t)
+	mongo.Handle("expenses.update", func(bson.Raw) []any {
+		return []any{bson.M{"ok": 0, "errmsg": "write failed", "code": 8}}
+	})
+	req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/api/v1/rules/apply", nil), "alice", nil)
+	if rec := serve(h.ApplyRules(), req); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", rec.Code, rec.Body.String())
+	}
+}
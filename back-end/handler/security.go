@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"mongodb-budget/config"
+)
+
+// SecurityHeaders 每個回應都帶上安全相關的header，設定是空字串(或0)的header不送
+func SecurityHeaders(cfg config.MiddlewareConfig) func(http.Handler) http.HandlerFunc {
+	headers := map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": cfg.ContentSecurityPolicy,
+		"X-Frame-Options":         cfg.FrameOptions,
+		"Referrer-Policy":         cfg.ReferrerPolicy,
+	}
+	if cfg.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds()))
+		if cfg.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		headers["Strict-Transport-Security"] = hsts
+	}
+	for name, value := range headers {
+		if value == "" {
+			delete(headers, name)
+		}
+	}
+
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
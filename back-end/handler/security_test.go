@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mongodb-budget/config"
+)
+
+func securityHeaders(cfg config.MiddlewareConfig) http.Header {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	rec := httptest.NewRecorder()
+	SecurityHeaders(cfg)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Header()
+}
+
+func TestSecurityHeadersDefault(t *testing.T) {
+	h := securityHeaders(config.Default().Middleware)
+	for _, name := range []string{"X-Content-Type-Options", "Content-Security-Policy", "X-Frame-Options", "Referrer-Policy"} {
+		if h.Get(name) == "" {
+			t.Errorf("missing %s", name)
+		}
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+	// 預設沒有TLS，HTTP的回應不送HSTS
+	if _, ok := h["Strict-Transport-Security"]; ok {
+		t.Error("Strict-Transport-Security sent by default")
+	}
+}
+
+func TestSecurityHeadersConfigurable(t *testing.T) {
+	h := securityHeaders(config.MiddlewareConfig{
+		ContentSecurityPolicy: "default-src 'self'",
+		FrameOptions:          "",
+		ReferrerPolicy:        "no-referrer",
+		HSTSMaxAge:            48 * time.Hour,
+		HSTSIncludeSubdomains: true,
+	})
+	want := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"Content-Security-Policy":   "default-src 'self'",
+		"Referrer-Policy":           "no-referrer",
+		"Strict-Transport-Security": "max-age=172800; includeSubDomains",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	// 空字串的header不送
+	if _, ok := h["X-Frame-Options"]; ok {
+		t.Error("X-Frame-Options sent although it is empty")
+	}
+
+	h = securityHeaders(config.MiddlewareConfig{})
+	if _, ok := h["Strict-Transport-Security"]; ok {
+		t.Error("Strict-Transport-Security sent with HSTSMaxAge 0")
+	}
+}
@@ -0,0 +1,80 @@
+package handler_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mongodb-budget/config"
+	"mongodb-budget/handler"
+	"mongodb-budget/internal/testutil"
+	"mongodb-budget/server"
+)
+
+// 允許的網域，會改資料的request帶這個Origin才會通過CSRF檢查
+const testOrigin = "http://localhost:3000"
+
+// testServer 用假資料庫啟動的完整server，route跟middleware都跟正式的一樣
+type testServer struct {
+	*server.Server
+	cfg   config.Config
+	mongo *testutil.FakeMongo
+}
+
+// configure可以在啟動前調整設定
+func newTestServer(t *testing.T, configure ...func(*config.Config)) *testServer {
+	t.Helper()
+	// access log每個request都會印，測試的時候不需要
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+
+	mongo := testutil.NewFakeMongo(t)
+	cfg := config.Default()
+	cfg.Database.URI = mongo.URI
+	cfg.Database.ConnectRetries = 0
+	cfg.Database.ConnectTimeout = 5 * time.Second
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	s, err := server.InitServer(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	})
+	return &testServer{Server: s, cfg: cfg, mongo: mongo}
+}
+
+// login 在request帶上account已經登入的session cookie
+func (s *testServer) login(t *testing.T, req *http.Request, account string) {
+	t.Helper()
+	session, err := handler.Store.New(req, s.cfg.Session.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["account"] = account
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+}
+
+func (s *testServer) do(req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Origin", testOrigin)
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	return rec
+}
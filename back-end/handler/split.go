@@ -0,0 +1,492 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 分帳：一筆花費可以由一個人付錢，分給好幾個人負擔
+// 餘額不另外存，每次從有分帳的花費跟還款紀錄算出來，花費改了或刪了餘額就跟著變
+// 帶X-Household-ID時算家庭成員之間的，沒帶的話算自己跟別人之間(不屬於家庭的花費)
+
+const (
+	SplitEqual  = "equal"  // 平分
+	SplitShares = "shares" // 依照份數
+	SplitExact  = "exact"  // 各自指定金額，加起來要等於花費金額
+)
+
+const maxSplitParticipants = 50
+
+type SplitShare struct {
+	Account string `json:"account"`
+	Shares  int    `json:"shares,omitempty"` // shares才需要
+	Amount  int    `json:"amount"`           // 要負擔的金額，exact是自己填的，其他方式由伺服器算
+}
+
+type ExpenseSplit struct {
+	PaidBy       string       `json:"paidBy"` // 付錢的帳號，預設是新增花費的人
+	Method       string       `json:"method"`
+	Participants []SplitShare `json:"participants"` // 付錢的人也要負擔的話自己也要列在裡面
+}
+
+// SettlementObject 是一筆還款，From付了Amount給To
+type SettlementObject struct {
+	ID          string `json:"id"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      int    `json:"amount"`
+	Date        int    `json:"date"`
+	Note        string `json:"note"`
+	HouseholdID string `json:"householdID,omitempty"`
+	CreatedBy   string `json:"createdBy"`
+}
+
+// Debt From欠To Amount
+type Debt struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+// MemberBalance Net是正的代表別人欠他，負的代表他欠別人
+type MemberBalance struct {
+	Account string `json:"account"`
+	Net     int    `json:"net"`
+}
+
+type BalanceResponse struct {
+	Balances []MemberBalance `json:"balances"`
+	Debts    []Debt          `json:"debts"`    // 兩兩之間抵銷後的欠款
+	SettleUp []Debt          `json:"settleUp"` // 建議的還款方式，筆數盡量少
+}
+
+// doc 存進資料庫的格式，key要跟查詢條件(split.paidBy、split.participants.account)一致
+func (s ExpenseSplit) doc() bson.M {
+	participants := bson.A{}
+	for _, p := range s.Participants {
+		participants = append(participants, bson.M{"account": p.Account, "shares": p.Shares, "amount": p.Amount})
+	}
+	return bson.M{"paidBy": s.PaidBy, "method": s.Method, "participants": participants}
+}
+
+// normalizeSplit 檢查分帳設定並算出每個人要負擔的金額，回傳有問題的欄位跟訊息
+func normalizeSplit(amount int, split ExpenseSplit, creator string) (ExpenseSplit, string, string) {
+	split.PaidBy = strings.TrimSpace(split.PaidBy)
+	if split.PaidBy == "" {
+		split.PaidBy = creator
+	}
+	if split.Method == "" {
+		split.Method = SplitEqual
+	}
+	switch split.Method {
+	case SplitEqual, SplitShares, SplitExact:
+	default:
+		return split, "split.method", "split.methodInvalid"
+	}
+	if len(split.Participants) == 0 {
+		return split, "split.participants", "split.participantsRequired"
+	}
+	if len(split.Participants) > maxSplitParticipants {
+		return split, "split.participants", "split.tooManyParticipants"
+	}
+
+	seen := map[string]bool{}
+	participants := make([]SplitShare, len(split.Participants))
+	exactTotal := 0
+	for i, p := range split.Participants {
+		p.Account = strings.TrimSpace(p.Account)
+		if p.Account == "" {
+			return split, "split.participants", "account.required"
+		}
+		if seen[p.Account] {
+			return split, "split.participants", "split.duplicateParticipant"
+		}
+		seen[p.Account] = true
+		switch split.Method {
+		case SplitEqual:
+			p.Shares = 0
+		case SplitShares:
+			if p.Shares <= 0 {
+				return split, "split.participants", "split.sharesInvalid"
+			}
+		case SplitExact:
+			p.Shares = 0
+			if p.Amount < 0 {
+				return split, "split.participants", "split.exactMismatch"
+			}
+			exactTotal += p.Amount
+		}
+		participants[i] = p
+	}
+	if split.Method == SplitExact && exactTotal != amount {
+		return split, "split.participants", "split.exactMismatch"
+	}
+	split.Participants = participants
+	for i, owed := range splitAmounts(amount, split) {
+		split.Participants[i].Amount = owed
+	}
+	return split, "", ""
+}
+
+// splitAmounts 每個參與者要負擔的金額，金額都是整數，除不盡的部分由排在前面的人多負擔1
+// 平分跟依份數的都依照目前的花費金額重算，舊的route改了金額也不會對不上
+func splitAmounts(total int, split ExpenseSplit) []int {
+	amounts := make([]int, len(split.Participants))
+	if split.Method == SplitExact {
+		for i, p := range split.Participants {
+			amounts[i] = p.Amount
+		}
+		return amounts
+	}
+	weights := make([]int, len(split.Participants))
+	sum := 0
+	for i, p := range split.Participants {
+		weights[i] = 1
+		if split.Method == SplitShares && p.Shares > 0 {
+			weights[i] = p.Shares
+		}
+		sum += weights[i]
+	}
+	if sum == 0 {
+		return amounts
+	}
+	assigned := 0
+	for i, w := range weights {
+		amounts[i] = total * w / sum
+		assigned += amounts[i]
+	}
+	for i := 0; assigned < total; i = (i + 1) % len(amounts) {
+		amounts[i]++
+		assigned++
+	}
+	return amounts
+}
+
+// splitAccounts 分帳用到的所有帳號
+func splitAccounts(split ExpenseSplit) []string {
+	accounts := []string{split.PaidBy}
+	for _, p := range split.Participants {
+		if p.Account != split.PaidBy {
+			accounts = append(accounts, p.Account)
+		}
+	}
+	return accounts
+}
+
+// accountsAllowed 家庭裡只能跟成員分帳，自己的花費只能跟同一個家庭的成員分帳
+// 不能隨便填別人的帳號，也不會透露帳號存不存在，不存在跟不是成員回一樣的結果
+func (h *handlerWithDB) accountsAllowed(r *http.Request, sc scope, accounts []string) (bool, error) {
+	filter := bson.M{"id": sc.householdID}
+	if sc.householdID == "" {
+		filter = bson.M{"members.account": sc.account}
+	}
+	var households []HouseholdObject
+	cursor, err := h.HColl.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"members": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &households)
+	}
+	if err != nil {
+		return false, err
+	}
+	members := map[string]bool{sc.account: sc.householdID == ""}
+	for _, household := range households {
+		for _, m := range household.Members {
+			members[m.Account] = true
+		}
+	}
+	for _, a := range accounts {
+		if !members[a] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkSplit 檢查並算好分帳，有問題的話已經回覆錯誤，回傳false
+func (h *handlerWithDB) checkSplit(w http.ResponseWriter, r *http.Request, sc scope, amount int, split *ExpenseSplit) bool {
+	normalized, field, msg := normalizeSplit(amount, *split, sc.account)
+	if msg != "" {
+		writeError(w, r, CodeValidation, field, msg)
+		return false
+	}
+	ok, err := h.accountsAllowed(r, sc, splitAccounts(normalized))
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return false
+	}
+	if !ok {
+		writeError(w, r, CodeValidation, "split.participants", "split.unknownAccount")
+		return false
+	}
+	*split = normalized
+	return true
+}
+
+// ledger 記錄兩兩之間的欠款，key是[欠錢的人, 被欠的人]，同一對只會有一個方向
+type ledger map[[2]string]int
+
+func (l ledger) add(from, to string, amount int) {
+	if from == to || amount == 0 {
+		return
+	}
+	forward, reverse := [2]string{from, to}, [2]string{to, from}
+	amount += l[forward] - l[reverse]
+	delete(l, forward)
+	delete(l, reverse)
+	if amount > 0 {
+		l[forward] = amount
+	} else if amount < 0 {
+		l[reverse] = -amount
+	}
+}
+
+func (l ledger) debts() []Debt {
+	debts := []Debt{}
+	for pair, amount := range l {
+		debts = append(debts, Debt{From: pair[0], To: pair[1], Amount: amount})
+	}
+	sort.Slice(debts, func(i, j int) bool {
+		if debts[i].From != debts[j].From {
+			return debts[i].From < debts[j].From
+		}
+		return debts[i].To < debts[j].To
+	})
+	return debts
+}
+
+func netBalances(debts []Debt) []MemberBalance {
+	net := map[string]int{}
+	for _, d := range debts {
+		net[d.From] -= d.Amount
+		net[d.To] += d.Amount
+	}
+	balances := []MemberBalance{}
+	for account, amount := range net {
+		balances = append(balances, MemberBalance{Account: account, Net: amount})
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Account < balances[j].Account })
+	return balances
+}
+
+// settleUp 每次讓欠最多的人還給被欠最多的人，最多n-1筆就能全部結清
+func settleUp(balances []MemberBalance) []Debt {
+	var creditors, debtors []MemberBalance
+	for _, b := range balances {
+		if b.Net > 0 {
+			creditors = append(creditors, b)
+		} else if b.Net < 0 {
+			debtors = append(debtors, MemberBalance{Account: b.Account, Net: -b.Net})
+		}
+	}
+	byAmount := func(list []MemberBalance) {
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Net != list[j].Net {
+				return list[i].Net > list[j].Net
+			}
+			return list[i].Account < list[j].Account
+		})
+	}
+	transfers := []Debt{}
+	for len(creditors) > 0 && len(debtors) > 0 {
+		byAmount(creditors)
+		byAmount(debtors)
+		amount := min(creditors[0].Net, debtors[0].Net)
+		transfers = append(transfers, Debt{From: debtors[0].Account, To: creditors[0].Account, Amount: amount})
+		creditors[0].Net -= amount
+		debtors[0].Net -= amount
+		if creditors[0].Net == 0 {
+			creditors = creditors[1:]
+		}
+		if debtors[0].Net == 0 {
+			debtors = debtors[1:]
+		}
+	}
+	return transfers
+}
+
+// splitScopeFilter 分帳相關資料的範圍：家庭的全部，或是不屬於家庭而且跟自己有關的
+func splitScopeFilter(sc scope, involving ...string) bson.M {
+	if sc.householdID != "" {
+		return bson.M{"householdID": sc.householdID}
+	}
+	or := bson.A{}
+	for _, field := range involving {
+		or = append(or, bson.M{field: sc.account})
+	}
+	return bson.M{"householdID": bson.M{"$exists": false}, "$or": or}
+}
+
+func (h *handlerWithDB) Balances() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+
+		filter := splitScopeFilter(sc, "split.paidBy", "split.participants.account")
+		filter["split"] = bson.M{"$exists": true}
+		var expenses []ExpenseObject
+		cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"amount": 1, "split": 1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &expenses)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		var settlements []SettlementObject
+		cursor, err = h.SColl.Find(r.Context(), splitScopeFilter(sc, "from", "to"))
+		if err == nil {
+			err = cursor.All(r.Context(), &settlements)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+
+		l := ledger{}
+		for _, e := range expenses {
+			if e.Split == nil {
+				continue
+			}
+			for i, owed := range splitAmounts(e.Amount, *e.Split) {
+				l.add(e.Split.Participants[i].Account, e.Split.PaidBy, owed)
+			}
+		}
+		for _, s := range settlements {
+			l.add(s.To, s.From, s.Amount)
+		}
+		if sc.householdID == "" {
+			// 別人之間的欠款不關自己的事
+			for pair := range l {
+				if pair[0] != sc.account && pair[1] != sc.account {
+					delete(l, pair)
+				}
+			}
+		}
+
+		debts := l.debts()
+		balances := netBalances(debts)
+		writeJSON(w, http.StatusOK, BalanceResponse{Balances: balances, Debts: debts, SettleUp: settleUp(balances)})
+	}
+}
+
+func (h *handlerWithDB) ListSettlements() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		data := []SettlementObject{}
+		cursor, err := h.SColl.Find(r.Context(), splitScopeFilter(sc, "from", "to"), options.Find().SetSort(bson.M{"date": -1}))
+		if err == nil {
+			err = cursor.All(r.Context(), &data)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+	}
+}
+
+// PostSettlement 記錄一筆還款，自己的話一定要是付款或收款的一方
+func (h *handlerWithDB) PostSettlement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data SettlementObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.From = strings.TrimSpace(data.From)
+		data.To = strings.TrimSpace(data.To)
+		data.Note = strings.TrimSpace(data.Note)
+		switch {
+		case data.From == "":
+			writeError(w, r, CodeValidation, "from", "account.required")
+			return
+		case data.To == "":
+			writeError(w, r, CodeValidation, "to", "account.required")
+			return
+		case data.From == data.To:
+			writeError(w, r, CodeValidation, "to", "settlement.sameAccount")
+			return
+		case data.Amount <= 0:
+			writeError(w, r, CodeValidation, "amount", "settlement.amountInvalid")
+			return
+		case data.Date < 0:
+			writeError(w, r, CodeValidation, "date", "expense.dateInvalid")
+			return
+		case sc.householdID == "" && data.From != sc.account && data.To != sc.account:
+			writeError(w, r, CodeValidation, "from", "settlement.notInvolved")
+			return
+		}
+		allowed, err := h.accountsAllowed(r, sc, []string{data.From, data.To})
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		if !allowed {
+			writeError(w, r, CodeValidation, "to", "split.unknownAccount")
+			return
+		}
+		if data.Date == 0 {
+			data.Date = int(time.Now().Unix())
+		}
+
+		data.ID = primitive.NewObjectID().Hex()
+		data.HouseholdID = sc.householdID
+		data.CreatedBy = sc.account
+		doc := bson.M{"id": data.ID, "from": data.From, "to": data.To, "amount": data.Amount,
+			"date": data.Date, "note": data.Note, "createdBy": data.CreatedBy}
+		if sc.householdID != "" {
+			doc["householdID"] = sc.householdID
+		}
+		if _, err := h.SColl.InsertOne(r.Context(), doc); err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		logFor(r).Info("settlement recorded", "id", data.ID, "household_id", sc.householdID, "amount", data.Amount)
+		w.Header().Set("Location", "/api/v1/settlements/"+data.ID)
+		writeJSON(w, http.StatusCreated, data)
+	}
+}
+
+// RemoveSettlement 家庭裡editor以上都可以刪，自己的只能刪自己記的
+func (h *handlerWithDB) RemoveSettlement() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		filter := bson.M{"id": mux.Vars(r)["id"]}
+		if sc.householdID != "" {
+			filter["householdID"] = sc.householdID
+		} else {
+			filter["householdID"] = bson.M{"$exists": false}
+			filter["createdBy"] = sc.account
+		}
+		res, err := h.SColl.DeleteOne(r.Context(), filter)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.DeletedCount == 0 {
+			writeError(w, r, CodeNotFound, "id", "settlement.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
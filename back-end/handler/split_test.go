@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func participants(accounts ...string) []SplitShare {
+	list := make([]SplitShare, len(accounts))
+	for i, a := range accounts {
+		list[i] = SplitShare{Account: a}
+	}
+	return list
+}
+
+func TestSplitAmounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int
+		split ExpenseSplit
+		want  []int
+	}{
+		{"equal exact", 90, ExpenseSplit{Method: SplitEqual, Participants: participants("a", "b", "c")}, []int{30, 30, 30}},
+		{"equal remainder to first", 100, ExpenseSplit{Method: SplitEqual, Participants: participants("a", "b", "c")}, []int{34, 33, 33}},
+		{"equal two remainder", 101, ExpenseSplit{Method: SplitEqual, Participants: participants("a", "b", "c")}, []int{34, 34, 33}},
+		{"equal less than participants", 2, ExpenseSplit{Method: SplitEqual, Participants: participants("a", "b", "c")}, []int{1, 1, 0}},
+		{"shares", 100, ExpenseSplit{Method: SplitShares, Participants: []SplitShare{{Account: "a", Shares: 1}, {Account: "b", Shares: 2}}}, []int{34, 66}},
+		{"shares remainder", 10, ExpenseSplit{Method: SplitShares, Participants: []SplitShare{{Account: "a", Shares: 3}, {Account: "b", Shares: 3}, {Account: "c", Shares: 1}}}, []int{5, 4, 1}},
+		{"exact", 100, ExpenseSplit{Method: SplitExact, Participants: []SplitShare{{Account: "a", Amount: 70}, {Account: "b", Amount: 30}}}, []int{70, 30}},
+		{"zero", 0, ExpenseSplit{Method: SplitEqual, Participants: participants("a", "b")}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitAmounts(tt.total, tt.split)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitAmounts(%d) = %v, want %v", tt.total, got, tt.want)
+			}
+			sum := 0
+			for _, owed := range got {
+				sum += owed
+			}
+			if sum != tt.total {
+				t.Fatalf("amounts sum to %d, want %d", sum, tt.total)
+			}
+		})
+	}
+}
+
+// 各種金額跟人數，加起來都要等於總金額，而且前面的人不會比後面的人少負擔
+func TestSplitAmountsSumToTotal(t *testing.T) {
+	for total := 0; total <= 200; total += 7 {
+		for n := 1; n <= 7; n++ {
+			accounts := make([]string, n)
+			for i := range accounts {
+				accounts[i] = string(rune('a' + i))
+			}
+			got := splitAmounts(total, ExpenseSplit{Method: SplitEqual, Participants: participants(accounts...)})
+			sum := 0
+			for i, owed := range got {
+				sum += owed
+				if i > 0 && owed > got[i-1] {
+					t.Fatalf("total %d, %d people: %v gives the remainder to a later participant", total, n, got)
+				}
+			}
+			if sum != total {
+				t.Fatalf("total %d, %d people: %v sums to %d", total, n, got, sum)
+			}
+		}
+	}
+}
+
+func TestNormalizeSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int
+		split  ExpenseSplit
+		field  string
+		msg    string
+	}{
+		{"default method and payer", 100, ExpenseSplit{Participants: participants("alice", "bob")}, "", ""},
+		{"unknown method", 100, ExpenseSplit{Method: "percent", Participants: participants("alice")}, "split.method", "split.methodInvalid"},
+		{"no participants", 100, ExpenseSplit{Method: SplitEqual}, "split.participants", "split.participantsRequired"},
+		{"blank account", 100, ExpenseSplit{Participants: participants("alice", " ")}, "split.participants", "account.required"},
+		{"duplicate", 100, ExpenseSplit{Participants: participants("alice", " alice")}, "split.participants", "split.duplicateParticipant"},
+		{"zero shares", 100, ExpenseSplit{Method: SplitShares, Participants: []SplitShare{{Account: "alice", Shares: 1}, {Account: "bob"}}}, "split.participants", "split.sharesInvalid"},
+		{"exact mismatch", 100, ExpenseSplit{Method: SplitExact, Participants: []SplitShare{{Account: "alice", Amount: 60}, {Account: "bob", Amount: 30}}}, "split.participants", "split.exactMismatch"},
+		{"exact negative", 100, ExpenseSplit{Method: SplitExact, Participants: []SplitShare{{Account: "alice", Amount: 110}, {Account: "bob", Amount: -10}}}, "split.participants", "split.exactMismatch"},
+		{"exact", 100, ExpenseSplit{Method: SplitExact, Participants: []SplitShare{{Account: "alice", Amount: 60}, {Account: "bob", Amount: 40}}}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, field, msg := normalizeSplit(tt.amount, tt.split, "alice")
+			if field != tt.field || msg != tt.msg {
+				t.Fatalf("normalizeSplit = (%q, %q), want (%q, %q)", field, msg, tt.field, tt.msg)
+			}
+			if msg != "" {
+				return
+			}
+			if got.PaidBy != "alice" || got.Method == "" {
+				t.Errorf("paidBy = %q, method = %q, want the creator and a default method", got.PaidBy, got.Method)
+			}
+			sum := 0
+			for _, p := range got.Participants {
+				sum += p.Amount
+			}
+			if sum != tt.amount {
+				t.Errorf("participants owe %d in total, want %d", sum, tt.amount)
+			}
+		})
+	}
+
+	many := make([]string, maxSplitParticipants+1)
+	for i := range many {
+		many[i] = string(rune('A' + i))
+	}
+	if _, _, msg := normalizeSplit(100, ExpenseSplit{Participants: participants(many...)}, "alice"); msg != "split.tooManyParticipants" {
+		t.Errorf("%d participants: msg = %q, want split.tooManyParticipants", len(many), msg)
+	}
+}
+
+func TestSettleUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		balances []MemberBalance
+		want     int // 最多幾筆還款
+	}{
+		{"settled", []MemberBalance{{"a", 0}, {"b", 0}}, 0},
+		{"one pair", []MemberBalance{{"a", 50}, {"b", -50}}, 1},
+		{"one creditor", []MemberBalance{{"a", 90}, {"b", -30}, {"c", -60}}, 2},
+		{"matching pairs", []MemberBalance{{"a", 100}, {"b", 40}, {"c", -100}, {"d", -40}}, 2},
+		{"chain", []MemberBalance{{"a", 70}, {"b", -20}, {"c", 10}, {"d", -45}, {"e", -15}}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfers := settleUp(tt.balances)
+			if len(transfers) > tt.want {
+				t.Errorf("%d transfers, want at most %d: %v", len(transfers), tt.want, transfers)
+			}
+			net := map[string]int{}
+			for _, b := range tt.balances {
+				net[b.Account] = b.Net
+			}
+			for _, d := range transfers {
+				if d.Amount <= 0 {
+					t.Errorf("transfer %v has a non-positive amount", d)
+				}
+				net[d.From] += d.Amount
+				net[d.To] -= d.Amount
+			}
+			for account, left := range net {
+				if left != 0 {
+					t.Errorf("%s still has a balance of %d after %v", account, left, transfers)
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerNetsPairs(t *testing.T) {
+	l := ledger{}
+	l.add("bob", "alice", 30)
+	l.add("alice", "bob", 50)
+	l.add("carol", "carol", 10)
+	want := []Debt{{From: "alice", To: "bob", Amount: 20}}
+	if got := l.debts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("debts = %v, want %v", got, want)
+	}
+	l.add("bob", "alice", 20)
+	if got := l.debts(); len(got) != 0 {
+		t.Fatalf("debts after settling = %v, want none", got)
+	}
+}
+
+func TestAccountsAllowed(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("households.find", func(cmd bson.Raw) []any {
+		filter := cmd.Lookup("filter").Document()
+		if id, ok := filter.Lookup("id").StringValueOK(); ok && id != "h1" {
+			return nil
+		}
+		return []any{bson.M{"id": "h1", "members": bson.A{bson.M{"account": "alice"}, bson.M{"account": "bob"}}}}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+
+	tests := []struct {
+		name     string
+		sc       scope
+		accounts []string
+		want     bool
+	}{
+		{"household members", scope{account: "alice", householdID: "h1"}, []string{"alice", "bob"}, true},
+		{"household non-member", scope{account: "alice", householdID: "h1"}, []string{"alice", "mallory"}, false},
+		{"other household", scope{account: "alice", householdID: "h2"}, []string{"alice"}, false},
+		{"personal with member", scope{account: "alice"}, []string{"alice", "bob"}, true},
+		{"personal with stranger", scope{account: "alice"}, []string{"alice", "mallory"}, false},
+		{"personal alone", scope{account: "carol"}, []string{"carol"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.accountsAllowed(req, tt.sc, tt.accounts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("accountsAllowed(%v) = %v, want %v", tt.accounts, got, tt.want)
+			}
+		})
+	}
+}
+
+// 舊的updateExpense改了金額，平分的分帳要照新的金額重算，指定金額的要取消
+func TestUpdateExpenseRecomputesSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		split  bson.M
+		want   []int32 // nil代表要取消分帳
+		remove bool
+	}{
+		{"equal", bson.M{"paidBy": "alice", "method": SplitEqual, "participants": bson.A{
+			bson.M{"account": "alice", "amount": 50}, bson.M{"account": "bob", "amount": 50}}}, []int32{61, 60}, false},
+		{"exact", bson.M{"paidBy": "alice", "method": SplitExact, "participants": bson.A{
+			bson.M{"account": "alice", "amount": 70}, bson.M{"account": "bob", "amount": 30}}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := newTestHandler(t)
+			mongo.Handle("expenses.find", func(bson.Raw) []any {
+				return []any{bson.M{"id": "e1", "budgetID": "b1", "amount": 100, "split": tt.split}}
+			})
+			var mu sync.Mutex
+			var update bson.Raw
+			mongo.Handle("expenses.update", func(cmd bson.Raw) []any {
+				mu.Lock()
+				defer mu.Unlock()
+				update = cmd.Lookup("updates", "0", "u").Document()
+				return []any{bson.M{"n": 1, "nModified": 1}}
+			})
+
+			body := `{"NewBudgetID":"b1","ID":"e1","Description":"dinner","Amount":121}`
+			req := loggedIn(t, httptest.NewRequest(http.MethodPost, "/updateExpense", strings.NewReader(body)), "alice", nil)
+			if rec := serve(h.UpdateExpense(), req); rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if update == nil {
+				t.Fatal("expense not updated")
+			}
+			if _, err := update.LookupErr("$unset", "split"); (err == nil) != tt.remove {
+				t.Fatalf("split unset = %v, want %v: %v", err == nil, tt.remove, update)
+			}
+			if tt.remove {
+				return
+			}
+			values, err := update.Lookup("$set", "split", "participants").Array().Values()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int32
+			for _, v := range values {
+				got = append(got, v.Document().Lookup("amount").Int32())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("split amounts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
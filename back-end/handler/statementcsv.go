@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+
+	"mongodb-budget/Utils"
+)
+
+// 銀行跟信用卡的對帳單CSV，欄位名稱跟格式各家不同，這裡盡量自動判斷
+// 台灣的銀行常常是Big5編碼、民國年、千分位逗號，還有支出跟存入分成兩欄
+
+const (
+	maxStatementLines  = 2000
+	headerSearchRows   = 10 // 表頭前面可能有帳號、期間之類的說明
+	minROCYearSentinel = 1000
+)
+
+// 表頭的別名，比對前會轉小寫並去掉空白
+var statementColumns = map[string][]string{
+	"date":        {"date", "transactiondate", "postingdate", "posteddate", "日期", "交易日期", "交易日", "入帳日期", "記帳日", "消費日期"},
+	"description": {"description", "memo", "details", "payee", "name", "摘要", "說明", "備註", "交易說明", "消費明細", "明細", "交易摘要"},
+	"amount":      {"amount", "金額", "交易金額", "新臺幣金額", "新台幣金額"},
+	"debit":       {"debit", "withdrawal", "支出", "提款", "支出金額", "提款金額"},
+	"credit":      {"credit", "deposit", "存入", "收入", "存款", "存入金額"},
+}
+
+// statementRow 對帳單的一列，Amount是對帳戶的影響，支出是負的
+type statementRow struct {
+	Day         string
+	Description string
+	Amount      int
+}
+
+// csvError Line是CSV裡的第幾行(從1開始)，0代表不是某一行的問題
+type csvError struct {
+	Line int
+	Key  string
+}
+
+func (e *csvError) Error() string {
+	return fmt.Sprintf("statement csv line %d: %s", e.Line, e.Key)
+}
+
+// field 回覆錯誤時的欄位，例如csv:12
+func (e *csvError) field() string {
+	if e.Line == 0 {
+		return "csv"
+	}
+	return "csv:" + strconv.Itoa(e.Line)
+}
+
+func normalizeHeader(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), ""))
+}
+
+// columnsFound 各欄位在第幾欄，找不到的是-1
+type columnsFound map[string]int
+
+// ok 至少要有日期跟金額(或支出/存入)
+func (c columnsFound) ok() bool {
+	return c["date"] >= 0 && (c["amount"] >= 0 || c["debit"] >= 0 || c["credit"] >= 0)
+}
+
+// findColumns 從表頭找出各欄位在第幾欄
+func findColumns(header []string) columnsFound {
+	columns := columnsFound{}
+	for name := range statementColumns {
+		columns[name] = -1
+	}
+	for i, cell := range header {
+		cell = normalizeHeader(cell)
+		for name, aliases := range statementColumns {
+			if columns[name] >= 0 {
+				continue
+			}
+			for _, alias := range aliases {
+				if cell == alias {
+					columns[name] = i
+				}
+			}
+		}
+	}
+	return columns
+}
+
+// parseStatementDay 支援2006-01-02、2006/1/2、2006.01.02、20060102跟民國年(113/01/02)，後面的時間會忽略
+func parseStatementDay(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " T"); i > 0 {
+		s = s[:i]
+	}
+	var parts []string
+	if len(s) == 8 && !strings.ContainsAny(s, "/-.") {
+		parts = []string{s[:4], s[4:6], s[6:]}
+	} else {
+		parts = strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '-' || r == '.' })
+	}
+	if len(parts) != 3 {
+		return "", false
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return "", false
+		}
+		nums[i] = n
+	}
+	year, month, day := nums[0], nums[1], nums[2]
+	if year < minROCYearSentinel {
+		year += 1911
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if t.Year() != year || int(t.Month()) != month || t.Day() != day {
+		return "", false
+	}
+	return t.Format(Utils.DayLayout), true
+}
+
+// parseStatementAmount 去掉幣別符號跟千分位，(100)跟100-都當成負的，小數四捨五入，空的是0
+func parseStatementAmount(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	for _, token := range []string{",", " ", "NT$", "TWD", "$", "元", "+"} {
+		s = strings.ReplaceAll(s, token, "")
+	}
+	if s == "" || s == "-" {
+		return 0, true
+	}
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative, s = true, s[1:len(s)-1]
+	}
+	if strings.HasSuffix(s, "-") {
+		negative, s = !negative, strings.TrimSuffix(s, "-")
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt32 {
+		return 0, false
+	}
+	if negative {
+		f = -f
+	}
+	return int(math.Round(f)), true
+}
+
+// parseStatementCSV 解析對帳單，outflowPositive代表金額欄是正的支出(信用卡帳單常見)
+func parseStatementCSV(data []byte, outflowPositive bool) ([]statementRow, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		decoded, err := traditionalchinese.Big5.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, &csvError{Key: "statement.encodingInvalid"}
+		}
+		data = decoded
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	var columns columnsFound
+	var rows []statementRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			return nil, &csvError{Line: line, Key: "statement.csvInvalid"}
+		}
+		if columns == nil {
+			if line > headerSearchRows {
+				return nil, &csvError{Key: "statement.columnsMissing"}
+			}
+			if c := findColumns(record); c.ok() {
+				columns = c
+			}
+			continue
+		}
+		cell := func(name string) string {
+			if i := columns[name]; i >= 0 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		// 空白行或是最後的合計列
+		if cell("date") == "" {
+			continue
+		}
+		day, ok := parseStatementDay(cell("date"))
+		if !ok {
+			return nil, &csvError{Line: line, Key: "statement.dateInvalid"}
+		}
+		var amount int
+		if columns["amount"] >= 0 {
+			amount, ok = parseStatementAmount(cell("amount"))
+			if outflowPositive {
+				amount = -amount
+			}
+		} else {
+			debit, okDebit := parseStatementAmount(cell("debit"))
+			credit, okCredit := parseStatementAmount(cell("credit"))
+			amount, ok = credit-debit, okDebit && okCredit
+		}
+		if !ok {
+			return nil, &csvError{Line: line, Key: "statement.amountInvalid"}
+		}
+		if len(rows) == maxStatementLines {
+			return nil, &csvError{Line: line, Key: "statement.tooManyLines"}
+		}
+		rows = append(rows, statementRow{Day: day, Description: cell("description"), Amount: amount})
+	}
+	if columns == nil {
+		return nil, &csvError{Key: "statement.columnsMissing"}
+	}
+	if len(rows) == 0 {
+		return nil, &csvError{Key: "statement.empty"}
+	}
+	return rows, nil
+}
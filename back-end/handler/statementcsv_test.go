@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+func TestParseStatementDay(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // 空字串代表解析失敗
+	}{
+		{"2024-01-02", "2024-01-02"},
+		{"2024/1/2", "2024-01-02"},
+		{"2024.01.02", "2024-01-02"},
+		{"20240102", "2024-01-02"},
+		{" 2024/01/02 13:45:00", "2024-01-02"},
+		{"2024-01-02T13:45:00+08:00", "2024-01-02"},
+		{"113/01/02", "2024-01-02"}, // 民國年
+		{"113/2/29", "2024-02-29"},  // 民國113年是閏年
+		{"99/12/31", "2010-12-31"},  // 兩位數的民國年
+		{"2024/02/30", ""},          // 沒有這一天，不能進位成3月
+		{"112/02/29", ""},           // 2023不是閏年
+		{"2024/13/01", ""},
+		{"2024/00/10", ""},
+		{"2024/01", ""},
+		{"2024/01/02/03", ""},
+		{"Jan 2 2024", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseStatementDay(tt.in)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("parseStatementDay(%q) = (%q, %v), want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseStatementAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"100", 100, true},
+		{"-100", -100, true},
+		{"+100", 100, true},
+		{"(100)", -100, true},
+		{"100-", -100, true},
+		{"1,234,567", 1234567, true},
+		{"NT$1,234", 1234, true},
+		{"TWD 1,234", 1234, true},
+		{"$ 99", 99, true},
+		{"500元", 500, true},
+		{"NT$(1,200)", -1200, true},
+		{"12.4", 12, true},
+		{"12.5", 13, true},
+		{"-12.5", -13, true},
+		{"", 0, true},
+		{"-", 0, true},
+		{"abc", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"99999999999", 0, false},
+		{"1.2.3", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseStatementAmount(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseStatementAmount(%q) = (%d, %v), want (%d, %v)", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseStatementCSV(t *testing.T) {
+	big5, err := traditionalchinese.Big5.NewEncoder().String("帳號,123\n交易日期,摘要,支出,存入\n113/01/05,全聯,\"1,200\",\n113/01/06,薪資,,50000\n,合計,1200,50000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		data            string
+		outflowPositive bool
+		want            []statementRow
+		key             string
+	}{
+		{
+			name: "amount column",
+			data: "\xef\xbb\xbfDate,Description,Amount\n2024-01-05,Coffee,-120\n2024-01-06,Refund,(30)\n",
+			want: []statementRow{{"2024-01-05", "Coffee", -120}, {"2024-01-06", "Refund", -30}},
+		},
+		{
+			name:            "credit card statement",
+			data:            "消費日期,消費明細,新臺幣金額\n2024/01/05,Coffee,120\n2024/01/06,Refund,-30\n",
+			outflowPositive: true,
+			want:            []statementRow{{"2024-01-05", "Coffee", -120}, {"2024-01-06", "Refund", 30}},
+		},
+		{
+			name: "big5 with debit and credit columns",
+			data: big5,
+			want: []statementRow{{"2024-01-05", "全聯", -1200}, {"2024-01-06", "薪資", 50000}},
+		},
+		{name: "no header", data: "2024-01-05,Coffee,-120\n", key: "statement.columnsMissing"},
+		{name: "header only", data: "Date,Amount\n", key: "statement.empty"},
+		{name: "bad date", data: "Date,Amount\n2024/02/30,-120\n", key: "statement.dateInvalid"},
+		{name: "bad amount", data: "Date,Amount\n2024-01-05,abc\n", key: "statement.amountInvalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseStatementCSV([]byte(tt.data), tt.outflowPositive)
+			if tt.key != "" {
+				var ce *csvError
+				if !errors.As(err, &ce) || ce.Key != tt.key {
+					t.Fatalf("err = %v, want %s", err, tt.key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Fatalf("rows = %v, want %v", rows, tt.want)
+			}
+		})
+	}
+}
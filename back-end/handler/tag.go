@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 花費的標籤，一筆花費可以有很多個，用來追蹤跨預算的東西(例如「台南旅遊」)
+// 沒有另外的collection，標籤就是花費上的tags欄位，改名、合併跟刪除都是直接改花費
+
+const (
+	maxTagLength      = 20
+	maxTagsPerExpense = 10
+
+	TagMatchAny = "any"
+	TagMatchAll = "all"
+)
+
+// TagTotal 某個標籤的花費筆數跟金額
+type TagTotal struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Total int    `json:"total"`
+}
+
+// TagPatch 改名，新名稱已經有花費在用的話就等於合併
+type TagPatch struct {
+	Name string `json:"name"`
+}
+
+// TagMerge 把Tags都換成Into
+type TagMerge struct {
+	Tags []string `json:"tags"`
+	Into string   `json:"into"`
+}
+
+// validateTag 回傳錯誤訊息，空字串代表沒問題
+// 斜線會讓/tags/{name}對不到route，逗號是查詢時的分隔符號
+func validateTag(tag string) string {
+	if tag == "" {
+		return "tag.nameRequired"
+	}
+	if len([]rune(tag)) > maxTagLength {
+		return "tag.nameTooLong"
+	}
+	if strings.ContainsAny(tag, "/,") {
+		return "tag.nameInvalid"
+	}
+	return ""
+}
+
+// normalizeTags 去掉前後空白、空的跟重複的標籤，順序照原本的
+func normalizeTags(tags []string) ([]string, string) {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if msg := validateTag(tag); msg != "" {
+			return nil, msg
+		}
+		seen[tag] = true
+		res = append(res, tag)
+	}
+	if len(res) > maxTagsPerExpense {
+		return nil, "expense.tooManyTags"
+	}
+	return res, ""
+}
+
+// tagFilter ?tags=a,b&tagMatch=any|all，any(預設)是有其中一個標籤，all是每個標籤都要有
+// 沒有tags的話回傳nil
+func tagFilter(r *http.Request) (bson.M, string, string) {
+	query := r.URL.Query()
+	var tags []string
+	for _, tag := range strings.Split(query.Get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	switch query.Get("tagMatch") {
+	case "", TagMatchAny:
+		if len(tags) == 0 {
+			return nil, "", ""
+		}
+		return bson.M{"tags": bson.M{"$in": tags}}, "", ""
+	case TagMatchAll:
+		if len(tags) == 0 {
+			return nil, "", ""
+		}
+		return bson.M{"tags": bson.M{"$all": tags}}, "", ""
+	}
+	return nil, "tagMatch", "tag.matchInvalid"
+}
+
+// tagTotals 依照金額由大到小排，同金額照名稱
+func tagTotals(expenses []ExpenseObject) []TagTotal {
+	byName := map[string]*TagTotal{}
+	for _, e := range expenses {
+		for _, tag := range e.Tags {
+			if byName[tag] == nil {
+				byName[tag] = &TagTotal{Name: tag}
+			}
+			byName[tag].Count++
+			byName[tag].Total += e.Amount
+		}
+	}
+	res := []TagTotal{}
+	for _, t := range byName {
+		res = append(res, *t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Total != res[j].Total {
+			return res[i].Total > res[j].Total
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// taggedExpenses 有標籤的花費，只讀加總需要的欄位
+func (h *handlerWithDB) taggedExpenses(r *http.Request, filter bson.M) ([]ExpenseObject, error) {
+	filter = bson.M{"$and": bson.A{filter, bson.M{"tags.0": bson.M{"$exists": true}}}}
+	var expenses []ExpenseObject
+	cursor, err := h.EColl.Find(r.Context(), filter, options.Find().SetProjection(bson.M{"tags": 1, "amount": 1}))
+	if err == nil {
+		err = cursor.All(r.Context(), &expenses)
+	}
+	return expenses, err
+}
+
+// tagTotal 改名或合併之後回傳的結果，不限日期
+func (h *handlerWithDB) tagTotal(r *http.Request, sc scope, tag string) (TagTotal, error) {
+	expenses, err := h.taggedExpenses(r, sc.filter(bson.M{"tags": tag}))
+	if err != nil {
+		return TagTotal{}, err
+	}
+	res := TagTotal{Name: tag}
+	for _, e := range expenses {
+		res.Count++
+		res.Total += e.Amount
+	}
+	return res, nil
+}
+
+// replaceTags 把有from其中一個標籤的花費換成into
+// 用pipeline update一次換掉，不會只加了新的還留著舊的；$setUnion不保留原本的順序
+// 對帳鎖定的花費也會改，標籤不影響金額跟帳戶
+func (h *handlerWithDB) replaceTags(r *http.Request, sc scope, from []string, into string) (int64, error) {
+	filter := sc.filter(bson.M{"tags": bson.M{"$in": from}})
+	update := bson.A{bson.M{"$set": bson.M{"tags": bson.M{
+		"$setUnion": bson.A{bson.M{"$setDifference": bson.A{"$tags", from}}, bson.A{into}},
+	}}}}
+	res, err := h.EColl.UpdateMany(r.Context(), filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+// ListTags 所有用過的標籤跟花費的加總，日期條件跟花費一樣
+func (h *handlerWithDB) ListTags() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleViewer)
+		if !ok {
+			return
+		}
+		filter, err := h.expenseFilter(r, sc)
+		if err == errInvalidDateRange {
+			writeError(w, r, CodeValidation, "from", "date.rangeInvalid")
+			return
+		}
+		var expenses []ExpenseObject
+		if err == nil {
+			expenses, err = h.taggedExpenses(r, filter)
+		}
+		if err != nil {
+			writeDBError(w, r, "db query failed", err, "db.readFailed")
+			return
+		}
+		writeJSON(w, http.StatusOK, tagTotals(expenses))
+	}
+}
+
+// PatchTag 標籤改名
+func (h *handlerWithDB) PatchTag() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		name := mux.Vars(r)["name"]
+		var patch TagPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		patch.Name = strings.TrimSpace(patch.Name)
+		if msg := validateTag(patch.Name); msg != "" {
+			writeError(w, r, CodeValidation, "name", msg)
+			return
+		}
+		h.mergeTags(w, r, sc, []string{name}, patch.Name)
+	}
+}
+
+// MergeTags 把幾個標籤合併成一個
+func (h *handlerWithDB) MergeTags() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		var data TagMerge
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+		data.Into = strings.TrimSpace(data.Into)
+		if msg := validateTag(data.Into); msg != "" {
+			writeError(w, r, CodeValidation, "into", msg)
+			return
+		}
+		var from []string
+		for _, tag := range data.Tags {
+			if tag = strings.TrimSpace(tag); tag != "" && tag != data.Into {
+				from = append(from, tag)
+			}
+		}
+		if len(from) == 0 {
+			writeError(w, r, CodeValidation, "tags", "tag.mergeEmpty")
+			return
+		}
+		h.mergeTags(w, r, sc, from, data.Into)
+	}
+}
+
+// mergeTags 改名跟合併共用，from都沒有花費在用的話回404
+func (h *handlerWithDB) mergeTags(w http.ResponseWriter, r *http.Request, sc scope, from []string, into string) {
+	if len(from) == 1 && from[0] == into {
+		from = nil
+	}
+	if len(from) > 0 {
+		matched, err := h.replaceTags(r, sc, from, into)
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if matched == 0 {
+			writeError(w, r, CodeNotFound, "name", "tag.notFound")
+			return
+		}
+		logFor(r).Info("tags merged", "from", from, "into", into, "expenses", matched)
+	}
+	res, err := h.tagTotal(r, sc, into)
+	if err != nil {
+		writeDBError(w, r, "db query failed", err, "db.readFailed")
+		return
+	}
+	if res.Count == 0 {
+		writeError(w, r, CodeNotFound, "name", "tag.notFound")
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// RemoveTag 從所有花費移除這個標籤，花費本身不會刪
+func (h *handlerWithDB) RemoveTag() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sc, ok := h.requireScope(w, r, RoleEditor)
+		if !ok {
+			return
+		}
+		name := mux.Vars(r)["name"]
+		res, err := h.EColl.UpdateMany(r.Context(), sc.filter(bson.M{"tags": name}), bson.M{"$pull": bson.M{"tags": name}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			writeError(w, r, CodeNotFound, "name", "tag.notFound")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTagFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bson.M
+		msg   string
+	}{
+		{"", nil, ""},
+		{"tags=", nil, ""},
+		{"tags=trip", bson.M{"tags": bson.M{"$in": []string{"trip"}}}, ""},
+		{"tags=trip,+food+,,", bson.M{"tags": bson.M{"$in": []string{"trip", "food"}}}, ""},
+		{"tags=trip,food&tagMatch=any", bson.M{"tags": bson.M{"$in": []string{"trip", "food"}}}, ""},
+		{"tags=trip,food&tagMatch=all", bson.M{"tags": bson.M{"$all": []string{"trip", "food"}}}, ""},
+		{"tagMatch=all", nil, ""},
+		{"tags=trip&tagMatch=some", nil, "tag.matchInvalid"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/expenses?"+tt.query, nil)
+		got, field, msg := tagFilter(req)
+		if !reflect.DeepEqual(got, tt.want) || msg != tt.msg {
+			t.Errorf("tagFilter(%q) = (%v, %q), want (%v, %q)", tt.query, got, msg, tt.want, tt.msg)
+		}
+		if msg != "" && field != "tagMatch" {
+			t.Errorf("tagFilter(%q) field = %q, want tagMatch", tt.query, field)
+		}
+	}
+}
+
+func TestTagTotals(t *testing.T) {
+	expenses := []ExpenseObject{
+		{Amount: 100, Tags: []string{"trip", "food"}},
+		{Amount: 300, Tags: []string{"trip"}},
+		{Amount: 50, Tags: []string{"coffee"}},
+		{Amount: 50, Tags: []string{"bakery"}},
+		{Amount: 999},
+	}
+	want := []TagTotal{
+		{Name: "trip", Count: 2, Total: 400},
+		{Name: "food", Count: 1, Total: 100},
+		{Name: "bakery", Count: 1, Total: 50}, // 同金額照名稱
+		{Name: "coffee", Count: 1, Total: 50},
+	}
+	if got := tagTotals(expenses); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tagTotals = %v, want %v", got, want)
+	}
+	if got := tagTotals(nil); got == nil || len(got) != 0 {
+		t.Fatalf("tagTotals(nil) = %#v, want an empty list", got)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+		msg  string
+	}{
+		{nil, []string{}, ""},
+		{[]string{" trip ", "food", "trip", ""}, []string{"trip", "food"}, ""},
+		{[]string{"a/b"}, nil, "tag.nameInvalid"},
+		{[]string{"a,b"}, nil, "tag.nameInvalid"},
+		{[]string{strings.Repeat("長", maxTagLength+1)}, nil, "tag.nameTooLong"},
+		{strings.Split("a b c d e f g h i j k", " "), nil, "expense.tooManyTags"},
+	}
+	for _, tt := range tests {
+		got, msg := normalizeTags(tt.in)
+		if !reflect.DeepEqual(got, tt.want) || msg != tt.msg {
+			t.Errorf("normalizeTags(%q) = (%q, %q), want (%q, %q)", tt.in, got, msg, tt.want, tt.msg)
+		}
+	}
+}
+
+// 改名跟合併只送一個update，同時加上新的標籤跟拿掉舊的
+func TestMergeTagsSingleUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(h *handlerWithDB) http.HandlerFunc
+		path    string
+		body    string
+		vars    map[string]string
+		from    []string
+	}{
+		{"rename", (*handlerWithDB).PatchTag, "/api/v1/tags/taipei", `{"name":" tainan "}`, map[string]string{"name": "taipei"}, []string{"taipei"}},
+		{"merge", (*handlerWithDB).MergeTags, "/api/v1/tags/merge", `{"tags":["taipei","tainan"," kaohsiung"],"into":"tainan"}`, nil, []string{"taipei", "kaohsiung"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := newTestHandler(t)
+			var mu sync.Mutex
+			var updates []bson.Raw
+			mongo.Handle("expenses.update", func(cmd bson.Raw) []any {
+				mu.Lock()
+				defer mu.Unlock()
+				updates = append(updates, cmd.Lookup("updates", "0").Document())
+				return []any{bson.M{"n": 2, "nModified": 2}}
+			})
+			mongo.Handle("expenses.find", docs(
+				bson.M{"id": "e1", "amount": 100, "tags": bson.A{"tainan"}},
+				bson.M{"id": "e2", "amount": 200, "tags": bson.A{"food", "tainan"}},
+			))
+			req := loggedIn(t, httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body)), "alice", tt.vars)
+			rec := serve(tt.handler(h), req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(updates) != 1 {
+				t.Fatalf("%d update commands, want 1", len(updates))
+			}
+			var update struct {
+				Q struct {
+					Tags struct {
+						In []string `bson:"$in"`
+					}
+				}
+				U     []bson.Raw
+				Multi bool
+			}
+			if err := bson.Unmarshal(updates[0], &update); err != nil {
+				t.Fatal(err)
+			}
+			if !update.Multi || !reflect.DeepEqual(update.Q.Tags.In, tt.from) || len(update.U) != 1 {
+				t.Fatalf("update = %v", updates[0])
+			}
+			var stage struct {
+				Set struct {
+					Tags struct {
+						SetUnion []bson.RawValue `bson:"$setUnion"`
+					}
+				} `bson:"$set"`
+			}
+			if err := bson.Unmarshal(update.U[0], &stage); err != nil {
+				t.Fatal(err)
+			}
+			union := stage.Set.Tags.SetUnion
+			if len(union) != 2 {
+				t.Fatalf("pipeline = %v", update.U[0])
+			}
+			var diff []any
+			if err := union[0].Document().Lookup("$setDifference").Unmarshal(&diff); err != nil {
+				t.Fatal(err)
+			}
+			var added []string
+			if err := union[1].Unmarshal(&added); err != nil {
+				t.Fatal(err)
+			}
+			wantDiff := []any{"$tags", bson.A{}}
+			for _, tag := range tt.from {
+				wantDiff[1] = append(wantDiff[1].(bson.A), tag)
+			}
+			if !reflect.DeepEqual(diff, wantDiff) || !reflect.DeepEqual(added, []string{"tainan"}) {
+				t.Fatalf("pipeline = %v", update.U[0])
+			}
+		})
+	}
+}
+
+func TestMergeTagsNotFound(t *testing.T) {
+	h, mongo := newTestHandler(t)
+	mongo.Handle("expenses.update", func(bson.Raw) []any {
+		return []any{bson.M{"n": 0, "nModified": 0}}
+	})
+	req := loggedIn(t, httptest.NewRequest(http.MethodPatch, "/api/v1/tags/nothing", strings.NewReader(`{"name":"other"}`)),
+		"alice", map[string]string{"name": "nothing"})
+	rec := serve(h.PatchTag(), req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	if e := decodeError(t, rec); e.Message != T(req, "tag.notFound") {
+		t.Fatalf("message = %q", e.Message)
+	}
+}
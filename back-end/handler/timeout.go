@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Timeout 依照route設定request context的期限，用mux.Use套用，比對完route之後才知道是哪個route
+// routes的key是"GET /api/v1/expenses"或"/api/v1/expenses"，都沒有就用defaultTimeout，0代表不限制
+// 這裡只設定期限，不會中斷handler，也不會替handler回應：期限到了之後資料庫操作會被取消，
+// handler照常透過writeDBError回503 (request_timeout)；沒有用到ctx的部分會繼續跑到結束，
+// 整個回應的上限要靠http.Server的WriteTimeout
+func Timeout(defaultTimeout time.Duration, routes map[string]time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := defaultTimeout
+			if route := mux.CurrentRoute(r); route != nil {
+				if tpl, err := route.GetPathTemplate(); err == nil {
+					if d, ok := routes[r.Method+" "+tpl]; ok {
+						timeout = d
+					} else if d, ok := routes[tpl]; ok {
+						timeout = d
+					}
+				}
+			}
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTimeoutDeadline(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Timeout(time.Minute, map[string]time.Duration{
+		"GET /expenses/{id}": time.Second,
+		"/budgets":           time.Hour,
+		"/export":            0,
+	}))
+	var deadline time.Time
+	var hasDeadline bool
+	record := func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}
+	router.HandleFunc("/expenses/{id}", record)
+	router.HandleFunc("/budgets", record)
+	router.HandleFunc("/export", record)
+	router.HandleFunc("/other", record)
+
+	tests := []struct {
+		method, path string
+		want         time.Duration // 0代表沒有期限
+	}{
+		{http.MethodGet, "/expenses/1", time.Second},
+		{http.MethodPatch, "/expenses/1", time.Minute}, // 只設定了GET，其他method用預設值
+		{http.MethodPost, "/budgets", time.Hour},
+		{http.MethodGet, "/export", 0},
+		{http.MethodGet, "/other", time.Minute},
+	}
+	for _, tt := range tests {
+		hasDeadline = false
+		start := time.Now()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if tt.want == 0 {
+			if hasDeadline {
+				t.Errorf("%s %s: unexpected deadline", tt.method, tt.path)
+			}
+			continue
+		}
+		if !hasDeadline {
+			t.Errorf("%s %s: no deadline", tt.method, tt.path)
+			continue
+		}
+		if got := deadline.Sub(start); got < tt.want || got > tt.want+time.Second {
+			t.Errorf("%s %s: deadline in %v, want about %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"mongodb-budget/Utils"
+)
+
+type UpdateTimeZoneObject struct {
+	TimeZone string `json:"timeZone"`
+}
+
+var errInvalidDateRange = errors.New("invalid date range")
+
+// userLocation 讀取使用者設定的時區，沒設定(舊帳號)就用預設時區
+func (h *handlerWithDB) userLocation(ctx context.Context, account string) (*time.Location, error) {
+	var user UserObject
+	err := h.UColl.FindOne(ctx, bson.M{"account": account}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return Utils.LoadLocation(user.TimeZone)
+}
+
+// periodFromQuery 從query string取出日期區間 [start, end)
+// ?from=&to= 優先，其次是 ?period=month&date=2006-01-02 (date不填就是今天)
+func periodFromQuery(query url.Values, loc *time.Location) (time.Time, time.Time, error) {
+	if query.Get("from") != "" || query.Get("to") != "" {
+		return Utils.DayRange(query.Get("from"), query.Get("to"), loc)
+	}
+	if query.Get("period") == "" {
+		return time.Time{}, time.Time{}, nil
+	}
+	day := time.Now()
+	if query.Get("date") != "" {
+		t, err := Utils.ParseDay(query.Get("date"), loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		day = t
+	}
+	return Utils.PeriodRange(query.Get("period"), day, loc)
+}
+
+// expenseFilter 產生查詢使用者或家庭花費的條件
+// 可以用 ?from=2006-01-02&to=2006-01-02 或 ?period=month&date=2006-01-02 篩選，日期都以登入的使用者的時區為準
+func (h *handlerWithDB) expenseFilter(r *http.Request, sc scope) (bson.M, error) {
+	filter := sc.filter(nil)
+	query := r.URL.Query()
+	if query.Get("from") == "" && query.Get("to") == "" && query.Get("period") == "" {
+		return filter, nil
+	}
+	loc, err := h.userLocation(r.Context(), sc.account)
+	if err != nil {
+		return nil, err
+	}
+	start, end, err := periodFromQuery(query, loc)
+	if err != nil {
+		return nil, errInvalidDateRange
+	}
+	if f := dateRangeFilter(start, end); f != nil {
+		filter = bson.M{"$and": bson.A{filter, f}}
+	}
+	return filter, nil
+}
+
+// dateRangeFilter 產生date欄位的篩選條件，start或end是zero value就代表那一端不限制
+// 舊資料的date有秒也有毫秒(前端送的是Date.now())，所以兩種單位都要比對
+func dateRangeFilter(start, end time.Time) bson.M {
+	if start.IsZero() && end.IsZero() {
+		return nil
+	}
+	// 秒數一定小於門檻，毫秒一定大於等於門檻，所以兩個區間不會重疊
+	seconds := bson.M{"$lt": Utils.MillisecondThreshold}
+	millis := bson.M{"$gte": Utils.MillisecondThreshold}
+	if !start.IsZero() {
+		seconds["$gte"] = start.Unix()
+		millis["$gte"] = start.UnixMilli()
+	}
+	if !end.IsZero() {
+		seconds["$lt"] = end.Unix()
+		millis["$lt"] = end.UnixMilli()
+	}
+	return bson.M{"$or": bson.A{bson.M{"date": seconds}, bson.M{"date": millis}}}
+}
+
+func (h *handlerWithDB) UpdateTimeZone() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		SID, ok := requireAccount(w, r)
+		if !ok {
+			// 通知front-end去log out並提醒使用者要重新登入
+			return
+		}
+
+		var data UpdateTimeZoneObject
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			writeInvalidJSON(w, r)
+			return
+		}
+
+		data.TimeZone = strings.TrimSpace(data.TimeZone)
+		if data.TimeZone == "" {
+			writeError(w, r, CodeValidation, "timeZone", "timeZone.required")
+			return
+		}
+		if _, err := Utils.LoadLocation(data.TimeZone); err != nil {
+			writeError(w, r, CodeValidation, "timeZone", "timeZone.invalid")
+			return
+		}
+
+		res, err := h.UColl.UpdateOne(r.Context(), bson.M{"account": SID}, bson.M{"$set": bson.M{"timeZone": data.TimeZone}})
+		if err != nil {
+			writeDBError(w, r, "db write failed", err, "db.writeFailed")
+			return
+		}
+		if res.MatchedCount == 0 {
+			logFor(r).Warn("signed-in account not found")
+			writeError(w, r, CodeNotFound, "", "user.notFound")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &CRUDResponse{LogIn: true, Msg: T(r, "timeZone.updated")})
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"mongodb-budget/Utils"
+)
+
+// inDateRange 照MongoDB的規則比對dateRangeFilter產生的條件
+func inDateRange(t *testing.T, filter bson.M, date int64) bool {
+	t.Helper()
+	for _, clause := range filter["$or"].(bson.A) {
+		cond := clause.(bson.M)["date"].(bson.M)
+		ok := true
+		for op, v := range cond {
+			switch op {
+			case "$gte":
+				ok = ok && date >= v.(int64)
+			case "$lt":
+				ok = ok && date < v.(int64)
+			default:
+				t.Fatalf("unexpected operator %s", op)
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDateRangeFilter(t *testing.T) {
+	taipeiLoc := mustLocation(t, Utils.DefaultTimeZone)
+	// 台北時間4/1 00:30，UTC還是3/31
+	lateMarch := time.Date(2024, 3, 31, 23, 30, 0, 0, taipeiLoc)
+	earlyApril := time.Date(2024, 4, 1, 0, 30, 0, 0, taipeiLoc)
+	tests := []struct {
+		name       string
+		loc        *time.Location
+		date       time.Time
+		inMarch    bool
+		beforeThat bool
+	}{
+		{"late March in Taipei", taipeiLoc, lateMarch, true, false},
+		{"early April in Taipei", taipeiLoc, earlyApril, false, false},
+		{"early April in Taipei is March in UTC", time.UTC, earlyApril, true, false},
+		{"February", taipeiLoc, time.Date(2024, 2, 29, 23, 59, 59, 0, taipeiLoc), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := Utils.PeriodRange("month", time.Date(2024, 3, 15, 0, 0, 0, 0, tt.loc), tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 秒跟毫秒都要對
+			for _, date := range []int64{tt.date.Unix(), tt.date.UnixMilli()} {
+				if got := inDateRange(t, dateRangeFilter(start, end), date); got != tt.inMarch {
+					t.Errorf("date %d in March = %v, want %v", date, got, tt.inMarch)
+				}
+				if got := inDateRange(t, dateRangeFilter(time.Time{}, start), date); got != tt.beforeThat {
+					t.Errorf("date %d before March = %v, want %v", date, got, tt.beforeThat)
+				}
+			}
+		})
+	}
+	if f := dateRangeFilter(time.Time{}, time.Time{}); f != nil {
+		t.Fatalf("open range = %v, want nil", f)
+	}
+	// 秒數的門檻前後不會被當成另一種單位
+	start := time.Unix(0, 0)
+	if !inDateRange(t, dateRangeFilter(start, time.Time{}), Utils.MillisecondThreshold-1) {
+		t.Error("the largest second is not after 1970")
+	}
+	if inDateRange(t, dateRangeFilter(time.Time{}, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)), Utils.MillisecondThreshold-1) {
+		t.Error("the largest second matched a range before 2000")
+	}
+}
+
+func TestPeriodFromQuery(t *testing.T) {
+	taipeiLoc := mustLocation(t, Utils.DefaultTimeZone)
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name       string
+		query      string
+		loc        *time.Location
+		start, end string // RFC3339，空字串代表不限制
+		hours      float64
+		wantErr    bool
+	}{
+		{"nothing", "", taipeiLoc, "", "", 0, false},
+		{"from and to include both days", "from=2024-03-01&to=2024-03-31", taipeiLoc, "2024-03-01T00:00:00+08:00", "2024-04-01T00:00:00+08:00", 0, false},
+		{"from only", "from=2024-03-01", taipeiLoc, "2024-03-01T00:00:00+08:00", "", 0, false},
+		{"from wins over period", "from=2024-03-01&to=2024-03-01&period=year", taipeiLoc, "2024-03-01T00:00:00+08:00", "2024-03-02T00:00:00+08:00", 0, false},
+		{"from after to", "from=2024-03-02&to=2024-03-01", taipeiLoc, "", "", 0, true},
+		{"bad from", "from=2024-13-01", taipeiLoc, "", "", 0, true},
+		{"week starts on Monday", "period=week&date=2024-03-10", taipeiLoc, "2024-03-04T00:00:00+08:00", "2024-03-11T00:00:00+08:00", 0, false},
+		{"month in UTC", "period=month&date=2024-02-10", time.UTC, "2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z", 0, false},
+		{"bad period", "period=decade&date=2024-03-10", taipeiLoc, "", "", 0, true},
+		{"bad date", "period=day&date=03/10/2024", taipeiLoc, "", "", 0, true},
+		// 夏令時間開始那天只有23小時，結束那天有25小時
+		{"spring forward", "period=day&date=2024-03-10", newYork, "2024-03-10T00:00:00-05:00", "2024-03-11T00:00:00-04:00", 23, false},
+		{"fall back", "period=day&date=2024-11-03", newYork, "2024-11-03T00:00:00-04:00", "2024-11-04T00:00:00-05:00", 25, false},
+		{"week across DST", "period=week&date=2024-03-10", newYork, "2024-03-04T00:00:00-05:00", "2024-03-11T00:00:00-04:00", 7*24 - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, end, err := periodFromQuery(query, tt.loc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			format := func(t time.Time) string {
+				if t.IsZero() {
+					return ""
+				}
+				return t.Format(time.RFC3339)
+			}
+			if format(start) != tt.start || format(end) != tt.end {
+				t.Fatalf("range = [%s, %s), want [%s, %s)", format(start), format(end), tt.start, tt.end)
+			}
+			if tt.hours != 0 && end.Sub(start).Hours() != tt.hours {
+				t.Fatalf("range is %v hours, want %v", end.Sub(start).Hours(), tt.hours)
+			}
+		})
+	}
+}
+
+func TestPeriodFromQueryToday(t *testing.T) {
+	loc := mustLocation(t, Utils.DefaultTimeZone)
+	start, end, err := periodFromQuery(url.Values{"period": {"day"}}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now := time.Now(); now.Before(start) || !now.Before(end) {
+		t.Fatalf("today = [%v, %v), does not contain %v", start, end, now)
+	}
+}
+
+func TestUserLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeZone string // 空字串代表沒有這個使用者
+		want     string
+		wantErr  bool
+	}{
+		{"no user", "", Utils.DefaultTimeZone, false},
+		{"set", "America/New_York", "America/New_York", false},
+		{"broken", "Mars/Olympus", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mongo := newTestHandler(t)
+			mongo.Handle("users.find", func(cmd bson.Raw) []any {
+				if tt.timeZone == "" || cmd.Lookup("filter", "account").StringValue() != "alice" {
+					return nil
+				}
+				return []any{bson.M{"account": "alice", "timeZone": tt.timeZone}}
+			})
+			loc, err := h.userLocation(context.Background(), "alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && loc.String() != tt.want {
+				t.Fatalf("location = %s, want %s", loc, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"mongodb-budget/tracing"
+)
+
+// middleware 每個request開一個server span，handler裡的Mongo呼叫都用r.Context()，所以會變成它的child span
+// 要放在AccessLog裡面，結束時才拿得到route template
+func Tracing(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 上游有帶traceparent的話就接著同一個trace
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("request.id", RequestIDFromContext(r.Context())),
+			),
+		)
+		defer span.End()
+
+		info := requestLogFromContext(r)
+		if info != nil && span.SpanContext().IsValid() {
+			info.traceID = span.SpanContext().TraceID().String()
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if info != nil && info.route != "" {
+			span.SetName(r.Method + " " + info.route)
+			span.SetAttributes(semconv.HTTPRoute(info.route))
+		}
+		if info != nil && info.user != "" {
+			span.SetAttributes(attribute.String("enduser.id", info.user))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.Status()))
+		if rec.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.Status()))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"mongodb-budget/internal/testutil"
+)
+
+func TestTracingSpans(t *testing.T) {
+	exp := testutil.UseTestExporter(t)
+	s := newTestServer(t)
+	// 啟動時的ping之類的span不算
+	exp.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/budgets", nil)
+	s.login(t, req, "alice")
+	if rec := s.do(req); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	spans := exp.GetSpans()
+	var server *tracetest.SpanStub
+	for i := range spans {
+		if spans[i].SpanKind == trace.SpanKindServer {
+			server = &spans[i]
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span in %d spans", len(spans))
+	}
+	if server.Name != "GET /api/v1/budgets" {
+		t.Errorf("server span name = %q, want %q", server.Name, "GET /api/v1/budgets")
+	}
+
+	// handler用r.Context()查Mongo，otelmongo的span要是server span的child
+	found := false
+	for _, span := range spans {
+		if span.SpanKind != trace.SpanKindClient {
+			continue
+		}
+		if span.Parent.TraceID() != server.SpanContext.TraceID() || span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("mongo span %q is not a child of the server span", span.Name)
+		}
+		found = found || span.Name == "budgets.find"
+	}
+	if !found {
+		t.Errorf("no budgets.find span in %v", spanNames(spans))
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
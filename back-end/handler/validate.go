@@ -0,0 +1,55 @@
+package handler
+
+import "strings"
+
+// 新增預算/花費的資料檢查，legacy route跟/api/v1共用
+// 回傳有問題的欄位跟錯誤訊息，msg是空字串代表沒問題
+
+func validateBudget(data BudgetObject) (string, string) {
+	if strings.TrimSpace(data.ID) == "" {
+		return "id", "budget.idRequired"
+	}
+	return validateBudgetFields(data.Name, data.Max)
+}
+
+func validateBudgetFields(name string, max int) (string, string) {
+	if strings.TrimSpace(name) == "" {
+		return "name", "budget.nameRequired"
+	}
+	if len([]rune(strings.TrimSpace(name))) > 12 {
+		return "name", "budget.nameTooLong"
+	}
+	if strings.TrimSpace(name) == "總計" {
+		return "name", "budget.nameReserved"
+	}
+	if max < 0 {
+		return "max", "budget.maxInvalid"
+	}
+	return "", ""
+}
+
+func validateMaxMode(mode string) (string, string) {
+	if mode != "" && mode != BudgetMaxOwn && mode != BudgetMaxChildren {
+		return "maxMode", "budget.maxModeInvalid"
+	}
+	return "", ""
+}
+
+func validateExpense(data ExpenseObject) (string, string) {
+	if strings.TrimSpace(data.ID) == "" {
+		return "id", "expense.idRequired"
+	}
+	if strings.TrimSpace(data.BudgetID) == "" {
+		return "budgetID", "expense.budgetRequired"
+	}
+	if strings.TrimSpace(data.Description) == "" {
+		return "description", "expense.descriptionRequired"
+	}
+	if data.Amount < 0 {
+		return "amount", "expense.amountInvalid"
+	}
+	if data.Date < 0 {
+		return "date", "expense.dateInvalid"
+	}
+	return "", ""
+}
@@ -0,0 +1,119 @@
+// Package i18n 是伺服器回給使用者的訊息目錄，每個訊息用key查詢，
+// 翻譯放在locales/<語言>.json，新增訊息時每個語言檔都要加上同一個key。
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// 預設語言，也是其他語言檔比對key的基準
+const DefaultLocale = "zh-TW"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// locale -> key -> 訊息
+var bundles = map[string]map[string]string{}
+
+// 支援的語言，第一個是預設值
+var supported = []language.Tag{language.MustParse(DefaultLocale), language.English}
+
+var matcher = language.NewMatcher(supported)
+
+func init() {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := localeFiles.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		bundle := map[string]string{}
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			panic(fmt.Sprintf("i18n: %s: %v", entry.Name(), err))
+		}
+		bundles[strings.TrimSuffix(entry.Name(), ".json")] = bundle
+	}
+	if problems := Check(); len(problems) > 0 {
+		panic("i18n: incomplete message catalog:\n" + strings.Join(problems, "\n"))
+	}
+}
+
+// Check 確認每個支援的語言都有語言檔，而且每個key在每個語言檔都有翻譯
+func Check() []string {
+	var problems []string
+	base := bundles[DefaultLocale]
+	for _, tag := range supported {
+		locale := tag.String()
+		bundle, ok := bundles[locale]
+		if !ok {
+			problems = append(problems, "missing bundle "+locale)
+			continue
+		}
+		for key := range base {
+			if strings.TrimSpace(bundle[key]) == "" {
+				problems = append(problems, fmt.Sprintf("%s: missing key %q", locale, key))
+			}
+		}
+		for key := range bundle {
+			if _, ok := base[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown key %q", locale, key))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Supported 回傳locale是不是支援的語言，是的話回傳標準寫法
+func Supported(locale string) (string, bool) {
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return "", false
+	}
+	for _, s := range supported {
+		if s == tag {
+			return s.String(), true
+		}
+	}
+	return "", false
+}
+
+// Match 從Accept-Language選出最適合的語言，沒有合適的就用預設語言
+func Match(acceptLanguage string) string {
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return DefaultLocale
+	}
+	_, index, confidence := matcher.Match(tags...)
+	if confidence == language.No {
+		return DefaultLocale
+	}
+	return supported[index].String()
+}
+
+// T 取得訊息，找不到翻譯就用預設語言，再找不到就直接回傳key
+func T(locale, key string) string {
+	if msg, ok := bundles[locale][key]; ok {
+		return msg
+	}
+	if msg, ok := bundles[DefaultLocale][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// Has 回傳key是否存在於訊息目錄
+func Has(key string) bool {
+	_, ok := bundles[DefaultLocale][key]
+	return ok
+}
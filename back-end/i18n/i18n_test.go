@@ -0,0 +1,86 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCatalogComplete(t *testing.T) {
+	for _, p := range Check() {
+		t.Error(p)
+	}
+}
+
+// handler裡傳訊息key的函式，值是key在第幾個參數
+var keyArgs = map[string]int{
+	"T":             1,
+	"writeError":    4,
+	"writeDBError":  4,
+	"writeInternal": 2,
+	"rejectCSRF":    2,
+}
+
+// 驗證函式回傳的訊息，例如return "amount", "expense.amountInvalid"或return "tag.nameRequired"
+var keyPattern = regexp.MustCompile(`^[a-z]+\.[a-zA-Z]+$`)
+
+// TestHandlerKeys 找出handler裡直接寫死的訊息key，每個都要在訊息目錄裡
+func TestHandlerKeys(t *testing.T) {
+	files, err := filepath.Glob("../handler/*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	found := 0
+	check := func(lit *ast.BasicLit) {
+		key, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return
+		}
+		found++
+		if !Has(key) {
+			t.Errorf("%s: missing key %q", fset.Position(lit.Pos()), key)
+		}
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				ident, ok := n.Fun.(*ast.Ident)
+				if !ok {
+					return true
+				}
+				if i, ok := keyArgs[ident.Name]; ok && i < len(n.Args) {
+					if lit, ok := n.Args[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						check(lit)
+					}
+				}
+			case *ast.ReturnStmt:
+				// 驗證函式回傳的訊息是最後一個值
+				if len(n.Results) == 0 {
+					return true
+				}
+				lit, ok := n.Results[len(n.Results)-1].(*ast.BasicLit)
+				if ok && lit.Kind == token.STRING && keyPattern.MatchString(strings.Trim(lit.Value, `"`)) {
+					check(lit)
+				}
+			}
+			return true
+		})
+	}
+	if found == 0 {
+		t.Fatal("no message keys found in handler")
+	}
+}
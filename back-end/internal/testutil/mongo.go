@@ -0,0 +1,281 @@
+// Package testutil 是測試共用的工具，只給_test.go用，不會編進server
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// wire protocol的OP_MSG，driver設定了Stable API就只會送這種訊息
+const opMsg = 2013
+
+// FakeMongo 用MongoDB wire protocol回應的假資料庫，預設內容是空的：
+// 查詢回傳空的結果，新增成功，更新跟刪除都找不到文件，需要資料的測試用Handle指定回應
+// 收到的command記在Commands，測試可以檢查handler送了什麼
+type FakeMongo struct {
+	URI string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]bool
+	commands []string
+	handlers map[string]func(cmd bson.Raw) []any
+}
+
+// NewFakeMongo 在127.0.0.1開一個假資料庫，測試結束時關閉
+func NewFakeMongo(t testing.TB) *FakeMongo {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &FakeMongo{URI: "mongodb://" + l.Addr().String() + "/?directConnection=true", listener: l,
+		conns: map[net.Conn]bool{}, handlers: map[string]func(bson.Raw) []any{}}
+	f.wg.Add(1)
+	go f.accept()
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Close 關掉listener跟所有連線，等處理中的訊息結束
+func (f *FakeMongo) Close() {
+	f.listener.Close()
+	f.mu.Lock()
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// Commands 目前為止收到的command，格式是"collection.command"，例如"budgets.find"，不包含握手跟ping
+func (f *FakeMongo) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// Handle 收到key("collection.command"，command用小寫，例如"households.find")時改用fn回傳的文件：
+// find跟aggregate當作查詢結果；其他command把第一個文件的欄位蓋過預設的回應，例如bson.M{"n": 1}
+func (f *FakeMongo) Handle(key string, fn func(cmd bson.Raw) []any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[key] = fn
+}
+
+func (f *FakeMongo) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		if f.closed {
+			conn.Close()
+		}
+		f.conns[conn] = true
+		f.wg.Add(1)
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+func (f *FakeMongo) serve(conn net.Conn) {
+	defer f.wg.Done()
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		requestID, cmd, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		reply, err := bson.Marshal(f.reply(cmd))
+		if err != nil {
+			return
+		}
+		if err := writeMsg(conn, requestID, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readMsg 讀一個OP_MSG，回傳request ID跟command本體
+// document sequence(insert的documents、update的updates等)會併回command裡，跟直接寫在command裡一樣
+func readMsg(r io.Reader) (int32, bson.Raw, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.LittleEndian.Uint32(header[0:]))
+	requestID := int32(binary.LittleEndian.Uint32(header[4:]))
+	if opCode := binary.LittleEndian.Uint32(header[12:]); opCode != opMsg || length < 21 {
+		return 0, nil, errors.New("unsupported message")
+	}
+	body := make([]byte, length-16)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	end := len(body)
+	if binary.LittleEndian.Uint32(body)&1 != 0 { // checksumPresent
+		end -= 4
+	}
+	var cmd bson.Raw
+	var sequences bson.D
+	for i := 4; i < end; {
+		kind := body[i]
+		size := int(binary.LittleEndian.Uint32(body[i+1:]))
+		section := body[i+1 : i+1+size]
+		switch kind {
+		case 0:
+			cmd = bson.Raw(section)
+		case 1:
+			// int32 size、cstring identifier、之後是一個接一個的文件
+			name := bytes.IndexByte(section[4:], 0)
+			docs := bson.A{}
+			for j := 4 + name + 1; j < len(section); {
+				n := int(binary.LittleEndian.Uint32(section[j:]))
+				docs = append(docs, bson.Raw(section[j:j+n]))
+				j += n
+			}
+			sequences = append(sequences, bson.E{Key: string(section[4 : 4+name]), Value: docs})
+		}
+		i += 1 + size
+	}
+	if cmd == nil {
+		return 0, nil, errors.New("missing command")
+	}
+	if len(sequences) > 0 {
+		var merged bson.D
+		if err := bson.Unmarshal(cmd, &merged); err != nil {
+			return 0, nil, err
+		}
+		raw, err := bson.Marshal(append(merged, sequences...))
+		if err != nil {
+			return 0, nil, err
+		}
+		cmd = raw
+	}
+	return requestID, cmd, nil
+}
+
+func writeMsg(w io.Writer, responseTo int32, doc []byte) error {
+	msg := make([]byte, 21, 21+len(doc))
+	binary.LittleEndian.PutUint32(msg[0:], uint32(21+len(doc)))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], opMsg)
+	// flagBits是0，section kind 0
+	msg = append(msg, doc...)
+	_, err := w.Write(msg)
+	return err
+}
+
+func (f *FakeMongo) reply(cmd bson.Raw) bson.D {
+	elems, err := cmd.Elements()
+	if err != nil || len(elems) == 0 {
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: "invalid command"}}
+	}
+	name := strings.ToLower(elems[0].Key())
+	coll, _ := elems[0].Value().StringValueOK()
+	db, _ := cmd.Lookup("$db").StringValueOK()
+	ok := bson.E{Key: "ok", Value: 1.0}
+
+	switch name {
+	case "hello", "ismaster":
+		return bson.D{
+			{Key: "isWritablePrimary", Value: true}, {Key: "ismaster", Value: true}, {Key: "helloOk", Value: true},
+			{Key: "maxBsonObjectSize", Value: int32(16 * 1024 * 1024)}, {Key: "maxMessageSizeBytes", Value: int32(48000000)},
+			{Key: "maxWriteBatchSize", Value: int32(100000)}, {Key: "localTime", Value: time.Now()},
+			{Key: "minWireVersion", Value: int32(0)}, {Key: "maxWireVersion", Value: int32(17)}, ok,
+		}
+	case "ping", "endsessions", "killcursors":
+		return bson.D{ok}
+	}
+
+	f.mu.Lock()
+	f.commands = append(f.commands, coll+"."+name)
+	handler := f.handlers[coll+"."+name]
+	f.mu.Unlock()
+
+	ns := db + "." + coll
+	reply := defaultReply(name, ns, cmd)
+	if handler == nil {
+		return reply
+	}
+	result := handler(cmd)
+	switch name {
+	case "find", "aggregate":
+		return cursorReply(ns, "firstBatch", append(bson.A{}, result...))
+	}
+	if len(result) == 0 {
+		return reply
+	}
+	raw, err := bson.Marshal(result[0])
+	if err != nil {
+		return bson.D{{Key: "ok", Value: 0.0}, {Key: "errmsg", Value: err.Error()}}
+	}
+	var fields bson.D
+	bson.Unmarshal(raw, &fields)
+	for _, field := range fields {
+		replaced := false
+		for i := range reply {
+			if reply[i].Key == field.Key {
+				reply[i].Value, replaced = field.Value, true
+			}
+		}
+		if !replaced {
+			reply = append(bson.D{field}, reply...)
+		}
+	}
+	return reply
+}
+
+// defaultReply 空資料庫的回應
+func defaultReply(name, ns string, cmd bson.Raw) bson.D {
+	ok := bson.E{Key: "ok", Value: 1.0}
+	docs := 0
+	if n, found := cmd.Lookup("documents").ArrayOK(); found {
+		values, _ := n.Values()
+		docs = len(values)
+	}
+	switch name {
+	case "find", "aggregate", "listindexes", "listcollections":
+		return cursorReply(ns, "firstBatch", bson.A{})
+	case "getmore":
+		return cursorReply(ns, "nextBatch", bson.A{})
+	case "insert":
+		return bson.D{{Key: "n", Value: int32(docs)}, ok}
+	case "update":
+		return bson.D{{Key: "n", Value: int32(0)}, {Key: "nModified", Value: int32(0)}, ok}
+	case "delete", "count":
+		return bson.D{{Key: "n", Value: int32(0)}, ok}
+	case "distinct":
+		return bson.D{{Key: "values", Value: bson.A{}}, ok}
+	case "findandmodify":
+		return bson.D{{Key: "lastErrorObject", Value: bson.D{{Key: "n", Value: int32(0)}, {Key: "updatedExisting", Value: false}}},
+			{Key: "value", Value: nil}, ok}
+	}
+	return bson.D{ok}
+}
+
+// cursorReply 一次就回完所有結果的cursor，id是0所以driver不會再送getMore
+func cursorReply(ns, field string, batch bson.A) bson.D {
+	return bson.D{{Key: "cursor", Value: bson.D{{Key: "id", Value: int64(0)}, {Key: "ns", Value: ns}, {Key: field, Value: batch}}}, {Key: "ok", Value: 1.0}}
+}
@@ -0,0 +1,76 @@
+// Package logger 設定整個server共用的log/slog logger，
+// 支援text/JSON兩種輸出、log level，並且會把密碼之類的敏感欄位遮掉。
+package logger
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// 這些key(不分大小寫，包含就算)的值一律不會寫進log
+var sensitiveKeys = []string{"password", "secret", "token", "cookie", "authorization", "hash", "session"}
+
+type ctxKey struct{}
+
+// Init 設定預設logger，format是"json"或"text"，level是debug/info/warn/error
+func Init(format, level string) *slog.Logger {
+	l := New(os.Stdout, format, level)
+	slog.SetDefault(l)
+	return l
+}
+
+func New(w io.Writer, format, level string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: ParseLevel(level), ReplaceAttr: redact}
+	if strings.EqualFold(format, "json") {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// IsSensitive 回傳這個欄位名稱是否應該被遮掉
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// WithContext 把request專用的logger放進context
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext 取出request專用的logger，沒有的話就用預設logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -1,13 +1,120 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"mongodb-budget/config"
+	"mongodb-budget/logger"
 	"mongodb-budget/server"
+	"mongodb-budget/tracing"
+	_ "time/tzdata" // 內嵌時區資料，部署環境沒有tzdata也能載入使用者的時區
 )
 
 func main() {
-	server := server.InitServer()
-	fmt.Println("Server is running on")
-	log.Fatal(server.ListenAndServe())
+	os.Exit(run())
+}
+
+// run 回傳exit code，讓defer都能在結束前執行
+func run() int {
+	if len(os.Args) > 1 && os.Args[1] == "devcert" {
+		return devCert(os.Args[2:])
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		return 2
+	}
+	logger.Init(cfg.Log.Format, cfg.Log.Level)
+	slog.Info("configuration loaded", "config", cfg) // 金鑰跟資料庫密碼會遮掉
+	for _, warning := range cfg.Warnings() {
+		slog.Warn(warning)
+	}
+
+	// exporter是otlp才會送出span，endpoint用標準的OTEL_EXPORTER_OTLP_ENDPOINT設定
+	shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		slog.Error("tracing init failed", "err", err)
+		return 1
+	}
+	defer shutdownTracing(context.Background())
+
+	// 等資料庫的時候收到SIGTERM也要能馬上結束
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server, err := server.InitServer(ctx, cfg)
+	if err != nil {
+		slog.Error("server init failed", "err", err)
+		return 1
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server is running", "addr", server.Addr, "tls", cfg.TLS.Enabled(), "redirectAddr", cfg.TLS.RedirectAddr, "metricsAddr", cfg.Metrics.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	code := 0
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server stopped", "err", err)
+			code = 1
+		}
+	case <-ctx.Done():
+		slog.Info("shutting down", "timeout", cfg.Server.ShutdownTimeout.String())
+	}
+	stop() // 再收到一次signal就直接結束
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutdown incomplete", "err", err)
+		code = 1
+	}
+	slog.Info("server stopped")
+	return code
+}
+
+// devCert 是devcert子命令，產生本機開發用的自簽憑證
+// 之後用 -tls-cert cert.pem -tls-key key.pem 啟動server
+func devCert(args []string) int {
+	fs := flag.NewFlagSet("budget-server devcert", flag.ContinueOnError)
+	certFile := fs.String("cert", "cert.pem", "where to write the certificate")
+	keyFile := fs.String("key", "key.pem", "where to write the private key")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma separated host names and IPs the certificate is valid for")
+	validFor := fs.Duration("valid-for", 365*24*time.Hour, "certificate lifetime")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	var names []string
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if err := server.GenerateDevCert(*certFile, *keyFile, names, *validFor, *force); err != nil {
+		slog.Error("generate certificate failed", "err", err)
+		return 1
+	}
+	slog.Info("development certificate written", "cert", *certFile, "key", *keyFile, "hosts", names, "validFor", validFor.String())
+	return 0
 }
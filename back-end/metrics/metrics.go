@@ -0,0 +1,159 @@
+// Package metrics 定義server的Prometheus指標，/metrics由promhttp輸出。
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "budget"
+
+// 多久內有發過request的帳號算是活躍的session (cookie session存在瀏覽器，server只能用最近的活動來估計)
+const sessionWindow = 15 * time.Minute
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "MongoDB command latency by collection and command.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection", "operation"})
+
+	DBErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_operation_errors_total",
+		Help:      "Failed MongoDB commands by collection and command.",
+	}, []string{"collection", "operation"})
+
+	DBBreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "db_circuit_open",
+		Help:      "1 while the database circuit breaker is rejecting operations.",
+	})
+
+	TLSCertExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tls_cert_expiry_timestamp_seconds",
+		Help:      "Unix time when the certificate currently served expires.",
+	})
+
+	Signups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Accounts created.",
+	})
+
+	BudgetsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "budgets_created_total",
+		Help:      "Budgets created.",
+	})
+
+	ExpensesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "expenses_created_total",
+		Help:      "Expenses created.",
+	})
+
+	IncomesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "incomes_created_total",
+		Help:      "Income entries created.",
+	})
+
+	sessions = &sessionTracker{seen: map[string]time.Time{}}
+
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration, DBDuration, DBErrors, DBBreakerOpen, TLSCertExpiry,
+		Signups, BudgetsCreated, ExpensesCreated, IncomesCreated,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sessions",
+			Help:      "Distinct signed-in accounts that made a request in the last 15 minutes.",
+		}, sessions.count),
+	)
+}
+
+// Handler 是/metrics的handler
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// Registry 讓其他package註冊自己的指標
+func Registry() prometheus.Registerer {
+	return registry
+}
+
+// SeenSession 記錄某個帳號剛剛用有效的session發了request
+func SeenSession(account string) {
+	sessions.touch(account, time.Now())
+}
+
+type sessionTracker struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func (s *sessionTracker) touch(account string, now time.Time) {
+	s.mu.Lock()
+	s.seen[account] = now
+	s.mu.Unlock()
+}
+
+// count 順便清掉過期的帳號，map不會一直長大
+func (s *sessionTracker) count() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	return float64(len(s.seen))
+}
+
+// 呼叫前要先拿到s.mu
+func (s *sessionTracker) prune(now time.Time) {
+	cutoff := now.Add(-sessionWindow)
+	for account, last := range s.seen {
+		if last.Before(cutoff) {
+			delete(s.seen, account)
+		}
+	}
+}
+
+// SweepSessions 定期清掉過期的帳號，沒有人抓/metrics時map也不會一直長大，ctx取消後才回傳
+func SweepSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sessions.mu.Lock()
+			sessions.prune(now)
+			sessions.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// CommandMonitor 記錄每個MongoDB command花的時間跟錯誤，掛在DB client的options上
+func CommandMonitor() *event.CommandMonitor {
+	// Succeeded/Failed事件沒有collection名稱，要從Started事件用RequestID對回來
+	var collections sync.Map
+
+	finish := func(requestID int64, operation string, seconds float64, failed bool) {
+		collection := "unknown"
+		if c, ok := collections.LoadAndDelete(requestID); ok {
+			collection = c.(string)
+		}
+		DBDuration.WithLabelValues(collection, operation).Observe(seconds)
+		if failed {
+			DBErrors.WithLabelValues(collection, operation).Inc()
+		}
+	}
+
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			// command的第一個欄位就是collection名稱，例如 {find: "budgets", ...}
+			if elems, err := e.Command.Elements(); err == nil && len(elems) > 0 {
+				if name, ok := elems[0].Value().StringValueOK(); ok {
+					collections.Store(e.RequestID, name)
+					return
+				}
+			}
+			collections.Store(e.RequestID, e.DatabaseName)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, e.CommandName, e.Duration.Seconds(), false)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, e.CommandName, e.Duration.Seconds(), true)
+		},
+	}
+}
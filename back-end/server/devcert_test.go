@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateDevCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateDevCert(certFile, keyFile, []string{"localhost", "127.0.0.1", "::1"}, 24*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(leaf.DNSNames, []string{"localhost"}) || len(leaf.IPAddresses) != 2 || !leaf.IPAddresses[1].Equal(net.IPv6loopback) {
+		t.Fatalf("names = %v %v, want localhost, 127.0.0.1 and ::1", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if !leaf.IsCA || leaf.Subject.CommonName != "localhost" {
+		t.Fatalf("IsCA = %v, CN = %q, want a CA for localhost", leaf.IsCA, leaf.Subject.CommonName)
+	}
+	if remaining := time.Until(leaf.NotAfter); remaining < 23*time.Hour || remaining > 24*time.Hour {
+		t.Fatalf("valid for another %v, want 24h", remaining)
+	}
+	// 自簽的憑證自己就能驗證自己
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"}); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("key file mode = %o, want 600", perm)
+	}
+}
+
+func TestGenerateDevCertExisting(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateDevCert(certFile, keyFile, []string{"localhost"}, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenerateDevCert(certFile, keyFile, []string{"localhost"}, time.Hour, false)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("err = %v, want already exists", err)
+	}
+	if after, _ := os.ReadFile(certFile); string(after) != string(before) {
+		t.Fatal("existing certificate replaced without overwrite")
+	}
+	if err := GenerateDevCert(certFile, keyFile, []string{"localhost"}, time.Hour, true); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	if after, _ := os.ReadFile(certFile); string(after) == string(before) {
+		t.Fatal("certificate not replaced with overwrite")
+	}
+
+	if err := GenerateDevCert(certFile, keyFile, nil, time.Hour, true); err == nil {
+		t.Fatal("no hosts accepted")
+	}
+}
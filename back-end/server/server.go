@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"mongodb-budget/config"
 	"mongodb-budget/handler"
+	"mongodb-budget/metrics"
 
 	"github.com/gorilla/mux"
 )
@@ -21,12 +26,66 @@ func chainMiddleware(middlewares ...Middleware) Middleware {
 	}
 }
 
-// chained middleware
-var ChainedMiddleware = chainMiddleware(handler.PrintPath, handler.Cors)
+// buildMiddleware 依照設定組出middleware鏈，列在後面的在外層
+// 順序：RequestID > AccessLog > Tracing > Metrics > SecurityHeaders > Compress > Recover > BodyLimit > Cors > CSRF > router
+// Cors要拿router查每個path接受哪些method，CSRF在Cors裡面，被擋下來的回應前端才讀得到
+func buildMiddleware(cfg config.Config, router *mux.Router) Middleware {
+	m := cfg.Middleware
+	var middlewares []Middleware
+	if cfg.CSRF.Enabled {
+		middlewares = append(middlewares, handler.CSRF(cfg.CSRF, cfg.CORS.AllowedOrigins))
+	}
+	middlewares = append(middlewares, handler.Cors(cfg.CORS, router))
+	if m.MaxBodyBytes > 0 {
+		middlewares = append(middlewares, handler.BodyLimit(int64(m.MaxBodyBytes)))
+	}
+	// Recover在Compress裡面，panic時回的500一樣會被壓縮，也不會先送出一半的回應
+	if m.Recover {
+		middlewares = append(middlewares, handler.Recover)
+	}
+	if len(m.Compression) > 0 {
+		middlewares = append(middlewares, handler.Compress(m.Compression, m.CompressMinBytes))
+	}
+	if m.SecurityHeaders {
+		middlewares = append(middlewares, handler.SecurityHeaders(m))
+	}
+	middlewares = append(middlewares, handler.Metrics, handler.Tracing, handler.AccessLog)
+	if m.RequestID {
+		middlewares = append(middlewares, handler.RequestID(m.TrustRequestID))
+	}
+	return chainMiddleware(middlewares...)
+}
+
+// Server 多了關機時要依序收尾的東西：readiness、背景工作、進行中的request、資料庫連線
+type Server struct {
+	*http.Server
+	redirect    *http.Server // HTTP轉HTTPS，沒有設定的話是nil
+	metrics     *http.Server // 只提供/metrics，沒有設定的話是nil
+	router      *mux.Router
+	drain       func()
+	closeDB     func(context.Context) error
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+}
+
+// ctx只用在啟動階段，取消的話就不再等資料庫
+func InitServer(ctx context.Context, cfg config.Config) (*Server, error) {
+	// 憑證有問題就不用等資料庫了
+	var certs *certReloader
+	if cfg.TLS.Enabled() {
+		var err error
+		if certs, err = newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			return nil, fmt.Errorf("load tls certificate: %w", err)
+		}
+	}
 
-func InitServer() *http.Server {
-	h := handler.Inithandler()
+	h, err := handler.Inithandler(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 	mux := mux.NewRouter()
+	mux.Use(handler.RouteName) // route比對完之後把route template記到access log
+	mux.Use(handler.Timeout(cfg.Middleware.RequestTimeout, cfg.Middleware.RouteTimeouts))
 	mux.HandleFunc("/", h.Home())
 	mux.HandleFunc("/isLoggedIn", h.IsLoggedIn)
 	mux.HandleFunc("/getBudgets", h.GetBudgets())
@@ -34,17 +93,187 @@ func InitServer() *http.Server {
 	mux.HandleFunc("/signUp", h.SignUp)
 	mux.HandleFunc("/signIn", h.SignIn)
 	mux.HandleFunc("/logOut", handler.LogOut)
+	mux.HandleFunc("/csrfToken", handler.CSRFToken).Methods(http.MethodGet)
 	mux.HandleFunc("/createBudget", h.CreatBudget())
 	mux.HandleFunc("/createExpense", h.CreateExpense())
 	mux.HandleFunc("/updateBudget", h.UpdateBudget())
 	mux.HandleFunc("/updateExpense", h.UpdateExpense())
 	mux.HandleFunc("/deleteBudget", h.DeleteBudget())
 	mux.HandleFunc("/deleteExpense", h.DeleteExpense())
+	mux.HandleFunc("/updateTimeZone", h.UpdateTimeZone())
+	mux.HandleFunc("/updateLocale", h.UpdateLocale())
+	if cfg.Metrics.Token != "" {
+		// Prometheus，對外的listener上要帶token，沒設定的話只在metrics.addr提供
+		mux.Handle("/metrics", handler.MetricsAuth(cfg.Metrics.Token)(metrics.Handler())).Methods(http.MethodGet)
+	}
+	mux.HandleFunc("/healthz", handler.Healthz).Methods(http.MethodGet)
+	mux.HandleFunc("/readyz", h.Readyz()).Methods(http.MethodGet)
+
+	// RESTful API，上面的舊route先保留到前端都遷移完為止
+	api := mux.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/budgets", h.ListBudgets()).Methods(http.MethodGet)
+	api.HandleFunc("/budgets", h.PostBudget()).Methods(http.MethodPost)
+	api.HandleFunc("/budgets/{id}", h.PatchBudget()).Methods(http.MethodPatch)
+	api.HandleFunc("/budgets/{id}", h.RemoveBudget()).Methods(http.MethodDelete)
+	api.HandleFunc("/expenses", h.ListExpenses()).Methods(http.MethodGet)
+	api.HandleFunc("/expenses", h.PostExpense()).Methods(http.MethodPost)
+	api.HandleFunc("/expenses/{id}", h.PatchExpense()).Methods(http.MethodPatch)
+	api.HandleFunc("/expenses/{id}", h.RemoveExpense()).Methods(http.MethodDelete)
+	api.HandleFunc("/households", h.ListHouseholds()).Methods(http.MethodGet)
+	api.HandleFunc("/households", h.PostHousehold()).Methods(http.MethodPost)
+	api.HandleFunc("/households/{householdID}", h.GetHousehold()).Methods(http.MethodGet)
+	api.HandleFunc("/households/{householdID}", h.PatchHousehold()).Methods(http.MethodPatch)
+	api.HandleFunc("/households/{householdID}", h.RemoveHousehold()).Methods(http.MethodDelete)
+	api.HandleFunc("/households/{householdID}/invitations", h.PostInvitation()).Methods(http.MethodPost)
+	api.HandleFunc("/households/{householdID}/invitations/{account}", h.RemoveInvitation()).Methods(http.MethodDelete)
+	api.HandleFunc("/households/{householdID}/members/{account}", h.PatchMember()).Methods(http.MethodPatch)
+	api.HandleFunc("/households/{householdID}/members/{account}", h.RemoveMember()).Methods(http.MethodDelete)
+	api.HandleFunc("/invitations", h.ListInvitations()).Methods(http.MethodGet)
+	api.HandleFunc("/invitations/{householdID}/accept", h.AcceptInvitation()).Methods(http.MethodPost)
+	api.HandleFunc("/invitations/{householdID}", h.DeclineInvitation()).Methods(http.MethodDelete)
+	api.HandleFunc("/balances", h.Balances()).Methods(http.MethodGet)
+	api.HandleFunc("/settlements", h.ListSettlements()).Methods(http.MethodGet)
+	api.HandleFunc("/settlements", h.PostSettlement()).Methods(http.MethodPost)
+	api.HandleFunc("/settlements/{id}", h.RemoveSettlement()).Methods(http.MethodDelete)
+	api.HandleFunc("/incomes", h.ListIncomes()).Methods(http.MethodGet)
+	api.HandleFunc("/incomes", h.PostIncome()).Methods(http.MethodPost)
+	api.HandleFunc("/incomes/{id}", h.PatchIncome()).Methods(http.MethodPatch)
+	api.HandleFunc("/incomes/{id}", h.RemoveIncome()).Methods(http.MethodDelete)
+	api.HandleFunc("/recurringIncomes", h.ListRecurringIncomes()).Methods(http.MethodGet)
+	api.HandleFunc("/recurringIncomes", h.PostRecurringIncome()).Methods(http.MethodPost)
+	api.HandleFunc("/recurringIncomes/{id}", h.PatchRecurringIncome()).Methods(http.MethodPatch)
+	api.HandleFunc("/recurringIncomes/{id}", h.RemoveRecurringIncome()).Methods(http.MethodDelete)
+	api.HandleFunc("/cashFlow", h.CashFlow()).Methods(http.MethodGet)
+	api.HandleFunc("/budgetTotals", h.BudgetTotals()).Methods(http.MethodGet)
+	api.HandleFunc("/tags", h.ListTags()).Methods(http.MethodGet)
+	api.HandleFunc("/tags/merge", h.MergeTags()).Methods(http.MethodPost)
+	api.HandleFunc("/tags/{name}", h.PatchTag()).Methods(http.MethodPatch)
+	api.HandleFunc("/tags/{name}", h.RemoveTag()).Methods(http.MethodDelete)
+	api.HandleFunc("/accounts", h.ListAccounts()).Methods(http.MethodGet)
+	api.HandleFunc("/accounts", h.PostAccount()).Methods(http.MethodPost)
+	api.HandleFunc("/accounts/{id}", h.GetAccount()).Methods(http.MethodGet)
+	api.HandleFunc("/accounts/{id}", h.PatchAccount()).Methods(http.MethodPatch)
+	api.HandleFunc("/accounts/{id}", h.RemoveAccount()).Methods(http.MethodDelete)
+	api.HandleFunc("/accounts/{id}/ledger", h.AccountLedger()).Methods(http.MethodGet)
+	api.HandleFunc("/transfers", h.ListTransfers()).Methods(http.MethodGet)
+	api.HandleFunc("/transfers", h.PostTransfer()).Methods(http.MethodPost)
+	api.HandleFunc("/transfers/{id}", h.RemoveTransfer()).Methods(http.MethodDelete)
+	api.HandleFunc("/accounts/{id}/statements", h.PostStatement()).Methods(http.MethodPost)
+	api.HandleFunc("/statements", h.ListStatements()).Methods(http.MethodGet)
+	api.HandleFunc("/statements/{id}", h.GetStatement()).Methods(http.MethodGet)
+	api.HandleFunc("/statements/{id}", h.RemoveStatement()).Methods(http.MethodDelete)
+	api.HandleFunc("/statements/{id}/lines/{index}", h.PatchStatementLine()).Methods(http.MethodPatch)
+	api.HandleFunc("/statements/{id}/rematch", h.RematchStatement()).Methods(http.MethodPost)
+	api.HandleFunc("/statements/{id}/lock", h.LockStatement()).Methods(http.MethodPost)
+	api.HandleFunc("/statements/{id}/unlock", h.UnlockStatement()).Methods(http.MethodPost)
+	api.HandleFunc("/goals", h.ListGoals()).Methods(http.MethodGet)
+	api.HandleFunc("/goals", h.PostGoal()).Methods(http.MethodPost)
+	api.HandleFunc("/goals/{id}", h.GetGoal()).Methods(http.MethodGet)
+	api.HandleFunc("/goals/{id}", h.PatchGoal()).Methods(http.MethodPatch)
+	api.HandleFunc("/goals/{id}", h.RemoveGoal()).Methods(http.MethodDelete)
+	api.HandleFunc("/goals/{id}/contributions", h.ListContributions()).Methods(http.MethodGet)
+	api.HandleFunc("/goals/{id}/contributions", h.PostContribution()).Methods(http.MethodPost)
+	api.HandleFunc("/goals/{id}/contributions/{contributionID}", h.RemoveContribution()).Methods(http.MethodDelete)
+	api.HandleFunc("/rules", h.ListRules()).Methods(http.MethodGet)
+	api.HandleFunc("/rules", h.PostRule()).Methods(http.MethodPost)
+	api.HandleFunc("/rules/test", h.TestRule()).Methods(http.MethodPost)
+	api.HandleFunc("/rules/apply", h.ApplyRules()).Methods(http.MethodPost)
+	api.HandleFunc("/rules/{id}", h.PatchRule()).Methods(http.MethodPatch)
+	api.HandleFunc("/rules/{id}", h.RemoveRule()).Methods(http.MethodDelete)
+	api.HandleFunc("/openapi.json", handler.OpenAPI).Methods(http.MethodGet)
+
+	s := &Server{
+		Server: &http.Server{
+			Addr:         cfg.Server.Addr,
+			Handler:      buildMiddleware(cfg, mux)(mux), // 直接對router套用middleware，讓所有handler都套用
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		},
+		router:  mux,
+		drain:   h.Drain,
+		closeDB: h.Close,
+	}
+	if certs != nil {
+		s.TLSConfig = tlsConfig(cfg.TLS, certs)
+	}
+	if cfg.TLS.RedirectAddr != "" {
+		s.redirect = &http.Server{
+			Addr:         cfg.TLS.RedirectAddr,
+			Handler:      redirectHandler(cfg.Server.Addr),
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+	}
+
+	if cfg.Metrics.Addr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		s.metrics = &http.Server{
+			Addr:         cfg.Metrics.Addr,
+			Handler:      metricsMux,
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+	}
+
+	// 背景工作都用這個ctx，Shutdown時取消並等它們結束
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	s.stopWorkers = stopWorkers
+	s.goWorker(func() { metrics.SweepSessions(workerCtx, time.Minute) })
+	if certs != nil && cfg.TLS.ReloadInterval > 0 {
+		s.goWorker(func() { certs.watch(workerCtx, cfg.TLS.ReloadInterval) })
+	}
+
+	return s, nil
+}
+
+// Router 註冊了所有route的router，沒有套用middleware，測試比對OpenAPI文件時用
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+func (s *Server) goWorker(fn func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+// Shutdown 先讓/readyz回503，停止背景工作，等進行中的request處理完，最後才關閉資料庫連線
+// ctx到期時不再等待，回傳第一個遇到的錯誤
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drain()
+	s.stopWorkers()
+
+	err := s.Server.Shutdown(ctx)
+	for _, extra := range []*http.Server{s.redirect, s.metrics} {
+		if extra == nil {
+			continue
+		}
+		if extraErr := extra.Shutdown(ctx); err == nil {
+			err = extraErr
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("background workers: %w", ctx.Err())
+		}
+	}
 
-	return &http.Server{
-		Addr:         ":5000",
-		Handler:      ChainedMiddleware(mux), // 直接對router套用middleware，讓所有handler都套用
-		ReadTimeout:  time.Second * 5,
-		WriteTimeout: time.Second * 5,
+	if closeErr := s.closeDB(ctx); err == nil && closeErr != nil {
+		err = fmt.Errorf("close database: %w", closeErr)
 	}
+	return err
 }
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mongodb-budget/config"
+	"mongodb-budget/metrics"
+)
+
+// 憑證快到期時提早提醒，certbot之類的工具通常在剩30天時更新
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// certReloader 每次TLS握手都拿最新載入的憑證，檔案換掉之後不用重開server
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	stamp    fileStamp // 最後一次嘗試載入時檔案的狀態
+}
+
+// fileStamp 用修改時間跟大小判斷檔案有沒有變
+type fileStamp struct {
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	stamp, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.stamp = stamp
+	return r, nil
+}
+
+func (r *certReloader) stat() (fileStamp, error) {
+	cert, err := os.Stat(r.certFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	key, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{certMod: cert.ModTime(), keyMod: key.ModTime(), certSize: cert.Size(), keySize: key.Size()}, nil
+}
+
+func (r *certReloader) load() error {
+	pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	pair.Leaf = leaf
+	r.cert.Store(&pair)
+	metrics.TLSCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+
+	log := slog.With("subject", leaf.Subject.String(), "dnsNames", leaf.DNSNames, "notAfter", leaf.NotAfter)
+	if remaining := time.Until(leaf.NotAfter); remaining < certExpiryWarning {
+		log.Warn("tls certificate expires soon", "remaining", remaining.Round(time.Minute).String())
+		return nil
+	}
+	log.Info("tls certificate loaded")
+	return nil
+}
+
+// watch 定期檢查憑證檔，有變動就重新載入，載入失敗的話繼續用原本的憑證
+// cert跟key通常不是同時寫入的，只換了一半的時候會失敗，等另一個檔案寫好再試一次
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamp, err := r.stat()
+		if err != nil {
+			// 更新憑證的工具可能是先刪再寫，下一輪再看
+			slog.Debug("stat tls certificate failed", "err", err)
+			continue
+		}
+		if stamp == r.stamp {
+			continue
+		}
+		r.stamp = stamp
+		if err := r.load(); err != nil {
+			slog.Error("reload tls certificate failed, keeping the previous one", "err", err)
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+func tlsConfig(cfg config.TLSConfig, certs *certReloader) *tls.Config {
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.MinVersion == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.getCertificate,
+	}
+}
+
+// redirectHandler 把HTTP的request轉到同一個host的HTTPS，httpsAddr的port不是443的話要帶上
+// 用308讓POST之類的request重送時method跟body不變
+func redirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// 沒帶port的IPv6像[::1]，先拿掉括號，下面再統一加回去
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// ListenAndServe 有設定憑證就用HTTPS，也一起啟動HTTP轉HTTPS跟/metrics的listener
+// 任何一個listener停止就回傳，關機時是http.ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	errs := make(chan error, 3)
+	if s.redirect != nil {
+		go func() {
+			errs <- fmt.Errorf("https redirect listener: %w", s.redirect.ListenAndServe())
+		}()
+	}
+	if s.metrics != nil {
+		go func() {
+			errs <- fmt.Errorf("metrics listener: %w", s.metrics.ListenAndServe())
+		}()
+	}
+	go func() {
+		if s.TLSConfig != nil {
+			errs <- s.Server.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- s.Server.ListenAndServe()
+	}()
+	return <-errs
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// devPair 在dir底下產生一組只給host用的憑證
+func devPair(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateDevCert(certFile, keyFile, []string{host}, 30*24*time.Hour, true); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// replaceFile 把src的內容寫到dst，修改時間往後調，檔案系統的時間精度太粗也看得出來有變
+func replaceFile(t *testing.T, src, dst string, mod time.Time) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dst, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedNames(t *testing.T, r *certReloader) []string {
+	t.Helper()
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.DNSNames
+}
+
+func waitForNames(t *testing.T, r *certReloader, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(servedNames(t, r), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("serving %v, want %v", servedNames(t, r), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderPicksUpNewCertificate(t *testing.T) {
+	certFile, keyFile := devPair(t, t.TempDir(), "old.example.test")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedNames(t, r); !reflect.DeepEqual(got, []string{"old.example.test"}) {
+		t.Fatalf("serving %v, want old.example.test", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	newCert, newKey := devPair(t, t.TempDir(), "new.example.test")
+	mod := time.Now().Add(time.Minute)
+	// 只換了憑證還沒換key，載入會失敗，繼續用原本的
+	replaceFile(t, newCert, certFile, mod)
+	time.Sleep(50 * time.Millisecond)
+	if got := servedNames(t, r); !reflect.DeepEqual(got, []string{"old.example.test"}) {
+		t.Fatalf("serving %v with a mismatched key, want the previous certificate", got)
+	}
+	// key也寫好之後就換成新的
+	replaceFile(t, newKey, keyFile, mod)
+	waitForNames(t, r, []string{"new.example.test"})
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := devPair(t, dir, "localhost")
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("missing certificate accepted")
+	}
+	_, otherKey := devPair(t, t.TempDir(), "localhost")
+	if _, err := newCertReloader(certFile, otherKey); err == nil {
+		t.Error("certificate with the wrong key accepted")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsAddr string
+		method    string
+		host      string
+		target    string
+		want      string
+	}{
+		{"default port", ":443", http.MethodGet, "example.com", "/api/v1/budgets?from=2024-03-01&to=2024-03-31", "https://example.com/api/v1/budgets?from=2024-03-01&to=2024-03-31"},
+		{"http port is dropped", ":443", http.MethodGet, "example.com:80", "/", "https://example.com/"},
+		{"https port is added", ":8443", http.MethodGet, "example.com:8080", "/signIn?next=%2Fbudgets", "https://example.com:8443/signIn?next=%2Fbudgets"},
+		{"post keeps its method", "0.0.0.0:5000", http.MethodPost, "localhost:5080", "/api/v1/expenses", "https://localhost:5000/api/v1/expenses"},
+		{"ipv6", ":443", http.MethodGet, "[::1]:80", "/healthz", "https://[::1]/healthz"},
+		{"ipv6 without a port", ":443", http.MethodGet, "[::1]", "/healthz", "https://[::1]/healthz"},
+		{"ipv6 gets the https port", ":8443", http.MethodGet, "[::1]", "/healthz", "https://[::1]:8443/healthz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://placeholder"+tt.target, nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			redirectHandler(tt.httpsAddr).ServeHTTP(rec, req)
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Fatalf("status = %d, want 308", rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Fatalf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = ""
+	rec := httptest.NewRecorder()
+	redirectHandler(":443").ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d without a Host, want 400", rec.Code)
+	}
+}
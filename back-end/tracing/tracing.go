@@ -0,0 +1,57 @@
+// Package tracing 設定OpenTelemetry的TracerProvider。
+// 預設是no-op，設定TRACING_EXPORTER=otlp才會把span送到OTLP collector，
+// collector的位置用標準的OTEL_EXPORTER_OTLP_ENDPOINT (預設http://localhost:4318)。
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const ServiceName = "budget-server"
+
+// 這個package的instrumentation名稱
+const instrumentationName = "mongodb-budget"
+
+// Tracer 取得server用的tracer，會跟著目前設定的global TracerProvider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Init 依照exporter設定global TracerProvider，回傳的shutdown要在server結束前呼叫，把剩下的span送出去
+// exporter: "none"(或空字串) 不收集、"otlp" 送到OTLP/HTTP collector，其他值都當錯誤
+func Init(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	switch strings.ToLower(exporter) {
+	case "", "none":
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tp := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exp),
+			sdktrace.WithResource(newResource()),
+		)
+		otel.SetTracerProvider(tp)
+		return tp.Shutdown, nil
+	}
+	return nil, fmt.Errorf("tracing: unknown exporter %q", exporter)
+}
+
+func newResource() *resource.Resource {
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName))
+}
@@ -117,13 +117,14 @@ export default function SignInModal({
           handleSignInClose();
           LogIn!();
         } else {
-          // 查看是哪個環節出問題
-          switch (responseData.target) {
+          // 查看是哪個環節出問題 錯誤格式是 {error: {code, field, message}}
+          const { field, message } = responseData.error;
+          switch (field) {
             case "account":
-              setAccountErrorMsg(responseData.msg);
+              setAccountErrorMsg(message);
               break;
             case "password":
-              setPasswordErrorMsg(responseData.msg);
+              setPasswordErrorMsg(message);
               break;
           }
         }
@@ -133,16 +133,17 @@ export default function SignUpModal({
           // 顯示註冊成功
           setShowSignUpSuccess();
         } else {
-          // 查看是哪個環節出問題
-          switch (responseData.target) {
+          // 查看是哪個環節出問題 錯誤格式是 {error: {code, field, message}}
+          const { field, message } = responseData.error;
+          switch (field) {
             case "name":
-              setNameErrorMsg(responseData.msg);
+              setNameErrorMsg(message);
               break;
             case "account":
-              setAccountErrorMsg(responseData.msg);
+              setAccountErrorMsg(message);
               break;
             case "password":
-              setPasswordErrorMsg(responseData.msg);
+              setPasswordErrorMsg(message);
               break;
           }
         }
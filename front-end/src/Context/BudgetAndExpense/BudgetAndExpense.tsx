@@ -217,10 +217,13 @@ export default function BudgetAndExpenseContext({
             body: JSON.stringify(data),
           });
           const res = await response.json();
-          // 如果session cookie錯誤或是過期，就登出
-          if (res.logIn === false) {
-            alert(res.msg);
+          // 如果session cookie錯誤或是過期(401)，就登出
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setBudgets((prevBudgets) => {
               name = name.trim();
@@ -274,9 +277,12 @@ export default function BudgetAndExpenseContext({
           });
           const res = await response.json();
 
-          if (res.logIn === false) {
-            alert(res.msg);
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setExpenses((prevExpenses) => {
               description = description.trim();
@@ -324,9 +330,12 @@ export default function BudgetAndExpenseContext({
           });
           const res = await response.json();
 
-          if (res.logIn === false) {
-            alert(res.msg);
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setBudgets((prevBudgets) => {
               return prevBudgets.map((budget) => {
@@ -394,9 +403,12 @@ export default function BudgetAndExpenseContext({
           });
           const res = await response.json();
 
-          if (res.logIn === false) {
-            alert(res.msg);
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setExpenses((preExpenses) =>
               preExpenses.map((preExpense) => {
@@ -457,9 +469,12 @@ export default function BudgetAndExpenseContext({
           });
           const res = await response.json();
 
-          if (res.logIn === false) {
-            alert(res.msg);
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setBudgets((preBudgets) => {
               return preBudgets.filter((budget) => budget.id !== budgetID);
@@ -508,9 +523,12 @@ export default function BudgetAndExpenseContext({
           });
           const res = await response.json();
 
-          if (res.logIn === false) {
-            alert(res.msg);
+          if (response.status === 401) {
+            alert(res.error.message);
             LogOut();
+          } else if (!response.ok) {
+            // 錯誤格式是 {error: {code, field, message, requestID}}
+            displaysetShowPostAlert(res.error.message);
           } else {
             setExpenses((preExpense) => {
               return preExpense.filter((expense) => expense.id !== expenseID);